@@ -0,0 +1,67 @@
+package backoff
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff exponential backoff with full jitter, the n-th delay is
+// random in [0, min(Max, Min * Factor^n)], so that clients failed at
+// the same time retry at different times
+type Backoff struct {
+	Min    time.Duration
+	Max    time.Duration
+	Factor float64
+
+	lock    sync.Mutex
+	attempt int
+	rand    *rand.Rand
+}
+
+// New create backoff grow from min to max, doubled every attempt
+func New(min time.Duration, max time.Duration) *Backoff {
+	return &Backoff{
+		Min:    min,
+		Max:    max,
+		Factor: 2,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next the delay before next attempt
+func (b *Backoff) Next() time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	ceil := float64(b.Min)
+	for i := 0; i < b.attempt && ceil < float64(b.Max); i++ {
+		ceil *= b.Factor
+	}
+
+	if ceil > float64(b.Max) {
+		ceil = float64(b.Max)
+	}
+
+	b.attempt++
+	if ceil <= 0 {
+		return 0
+	}
+
+	return time.Duration(b.rand.Int63n(int64(ceil) + 1))
+}
+
+// Attempt attempts since the last Reset
+func (b *Backoff) Attempt() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return b.attempt
+}
+
+// Reset start over from Min, call it after a success
+func (b *Backoff) Reset() {
+	b.lock.Lock()
+	b.attempt = 0
+	b.lock.Unlock()
+}
@@ -0,0 +1,98 @@
+package backoff
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func testBackoff(min time.Duration, max time.Duration) *Backoff {
+	b := New(min, max)
+	b.rand = rand.New(rand.NewSource(1))
+	return b
+}
+
+func TestNextJitter(t *testing.T) {
+	b := testBackoff(100*time.Millisecond, time.Minute)
+
+	for n := 0; n < 8; n++ {
+		ceil := 100 * time.Millisecond << uint(n)
+		low, high := ceil, time.Duration(0)
+		for i := 0; i < 200; i++ {
+			b.Reset()
+			for j := 0; j < n; j++ {
+				b.Next()
+			}
+
+			d := b.Next()
+			if d < 0 || d > ceil {
+				t.Fatalf("attempt %d delay %v, want in [0, %v]", n, d, ceil)
+			}
+
+			if d < low {
+				low = d
+			}
+			if d > high {
+				high = d
+			}
+		}
+
+		// full jitter spread over the whole range
+		if low > ceil/4 || high < ceil*3/4 {
+			t.Errorf("attempt %d delays in [%v, %v], not spread over [0, %v]", n, low, high, ceil)
+		}
+	}
+}
+
+func TestNextCap(t *testing.T) {
+	b := testBackoff(time.Second, 10*time.Second)
+
+	var high time.Duration
+	for i := 0; i < 1000; i++ {
+		d := b.Next()
+		if d > 10*time.Second {
+			t.Fatalf("attempt %d delay %v over the cap", i, d)
+		}
+
+		if d > high {
+			high = d
+		}
+	}
+
+	if high < 5*time.Second {
+		t.Fatalf("max delay %v, the cap is never approached", high)
+	}
+
+	if b.Attempt() != 1000 {
+		t.Fatalf("attempt %d, want 1000", b.Attempt())
+	}
+}
+
+func TestReset(t *testing.T) {
+	b := testBackoff(time.Second, time.Minute)
+	for i := 0; i < 10; i++ {
+		b.Next()
+	}
+
+	b.Reset()
+	if b.Attempt() != 0 {
+		t.Fatalf("attempt %d after reset", b.Attempt())
+	}
+
+	for i := 0; i < 100; i++ {
+		b.Reset()
+		d := b.Next()
+		if d > time.Second {
+			t.Fatalf("first delay %v after reset, over min", d)
+		}
+	}
+}
+
+func TestNextZero(t *testing.T) {
+	b := testBackoff(0, time.Second)
+	for i := 0; i < 10; i++ {
+		if d := b.Next(); d != 0 {
+			t.Fatalf("delay %v with zero min", d)
+		}
+	}
+}
@@ -5,23 +5,124 @@ import (
 	"fmt"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"lxquic/server"
+	"lxquic/transport"
 	"lxquic/wait"
 )
 
 var (
-	listenAddr = ""
-	daemon     = ""
-	proxyToken = ""
+	listenAddr    = ""
+	tcpListenAddr = ""
+	daemon        = ""
+	proxyToken    = ""
+	aclFile       = ""
+	adminAddr     = ""
+	adminToken    = ""
+
+	metricsAddr      = ""
+	metricsPerDevice = false
+
+	// relay cluster, standalone if clusterAddr is empty
+	clusterAddr  = ""
+	clusterPeers = ""
+	clusterToken = ""
+
+	// known devices and their history, memory only if empty
+	registryDir = ""
+
+	// device, session and tunnel events
+	eventWebhooks = ""
+	eventSecret   = ""
+	eventFile     = ""
+	eventBuffer   = 0
+
+	// drain on exit, clients are told to reconnect to drainRelay
+	drainGrace time.Duration
+	drainRelay = ""
+
+	// quic parameters, and cmd stream keepalive by role
+	transportConf = transport.DefaultConfig()
+	keepalive     = ""
+
+	egressPrivate      = false
+	egressAllowCIDRs   = ""
+	egressDenyCIDRs    = ""
+	egressAllowDomains = ""
+	egressDenyDomains  = ""
+	egressAllowPorts   = ""
+	egressDenyPorts    = ""
+
+	dnsUpstreams = ""
+	dnsCacheTTL  time.Duration
+	dnsTimeout   time.Duration
+	dnsPrefer    = ""
 )
 
 func init() {
 	flag.StringVar(&listenAddr, "l", ":443", "specify the listen address")
+	flag.StringVar(&tcpListenAddr, "lt", "", "specify websocket over tls fallback listen address, default the same as -l, 'off' to disable")
 	flag.StringVar(&proxyToken, "pt", "", "specify the proxy token")
 	flag.StringVar(&daemon, "d", "yes", "specify daemon mode")
+	flag.StringVar(&adminAddr, "admin", "", "specify admin api listen address, e.g. 127.0.0.1:8080, empty means disable")
+	flag.StringVar(&adminToken, "admin-token", "", "specify admin api bearer token, default from env LXQUIC_ADMIN_TOKEN")
+	transportConf.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&keepalive, "keepalive", "", "specify cmd stream keepalive by role, role=interval/misses, comma separated, default es=15s/4,ec=5s/3,px=5s/3")
+	flag.StringVar(&metricsAddr, "metrics", "", "specify metrics listen address, serve /metrics, e.g. 127.0.0.1:9090, empty means disable")
+	flag.BoolVar(&metricsPerDevice, "metrics-per-device", false, "add per-device bytes metrics, one series per device")
+	flag.StringVar(&registryDir, "registry", "", "specify directory that known devices and their online history saved in, empty means memory only")
+	flag.StringVar(&eventWebhooks, "event-webhook", "", "specify webhook urls that events are posted to, comma separated")
+	flag.StringVar(&eventSecret, "event-secret", "", "specify hmac-sha256 key to sign webhook requests, default from env LXQUIC_EVENT_SECRET")
+	flag.StringVar(&eventFile, "event-file", "", "specify file that events are appended to as json lines")
+	flag.IntVar(&eventBuffer, "event-buffer", server.DefaultEventBuffer, "specify events queued per webhook, new events are dropped when full")
+	flag.StringVar(&clusterAddr, "cluster-addr", "", "specify the address peer relays reach this relay, enable clustering, e.g. 10.0.0.1:443")
+	flag.StringVar(&clusterPeers, "cluster-peers", "", "specify peer relay addresses, comma separated")
+	flag.StringVar(&clusterToken, "cluster-token", "", "specify the shared token of cluster relays, default from env LXQUIC_CLUSTER_TOKEN")
+	flag.DurationVar(&drainGrace, "drain-grace", server.DefaultDrainGrace, "specify how long link streams can keep going when draining on exit, 0 means exit at once")
+	flag.StringVar(&drainRelay, "drain-relay", "", "specify alternate relay address that clients reconnect to when draining")
+	flag.StringVar(&aclFile, "acl", "", "specify device acl file, 'allow|deny ec|px|* selector [ports]' a line, first match decide")
+
+	flag.BoolVar(&egressPrivate, "egress-private", false, "allow proxy to connect private, loopback and link-local addresses")
+	flag.StringVar(&egressAllowCIDRs, "egress-allow-cidr", "", "specify CIDRs always allowed for proxy, even private ones, comma separated")
+	flag.StringVar(&egressDenyCIDRs, "egress-deny-cidr", "", "specify CIDRs denied for proxy, comma separated")
+	flag.StringVar(&egressAllowDomains, "egress-allow-domain", "", "specify the only domains allowed for proxy, comma separated")
+	flag.StringVar(&egressDenyDomains, "egress-deny-domain", "", "specify domains denied for proxy, comma separated")
+	flag.StringVar(&egressAllowPorts, "egress-allow-port", "", "specify the only ports allowed for proxy, comma separated")
+	flag.StringVar(&egressDenyPorts, "egress-deny-port", "", "specify ports denied for proxy, comma separated")
+
+	flag.StringVar(&dnsUpstreams, "dns", "", "specify proxy dns servers, udp://host[:port] or tcp://host[:port], comma separated, empty means system resolver")
+	flag.DurationVar(&dnsCacheTTL, "dns-ttl", time.Minute, "specify proxy dns max cache ttl, answers of -dns servers are cached no longer than their record ttl, 0 means no cache")
+	flag.DurationVar(&dnsTimeout, "dns-timeout", 5*time.Second, "specify proxy dns lookup timeout")
+	flag.StringVar(&dnsPrefer, "dns-prefer", "", "specify proxy preferred address family, ipv4 or ipv6")
+}
+
+// splitList split comma separated list, empty string means empty list
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	return strings.Split(s, ",")
+}
+
+// parsePorts parse comma separated port list
+func parsePorts(s string) []int {
+	var ports []int
+	for _, p := range splitList(s) {
+		port, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			log.Fatal("invalid port:", p)
+		}
+
+		ports = append(ports, port)
+	}
+
+	return ports
 }
 
 // getVersion get version
@@ -44,9 +145,83 @@ func main() {
 
 	log.Println("try to start  lxquic server, version:", getVersion())
 
+	// udp and tcp can share the same port
+	switch tcpListenAddr {
+	case "":
+		tcpListenAddr = listenAddr
+	case "off":
+		tcpListenAddr = ""
+	}
+
+	if adminToken == "" {
+		adminToken = os.Getenv("LXQUIC_ADMIN_TOKEN")
+	}
+
+	if eventSecret == "" {
+		eventSecret = os.Getenv("LXQUIC_EVENT_SECRET")
+	}
+
+	if clusterToken == "" {
+		clusterToken = os.Getenv("LXQUIC_CLUSTER_TOKEN")
+	}
+
+	err := transportConf.Validate()
+	if err != nil {
+		log.Fatal("invalid transport config:", err)
+	}
+
+	roleKeepalive, err := server.ParseKeepalive(keepalive)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	params := &server.Params{
-		ListenAddr: listenAddr,
-		ProxyToken: proxyToken,
+		ListenAddr:    listenAddr,
+		TCPListenAddr: tcpListenAddr,
+		ProxyToken:    proxyToken,
+		ACLFile:       aclFile,
+		AdminAddr:     adminAddr,
+		AdminToken:    adminToken,
+		Version:       getVersion(),
+
+		Transport: transportConf,
+		Keepalive: roleKeepalive,
+
+		MetricsAddr:      metricsAddr,
+		MetricsPerDevice: metricsPerDevice,
+		RegistryDir:      registryDir,
+		Egress: &server.EgressParams{
+			AllowPrivate: egressPrivate,
+			AllowCIDRs:   splitList(egressAllowCIDRs),
+			DenyCIDRs:    splitList(egressDenyCIDRs),
+			AllowDomains: splitList(egressAllowDomains),
+			DenyDomains:  splitList(egressDenyDomains),
+			AllowPorts:   parsePorts(egressAllowPorts),
+			DenyPorts:    parsePorts(egressDenyPorts),
+		},
+		Resolver: &server.ResolverParams{
+			Upstreams: splitList(dnsUpstreams),
+			CacheTTL:  dnsCacheTTL,
+			Timeout:   dnsTimeout,
+			Prefer:    dnsPrefer,
+		},
+	}
+
+	if eventWebhooks != "" || eventFile != "" {
+		params.Events = &server.EventsParams{
+			Webhooks: splitList(eventWebhooks),
+			Secret:   eventSecret,
+			File:     eventFile,
+			Buffer:   eventBuffer,
+		}
+	}
+
+	if clusterAddr != "" {
+		params.Cluster = &server.ClusterParams{
+			Addr:  clusterAddr,
+			Peers: splitList(clusterPeers),
+			Token: clusterToken,
+		}
 	}
 
 	// start http server
@@ -58,5 +233,18 @@ func main() {
 	} else {
 		wait.GetInput()
 	}
+
+	if drainGrace > 0 {
+		if daemon == "yes" {
+			// second signal exit without waiting
+			go func() {
+				wait.GetSignal()
+				log.Println("exit while draining")
+				os.Exit(1)
+			}()
+		}
+
+		server.Drain(drainRelay, drainGrace)
+	}
 	return
 }
@@ -1,14 +1,24 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"lxquic/endpointc"
+	"lxquic/protoj"
+	"lxquic/transport"
 	"lxquic/wait"
 )
 
@@ -18,8 +28,35 @@ var (
 	uuid       string
 	quicAddr   string
 	proxyToken string
+	exitDevice string
 	socks5Port int
 	daemon     = ""
+
+	dnsListen   string
+	dnsUpstream string
+	dnsDevice   string
+	fakeIPRange string
+
+	transparentListen string
+	transparentMode   string
+
+	stdioTarget string
+	p2p         bool
+
+	e2eEnabled   bool
+	knownDevices string
+	deviceKey    string
+
+	// transport mode, auto, quic or tcp
+	transportMode string
+	// keepalive and quic parameters
+	transportConf = transport.DefaultConfig()
+
+	retryMin     time.Duration
+	retryMax     time.Duration
+	queueTimeout time.Duration
+
+	metricsAddr string
 )
 
 func init() {
@@ -27,9 +64,31 @@ func init() {
 	flag.IntVar(&rport, "r", 3389, "specify target port")
 	flag.StringVar(&uuid, "u", "", "specify device uuid")
 	flag.StringVar(&quicAddr, "addr", "", "specify quic server address")
+	flag.StringVar(&transportMode, "t", "auto", "specify transport, auto, quic or tcp, auto means try quic first and fallback to tcp")
 	flag.IntVar(&socks5Port, "s", 1090, "specify socks5 local server port")
 	flag.StringVar(&proxyToken, "su", "", "specify proxy token")
+	flag.StringVar(&exitDevice, "sd", "", "specify device uuid as socks5 exit node")
 	flag.StringVar(&daemon, "d", "yes", "specify daemon mode")
+
+	flag.StringVar(&dnsListen, "dns", "", "specify local dns server listen address, e.g. 127.0.0.1:5353, empty means disable")
+	flag.StringVar(&dnsUpstream, "dns-upstream", "8.8.8.8:53", "specify dns resolver that local dns server forward to through tunnel")
+	flag.StringVar(&dnsDevice, "dns-device", "", "specify device uuid that dns queries exit from, default is socks5 exit node")
+	flag.StringVar(&fakeIPRange, "fakeip", "", "specify fake ip range for local dns server, e.g. 198.18.0.0/15, empty means disable")
+
+	flag.StringVar(&transparentListen, "tp", "", "specify transparent proxy listen address, linux only, empty means disable")
+	flag.StringVar(&transparentMode, "tp-mode", "redirect", "specify transparent proxy mode, redirect or tproxy")
+
+	flag.BoolVar(&p2p, "p2p", false, "enable peer-to-peer direct path to device")
+	flag.BoolVar(&e2eEnabled, "e2e", false, "enable end-to-end encryption with device")
+	flag.StringVar(&knownDevices, "kh", "", "specify known device keys file, default ~/.lxquic/known_devices")
+	flag.StringVar(&deviceKey, "pk", "", "specify pre-provisioned device public key, base64")
+	flag.DurationVar(&retryMin, "retry-min", time.Second, "specify min reconnect delay, doubled every failure, with full jitter")
+	flag.DurationVar(&retryMax, "retry-max", time.Minute, "specify max reconnect delay")
+	flag.DurationVar(&queueTimeout, "queue-timeout", 10*time.Second, "specify how long local connections wait for reconnect")
+	transportConf.RegisterKeepaliveFlags(flag.CommandLine)
+	transportConf.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&metricsAddr, "metrics", "", "specify metrics listen address, serve /metrics, e.g. 127.0.0.1:9101, empty means disable")
+	flag.StringVar(&stdioTarget, "W", "", "forward stdin and stdout to device:port, like ssh -W, for ssh ProxyCommand, exit 2 if relay unreachable, 3 if denied by server or acl, 4 if device offline, 5 if port refused")
 }
 
 // getVersion get version
@@ -50,6 +109,19 @@ func main() {
 		os.Exit(0)
 	}
 
+	err := transportConf.Validate()
+	if err != nil {
+		log.Fatal("invalid transport config:", err)
+	}
+
+	if stdioTarget != "" {
+		os.Exit(runStdio())
+	}
+
+	if flag.Arg(0) == "list" {
+		os.Exit(runList(flag.Args()[1:]))
+	}
+
 	log.Println("try to start  lxquic endpoint client, version:", getVersion())
 
 	if uuid == "" {
@@ -67,6 +139,29 @@ func main() {
 		QuicAddr:   quicAddr,
 		Socks5Port: socks5Port,
 		ProxyToken: proxyToken,
+		ExitDevice: exitDevice,
+
+		DNSListen:   dnsListen,
+		DNSUpstream: dnsUpstream,
+		DNSDevice:   dnsDevice,
+		FakeIPRange: fakeIPRange,
+
+		TransparentListen: transparentListen,
+		TransparentMode:   transparentMode,
+
+		P2P: p2p,
+
+		E2E:              e2eEnabled,
+		KnownDevicesFile: knownDevicesFile(),
+		DeviceKey:        deviceKey,
+
+		Transport:   transportMode,
+		Config:      transportConf,
+		MetricsAddr: metricsAddr,
+
+		RetryMin:     retryMin,
+		RetryMax:     retryMax,
+		QueueTimeout: queueTimeout,
 	}
 
 	// start http server
@@ -80,3 +175,137 @@ func main() {
 	}
 	return
 }
+
+// runStdio run in ssh -W mode, keep stdout clean, log to stderr
+// with warning level only
+func runStdio() int {
+	log.SetOutput(os.Stderr)
+	log.SetLevel(log.WarnLevel)
+
+	host, port, err := net.SplitHostPort(stdioTarget)
+	if err != nil {
+		log.Errorf("invalid -W target:%s, should be device:port", stdioTarget)
+		return endpointc.ExitError
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		log.Errorf("invalid -W target port:%s", port)
+		return endpointc.ExitError
+	}
+
+	if quicAddr == "" {
+		log.Error("please specify quic server addr")
+		return endpointc.ExitError
+	}
+
+	params := &endpointc.Params{
+		RemotePort: uint16(p),
+		UUID:       host,
+		QuicAddr:   quicAddr,
+
+		E2E:              e2eEnabled,
+		KnownDevicesFile: knownDevicesFile(),
+		DeviceKey:        deviceKey,
+
+		Transport: transportMode,
+		Config:    transportConf,
+	}
+
+	return endpointc.RunStdio(params)
+}
+
+// runList list online devices, e.g. qec -addr x.x.x.x:port list -tag lab
+func runList(args []string) int {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	tag := fs.String("tag", "", "only list devices with the tag")
+	pattern := fs.String("m", "", "only list devices that id match the glob pattern")
+	selector := fs.String("l", "", "only list devices match the label selector, e.g. env=prod,region!=eu")
+	asJSON := fs.Bool("json", false, "output json")
+	fs.Parse(args)
+
+	log.SetOutput(os.Stderr)
+	log.SetLevel(log.WarnLevel)
+
+	if quicAddr == "" {
+		log.Error("please specify quic server addr")
+		return 1
+	}
+
+	params := &endpointc.Params{
+		QuicAddr:   quicAddr,
+		ProxyToken: proxyToken,
+		Transport:  transportMode,
+		Config:     transportConf,
+	}
+
+	filter := &protoj.ListFilter{
+		Tag:      *tag,
+		Pattern:  *pattern,
+		Selector: *selector,
+	}
+
+	devices, err := endpointc.ListDevices(params, filter)
+	if err != nil {
+		log.Errorf("list devices failed:%v", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(devices)
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tHOST\tOS\tLABELS\tTAGS\tAGENT\tSINCE\tREMOTE\tRTT\tJITTER\tLOSS")
+	for _, d := range devices {
+		rtt, jitter, loss := "-", "-", "-"
+		if d.RTT > 0 {
+			rtt = fmt.Sprintf("%dms", d.RTT)
+		}
+
+		if d.Health != nil {
+			jitter = fmt.Sprintf("%.1fms", d.Health.Jitter)
+			loss = fmt.Sprintf("%.0f%%", d.Health.Loss*100)
+		}
+
+		host, osArch, labels := "-", "-", "-"
+		if d.Meta != nil {
+			host = d.Meta.Hostname
+			osArch = d.Meta.OS + "/" + d.Meta.Arch
+		}
+
+		// the labels selectors match
+		var kvs []string
+		for k, v := range d.Labels {
+			kvs = append(kvs, k+"="+v)
+		}
+
+		if len(kvs) > 0 {
+			sort.Strings(kvs)
+			labels = strings.Join(kvs, ",")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.DUID, host, osArch, labels,
+			strings.Join(d.Tags, ","), d.Agent, d.Since.Local().Format("2006-01-02 15:04:05"), d.RemoteAddr, rtt, jitter, loss)
+	}
+	w.Flush()
+
+	return 0
+}
+
+// knownDevicesFile the -kh file, or the default one in home dir
+func knownDevicesFile() string {
+	if knownDevices != "" {
+		return knownDevices
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "known_devices"
+	}
+
+	return filepath.Join(home, ".lxquic", "known_devices")
+}
@@ -3,25 +3,68 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"lxquic/endpoints"
+	"lxquic/protoj"
+	"lxquic/transport"
 	"lxquic/wait"
 )
 
 var (
-	uuid     string
-	quicAddr string
-	daemon   = ""
+	uuid       string
+	quicAddr   string
+	relayOrder string
+	retryMin   time.Duration
+	retryMax   time.Duration
+	lanTargets string
+	allowPorts string
+	p2p        bool
+	keyFile    string
+	daemon     = ""
+
+	tags   string
+	hidden bool
+
+	labels     string
+	labelsFile string
+	services   string
+
+	// transport mode, auto, quic or tcp
+	transportMode string
+	// keepalive and quic parameters
+	transportConf = transport.DefaultConfig()
+
+	metricsAddr string
 )
 
 func init() {
 	flag.StringVar(&uuid, "u", "", "specify device uuid")
-	flag.StringVar(&quicAddr, "addr", "", "specify quic server address")
+	flag.StringVar(&quicAddr, "addr", "", "specify quic server addresses, comma separated, tried in -relay-order, the last working one first")
+	flag.StringVar(&relayOrder, "relay-order", "priority", "specify the order relays are tried, priority or random")
+	flag.DurationVar(&retryMin, "retry-min", time.Second, "specify min reconnect delay, doubled every failure, with full jitter")
+	flag.DurationVar(&retryMax, "retry-max", 2*time.Minute, "specify max reconnect delay")
+	flag.StringVar(&transportMode, "t", "auto", "specify transport, auto, quic or tcp, auto means try quic first and fallback to tcp")
+	flag.StringVar(&allowPorts, "ports", "", "specify local ports that can be dialed, comma separated, * means all, empty means none (older versions allowed all when empty, set * to keep that)")
+	flag.StringVar(&lanTargets, "lan", "", "specify lan targets that can be dialed as exit node, host[:port] or CIDR[:port], comma separated")
 	flag.StringVar(&daemon, "d", "yes", "specify daemon mode")
+	flag.BoolVar(&p2p, "p2p", false, "enable peer-to-peer direct path with ec")
+	flag.StringVar(&keyFile, "key", "", "specify e2e static key file, created if not exist, empty means e2e disabled")
+	flag.StringVar(&tags, "tags", "", "specify device tags for discovery, comma separated")
+	flag.BoolVar(&hidden, "hidden", false, "hide device from ec list, proxy clients can still see it")
+	flag.StringVar(&labels, "labels", "", "specify device labels, key=value, comma separated, override the labels file, listed only, acl and routing use the labels assigned on relay")
+	flag.StringVar(&labelsFile, "labels-file", "", "specify device labels file, key=value a line")
+	transportConf.RegisterKeepaliveFlags(flag.CommandLine)
+	transportConf.RegisterFlags(flag.CommandLine)
+	flag.StringVar(&metricsAddr, "metrics", "", "specify metrics listen address, serve /metrics, e.g. 127.0.0.1:9100, empty means disable")
+	flag.StringVar(&services, "services", "", "specify exposed services, name:port[/proto], comma separated")
 }
 
 // getVersion get version
@@ -29,6 +72,41 @@ func getVersion() string {
 	return "0.1.0"
 }
 
+// addLabel parse key=value and add it
+func addLabel(labels map[string]string, s string) {
+	kv := strings.SplitN(strings.TrimSpace(s), "=", 2)
+	if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+		log.Fatal("invalid label:", s)
+	}
+
+	labels[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+}
+
+// parseService parse name:port[/proto]
+func parseService(s string) protoj.Service {
+	var svc protoj.Service
+	s = strings.TrimSpace(s)
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		log.Fatal("invalid service:", s)
+	}
+
+	svc.Name = s[:i]
+	port := s[i+1:]
+	if j := strings.Index(port, "/"); j >= 0 {
+		svc.Proto = port[j+1:]
+		port = port[:j]
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		log.Fatal("invalid service port:", s)
+	}
+
+	svc.Port = p
+	return svc
+}
+
 func main() {
 	// only one thread
 	runtime.GOMAXPROCS(1)
@@ -52,9 +130,82 @@ func main() {
 		log.Fatal("please specify quic server address")
 	}
 
+	err := transportConf.Validate()
+	if err != nil {
+		log.Fatal("invalid transport config:", err)
+	}
+
 	params := &endpoints.Params{
-		UUID:     uuid,
-		QuicAddr: quicAddr,
+		UUID:    uuid,
+		P2P:     p2p,
+		KeyFile: keyFile,
+
+		RelayOrder: relayOrder,
+		RetryMin:   retryMin,
+		RetryMax:   retryMax,
+
+		Transport:   transportMode,
+		Config:      transportConf,
+		MetricsAddr: metricsAddr,
+
+		Version: getVersion(),
+		Hidden:  hidden,
+	}
+
+	for _, a := range strings.Split(quicAddr, ",") {
+		params.QuicAddrs = append(params.QuicAddrs, strings.TrimSpace(a))
+	}
+
+	if strings.TrimSpace(allowPorts) == "*" {
+		params.AllowAllPorts = true
+	} else if allowPorts != "" {
+		for _, p := range strings.Split(allowPorts, ",") {
+			port, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil {
+				log.Fatal("invalid port:", p)
+			}
+
+			params.AllowPorts = append(params.AllowPorts, port)
+		}
+	}
+
+	if lanTargets != "" {
+		params.LANTargets = strings.Split(lanTargets, ",")
+	}
+
+	if tags != "" {
+		for _, t := range strings.Split(tags, ",") {
+			params.Tags = append(params.Tags, strings.TrimSpace(t))
+		}
+	}
+
+	params.Labels = make(map[string]string)
+	if labelsFile != "" {
+		data, err := ioutil.ReadFile(labelsFile)
+		if err != nil {
+			log.Fatal("read labels file failed:", err)
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			addLabel(params.Labels, line)
+		}
+	}
+
+	if labels != "" {
+		for _, l := range strings.Split(labels, ",") {
+			addLabel(params.Labels, l)
+		}
+	}
+
+	if services != "" {
+		for _, sv := range strings.Split(services, ",") {
+			params.Services = append(params.Services, parseService(sv))
+		}
 	}
 
 	// start http server
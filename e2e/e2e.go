@@ -0,0 +1,396 @@
+package e2e
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// end-to-end encryption of link streams between ec and es, the relay
+// only forward ciphertext.
+//
+// handshake, like noise NX, es is authenticated by its static key:
+//   ec -> es: e_i
+//   es -> ec: e_r, s_r, seal(k_r2i, nonce 0, empty)
+// h = sha256(protocolName || e_i || e_r || s_r)
+// k_i2r || k_r2i = hkdf(dh(e_i, e_r) || dh(e_i, s_r), salt h)
+//
+// after handshake, every record is 2 bytes length and the sealed chunk,
+// an empty chunk is the close record, a stream that end without it may
+// be truncated by the relay
+
+const (
+	protocolName = "lxquic-e2e-x25519-chachapoly-sha256-v1"
+	// KeySize size of static keys
+	KeySize = 32
+	// max plaintext of a record
+	maxRecordPlain = 16 * 1024
+	// poly1305 tag size
+	tagSize = 16
+)
+
+// KeyPair x25519 static key pair
+type KeyPair struct {
+	Private [KeySize]byte
+	Public  [KeySize]byte
+}
+
+// GenerateKey generate a random key pair
+func GenerateKey() (*KeyPair, error) {
+	kp := &KeyPair{}
+	_, err := io.ReadFull(rand.Reader, kp.Private[:])
+	if err != nil {
+		return nil, err
+	}
+
+	pub, err := curve25519.X25519(kp.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	copy(kp.Public[:], pub)
+	return kp, nil
+}
+
+// LoadOrCreateKey load private key from file, the file keep the base64
+// encoded private key, generate and save one if the file not exist
+func LoadOrCreateKey(path string) (*KeyPair, error) {
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		kp, err := GenerateKey()
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded := base64.StdEncoding.EncodeToString(kp.Private[:])
+		err = ioutil.WriteFile(path, []byte(encoded+"\n"), 0600)
+		if err != nil {
+			return nil, err
+		}
+
+		return kp, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	priv, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil || len(priv) != KeySize {
+		return nil, fmt.Errorf("invalid key file:%s", path)
+	}
+
+	kp := &KeyPair{}
+	copy(kp.Private[:], priv)
+	pub, err := curve25519.X25519(kp.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+
+	copy(kp.Public[:], pub)
+	return kp, nil
+}
+
+// PublicString base64 encoded public key
+func (kp *KeyPair) PublicString() string {
+	return EncodeKey(kp.Public[:])
+}
+
+// EncodeKey base64 encode a public key
+func EncodeKey(pub []byte) string {
+	return base64.StdEncoding.EncodeToString(pub)
+}
+
+// DecodeKey decode a base64 public key
+func DecodeKey(s string) ([]byte, error) {
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil || len(pub) != KeySize {
+		return nil, fmt.Errorf("invalid public key:%s", s)
+	}
+
+	return pub, nil
+}
+
+// Conn encrypted stream over the link stream
+type Conn struct {
+	rw io.ReadWriteCloser
+
+	sendAEAD  cipher.AEAD
+	sendNonce uint64
+	recvAEAD  cipher.AEAD
+	recvNonce uint64
+
+	// decrypted data not yet read
+	plain  []byte
+	recbuf []byte
+	sndbuf []byte
+
+	// close record received
+	peerClosed bool
+	// close record sent
+	closed bool
+}
+
+// Client run handshake as ec, verify is called with the peer's static key
+// before any data, a non-nil error abort the handshake
+func Client(rw io.ReadWriteCloser, verify func(pub []byte) error) (*Conn, error) {
+	eph, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = rw.Write(eph.Public[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var msg [2*KeySize + tagSize]byte
+	_, err = io.ReadFull(rw, msg[:])
+	if err != nil {
+		return nil, fmt.Errorf("e2e read handshake failed:%v", err)
+	}
+
+	ephR := msg[:KeySize]
+	staticR := msg[KeySize : 2*KeySize]
+
+	ee, err := curve25519.X25519(eph.Private[:], ephR)
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := curve25519.X25519(eph.Private[:], staticR)
+	if err != nil {
+		return nil, err
+	}
+
+	h := transcript(eph.Public[:], ephR, staticR)
+	i2r, r2i, err := deriveKeys(ee, es, h)
+	if err != nil {
+		return nil, err
+	}
+
+	// the peer prove it own the static key
+	_, err = r2i.Open(nil, nonce(0), msg[2*KeySize:], h)
+	if err != nil {
+		return nil, fmt.Errorf("e2e handshake, peer not own the static key")
+	}
+
+	if verify != nil {
+		err = verify(staticR)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := &Conn{
+		rw:        rw,
+		sendAEAD:  i2r,
+		recvAEAD:  r2i,
+		recvNonce: 1,
+	}
+
+	return c, nil
+}
+
+// Server run handshake as es with its static key
+func Server(rw io.ReadWriteCloser, static *KeyPair) (*Conn, error) {
+	var ephI [KeySize]byte
+	_, err := io.ReadFull(rw, ephI[:])
+	if err != nil {
+		return nil, fmt.Errorf("e2e read handshake failed:%v", err)
+	}
+
+	eph, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	ee, err := curve25519.X25519(eph.Private[:], ephI[:])
+	if err != nil {
+		return nil, err
+	}
+
+	es, err := curve25519.X25519(static.Private[:], ephI[:])
+	if err != nil {
+		return nil, err
+	}
+
+	h := transcript(ephI[:], eph.Public[:], static.Public[:])
+	i2r, r2i, err := deriveKeys(ee, es, h)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, 0, 2*KeySize+tagSize)
+	msg = append(msg, eph.Public[:]...)
+	msg = append(msg, static.Public[:]...)
+	msg = r2i.Seal(msg, nonce(0), nil, h)
+
+	_, err = rw.Write(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		rw:        rw,
+		sendAEAD:  r2i,
+		sendNonce: 1,
+		recvAEAD:  i2r,
+	}
+
+	return c, nil
+}
+
+func transcript(ephI, ephR, staticR []byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte(protocolName))
+	hash.Write(ephI)
+	hash.Write(ephR)
+	hash.Write(staticR)
+	return hash.Sum(nil)
+}
+
+func deriveKeys(ee, es, h []byte) (cipher.AEAD, cipher.AEAD, error) {
+	secret := append(append([]byte{}, ee...), es...)
+	kdf := hkdf.New(sha256.New, secret, h, []byte(protocolName))
+
+	var keys [2 * chacha20poly1305.KeySize]byte
+	_, err := io.ReadFull(kdf, keys[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	i2r, err := chacha20poly1305.New(keys[:chacha20poly1305.KeySize])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r2i, err := chacha20poly1305.New(keys[chacha20poly1305.KeySize:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return i2r, r2i, nil
+}
+
+func nonce(n uint64) []byte {
+	var b [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(b[4:], n)
+	return b[:]
+}
+
+// Read read and decrypt, not safe for concurrent use, io.EOF only after
+// the close record, io.ErrUnexpectedEOF if the stream end without it
+func (c *Conn) Read(p []byte) (int, error) {
+	if c.peerClosed {
+		return 0, io.EOF
+	}
+
+	if len(c.plain) == 0 {
+		var lenb [2]byte
+		_, err := io.ReadFull(c.rw, lenb[:])
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return 0, err
+		}
+
+		l := int(binary.BigEndian.Uint16(lenb[:]))
+		if cap(c.recbuf) < l {
+			c.recbuf = make([]byte, l)
+		}
+
+		record := c.recbuf[:l]
+		_, err = io.ReadFull(c.rw, record)
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+
+		plain, err := c.recvAEAD.Open(record[:0], nonce(c.recvNonce), record, nil)
+		if err != nil {
+			return 0, fmt.Errorf("e2e decrypt record failed:%v", err)
+		}
+
+		c.recvNonce++
+		if len(plain) == 0 {
+			c.peerClosed = true
+			return 0, io.EOF
+		}
+
+		c.plain = plain
+	}
+
+	n := copy(p, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+// Write encrypt and write, not safe for concurrent use
+func (c *Conn) Write(p []byte) (int, error) {
+	wrote := 0
+	for wrote < len(p) {
+		chunk := p[wrote:]
+		if len(chunk) > maxRecordPlain {
+			chunk = chunk[:maxRecordPlain]
+		}
+
+		_, err := c.rw.Write(c.seal(chunk))
+		if err != nil {
+			return wrote, err
+		}
+
+		wrote += len(chunk)
+	}
+
+	return wrote, nil
+}
+
+// seal make a record of the chunk
+func (c *Conn) seal(chunk []byte) []byte {
+	c.sndbuf = append(c.sndbuf[:0], 0, 0)
+	c.sndbuf = c.sendAEAD.Seal(c.sndbuf, nonce(c.sendNonce), chunk, nil)
+	c.sendNonce++
+	binary.BigEndian.PutUint16(c.sndbuf[0:2], uint16(len(c.sndbuf)-2))
+
+	return c.sndbuf
+}
+
+// Close send the close record and close the underlying link stream,
+// not safe for concurrent use with Write
+func (c *Conn) Close() error {
+	if !c.closed {
+		c.closed = true
+		_, err := c.rw.Write(c.seal(nil))
+		if err != nil {
+			c.rw.Close()
+			return err
+		}
+	}
+
+	return c.rw.Close()
+}
+
+// keysEqual constant time compare
+func keysEqual(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
@@ -0,0 +1,247 @@
+package e2e
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// handshake run the handshake over a pipe, return ec's and es's conn
+func handshake(t *testing.T, static *KeyPair, verify func(pub []byte) error) (*Conn, *Conn, error) {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		conn, err := Server(b, static)
+		done <- result{conn, err}
+	}()
+
+	client, err := Client(a, verify)
+	if err != nil {
+		// unblock the server
+		a.Close()
+		<-done
+		return nil, nil, err
+	}
+
+	r := <-done
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+
+	return client, r.conn, nil
+}
+
+func mustKey(t *testing.T) *KeyPair {
+	kp, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return kp
+}
+
+// recordBuf stand in for the link stream after handshake
+type recordBuf struct {
+	bytes.Buffer
+}
+
+func (rb *recordBuf) Close() error {
+	return nil
+}
+
+func TestRoundTrip(t *testing.T) {
+	static := mustKey(t)
+	var seen []byte
+	client, server, err := handshake(t, static, func(pub []byte) error {
+		seen = pub
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(seen, static.Public[:]) {
+		t.Fatal("verify not called with the static key")
+	}
+
+	// larger than a record, split and joined again
+	data := make([]byte, 3*maxRecordPlain+100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+
+	got, err := ioutil.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(data))
+	}
+
+	// the other direction
+	go func() {
+		server.Write([]byte("pong"))
+		server.Close()
+	}()
+
+	got, err = ioutil.ReadAll(client)
+	if err != nil || string(got) != "pong" {
+		t.Fatalf("got %q, err:%v", got, err)
+	}
+}
+
+// records of the data written by one side, and the other side to read
+func records(t *testing.T, chunks ...string) ([]byte, *Conn) {
+	client, server, err := handshake(t, mustKey(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rb := &recordBuf{}
+	client.rw = rb
+	for _, c := range chunks {
+		client.Write([]byte(c))
+	}
+
+	return rb.Bytes(), server
+}
+
+func readAllFrom(conn *Conn, raw []byte) ([]byte, error) {
+	rb := &recordBuf{}
+	rb.Write(raw)
+	conn.rw = rb
+
+	return ioutil.ReadAll(conn)
+}
+
+func TestTamperedRecord(t *testing.T) {
+	raw, server := records(t, "hello")
+	raw[len(raw)-1] ^= 1
+
+	_, err := readAllFrom(server, raw)
+	if err == nil {
+		t.Fatal("tampered record accepted")
+	}
+}
+
+func TestReorderedRecords(t *testing.T) {
+	raw, server := records(t, "first", "second")
+
+	// records are 2 bytes length, the chunk and the tag
+	first := 2 + len("first") + tagSize
+	reordered := append(append([]byte{}, raw[first:]...), raw[:first]...)
+
+	_, err := readAllFrom(server, reordered)
+	if err == nil {
+		t.Fatal("reordered records accepted")
+	}
+}
+
+func TestTruncatedStream(t *testing.T) {
+	// the relay drop the rest after a record
+	raw, server := records(t, "first", "second")
+	got, err := readAllFrom(server, raw[:2+len("first")+tagSize])
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated stream read %q, err:%v", got, err)
+	}
+
+	// the close record make a clean end
+	client, server, err := handshake(t, mustKey(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rb := &recordBuf{}
+	client.rw = rb
+	client.Write([]byte("all"))
+	client.Close()
+
+	got, err = readAllFrom(server, rb.Bytes())
+	if err != nil || string(got) != "all" {
+		t.Fatalf("got %q, err:%v", got, err)
+	}
+}
+
+func TestWrongStaticKey(t *testing.T) {
+	kd, err := LoadKnownDevices("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pinned := mustKey(t)
+	kd.Pin("dev1", pinned.Public[:])
+
+	_, _, err = handshake(t, mustKey(t), func(pub []byte) error {
+		return kd.Verify("dev1", pub)
+	})
+	if err == nil {
+		t.Fatal("handshake ok with a key other than the pinned one")
+	}
+
+	_, _, err = handshake(t, pinned, func(pub []byte) error {
+		return kd.Verify("dev1", pub)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKnownDevicesTOFU(t *testing.T) {
+	dir, err := ioutil.TempDir("", "e2e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "known_devices")
+	first, second := mustKey(t), mustKey(t)
+
+	kd, err := LoadKnownDevices(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first seen, pinned and saved
+	err = kd.Verify("dev1", first.Public[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kd, err = LoadKnownDevices(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if kd.Verify("dev1", second.Public[:]) == nil {
+		t.Fatal("pinned key not loaded, another key accepted")
+	}
+
+	if err = kd.Verify("dev1", first.Public[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	// other devices are still first seen
+	if err = kd.Verify("dev2", second.Public[:]); err != nil {
+		t.Fatal(err)
+	}
+}
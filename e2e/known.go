@@ -0,0 +1,119 @@
+package e2e
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KnownDevices device static keys pinned by ec, trust on first use,
+// the file has one "duid base64key" per line
+type KnownDevices struct {
+	path string
+
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// LoadKnownDevices load pinned keys from file, not exist is ok
+func LoadKnownDevices(path string) (*KnownDevices, error) {
+	kd := &KnownDevices{
+		path: path,
+		keys: make(map[string][]byte),
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return kd, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid known devices line:%s", line)
+		}
+
+		pub, err := DecodeKey(fields[1])
+		if err != nil {
+			return nil, err
+		}
+
+		kd.keys[fields[0]] = pub
+	}
+
+	return kd, scanner.Err()
+}
+
+// Pin pre-provision the device key, it is not saved to file
+func (kd *KnownDevices) Pin(duid string, pub []byte) {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	kd.keys[duid] = pub
+}
+
+// Verify check the device key against the pinned one, pin
+// and save it if the device is first seen
+func (kd *KnownDevices) Verify(duid string, pub []byte) error {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+
+	pinned, ok := kd.keys[duid]
+	if ok {
+		if !keysEqual(pinned, pub) {
+			return fmt.Errorf("device %s key mismatch, pinned:%s, got:%s", duid, EncodeKey(pinned), EncodeKey(pub))
+		}
+
+		return nil
+	}
+
+	kd.keys[duid] = append([]byte{}, pub...)
+	return kd.saveLocked()
+}
+
+func (kd *KnownDevices) saveLocked() error {
+	if kd.path == "" {
+		return nil
+	}
+
+	var duids []string
+	for k := range kd.keys {
+		duids = append(duids, k)
+	}
+	sort.Strings(duids)
+
+	var sb strings.Builder
+	for _, duid := range duids {
+		fmt.Fprintf(&sb, "%s %s\n", duid, EncodeKey(kd.keys[duid]))
+	}
+
+	err := os.MkdirAll(filepath.Dir(kd.path), 0700)
+	if err != nil {
+		return err
+	}
+
+	tmp := kd.path + ".tmp"
+	err = ioutil.WriteFile(tmp, []byte(sb.String()), 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, kd.path)
+}
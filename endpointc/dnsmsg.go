@@ -0,0 +1,255 @@
+package endpointc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// minimal dns message helpers, only what the local dns server needs
+
+const (
+	dnsHeaderLen = 12
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsRcodeNoError  = 0
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+)
+
+var errDNSMsgShort = fmt.Errorf("dns message too short")
+
+// dnsQuestion the first question of a dns query
+type dnsQuestion struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	// offset of the end of question section
+	end int
+}
+
+// parseDNSQuestion parse the only question of a query
+func parseDNSQuestion(msg []byte) (*dnsQuestion, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errDNSMsgShort
+	}
+
+	qdcount := binary.BigEndian.Uint16(msg[4:6])
+	if qdcount != 1 {
+		return nil, fmt.Errorf("dns query with %d questions not supported", qdcount)
+	}
+
+	name, off, err := readDNSName(msg, dnsHeaderLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if off+4 > len(msg) {
+		return nil, errDNSMsgShort
+	}
+
+	q := &dnsQuestion{
+		name:   name,
+		qtype:  binary.BigEndian.Uint16(msg[off : off+2]),
+		qclass: binary.BigEndian.Uint16(msg[off+2 : off+4]),
+		end:    off + 4,
+	}
+
+	return q, nil
+}
+
+// readDNSName read a possibly compressed name, return the name
+// and the offset after the name
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; hops < 64; hops++ {
+		if off >= len(msg) {
+			return "", 0, errDNSMsgShort
+		}
+
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, "."), end, nil
+		case l&0xc0 == 0xc0:
+			if off+2 > len(msg) {
+				return "", 0, errDNSMsgShort
+			}
+
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3fff)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSMsgShort
+			}
+
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+
+	return "", 0, fmt.Errorf("dns name too many labels or pointers")
+}
+
+// skipDNSName skip a possibly compressed name
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += 1 + l
+		}
+	}
+
+	return 0, errDNSMsgShort
+}
+
+// walkDNSRecords call fn with the type and the ttl field of every
+// answer and authority record
+func walkDNSRecords(msg []byte, fn func(rtype uint16, ttl []byte)) (int, error) {
+	if len(msg) < dnsHeaderLen {
+		return 0, errDNSMsgShort
+	}
+
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10]))
+
+	off := dnsHeaderLen
+	var err error
+	for i := 0; i < qdcount; i++ {
+		off, err = skipDNSName(msg, off)
+		if err != nil {
+			return 0, err
+		}
+		off += 4
+	}
+
+	for i := 0; i < rrcount; i++ {
+		off, err = skipDNSName(msg, off)
+		if err != nil {
+			return 0, err
+		}
+
+		// type, class, ttl, rdlength
+		if off+10 > len(msg) {
+			return 0, errDNSMsgShort
+		}
+
+		rtype := binary.BigEndian.Uint16(msg[off : off+2])
+		ttl := msg[off+4 : off+8]
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8 : off+10]))
+		off += 10 + rdlen
+		if off > len(msg) {
+			return 0, errDNSMsgShort
+		}
+
+		fn(rtype, ttl)
+	}
+
+	return rrcount, nil
+}
+
+// dnsMinTTL the min ttl of answer and authority records, and
+// whether there is any record, a response without any record
+// should not be cached
+func dnsMinTTL(msg []byte) (uint32, bool, error) {
+	var minTTL uint32
+	first := true
+	rrcount, err := walkDNSRecords(msg, func(rtype uint16, ttl []byte) {
+		v := binary.BigEndian.Uint32(ttl)
+		if first || v < minTTL {
+			minTTL = v
+		}
+		first = false
+	})
+
+	if err != nil {
+		return 0, false, err
+	}
+
+	return minTTL, rrcount > 0, nil
+}
+
+// dnsAgeTTL decrease ttl of answer and authority records by the
+// seconds the message has been cached
+func dnsAgeTTL(msg []byte, age uint32) error {
+	_, err := walkDNSRecords(msg, func(rtype uint16, ttl []byte) {
+		v := binary.BigEndian.Uint32(ttl)
+		if v > age {
+			v -= age
+		} else {
+			v = 0
+		}
+		binary.BigEndian.PutUint32(ttl, v)
+	})
+
+	return err
+}
+
+// dnsRcode response code of a dns message
+func dnsRcode(msg []byte) int {
+	return int(msg[3] & 0x0f)
+}
+
+// dnsTruncated if the TC bit is set
+func dnsTruncated(msg []byte) bool {
+	return msg[2]&0x02 != 0
+}
+
+// buildDNSResponse build a response for query, copy the question,
+// and append an A or AAAA answer if ip is not nil
+func buildDNSResponse(query []byte, q *dnsQuestion, rcode int, ip net.IP, ttl uint32) []byte {
+	resp := make([]byte, q.end, q.end+16+len(ip))
+	copy(resp, query[:q.end])
+
+	// QR, keep opcode and RD, RA, rcode
+	flags := binary.BigEndian.Uint16(query[2:4])
+	flags = 0x8000 | (flags & 0x7900) | 0x0080 | uint16(rcode&0x0f)
+	binary.BigEndian.PutUint16(resp[2:4], flags)
+
+	// one question, drop the additional section, e.g. EDNS
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+	binary.BigEndian.PutUint16(resp[6:8], 0)
+	binary.BigEndian.PutUint16(resp[8:10], 0)
+	binary.BigEndian.PutUint16(resp[10:12], 0)
+
+	if ip == nil {
+		return resp
+	}
+
+	qtype := uint16(dnsTypeA)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		qtype = dnsTypeAAAA
+	}
+
+	binary.BigEndian.PutUint16(resp[6:8], 1)
+
+	var rr [12]byte
+	// pointer to the question name
+	binary.BigEndian.PutUint16(rr[0:2], 0xc000|dnsHeaderLen)
+	binary.BigEndian.PutUint16(rr[2:4], qtype)
+	binary.BigEndian.PutUint16(rr[4:6], dnsClassIN)
+	binary.BigEndian.PutUint32(rr[6:10], ttl)
+	binary.BigEndian.PutUint16(rr[10:12], uint16(len(ip)))
+
+	resp = append(resp, rr[:]...)
+	resp = append(resp, ip...)
+
+	return resp
+}
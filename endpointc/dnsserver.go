@@ -0,0 +1,319 @@
+package endpointc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"lxquic/backoff"
+	"lxquic/protoj"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	dnsTimeout = 5 * time.Second
+	// cache ttl upper bound
+	dnsMaxCacheTTL = time.Hour
+	// ttl of fake ip answer
+	dnsFakeIPTTL = 60
+	dnsCacheMax  = 4096
+
+	// delay after read or accept error, grow until they succeed again
+	dnsErrDelayMin = 5 * time.Millisecond
+	dnsErrDelayMax = time.Second
+)
+
+type dnsCacheEntry struct {
+	resp   []byte
+	stored time.Time
+	expire time.Time
+}
+
+// dnsServer local dns server, forward queries through the tunnel
+type dnsServer struct {
+	// upstream resolver, dialed through the tunnel
+	upstreamHost string
+	upstreamPort int
+	// device that queries exit from, empty means exit from quic server
+	device string
+
+	mu    sync.Mutex
+	cache map[string]*dnsCacheEntry
+}
+
+func newDNSServer(upstream string, device string) (*dnsServer, error) {
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil {
+		host = strings.Trim(upstream, "[]")
+		port = "53"
+	}
+
+	p, err := net.LookupPort("tcp", port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid dns upstream %s: %v", upstream, err)
+	}
+
+	ds := &dnsServer{
+		upstreamHost: host,
+		upstreamPort: p,
+		device:       device,
+		cache:        make(map[string]*dnsCacheEntry),
+	}
+
+	return ds, nil
+}
+
+// startDNSServer serve dns query on udp and tcp
+func startDNSServer(address string, ds *dnsServer) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		log.Fatal("startDNSServer udp listen failed:", err)
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal("startDNSServer tcp listen failed:", err)
+	}
+
+	log.Printf("dns server listen at:%s, upstream:%s:%d, device:%s", address, ds.upstreamHost, ds.upstreamPort, ds.device)
+	go ds.serveTCP(listener)
+	ds.serveUDP(pc)
+}
+
+func (ds *dnsServer) serveUDP(pc net.PacketConn) {
+	bo := backoff.New(dnsErrDelayMin, dnsErrDelayMax)
+	for {
+		buf := make([]byte, 4096)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("dnsServer.serveUDP closed")
+				return
+			}
+
+			delay := bo.Next()
+			log.Printf("dnsServer.serveUDP read error:%v, retry in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+
+		bo.Reset()
+
+		go func() {
+			resp := ds.handleQuery(buf[:n])
+			if resp != nil {
+				pc.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (ds *dnsServer) serveTCP(listener net.Listener) {
+	bo := backoff.New(dnsErrDelayMin, dnsErrDelayMax)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				log.Println("dnsServer.serveTCP closed")
+				return
+			}
+
+			delay := bo.Next()
+			log.Printf("dnsServer.serveTCP accept error:%v, retry in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+
+		bo.Reset()
+
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(2 * dnsTimeout))
+				query, err := readDNSTCPMsg(conn)
+				if err != nil {
+					return
+				}
+
+				resp := ds.handleQuery(query)
+				if resp == nil {
+					return
+				}
+
+				err = writeDNSTCPMsg(conn, resp)
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handleQuery answer from fake ip pool or cache, or forward it
+func (ds *dnsServer) handleQuery(query []byte) []byte {
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		log.Println("dnsServer.handleQuery parse query failed:", err)
+		return nil
+	}
+
+	if fakeIPs != nil && q.qclass == dnsClassIN {
+		switch q.qtype {
+		case dnsTypeA:
+			return buildDNSResponse(query, q, dnsRcodeNoError, fakeIPs.allocate(q.name), dnsFakeIPTTL)
+		case dnsTypeAAAA:
+			// no answer, make client fallback to ipv4
+			return buildDNSResponse(query, q, dnsRcodeNoError, nil, 0)
+		}
+	}
+
+	key := fmt.Sprintf("%s/%d/%d", strings.ToLower(q.name), q.qtype, q.qclass)
+	if resp := ds.cacheGet(key); resp != nil {
+		// reply with the query's id
+		copy(resp[0:2], query[0:2])
+		return resp
+	}
+
+	start := time.Now()
+	resp, err := ds.exchange(query)
+	if err != nil {
+		log.Printf("dnsServer.handleQuery %s type %d failed:%v", q.name, q.qtype, err)
+		return buildDNSResponse(query, q, dnsRcodeServFail, nil, 0)
+	}
+
+	log.Printf("dnsServer.handleQuery %s type %d took:%v", q.name, q.qtype, time.Since(start))
+	ds.cachePut(key, resp)
+
+	return resp
+}
+
+func (ds *dnsServer) cacheGet(key string) []byte {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	entry, ok := ds.cache[key]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(entry.expire) {
+		delete(ds.cache, key)
+		return nil
+	}
+
+	resp := make([]byte, len(entry.resp))
+	copy(resp, entry.resp)
+
+	// the answer has been in cache for a while, tell the client so
+	dnsAgeTTL(resp, uint32(time.Since(entry.stored)/time.Second))
+	return resp
+}
+
+func (ds *dnsServer) cachePut(key string, resp []byte) {
+	if len(resp) < dnsHeaderLen || dnsTruncated(resp) {
+		return
+	}
+
+	rcode := dnsRcode(resp)
+	if rcode != dnsRcodeNoError && rcode != dnsRcodeNXDomain {
+		return
+	}
+
+	ttl, ok, err := dnsMinTTL(resp)
+	if err != nil || !ok || ttl == 0 {
+		return
+	}
+
+	expire := time.Duration(ttl) * time.Second
+	if expire > dnsMaxCacheTTL {
+		expire = dnsMaxCacheTTL
+	}
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	now := time.Now()
+	if len(ds.cache) >= dnsCacheMax {
+		for k, v := range ds.cache {
+			if now.After(v.expire) {
+				delete(ds.cache, k)
+			}
+		}
+
+		if len(ds.cache) >= dnsCacheMax {
+			ds.cache = make(map[string]*dnsCacheEntry)
+		}
+	}
+
+	ds.cache[key] = &dnsCacheEntry{resp: resp, stored: now, expire: now.Add(expire)}
+}
+
+// exchange send the query to upstream resolver through the tunnel, use dns over tcp
+func (ds *dnsServer) exchange(query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	var header = &protoj.LinkStreamHeader{
+		Port:  ds.upstreamPort,
+		Host:  ds.upstreamHost,
+		DUID:  ds.device,
+		Reply: true,
+	}
+
+	stream, err := openProxyStream(ctx, header)
+	if err != nil {
+		return nil, err
+	}
+
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(dnsTimeout))
+
+	reply, err := protoj.ReadLinkReply(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	if reply.Code != protoj.LinkReplyOK {
+		return nil, fmt.Errorf("link failed, code:%d, reason:%s", reply.Code, reply.Reason)
+	}
+
+	err = writeDNSTCPMsg(stream, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return readDNSTCPMsg(stream)
+}
+
+// readDNSTCPMsg read a message with 2 bytes length prefix
+func readDNSTCPMsg(r io.Reader) ([]byte, error) {
+	var lenb [2]byte
+	_, err := io.ReadFull(r, lenb[:])
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, binary.BigEndian.Uint16(lenb[:]))
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// writeDNSTCPMsg write a message with 2 bytes length prefix
+func writeDNSTCPMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf[0:2], uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,121 @@
+package endpointc
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dnsQuery an A query of name
+func dnsQuery(name string) []byte {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg[0:2], 0x1234)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+
+	msg = append(msg, 0, 0, dnsTypeA, 0, dnsClassIN)
+	return msg
+}
+
+func TestDNSCacheAgeTTL(t *testing.T) {
+	ds, err := newDNSServer("192.0.2.53", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	query := dnsQuery("example.com")
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := buildDNSResponse(query, q, dnsRcodeNoError, net.IPv4(192, 0, 2, 1), 300)
+	ds.cachePut("example.com", resp)
+
+	// pretend it was cached 100 seconds ago
+	entry := ds.cache["example.com"]
+	entry.stored = entry.stored.Add(-100 * time.Second)
+
+	cached := ds.cacheGet("example.com")
+	if cached == nil {
+		t.Fatal("answer not cached")
+	}
+
+	ttl, ok, err := dnsMinTTL(cached)
+	if err != nil || !ok {
+		t.Fatalf("cached answer ttl:%v, %v", ok, err)
+	}
+
+	if ttl != 200 {
+		t.Fatalf("cached answer ttl %d, want 200", ttl)
+	}
+
+	// the entry itself is not aged twice
+	ttl, _, _ = dnsMinTTL(entry.resp)
+	if ttl != 300 {
+		t.Fatalf("cache entry ttl %d, want 300", ttl)
+	}
+}
+
+func TestDNSAgeTTLFloor(t *testing.T) {
+	query := dnsQuery("example.com")
+	q, err := parseDNSQuestion(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := buildDNSResponse(query, q, dnsRcodeNoError, net.IPv4(192, 0, 2, 1), 10)
+	err = dnsAgeTTL(resp, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ttl, _, _ := dnsMinTTL(resp)
+	if ttl != 0 {
+		t.Fatalf("ttl %d, want 0", ttl)
+	}
+}
+
+func TestDNSServeClosed(t *testing.T) {
+	ds, err := newDNSServer("192.0.2.53", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		ds.serveUDP(pc)
+		done <- struct{}{}
+	}()
+	go func() {
+		ds.serveTCP(listener)
+		done <- struct{}{}
+	}()
+
+	pc.Close()
+	listener.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("serve loop not return after close")
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package endpointc
+
+import (
+	"io"
+	"lxquic/e2e"
+	"lxquic/transport"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	e2eHandshakeTimeout = 10 * time.Second
+)
+
+// setupE2E load pinned device keys, and pin the pre-provisioned one
+func setupE2E(params *Params) {
+	var err error
+	knownDevices, err = e2e.LoadKnownDevices(params.KnownDevicesFile)
+	if err != nil {
+		log.Fatal("setupE2E load known devices failed:", err)
+	}
+
+	if params.DeviceKey != "" {
+		pub, err := e2e.DecodeKey(params.DeviceKey)
+		if err != nil {
+			log.Fatal("setupE2E invalid device key:", err)
+		}
+
+		knownDevices.Pin(deviceID, pub)
+	}
+
+	log.Printf("setupE2E e2e enabled, known devices file:%s", params.KnownDevicesFile)
+}
+
+// secureLink run e2e handshake over the link stream if e2e enabled,
+// the device key is verified against the pinned one
+func secureLink(stream transport.Stream) (io.ReadWriteCloser, error) {
+	if knownDevices == nil {
+		return stream, nil
+	}
+
+	stream.SetReadDeadline(time.Now().Add(e2eHandshakeTimeout))
+	conn, err := e2e.Client(stream, func(pub []byte) error {
+		return knownDevices.Verify(deviceID, pub)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stream.SetReadDeadline(time.Time{})
+	return conn, nil
+}
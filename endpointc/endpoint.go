@@ -1,6 +1,10 @@
 package endpointc
 
 import (
+	"lxquic/e2e"
+	"lxquic/transport"
+	"net"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -14,15 +18,62 @@ var (
 	remotePort uint16 // = 3389
 	// device uuid
 	deviceID string
-	// quic server addr
+	// quic server addr, changed by server goaway
 	quicAddr   string
 	socks5Port int
 	proxyToken string
+	// device uuid that socks5 traffic exit from,
+	// empty means exit from quic server
+	exitDeviceID string
+	// udp socket shared by the relay session and direct sessions,
+	// nil if p2p not enabled
+	p2pConn *net.UDPConn
+	// transport mode, auto, quic or tcp
+	transportMode string
+	// keepalive and quic parameters
+	transportConfig *transport.Config
+	// fake ip pool, nil if fake ip not enabled
+	fakeIPs *fakeIPPool
+	// pinned device keys, nil if e2e not enabled
+	knownDevices *e2e.KnownDevices
 	// map keep all current websocket
 	// use for keep-alive
-	holderMap = make(map[string]*sessionholder)
+	holderMap  = make(map[string]*sessionholder)
+	holderLock sync.Mutex
+
+	// sessions to the device and the proxy, nil if not used
+	ecSessions *sessionManager
+	pxSessions *sessionManager
+	// reconnect delay grow from retryMin to retryMax
+	retryMin time.Duration
+	retryMax time.Duration
+	// local connections wait for reconnect at most
+	queueTimeout time.Duration
 )
 
+// relayLock guard quicAddr after sessions started
+var relayLock sync.Mutex
+
+// getRelay the quic server address to dial
+func getRelay() string {
+	relayLock.Lock()
+	defer relayLock.Unlock()
+
+	return quicAddr
+}
+
+// setRelay dial the alternate quic server from now on
+func setRelay(addr string) {
+	relayLock.Lock()
+	defer relayLock.Unlock()
+
+	if quicAddr != addr {
+		log.Printf("setRelay switch quic server %s -> %s", quicAddr, addr)
+	}
+
+	quicAddr = addr
+}
+
 // Params parameters
 type Params struct {
 	// local listen tcp port
@@ -36,19 +87,83 @@ type Params struct {
 	QuicAddr   string
 	Socks5Port int
 	ProxyToken string
+	// device uuid as socks5 exit node
+	ExitDevice string
+
+	// local dns server listen address, empty means disable
+	DNSListen string
+	// dns resolver that queries are forwarded to, through the tunnel
+	DNSUpstream string
+	// device uuid that dns queries exit from, empty means
+	// the same as socks5 exit node
+	DNSDevice string
+	// fake ip range, e.g. 198.18.0.0/15, empty means disable
+	FakeIPRange string
+
+	// transparent proxy listen address, empty means disable
+	TransparentListen string
+	// transparent proxy mode, redirect or tproxy
+	TransparentMode string
+
+	// enable peer-to-peer direct path to device
+	P2P bool
+
+	// end-to-end encrypt link streams with device
+	E2E bool
+	// file of pinned device keys, trust on first use
+	KnownDevicesFile string
+	// pre-provisioned device public key, base64
+	DeviceKey string
+
+	// transport mode, auto, quic or tcp, empty means auto
+	Transport string
+	// keepalive and quic parameters, nil means transport.DefaultConfig
+	Config *transport.Config
+
+	// reconnect delay grow from RetryMin to RetryMax, with full jitter
+	RetryMin time.Duration
+	RetryMax time.Duration
+	// local connections wait for reconnect at most
+	QueueTimeout time.Duration
+
+	// metrics listen address, serve /metrics, empty means disable
+	MetricsAddr string
 }
 
 // keepalive send ping to all websocket holder
 func keepalive() {
 	for {
-		time.Sleep(time.Second * 5)
+		time.Sleep(transportConfig.KeepaliveInterval)
 
-		for _, v := range holderMap {
+		for _, v := range getHolders() {
 			v.keepalive()
 		}
 	}
 }
 
+// setTransport set transport mode and config
+func setTransport(params *Params) {
+	transportMode = params.Transport
+	transportConfig = params.Config
+	if transportConfig == nil {
+		transportConfig = transport.DefaultConfig()
+	}
+
+	retryMin, retryMax = params.RetryMin, params.RetryMax
+	if retryMin <= 0 {
+		retryMin = time.Second
+	}
+
+	if retryMax < retryMin {
+		retryMax = retryMin
+	}
+
+	queueTimeout = params.QueueTimeout
+	if queueTimeout <= 0 {
+		queueTimeout = 10 * time.Second
+	}
+}
+
 // Run run endpoint client and
 // wait client to connect
 func Run(params *Params) {
@@ -56,18 +171,74 @@ func Run(params *Params) {
 	remotePort = params.RemotePort
 	deviceID = params.UUID
 	quicAddr = params.QuicAddr
+	setTransport(params)
 	socks5Port = params.Socks5Port
 	proxyToken = params.ProxyToken
+	exitDeviceID = params.ExitDevice
 
 	log.Printf("endpoint run, local port:%d, target port:%d, device uuid:%s", localPort, remotePort, deviceID)
 
+	if params.E2E {
+		setupE2E(params)
+	}
+
+	if params.P2P {
+		var err error
+		p2pConn, err = net.ListenUDP("udp", nil)
+		if err != nil {
+			log.Fatal("endpoint run, create p2p udp socket failed:", err)
+		}
+	}
+
+	if params.MetricsAddr != "" {
+		startMetrics(params.MetricsAddr)
+	}
+
 	// keep-alive goroutine
 	go keepalive()
 
+	// connect eagerly, local connections need not wait the dialing
+	ecSessions = newSessionManager("ec", deviceID)
+	ecSessions.start()
+
 	if proxyToken != "" {
-		log.Printf("endpoint run socks5 server at:%d, proxy token:%s", socks5Port, proxyToken)
+		pxSessions = newSessionManager("px", proxyToken)
+		pxSessions.start()
+
+		log.Printf("endpoint run socks5 server at:%d, proxy token:%s, exit device:%s", socks5Port, proxyToken, exitDeviceID)
 		go startSocks5Server()
+
+		if params.DNSListen != "" {
+			startDNS(params)
+		}
+
+		if params.TransparentListen != "" {
+			go startTransparentListener(params.TransparentListen, params.TransparentMode)
+		}
 	}
 
 	startTCPListener(localPort)
 }
+
+// startDNS start local dns server, queries go through the px session
+func startDNS(params *Params) {
+	var err error
+	if params.FakeIPRange != "" {
+		fakeIPs, err = newFakeIPPool(params.FakeIPRange)
+		if err != nil {
+			log.Fatal("startDNS invalid fake ip range:", err)
+		}
+	}
+
+	device := params.DNSDevice
+	if device == "" {
+		device = exitDeviceID
+	}
+
+	ds, err := newDNSServer(params.DNSUpstream, device)
+	if err != nil {
+		log.Fatal("startDNS failed:", err)
+	}
+
+	go startDNSServer(params.DNSListen, ds)
+}
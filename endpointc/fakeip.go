@@ -0,0 +1,95 @@
+package endpointc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// fakeIPPool map domain names to fake ipv4 addresses, so that the
+// domain can be recovered from the address a client connect to
+type fakeIPPool struct {
+	mu sync.Mutex
+
+	ipnet *net.IPNet
+	// first address in pool, network address excluded
+	base uint32
+	size uint32
+	// next index to allocate, wrap around and reuse the oldest
+	next uint32
+
+	byIP   map[uint32]string
+	byName map[string]uint32
+}
+
+func newFakeIPPool(cidr string) (*fakeIPPool, error) {
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+
+	ones, bits := ipnet.Mask.Size()
+	if bits != 32 || ones > 30 {
+		return nil, fmt.Errorf("fake ip range %s must be ipv4 and at least /30", cidr)
+	}
+
+	pool := &fakeIPPool{
+		ipnet:  ipnet,
+		base:   binary.BigEndian.Uint32(ipnet.IP.To4()) + 1,
+		size:   (uint32(1) << uint(32-ones)) - 2,
+		byIP:   make(map[uint32]string),
+		byName: make(map[string]uint32),
+	}
+
+	return pool, nil
+}
+
+// allocate return the fake ip of the domain, allocate one if not exist
+func (pool *fakeIPPool) allocate(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	n, ok := pool.byName[name]
+	if !ok {
+		n = pool.base + pool.next
+		pool.next = (pool.next + 1) % pool.size
+
+		if old, ok := pool.byIP[n]; ok {
+			delete(pool.byName, old)
+		}
+
+		pool.byIP[n] = name
+		pool.byName[name] = n
+	}
+
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// lookup return the domain of the fake ip
+func (pool *fakeIPPool) lookup(ip net.IP) (string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || !pool.ipnet.Contains(ip4) {
+		return "", false
+	}
+
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	name, ok := pool.byIP[binary.BigEndian.Uint32(ip4)]
+	return name, ok
+}
+
+// fakeIPDomain return the domain if ip is a fake one
+func fakeIPDomain(ip net.IP) (string, bool) {
+	if fakeIPs == nil {
+		return "", false
+	}
+
+	return fakeIPs.lookup(ip)
+}
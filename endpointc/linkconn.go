@@ -0,0 +1,121 @@
+package endpointc
+
+import (
+	"context"
+	"io"
+	"lxquic/protoj"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// linkConn link the local connection to host:port through the px session,
+// exit from the exit device if specified. onReply is called with the
+// server's reply code before any data is forwarded, can be nil
+func linkConn(conn net.Conn, host string, port int, onReply func(code int) error) {
+	defer conn.Close()
+
+	result := "error"
+	defer func() {
+		linkStreams.Inc("px", result)
+	}()
+
+	replyClient := onReply
+	if replyClient == nil {
+		replyClient = func(int) error { return nil }
+	}
+
+	// count the result with the reply
+	onReply = func(code int) error {
+		result = linkResult(code)
+		return replyClient(code)
+	}
+
+	var header = &protoj.LinkStreamHeader{
+		Port:  port,
+		Host:  host,
+		DUID:  exitDeviceID,
+		Reply: true,
+	}
+
+	log.Printf("linkConn target host:%s, target port:%d, exit device:%s", host, port, exitDeviceID)
+
+	// create link stream and send link header
+	stream, err := openProxyStream(context.Background(), header)
+	if err != nil {
+		log.Println("linkConn openProxyStream failed:", err)
+		onReply(protoj.LinkReplyDialFailed)
+		return
+	}
+
+	defer stream.Close()
+
+	counted := &countedLink{stream, "px"}
+
+	// wait server reply
+	reply, err := protoj.ReadLinkReply(stream)
+	if err != nil {
+		log.Printf("linkConn read link reply failed:%v, discard", err)
+		onReply(protoj.LinkReplyDialFailed)
+		return
+	}
+
+	if reply.Code != protoj.LinkReplyOK {
+		log.Printf("linkConn target host:%s, target port:%d, failed, code:%d, reason:%s",
+			host, port, reply.Code, reply.Reason)
+		onReply(reply.Code)
+		return
+	}
+
+	err = onReply(protoj.LinkReplyOK)
+	if err != nil {
+		log.Printf("linkConn reply client failed:%v, discard", err)
+		return
+	}
+
+	quicbuf := make([]byte, 64*1024)
+	// read websocket message and forward to tcp
+	go func() {
+		// read tcp message and forward to websocket
+		tcpbuf := make([]byte, 8192)
+		for {
+			n, err := conn.Read(tcpbuf)
+			//log.Printf("linkConn tcp read bytes:%d, err:%v", n, err)
+			if err != nil {
+				log.Println("linkConn tcp read error:", err)
+				if err != io.EOF {
+					stream.Close()
+				}
+				break
+			}
+
+			if n == 0 {
+				break
+			}
+
+			_, err = counted.Write(tcpbuf[:n])
+			if err != nil {
+				log.Println("linkConn ws write error:", err)
+				break
+			}
+		}
+	}()
+
+	for {
+		n, err := counted.Read(quicbuf)
+		if err != nil {
+			log.Println("linkConn stream read error:", err)
+			break
+		}
+
+		if n == 0 {
+			break
+		}
+
+		// log.Println("linkConn, ws message len:", len(message))
+		err = protoj.WriteAll(conn, quicbuf[:n])
+		if err != nil {
+			break
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package endpointc
+
+import (
+	"fmt"
+	"lxquic/protoj"
+	"time"
+)
+
+// ListDevices list online devices on the quic server, connect as px if
+// proxy token is specified, so that hidden devices are listed too
+func ListDevices(params *Params, filter *protoj.ListFilter) ([]protoj.DeviceInfo, error) {
+	quicAddr = params.QuicAddr
+	setTransport(params)
+
+	role, uid := "ec", ""
+	if params.ProxyToken != "" {
+		role, uid = "px", params.ProxyToken
+	}
+
+	holder, err := buildQuicConnection(role, uid)
+	if err != nil {
+		return nil, err
+	}
+
+	defer holder.sess.CloseWithError(0, "list end")
+
+	err = holder.waitHello(10 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	var devices []protoj.DeviceInfo
+	err = holder.rpc.Invoke(protoj.CmdList, filter, &devices, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+// waitHello wait server hello, rpc is available after it
+func (wh *sessionholder) waitHello(timeout time.Duration) error {
+	if wh.sess.Protocol() != protoj.ALPNv2 {
+		return fmt.Errorf("server not support rpc, protocol:%s", wh.sess.Protocol())
+	}
+
+	select {
+	case <-wh.hello:
+		return nil
+	case cmd := <-wh.notify:
+		return fmt.Errorf("server %s:%s", cmd.Cmd, cmd.Reason)
+	case <-wh.sess.Context().Done():
+		return fmt.Errorf("session closed before hello")
+	case <-time.After(timeout):
+		return fmt.Errorf("wait server hello timeout")
+	}
+}
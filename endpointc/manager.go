@@ -0,0 +1,157 @@
+package endpointc
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"lxquic/backoff"
+	"lxquic/transport"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// session states of manager
+const (
+	sessionConnecting = "connecting"
+	sessionUp         = "up"
+	sessionDown       = "down"
+)
+
+const (
+	// attempts to open a stream, the later ones on a fresh session
+	openStreamAttempts = 2
+)
+
+// sessionManager keep the session of a role to server, connect eagerly
+// and reconnect in background with backoff, local connections wait for
+// the session during reconnect
+type sessionManager struct {
+	role string
+	uid  string
+
+	lock    sync.Mutex
+	holder  *sessionholder
+	state   string
+	lastErr error
+	// closed and replaced when holder or state changed
+	changed chan struct{}
+
+	bo *backoff.Backoff
+}
+
+func newSessionManager(role string, uid string) *sessionManager {
+	return &sessionManager{
+		role:    role,
+		uid:     uid,
+		state:   sessionDown,
+		changed: make(chan struct{}),
+		bo:      backoff.New(retryMin, retryMax),
+	}
+}
+
+// start connect and keep the session, never stop
+func (m *sessionManager) start() {
+	go m.run()
+}
+
+func (m *sessionManager) run() {
+	for {
+		m.setState(nil, sessionConnecting, nil)
+		holder, err := buildQuicConnection(m.role, m.uid)
+		if err != nil {
+			delay := m.bo.Next()
+			log.Printf("sessionManager %s connect failed:%v, reconnect in %v", m.role, err, delay)
+			m.setState(nil, sessionDown, err)
+			time.Sleep(delay)
+			continue
+		}
+
+		m.bo.Reset()
+		m.setState(holder, sessionUp, nil)
+
+		select {
+		case <-holder.sess.Context().Done():
+		case <-holder.goaway:
+			// the old session is closed by server after link streams end
+			m.setState(nil, sessionDown, fmt.Errorf("server goaway"))
+			delay := m.bo.Next()
+			log.Printf("sessionManager %s server goaway, reconnect in %v", m.role, delay)
+			time.Sleep(delay)
+			continue
+		}
+
+		m.setState(nil, sessionDown, fmt.Errorf("session closed"))
+
+		// spread reconnects if the server restarted
+		delay := m.bo.Next()
+		log.Printf("sessionManager %s session lost, reconnect in %v", m.role, delay)
+		time.Sleep(delay)
+	}
+}
+
+func (m *sessionManager) setState(holder *sessionholder, state string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.state != state {
+		log.Printf("sessionManager %s state %s -> %s", m.role, m.state, state)
+	}
+
+	m.holder = holder
+	m.state = state
+	m.lastErr = err
+
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// get the live session, wait for reconnect until timeout
+func (m *sessionManager) get(timeout time.Duration) (*sessionholder, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		m.lock.Lock()
+		holder, changed, lastErr := m.holder, m.changed, m.lastErr
+		m.lock.Unlock()
+
+		if holder != nil && holder.alive() {
+			return holder, nil
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, fmt.Errorf("no %s session in %v, last error:%v", m.role, timeout, lastErr)
+		}
+	}
+}
+
+// openStream open stream by open on the live session, if it failed the
+// session is closed and the stream is opened on a fresh one
+func (m *sessionManager) openStream(open func(holder *sessionholder) (transport.Stream, error)) (transport.Stream, error) {
+	var lastErr error
+	for i := 0; i < openStreamAttempts; i++ {
+		holder, err := m.get(queueTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		stream, err := open(holder)
+		if err == nil {
+			return stream, nil
+		}
+
+		if _, ok := err.(*linkReplyError); ok {
+			// the session is fine, the target is not
+			return nil, err
+		}
+
+		log.Printf("sessionManager %s open stream failed:%v, reconnect", m.role, err)
+		holder.sess.CloseWithError(0, "open stream failed")
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
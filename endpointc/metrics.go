@@ -0,0 +1,108 @@
+package endpointc
+
+import (
+	"io"
+	"sync"
+
+	"lxquic/metrics"
+	"lxquic/protoj"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	sessionsOnline = metrics.NewGauge("lxquic_client_sessions", "Sessions to server by role.", "role")
+	connectsTotal  = metrics.NewCounter("lxquic_client_connects_total", "Attempts to connect server by role and result.", "role", "result")
+	reconnects     = metrics.NewCounter("lxquic_client_reconnects_total", "Sessions to server built after the first one, by role.", "role")
+	goaways        = metrics.NewCounter("lxquic_client_goaways_total", "Goaway received from draining server, by role.", "role")
+	handshakeTime  = metrics.NewHistogram("lxquic_client_handshake_seconds", "Time to dial server and send cmd stream header, by role.", nil, "role")
+
+	linkStreams = metrics.NewCounter("lxquic_client_link_streams_total", "Link streams by role and result.", "role", "result")
+	bytesTotal  = metrics.NewCounter("lxquic_client_bytes_total", "Link stream bytes by role and direction, in is from server.", "role", "direction")
+
+	pingRTT           = metrics.NewHistogram("lxquic_client_ping_rtt_seconds", "Keepalive ping round trip time.", nil)
+	pingLost          = metrics.NewCounter("lxquic_client_ping_lost_total", "Keepalive pings not answered before the next one.")
+	keepaliveTimeouts = metrics.NewCounter("lxquic_client_keepalive_timeouts_total", "Sessions closed by keepalive timeout.")
+
+	// smoothed, of the current session of the role
+	healthRTT    = metrics.NewGauge("lxquic_client_rtt_seconds", "Smoothed keepalive round trip time, by role.", "role")
+	healthJitter = metrics.NewGauge("lxquic_client_jitter_seconds", "Keepalive round trip time jitter, by role.", "role")
+	healthLoss   = metrics.NewGauge("lxquic_client_ping_loss_ratio", "Ratio of recent keepalive pings lost, by role.", "role")
+)
+
+var (
+	// roles that ever connected, for reconnects
+	connectedLock  sync.Mutex
+	connectedRoles = make(map[string]bool)
+)
+
+// onConnected count the session, reconnect if the role connected before
+func onConnected(role string) {
+	connectsTotal.Inc(role, "ok")
+	sessionsOnline.Inc(role)
+
+	connectedLock.Lock()
+	again := connectedRoles[role]
+	connectedRoles[role] = true
+	connectedLock.Unlock()
+
+	if again {
+		reconnects.Inc(role)
+	}
+}
+
+// setHealth set health gauges of the role
+func setHealth(role string, h protoj.LinkHealth) {
+	healthRTT.Set(h.RTT/1000, role)
+	healthJitter.Set(h.Jitter/1000, role)
+	healthLoss.Set(h.Loss, role)
+}
+
+// linkResult result label of link reply code
+func linkResult(code int) string {
+	switch code {
+	case protoj.LinkReplyOK:
+		return "ok"
+	case protoj.LinkReplyRefused:
+		return "refused"
+	case protoj.LinkReplyDenied:
+		return "denied"
+	case protoj.LinkReplyNoDevice:
+		return "no_device"
+	case protoj.LinkReplyDialFailed:
+		return "dial_failed"
+	}
+
+	return "error"
+}
+
+// countedLink count bytes of link stream by role
+type countedLink struct {
+	io.ReadWriteCloser
+	role string
+}
+
+func (cl *countedLink) Read(p []byte) (int, error) {
+	n, err := cl.ReadWriteCloser.Read(p)
+	if n > 0 {
+		bytesTotal.Add(float64(n), cl.role, "in")
+	}
+	return n, err
+}
+
+func (cl *countedLink) Write(p []byte) (int, error) {
+	n, err := cl.ReadWriteCloser.Write(p)
+	if n > 0 {
+		bytesTotal.Add(float64(n), cl.role, "out")
+	}
+	return n, err
+}
+
+// startMetrics serve /metrics on separate listener
+func startMetrics(addr string) {
+	log.Printf("metrics listen at:%s", addr)
+	go func() {
+		err := metrics.ListenAndServe(addr)
+		log.Fatalln("metrics ListenAndServe failed:", err)
+	}()
+}
@@ -0,0 +1,270 @@
+package endpointc
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"lxquic/protoj"
+	"lxquic/transport"
+	"net"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// timeout of dialing direct session
+	directDialTimeout = 8 * time.Second
+	// request punching again after direct path failed
+	punchRetryInterval = 60 * time.Second
+	// wait of the link reply from server, that may wait the device's
+	linkReplyTimeout = 10 * time.Second
+)
+
+// dialServer dial quic server, fallback to tcp if quic is blocked, ec's
+// quic use the shared udp socket if p2p enabled, so that the address
+// observed by server is the one to punch
+func dialServer(role string, tlsConf *tls.Config) (transport.Session, error) {
+	params := &transport.DialParams{
+		Addr:       getRelay(),
+		TLSConfig:  tlsConf,
+		QuicConfig: transportConfig.QuicConfig(),
+		Mode:       transportMode,
+	}
+
+	if p2pConn != nil && role == "ec" {
+		params.PacketConn = p2pConn
+	}
+
+	return transport.Dial(params)
+}
+
+// requestPunch ask server to coordinate hole punching with the device
+func (wh *sessionholder) requestPunch() {
+	log.Println("sessionholder.requestPunch")
+	err := wh.sendCmd(&protoj.StreamCmd{Cmd: protoj.CmdPunch})
+	if err != nil {
+		log.Println("sessionholder.requestPunch failed:", err)
+	}
+}
+
+// retryPunchLater request punching again if the holder is still alive
+func (wh *sessionholder) retryPunchLater() {
+	time.AfterFunc(punchRetryInterval, func() {
+		if getHolder(wh.uuid) != wh || wh.getDirect() != nil {
+			return
+		}
+
+		wh.requestPunch()
+	})
+}
+
+// onPunch server tell us the device's addresses, punch and dial them
+func (wh *sessionholder) onPunch(cmd *protoj.StreamCmd) {
+	if cmd.Code != 0 {
+		log.Printf("sessionholder.onPunch peer-to-peer unavailable, code:%d, reason:%s", cmd.Code, cmd.Reason)
+		return
+	}
+
+	log.Printf("sessionholder.onPunch, peer addrs:%v", cmd.Addrs)
+	for _, a := range cmd.Addrs {
+		go transport.Punch(p2pConn, a)
+	}
+
+	sess := dialDirect(cmd.Addrs, cmd.Token)
+	if sess == nil {
+		log.Println("sessionholder.onPunch direct path failed, use relay")
+		wh.retryPunchLater()
+		return
+	}
+
+	log.Printf("sessionholder.onPunch direct path ok, peer:%s", sess.RemoteAddr())
+	wh.setDirect(sess)
+
+	go func() {
+		<-sess.Context().Done()
+		log.Printf("sessionholder direct session closed, fallback to relay, peer:%s", sess.RemoteAddr())
+		wh.setDirect(nil)
+		wh.retryPunchLater()
+	}()
+}
+
+// dialDirect dial all candidates at the same time, the first
+// connected wins, and then present the token
+func dialDirect(addrs []string, token string) transport.Session {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         protoj.NextProtos(),
+	}
+
+	config := transportConfig.QuicConfig()
+	// keep the nat mapping alive
+	config.KeepAlive = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), directDialTimeout)
+	defer cancel()
+
+	results := make(chan transport.Session, len(addrs))
+	for _, a := range addrs {
+		go func(address string) {
+			raddr, err := net.ResolveUDPAddr("udp", address)
+			if err != nil {
+				results <- nil
+				return
+			}
+
+			sess, err := quic.DialContext(ctx, p2pConn, raddr, address, tlsConf, config)
+			if err != nil {
+				log.Printf("dialDirect %s failed:%v", address, err)
+				results <- nil
+				return
+			}
+
+			results <- transport.WrapQuic(sess)
+		}(a)
+	}
+
+	var winner transport.Session
+	for i := range addrs {
+		sess := <-results
+		if sess == nil {
+			continue
+		}
+
+		winner = sess
+		// close the late comers
+		go func(n int) {
+			for j := 0; j < n; j++ {
+				if late := <-results; late != nil {
+					late.CloseWithError(0, "another direct path won")
+				}
+			}
+		}(len(addrs) - i - 1)
+		break
+	}
+
+	if winner == nil {
+		return nil
+	}
+
+	stream, err := winner.OpenStreamSync(ctx)
+	if err != nil {
+		log.Println("dialDirect OpenStreamSync failed:", err)
+		winner.CloseWithError(0, "OpenStreamSync failed")
+		return nil
+	}
+
+	var header = &protoj.CmdStreamHeader{
+		Role: "p2p",
+		DUID: token,
+	}
+
+	err = protoj.StreamSendJSON(stream, header)
+	if err != nil {
+		log.Println("dialDirect StreamSendJSON failed:", err)
+		winner.CloseWithError(0, "StreamSendJSON failed")
+		return nil
+	}
+
+	return winner
+}
+
+// openLinkStream open link stream via direct session if available,
+// fallback to relay session
+func (wh *sessionholder) openLinkStream() (transport.Stream, error) {
+	if direct := wh.getDirect(); direct != nil {
+		stream, err := openDirectLinkStream(direct)
+		if err == nil {
+			return stream, nil
+		}
+
+		log.Println("sessionholder.openLinkStream direct path failed, fallback to relay:", err)
+	}
+
+	return wh.openRelayLinkStream()
+}
+
+// openRelayLinkStream open link stream via relay session, server that
+// take link headers reply on the stream if the device is linked
+func (wh *sessionholder) openRelayLinkStream() (transport.Stream, error) {
+	if wh.sess.Protocol() == protoj.ALPNv2 {
+		// the caps come with hello
+		err := wh.waitHello(linkReplyTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	stream, err := wh.sess.OpenStreamSync(context.Background())
+	if err != nil || !wh.hasCap(protoj.CapLinkHeader) {
+		return stream, err
+	}
+
+	err = sendLinkHeader(stream, wh.linkVersion(), linkReplyTimeout)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// openDirectLinkStream device know nothing about the target port,
+// send link header as server does, in json since the device may be
+// older than the server
+func openDirectLinkStream(sess transport.Session) (transport.Stream, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := sess.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = sendLinkHeader(stream, protoj.CmdVersionJSON, 5*time.Second)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+// sendLinkHeader send the link header of ec in the version and wait the
+// reply, a reply other than ok is returned as *linkReplyError
+func sendLinkHeader(stream transport.Stream, version uint8, timeout time.Duration) error {
+	var header = &protoj.LinkStreamHeader{
+		Port:  int(remotePort),
+		Reply: true,
+		E2E:   knownDevices != nil,
+	}
+
+	err := protoj.WriteLinkHeader(stream, header, version)
+	if err != nil {
+		return err
+	}
+
+	stream.SetReadDeadline(time.Now().Add(timeout))
+	reply, err := protoj.ReadLinkReply(stream)
+	if err != nil {
+		return err
+	}
+
+	stream.SetReadDeadline(time.Time{})
+	if reply.Code != protoj.LinkReplyOK {
+		return &linkReplyError{code: reply.Code, reason: reply.Reason}
+	}
+
+	return nil
+}
+
+// linkReplyError the link stream is refused by the reply
+type linkReplyError struct {
+	code   int
+	reason string
+}
+
+func (e *linkReplyError) Error() string {
+	return fmt.Sprintf("link reply code:%d, reason:%s", e.code, e.reason)
+}
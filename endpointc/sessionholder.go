@@ -3,10 +3,10 @@ package endpointc
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"lxquic/protoj"
-
-	"github.com/lucas-clemente/quic-go"
+	"lxquic/transport"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -14,71 +14,189 @@ import (
 // sessionholder websocket holder
 type sessionholder struct {
 	uuid string
-	sess quic.Session
+	// ec or px
+	role string
+	sess transport.Session
+
+	stream transport.Stream
+	// cmd stream is written by keepalive, handlers and punch
+	rpc *protoj.RPC
+
+	// peer-to-peer direct session to device, nil if not available
+	directLock sync.Mutex
+	direct     transport.Session
 
-	stream quic.Stream
+	// commands that server notify, e.g. link stream failed
+	notify chan *protoj.StreamCmd
 
-	// ping meesage that waiting for response counter
-	waitingPingCount int
+	// capabilities enabled by server hello, lxquic/2 only
+	capsLock sync.Mutex
+	caps     []string
+	// closed when hello received
+	hello     chan struct{}
+	helloOnce sync.Once
+
+	// closed when server goaway, new streams go to a fresh session
+	goaway     chan struct{}
+	goawayOnce sync.Once
+}
+
+// capabilities of client, p2p and e2e are added when the session use them
+var clientCaps = []string{
+	protoj.CapEnvelope,
+	protoj.CapLinkReply,
+	protoj.CapLinkHeader,
 }
 
 // newHolder create a websocket holder object
 // the uuid must be unique
-func newHolder(uuid string, sess1 quic.Session, stream1 quic.Stream) *sessionholder {
+func newHolder(uuid string, sess1 transport.Session, stream1 transport.Stream) *sessionholder {
 	wh := &sessionholder{
 		uuid:   uuid,
 		sess:   sess1,
 		stream: stream1,
+		rpc:    protoj.NewRPC(protoj.NewCmdCodec(stream1)),
+		notify: make(chan *protoj.StreamCmd, 16),
+		hello:  make(chan struct{}),
+		goaway: make(chan struct{}),
 	}
 
+	wh.rpc.MaxMisses = transportConfig.KeepaliveMisses
+
+	wh.rpc.OnRTT = func(rtt time.Duration) {
+		pingRTT.Observe(rtt.Seconds())
+	}
+	wh.rpc.OnLost = func() {
+		pingLost.Inc()
+	}
+
+	notify := func(cmd *protoj.StreamCmd) (*protoj.StreamCmd, error) {
+		wh.onNotify(cmd)
+		return nil, nil
+	}
+
+	wh.rpc.Handle(protoj.CmdLinkErr, notify)
+	wh.rpc.Handle(protoj.CmdDenied, notify)
+
+	wh.rpc.Handle(protoj.CmdPunch, func(cmd *protoj.StreamCmd) (*protoj.StreamCmd, error) {
+		go wh.onPunch(cmd)
+		return nil, nil
+	})
+
+	wh.rpc.Handle(protoj.CmdHello, func(cmd *protoj.StreamCmd) (*protoj.StreamCmd, error) {
+		wh.onHello(cmd)
+		return nil, nil
+	})
+
+	wh.rpc.Handle(protoj.CmdGoaway, func(cmd *protoj.StreamCmd) (*protoj.StreamCmd, error) {
+		wh.onGoaway(cmd)
+		return nil, nil
+	})
+
 	return wh
 }
 
 func getHolder(uid string) *sessionholder {
-	h, _ := holderMap[uid]
+	holderLock.Lock()
+	defer holderLock.Unlock()
+
+	return holderMap[uid]
+}
+
+// getHolders all holders, for keepalive
+func getHolders() []*sessionholder {
+	holderLock.Lock()
+	defer holderLock.Unlock()
 
-	return h
+	holders := make([]*sessionholder, 0, len(holderMap))
+	for _, h := range holderMap {
+		holders = append(holders, h)
+	}
+
+	return holders
 }
 
-func buildQuicConnection(role string, uid string) *sessionholder {
+// alive if the session is not closed, and server not goaway
+func (wh *sessionholder) alive() bool {
+	select {
+	case <-wh.goaway:
+		return false
+	default:
+	}
+
+	return wh.sess.Context().Err() == nil
+}
+
+func buildQuicConnection(role string, uid string) (*sessionholder, error) {
 	log.Println("buildQuicConnection")
+	start := time.Now()
 
 	tlsConf := &tls.Config{
 		InsecureSkipVerify: true,
-		NextProtos:         []string{"quic-echo-example"},
+		NextProtos:         protoj.NextProtos(),
 	}
 
 	// build websocket connection
-	session, err := quic.DialAddr(quicAddr, tlsConf, nil)
+	session, err := dialServer(role, tlsConf)
 	if err != nil {
-		log.Println("handleRequest quic.DialAddr failed:", err)
-		return nil
+		log.Println("handleRequest dialServer failed:", err)
+		connectsTotal.Inc(role, "failed")
+		return nil, err
 	}
 
 	cmdStream, err := session.OpenStreamSync(context.Background())
 	if err != nil {
 		log.Println("handleRequest session.OpenStreamSync failed:", err)
-		return nil
+		session.CloseWithError(0, "OpenStreamSync failed")
+		connectsTotal.Inc(role, "failed")
+		return nil, err
 	}
 
 	var header = &protoj.CmdStreamHeader{
 		Role: role,
 		DUID: uid,
 		Port: int(remotePort),
+		P2P:  role == "ec" && p2pConn != nil && transport.IsQuic(session),
+		E2E:  role == "ec" && knownDevices != nil,
+
+		Version: protoj.CmdVersion,
+	}
+
+	header.Caps = append(header.Caps, clientCaps...)
+	if header.P2P {
+		header.Caps = append(header.Caps, protoj.CapP2P)
+	}
+
+	if header.E2E {
+		header.Caps = append(header.Caps, protoj.CapE2E)
 	}
 
 	err = protoj.StreamSendJSON(cmdStream, header)
 	if err != nil {
 		log.Println("handleRequest streamSendJSON failed:", err)
-		return nil
+		session.CloseWithError(0, "StreamSendJSON failed")
+		connectsTotal.Inc(role, "failed")
+		return nil, err
 	}
 
+	handshakeTime.Observe(time.Since(start).Seconds(), role)
+	onConnected(role)
+
 	var holder = newHolder(uid, session, cmdStream)
+	holder.role = role
+
+	holderLock.Lock()
 	holderMap[uid] = holder
+	holderLock.Unlock()
 
 	go holder.serveCmdStream()
 
-	return holder
+	// lxquic/2 server decide in hello if p2p is enabled
+	if header.P2P && session.Protocol() != protoj.ALPNv2 {
+		go holder.requestPunch()
+	}
+
+	return holder, nil
 }
 
 func (wh *sessionholder) keepalive() {
@@ -86,59 +204,127 @@ func (wh *sessionholder) keepalive() {
 		return
 	}
 
-	// too many un-response ping, close the websocket connection
-	if wh.waitingPingCount > 3 {
-		if wh.sess != nil {
-			log.Println("sessionholder keepalive failed, close")
-			wh.sess.CloseWithError(0, "keepalive failed")
+	err := wh.rpc.Keepalive()
+	if err == protoj.ErrKeepalive {
+		log.Println("sessionholder keepalive failed, close")
+		keepaliveTimeouts.Inc()
+		wh.sess.CloseWithError(0, "keepalive failed")
+	} else if err != nil {
+		log.Println("sessionholder send ping error:", err)
+	}
+
+	setHealth(wh.role, wh.rpc.Health())
+	if h, changed := wh.rpc.HealthChanged(); changed {
+		log.Printf("sessionholder %s link health %s, conn:%+v", wh.role, h, wh.sess.Stats())
+	}
+}
+
+func (wh *sessionholder) serveCmdStream() {
+	// remove from map, unless replaced already
+	defer func() {
+		holderLock.Lock()
+		if holderMap[wh.uuid] == wh {
+			delete(holderMap, wh.uuid)
 		}
-		return
+		holderLock.Unlock()
+	}()
+	defer sessionsOnline.Dec(wh.role)
+	defer setHealth(wh.role, protoj.LinkHealth{})
+	// direct session belongs to this holder
+	defer func() {
+		if direct := wh.getDirect(); direct != nil {
+			direct.CloseWithError(0, "relay session closed")
+		}
+	}()
+
+	err := wh.rpc.Serve()
+	log.Println("serveCmdStream exit:", err)
+	// the session is useless without cmd stream
+	wh.sess.CloseWithError(0, "cmd stream closed")
+}
+
+// onNotify save the notification for whom may care
+func (wh *sessionholder) onNotify(cmd *protoj.StreamCmd) {
+	log.Printf("sessionholder got notification:%s, code:%d, reason:%s", cmd.Cmd, cmd.Code, cmd.Reason)
+	select {
+	case wh.notify <- cmd:
+	default:
+		// nobody care
 	}
 
-	var ping = &protoj.StreamCmd{
-		Cmd: "ping",
+	if cmd.Cmd == protoj.CmdDenied {
+		wh.sess.CloseWithError(0, "denied by server")
 	}
+}
 
-	err := protoj.StreamSendJSON(wh.stream, ping)
-	if err != nil {
-		log.Println("streamSendJSON ping error:", err)
-		return
+// onHello save the capabilities enabled by server
+func (wh *sessionholder) onHello(cmd *protoj.StreamCmd) {
+	log.Printf("sessionholder got hello, caps:%v", cmd.Caps)
+
+	wh.capsLock.Lock()
+	wh.caps = cmd.Caps
+	wh.capsLock.Unlock()
+
+	wh.helloOnce.Do(func() {
+		close(wh.hello)
+	})
+
+	if wh.role == "ec" && knownDevices != nil && !wh.hasCap(protoj.CapE2E) {
+		// link streams would wait the e2e handshake the device never start
+		log.Errorf("sessionholder server did not enable e2e, link streams will fail")
 	}
 
-	wh.waitingPingCount++
+	if wh.hasCap(protoj.CapP2P) {
+		go wh.requestPunch()
+	}
 }
 
-// onPong update waiting response ping counter
-func (wh *sessionholder) onPong(data []byte) {
-	wh.waitingPingCount = 0
+// hasCap if the capability is enabled for the session
+func (wh *sessionholder) hasCap(c string) bool {
+	wh.capsLock.Lock()
+	defer wh.capsLock.Unlock()
+
+	return protoj.HasCap(wh.caps, c)
 }
 
-func (wh *sessionholder) serveCmdStream() {
-	stream := wh.stream
-	// remove from map
-	defer delete(holderMap, wh.uuid)
-
-	for {
-		message, err := protoj.StreamReadJSON(stream)
-		if err != nil {
-			log.Println("serveCmdStream streamReadJSON failed:", err)
-			break
-		}
+// linkVersion version of link headers to server
+func (wh *sessionholder) linkVersion() uint8 {
+	wh.capsLock.Lock()
+	defer wh.capsLock.Unlock()
 
-		var cmd = &protoj.StreamCmd{}
-		err = json.Unmarshal(message, cmd)
-		if err == nil {
-			//log.Printf("sessionholder serveCmdStream get a json cmd:%+v", cmd)
-			if cmd.Cmd == "pong" {
-				wh.onPong(nil)
-			} else if cmd.Cmd == "ping" {
-				// reply pong
-				cmd.Cmd = "pong"
-				protoj.StreamSendJSON(stream, cmd)
-			}
-		} else {
-			//
-			log.Println("sessionholder serveCmdStream json.Unmarshal failed:", err)
-		}
+	return protoj.LinkVersion(wh.caps)
+}
+
+// sendCmd send command via cmd stream
+func (wh *sessionholder) sendCmd(cmd *protoj.StreamCmd) error {
+	return wh.rpc.Notify(cmd)
+}
+
+func (wh *sessionholder) getDirect() transport.Session {
+	wh.directLock.Lock()
+	defer wh.directLock.Unlock()
+
+	return wh.direct
+}
+
+func (wh *sessionholder) setDirect(sess transport.Session) {
+	wh.directLock.Lock()
+	defer wh.directLock.Unlock()
+
+	wh.direct = sess
+}
+
+// onGoaway server is draining, switch to the alternate relay if given,
+// the manager reconnect at once. Link streams already open keep going on
+// the old session until server close it
+func (wh *sessionholder) onGoaway(cmd *protoj.StreamCmd) {
+	log.Printf("sessionholder %s server goaway, reason:%s, alternate relay:%s", wh.role, cmd.Reason, cmd.Relay)
+	goaways.Inc(wh.role)
+	if cmd.Relay != "" {
+		setRelay(cmd.Relay)
 	}
+
+	wh.goawayOnce.Do(func() {
+		close(wh.goaway)
+	})
 }
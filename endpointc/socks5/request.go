@@ -31,6 +31,16 @@ const (
 	addrTypeNotSupported
 )
 
+// reply codes, for RequestHandler to reply connect command
+const (
+	ReplySucceeded          = successReply
+	ReplyServerFailure      = serverFailure
+	ReplyRuleFailure        = ruleFailure
+	ReplyHostUnreachable    = hostUnreachable
+	ReplyConnectionRefused  = connectionRefused
+	ReplyNetworkUnreachable = networkUnreachable
+)
+
 var (
 	errUnrecognizedAddrType = fmt.Errorf("Unrecognized address type")
 )
@@ -126,14 +136,16 @@ func (s *Server) handleRequest(req *SocksRequest, conn net.Conn) error {
 	}
 }
 
+// Reply send reply to socks client, RequestHandler must call it
+// exactly once for connect command
+func (r *SocksRequest) Reply(resp uint8) error {
+	return sendReply(r.Conn, resp, nil)
+}
+
 // handleConnect is used to handle a connect command
 func (s *Server) handleConnect(req *SocksRequest) error {
-	// Send success
-	conn := req.Conn
-	if err := sendReply(conn, successReply, nil); err != nil {
-		return fmt.Errorf("Failed to send reply: %v", err)
-	}
-
+	// the reply is deferred to RequestHandler, which knows
+	// whether the target can be connected
 	return nil
 }
 
@@ -144,7 +156,7 @@ func (s *Server) handleBind(req *SocksRequest) error {
 	if err := sendReply(conn, commandNotSupported, nil); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
-	return nil
+	return fmt.Errorf("Unsupported command: %v", req.Command)
 }
 
 // handleAssociate is used to handle a connect command
@@ -154,7 +166,7 @@ func (s *Server) handleAssociate(req *SocksRequest) error {
 	if err := sendReply(conn, commandNotSupported, nil); err != nil {
 		return fmt.Errorf("Failed to send reply: %v", err)
 	}
-	return nil
+	return fmt.Errorf("Unsupported command: %v", req.Command)
 }
 
 // readAddrSpec is used to read AddrSpec.
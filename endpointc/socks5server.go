@@ -3,12 +3,9 @@ package endpointc
 import (
 	"context"
 	"fmt"
-	"io"
 	"lxquic/endpointc/socks5"
 	"lxquic/protoj"
-	"net"
-
-	"github.com/lucas-clemente/quic-go"
+	"lxquic/transport"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -16,19 +13,27 @@ import (
 type socksReqHandler struct {
 }
 
-func (sh *socksReqHandler) HandleRequest(req *socks5.SocksRequest) error {
-	ssholder := getHolder(proxyToken)
-	if ssholder == nil {
-		ssholder = buildQuicConnection("px", proxyToken)
-	}
+// openProxyStream open stream on the px session and send the link header,
+// wait for the session if reconnecting
+func openProxyStream(ctx context.Context, header *protoj.LinkStreamHeader) (transport.Stream, error) {
+	return pxSessions.openStream(func(holder *sessionholder) (transport.Stream, error) {
+		stream, err := holder.sess.OpenStreamSync(ctx)
+		if err != nil {
+			return nil, err
+		}
 
-	if ssholder != nil {
-		// Handle connections in a new goroutine.
-		handleSocks5Request(req, ssholder.sess)
-	} else {
-		return fmt.Errorf("no quic session avaible, discard socks request")
-	}
+		err = protoj.WriteLinkHeader(stream, header, holder.linkVersion())
+		if err != nil {
+			stream.Close()
+			return nil, err
+		}
 
+		return stream, nil
+	})
+}
+
+func (sh *socksReqHandler) HandleRequest(req *socks5.SocksRequest) error {
+	handleSocks5Request(req)
 	return nil
 }
 
@@ -44,87 +49,38 @@ func startSocks5Server() {
 	log.Fatal(s.ListenAndServe("tcp", fmt.Sprintf("127.0.0.1:%d", socks5Port)))
 }
 
-func handleSocks5Request(req *socks5.SocksRequest, sess quic.Session) {
+func handleSocks5Request(req *socks5.SocksRequest) {
 	log.Println("handleSocks5Request")
-	conn := req.Conn.(*net.TCPConn)
-	defer conn.Close()
-
-	// create link stream
-	stream, err := sess.OpenStreamSync(context.Background())
-	if err != nil {
-		log.Println("handleSocks5Request session.OpenStreamSync failed:", err)
-		return
-	}
-
-	defer stream.Close()
 
 	address := req.DestAddr
 	var host string
 	var port = address.Port
 	if address.FQDN != "" {
 		host = address.FQDN
+	} else if domain, ok := fakeIPDomain(address.IP); ok {
+		// client resolved the name via our dns server
+		host = domain
 	} else {
 		host = address.IP.String()
 	}
 
-	// send link header
-	var header = &protoj.LinkStreamHeader{
-		Port: port,
-		Host: host,
-	}
-
-	log.Printf("handleSocks5Request target host:%s, target port:%d", host, port)
-	protoj.StreamSendJSON(stream, header)
-	if err != nil {
-		log.Printf("handleSocks5Request StreamSendJSON failed:%v, discard", err)
-		return
-	}
-
-	quicbuf := make([]byte, 64*1024)
-	// read websocket message and forward to tcp
-	go func() {
-		// read tcp message and forward to websocket
-		tcpbuf := make([]byte, 8192)
-		for {
-			n, err := conn.Read(tcpbuf)
-			//log.Printf("handleSocks5Request tcp read bytes:%d, err:%v", n, err)
-			if err != nil {
-				log.Println("handleSocks5Request tcp read error:", err)
-				if err != io.EOF {
-					stream.Close()
-				}
-				break
-			}
-
-			if n == 0 {
-				break
-			}
+	linkConn(req.Conn, host, port, func(code int) error {
+		return req.Reply(socksReplyCode(code))
+	})
 
-			_, err = stream.Write(tcpbuf[:n])
-			if err != nil {
-				log.Println("handleSocks5Request ws write error:", err)
-				break
-			}
-		}
-	}()
-
-	for {
-		n, err := stream.Read(quicbuf)
-		if err != nil {
-			log.Println("handleSocks5Request stream read error:", err)
-			break
-		}
-
-		if n == 0 {
-			break
-		}
+	log.Println("handleSocks5Request new request end")
+}
 
-		// log.Println("handleSocks5Request, ws message len:", len(message))
-		err = protoj.WriteAll(conn, quicbuf[:n])
-		if err != nil {
-			break
-		}
+// socksReplyCode convert link stream reply code to socks reply code
+func socksReplyCode(code int) uint8 {
+	switch code {
+	case protoj.LinkReplyOK:
+		return socks5.ReplySucceeded
+	case protoj.LinkReplyRefused, protoj.LinkReplyDenied:
+		return socks5.ReplyRuleFailure
+	case protoj.LinkReplyNoDevice:
+		return socks5.ReplyNetworkUnreachable
+	default:
+		return socks5.ReplyHostUnreachable
 	}
-
-	log.Println("handleSocks5Request new request end")
 }
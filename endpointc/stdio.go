@@ -0,0 +1,140 @@
+package endpointc
+
+import (
+	"io"
+	"lxquic/protoj"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// exit codes of stdio mode
+const (
+	// ExitOK link stream end normally
+	ExitOK = 0
+	// ExitError link stream broken
+	ExitError = 1
+	// ExitRelayUnreachable can not connect to quic server
+	ExitRelayUnreachable = 2
+	// ExitAuthFailed quic server refused us, or its acl deny us the device
+	ExitAuthFailed = 3
+	// ExitDeviceOffline target device not online
+	ExitDeviceOffline = 4
+	// ExitRefused target port refused by device policy, or can not be connected
+	ExitRefused = 5
+)
+
+// RunStdio link stdin and stdout to the target device port via
+// a single link stream, like ssh -W, return the exit code
+func RunStdio(params *Params) int {
+	remotePort = params.RemotePort
+	deviceID = params.UUID
+	quicAddr = params.QuicAddr
+	setTransport(params)
+
+	if params.E2E {
+		setupE2E(params)
+	}
+
+	log.Printf("stdio run, target port:%d, device uuid:%s", remotePort, deviceID)
+
+	// keep-alive goroutine
+	go keepalive()
+
+	holder, err := buildQuicConnection("ec", deviceID)
+	if err != nil {
+		log.Errorf("RunStdio connect to quic server failed:%v", err)
+		return ExitRelayUnreachable
+	}
+
+	defer holder.sess.CloseWithError(0, "stdio end")
+
+	stream, err := holder.openRelayLinkStream()
+	if err != nil {
+		log.Errorf("RunStdio open link stream failed:%v", err)
+		if le, ok := err.(*linkReplyError); ok {
+			return exitCodeOfReply(le.code)
+		}
+
+		return exitCodeOnBroken(holder, ExitError)
+	}
+
+	link, err := secureLink(stream)
+	if err != nil {
+		log.Errorf("RunStdio e2e handshake failed:%v", err)
+		return exitCodeOnBroken(holder, ExitAuthFailed)
+	}
+
+	go func() {
+		io.Copy(link, os.Stdin)
+		// stdin end, close write direction only
+		link.Close()
+	}()
+
+	type copyResult struct {
+		n   int64
+		err error
+	}
+
+	done := make(chan copyResult, 1)
+	go func() {
+		n, err := io.Copy(os.Stdout, link)
+		done <- copyResult{n: n, err: err}
+	}()
+
+	select {
+	case cmd := <-holder.notify:
+		return exitCodeOf(cmd)
+	case r := <-done:
+		if r.n > 0 {
+			if r.err != nil {
+				log.Errorf("RunStdio link stream broken:%v", r.err)
+				return ExitError
+			}
+
+			return ExitOK
+		}
+
+		// link stream end without any data, the reason may come later
+		if r.err != nil {
+			return exitCodeOnBroken(holder, ExitError)
+		}
+
+		return exitCodeOnBroken(holder, ExitOK)
+	}
+}
+
+// exitCodeOnBroken wait a moment for server's notification,
+// return fallback if no notification
+func exitCodeOnBroken(holder *sessionholder, fallback int) int {
+	select {
+	case cmd := <-holder.notify:
+		return exitCodeOf(cmd)
+	case <-time.After(time.Second):
+		return fallback
+	}
+}
+
+func exitCodeOf(cmd *protoj.StreamCmd) int {
+	log.Errorf("RunStdio failed:%s, code:%d, reason:%s", cmd.Cmd, cmd.Code, cmd.Reason)
+	if cmd.Cmd == protoj.CmdDenied {
+		return ExitAuthFailed
+	}
+
+	return exitCodeOfReply(cmd.Code)
+}
+
+// exitCodeOfReply exit code of the link reply code
+func exitCodeOfReply(code int) int {
+	switch code {
+	case protoj.LinkReplyNoDevice:
+		return ExitDeviceOffline
+	case protoj.LinkReplyDenied:
+		return ExitAuthFailed
+	case protoj.LinkReplyRefused, protoj.LinkReplyDialFailed:
+		return ExitRefused
+	default:
+		return ExitError
+	}
+}
@@ -0,0 +1,98 @@
+package endpointc
+
+import (
+	"net"
+	"testing"
+
+	"lxquic/protoj"
+)
+
+func TestExitCodeOf(t *testing.T) {
+	var tests = []struct {
+		cmd  *protoj.StreamCmd
+		code int
+	}{
+		{&protoj.StreamCmd{Cmd: protoj.CmdDenied}, ExitAuthFailed},
+		{&protoj.StreamCmd{Cmd: protoj.CmdLinkErr, Code: protoj.LinkReplyDenied}, ExitAuthFailed},
+		{&protoj.StreamCmd{Cmd: protoj.CmdLinkErr, Code: protoj.LinkReplyNoDevice}, ExitDeviceOffline},
+		{&protoj.StreamCmd{Cmd: protoj.CmdLinkErr, Code: protoj.LinkReplyRefused}, ExitRefused},
+		{&protoj.StreamCmd{Cmd: protoj.CmdLinkErr, Code: protoj.LinkReplyDialFailed}, ExitRefused},
+		{&protoj.StreamCmd{Cmd: protoj.CmdLinkErr, Code: 99}, ExitError},
+	}
+
+	for _, tt := range tests {
+		code := exitCodeOf(tt.cmd)
+		if code != tt.code {
+			t.Errorf("%s code %d: exit %d, want %d", tt.cmd.Cmd, tt.cmd.Code, code, tt.code)
+		}
+	}
+}
+
+func TestExitCodeOnBroken(t *testing.T) {
+	holder := &sessionholder{notify: make(chan *protoj.StreamCmd, 1)}
+	holder.notify <- &protoj.StreamCmd{Cmd: protoj.CmdLinkErr, Code: protoj.LinkReplyNoDevice}
+
+	code := exitCodeOnBroken(holder, ExitError)
+	if code != ExitDeviceOffline {
+		t.Fatalf("exit %d with notification, want %d", code, ExitDeviceOffline)
+	}
+
+	code = exitCodeOnBroken(holder, ExitAuthFailed)
+	if code != ExitAuthFailed {
+		t.Fatalf("exit %d without notification, want the fallback", code)
+	}
+}
+
+// replyLink read the link header in the version and reply with code
+func replyLink(t *testing.T, conn net.Conn, version uint8, code int) {
+	defer conn.Close()
+
+	header, err := protoj.ReadLinkHeader(conn)
+	if err != nil || !header.Reply || header.Port != int(remotePort) {
+		t.Errorf("link header %+v, err:%v", header, err)
+		return
+	}
+
+	if header.Version() != version {
+		t.Errorf("link header version %d, want %d", header.Version(), version)
+	}
+
+	protoj.WriteLinkReply(conn, &protoj.LinkStreamReply{Code: code, Reason: "test"}, header.Version())
+}
+
+func TestSendLinkHeader(t *testing.T) {
+	remotePort = 22
+
+	var tests = []struct {
+		code int
+		exit int
+	}{
+		{protoj.LinkReplyOK, ExitOK},
+		{protoj.LinkReplyDenied, ExitAuthFailed},
+		{protoj.LinkReplyNoDevice, ExitDeviceOffline},
+		{protoj.LinkReplyRefused, ExitRefused},
+	}
+
+	for _, version := range []uint8{protoj.CmdVersionJSON, protoj.CmdVersionEnvelope} {
+		for _, tt := range tests {
+			local, remote := net.Pipe()
+			go replyLink(t, remote, version, tt.code)
+
+			err := sendLinkHeader(local, version, linkReplyTimeout)
+			local.Close()
+
+			exit := ExitOK
+			if err != nil {
+				le, ok := err.(*linkReplyError)
+				if !ok {
+					t.Fatalf("version %d reply %d err:%v", version, tt.code, err)
+				}
+				exit = exitCodeOfReply(le.code)
+			}
+
+			if exit != tt.exit {
+				t.Errorf("version %d reply %d: exit %d, want %d", version, tt.code, exit, tt.exit)
+			}
+		}
+	}
+}
@@ -1,12 +1,11 @@
 package endpointc
 
 import (
-	"context"
 	"fmt"
 	"lxquic/protoj"
+	"lxquic/transport"
 	"net"
 
-	"github.com/lucas-clemente/quic-go"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -26,41 +25,49 @@ func startTCPListener(port uint16) {
 			continue
 		}
 
-		ssholder := getHolder(deviceID)
-		if ssholder == nil {
-			ssholder = buildQuicConnection("ec", deviceID)
-		}
-
-		if ssholder != nil {
-			// Handle connections in a new goroutine.
-			go handleRequest(conn.(*net.TCPConn), ssholder.sess)
-		} else {
-			conn.Close()
-		}
-
+		// Handle connections in a new goroutine, it wait for the session
+		// if reconnecting
+		go handleRequest(conn.(*net.TCPConn))
 	}
 }
 
 // handleRequest read tcp connection, and send to server via websocket connection
-func handleRequest(conn *net.TCPConn, session quic.Session) {
+func handleRequest(conn *net.TCPConn) {
 	log.Println("handleRequest new request")
 	defer conn.Close()
 
-	stream, err := session.OpenStreamSync(context.Background())
+	result := "error"
+	defer func() {
+		linkStreams.Inc("ec", result)
+	}()
+
+	stream, err := ecSessions.openStream(func(holder *sessionholder) (transport.Stream, error) {
+		return holder.openLinkStream()
+	})
 	if err != nil {
-		log.Println("handleRequest session.OpenStreamSync failed:", err)
+		log.Println("handleRequest openLinkStream failed:", err)
 		return
 	}
 
 	defer stream.Close()
 
+	link, err := secureLink(stream)
+	if err != nil {
+		log.Println("handleRequest e2e handshake failed:", err)
+		return
+	}
+
+	// e2e link send its close record before the stream close
+	defer link.Close()
+
+	link = &countedLink{link, "ec"}
 	log.Println("handleRequest session.OpenStreamSync ok")
 	quicbuf := make([]byte, 64*1024)
 	// read websocket message and forward to tcp
 	go func() {
 		defer conn.Close()
 		for {
-			n, err := stream.Read(quicbuf)
+			n, err := link.Read(quicbuf)
 			if err != nil {
 				log.Println("handleRequest stream read error:", err)
 				break
@@ -87,12 +94,13 @@ func handleRequest(conn *net.TCPConn, session quic.Session) {
 			break
 		}
 
-		_, err = stream.Write(tcpbuf[:n])
+		_, err = link.Write(tcpbuf[:n])
 		if err != nil {
 			log.Println("handleRequest ws write error:", err)
 			break
 		}
 	}
 
+	result = "ok"
 	log.Println("handleRequest new request end")
 }
@@ -0,0 +1,69 @@
+package endpointc
+
+import (
+	"net"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// transparent proxy modes
+const (
+	// iptables REDIRECT, original destination via SO_ORIGINAL_DST
+	transparentRedirect = "redirect"
+	// iptables TPROXY, original destination is the local address
+	transparentTProxy = "tproxy"
+)
+
+// transparentLink link the accepted connection, replaced in tests
+var transparentLink = linkConn
+
+// startTransparentListener accept connections redirected by iptables,
+// and link them through the px session, the same as socks5 requests
+func startTransparentListener(address string, mode string) {
+	if mode != transparentRedirect && mode != transparentTProxy {
+		log.Fatal("startTransparentListener unknown mode:", mode)
+	}
+
+	listener, err := listenTransparent(address, mode)
+	if err != nil {
+		log.Fatal("startTransparentListener listen failed:", err)
+	}
+
+	log.Printf("transparent proxy listen at:%s, mode:%s", address, mode)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Println("startTransparentListener error accepting:", err)
+			continue
+		}
+
+		go handleTransparentConn(conn.(*net.TCPConn), mode)
+	}
+}
+
+func handleTransparentConn(conn *net.TCPConn, mode string) {
+	dst, err := originalDst(conn, mode)
+	if err != nil {
+		log.Println("handleTransparentConn get original destination failed:", err)
+		conn.Close()
+		return
+	}
+
+	// connect to the listener directly, would loop forever
+	local := conn.LocalAddr().(*net.TCPAddr)
+	if mode == transparentRedirect && dst.IP.Equal(local.IP) && dst.Port == local.Port {
+		log.Println("handleTransparentConn connection not redirected, discard:", dst)
+		conn.Close()
+		return
+	}
+
+	host := dst.IP.String()
+	if domain, ok := fakeIPDomain(dst.IP); ok {
+		// client resolved the name via our dns server
+		host = domain
+	}
+
+	log.Printf("handleTransparentConn new request to:%s:%d", host, dst.Port)
+	transparentLink(conn, host, dst.Port, nil)
+	log.Println("handleTransparentConn request end")
+}
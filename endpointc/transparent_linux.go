@@ -0,0 +1,107 @@
+package endpointc
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// netfilter SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	soOriginalDst = 80
+)
+
+// listenTransparent listen tcp, set IP_TRANSPARENT in tproxy mode so that
+// connections to non-local destination can be accepted
+func listenTransparent(address string, mode string) (net.Listener, error) {
+	var lc net.ListenConfig
+	if mode == transparentTProxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+				if serr == nil && network == "tcp6" {
+					serr = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+
+			if err != nil {
+				return err
+			}
+
+			return serr
+		}
+	}
+
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// getOriginalDst read SO_ORIGINAL_DST of the redirected connection,
+// a variable so that tests can stub it without iptables
+var getOriginalDst = sockoptOriginalDst
+
+// originalDst the destination before iptables redirect
+func originalDst(conn *net.TCPConn, mode string) (*net.TCPAddr, error) {
+	if mode == transparentTProxy {
+		// tproxy keep the original destination as local address
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	}
+
+	return getOriginalDst(conn)
+}
+
+func sockoptOriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	local := conn.LocalAddr().(*net.TCPAddr)
+	var dst *net.TCPAddr
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// sockaddr_in: family, port, addr
+			var mreq *unix.IPv6Mreq
+			mreq, serr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, soOriginalDst)
+			if serr != nil {
+				return
+			}
+
+			raw := mreq.Multiaddr
+			dst = &net.TCPAddr{
+				IP:   net.IPv4(raw[4], raw[5], raw[6], raw[7]),
+				Port: int(binary.BigEndian.Uint16(raw[2:4])),
+			}
+
+			return
+		}
+
+		// sockaddr_in6, port is in network byte order
+		var info *unix.IPv6MTUInfo
+		info, serr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, soOriginalDst)
+		if serr != nil {
+			return
+		}
+
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		dst = &net.TCPAddr{
+			IP:   net.IP(append([]byte(nil), info.Addr.Addr[:]...)),
+			Port: int(binary.BigEndian.Uint16(port[:])),
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if serr != nil {
+		return nil, serr
+	}
+
+	return dst, nil
+}
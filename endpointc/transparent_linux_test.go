@@ -0,0 +1,139 @@
+package endpointc
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+type linked struct {
+	host string
+	port int
+}
+
+// stubTransparent replace SO_ORIGINAL_DST and the link step, the links
+// handleTransparentConn made are sent to the returned channel
+func stubTransparent(t *testing.T, dst func(conn *net.TCPConn) (*net.TCPAddr, error)) chan linked {
+	links := make(chan linked, 1)
+
+	oldDst, oldLink := getOriginalDst, transparentLink
+	getOriginalDst = dst
+	transparentLink = func(conn net.Conn, host string, port int, onReply func(code int) error) {
+		conn.Close()
+		links <- linked{host: host, port: port}
+	}
+
+	t.Cleanup(func() {
+		getOriginalDst, transparentLink = oldDst, oldLink
+	})
+
+	return links
+}
+
+// acceptedConn the server side of a loopback tcp connection
+func acceptedConn(t *testing.T) *net.TCPConn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn.(*net.TCPConn)
+}
+
+func expectLink(t *testing.T, links chan linked, want linked) {
+	t.Helper()
+
+	select {
+	case got := <-links:
+		if got != want {
+			t.Fatalf("linked %+v, want %+v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("not linked, want %+v", want)
+	}
+}
+
+func TestTransparentRedirect(t *testing.T) {
+	links := stubTransparent(t, func(conn *net.TCPConn) (*net.TCPAddr, error) {
+		return &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 443}, nil
+	})
+
+	handleTransparentConn(acceptedConn(t), transparentRedirect)
+	expectLink(t, links, linked{host: "192.0.2.1", port: 443})
+}
+
+func TestTransparentFakeIP(t *testing.T) {
+	pool, err := newFakeIPPool("198.18.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPool := fakeIPs
+	fakeIPs = pool
+	defer func() { fakeIPs = oldPool }()
+
+	ip := pool.allocate("example.com.")
+	links := stubTransparent(t, func(conn *net.TCPConn) (*net.TCPAddr, error) {
+		return &net.TCPAddr{IP: ip, Port: 80}, nil
+	})
+
+	handleTransparentConn(acceptedConn(t), transparentRedirect)
+	expectLink(t, links, linked{host: "example.com", port: 80})
+}
+
+func TestTransparentNotRedirected(t *testing.T) {
+	links := stubTransparent(t, func(conn *net.TCPConn) (*net.TCPAddr, error) {
+		return conn.LocalAddr().(*net.TCPAddr), nil
+	})
+
+	handleTransparentConn(acceptedConn(t), transparentRedirect)
+	select {
+	case got := <-links:
+		t.Fatalf("connection to the listener linked to %+v", got)
+	default:
+	}
+}
+
+func TestTransparentDstFailed(t *testing.T) {
+	links := stubTransparent(t, func(conn *net.TCPConn) (*net.TCPAddr, error) {
+		return nil, fmt.Errorf("no original destination")
+	})
+
+	conn := acceptedConn(t)
+	handleTransparentConn(conn, transparentRedirect)
+	select {
+	case got := <-links:
+		t.Fatalf("linked %+v without original destination", got)
+	default:
+	}
+
+	// closed by handleTransparentConn
+	if _, err := conn.Write([]byte{0}); err == nil {
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestTransparentTProxy(t *testing.T) {
+	links := stubTransparent(t, func(conn *net.TCPConn) (*net.TCPAddr, error) {
+		t.Error("SO_ORIGINAL_DST used in tproxy mode")
+		return nil, fmt.Errorf("unexpected")
+	})
+
+	conn := acceptedConn(t)
+	local := conn.LocalAddr().(*net.TCPAddr)
+	handleTransparentConn(conn, transparentTProxy)
+	expectLink(t, links, linked{host: local.IP.String(), port: local.Port})
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package endpointc
+
+import (
+	"fmt"
+	"net"
+)
+
+func listenTransparent(address string, mode string) (net.Listener, error) {
+	return nil, fmt.Errorf("transparent proxy only supported on linux")
+}
+
+func originalDst(conn *net.TCPConn, mode string) (*net.TCPAddr, error) {
+	return nil, fmt.Errorf("transparent proxy only supported on linux")
+}
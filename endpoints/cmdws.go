@@ -3,55 +3,89 @@ package endpoints
 import (
 	"context"
 	"crypto/tls"
-	"encoding/json"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 
-	quic "github.com/lucas-clemente/quic-go"
-
+	"lxquic/backoff"
+	"lxquic/e2e"
 	"lxquic/protoj"
+	"lxquic/transport"
 )
 
 type sessionholder struct {
 	// unique id, as sessionholder object's identifier
 	uuid string
-
-	sess quic.Session
-
-	stream quic.Stream
-
-	// ping meesage that waiting for response counter
-	waitingPingCount int
+	// relay address of the session
+	relay string
+
+	sess transport.Session
+	// cancel accepting link streams on goaway, the session is left to
+	// the relay to close, so that link streams keep going
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stream transport.Stream
+	// cmd stream rpc, written by keepalive and handlers
+	rpc *protoj.RPC
 }
 
 // newHolder create a websocket holder object
 // the uuid must be unique
-func newHolder(uuid string, sess1 quic.Session, stream1 quic.Stream) *sessionholder {
+func newHolder(uuid string, sess1 transport.Session, stream1 transport.Stream) *sessionholder {
 	wh := &sessionholder{
 		uuid:   uuid,
 		sess:   sess1,
 		stream: stream1,
+		rpc:    protoj.NewRPC(protoj.NewCmdCodec(stream1)),
+	}
+
+	wh.ctx, wh.cancel = context.WithCancel(context.Background())
+
+	wh.rpc.MaxMisses = transportConfig.KeepaliveMisses
+
+	wh.rpc.OnRTT = func(rtt time.Duration) {
+		pingRTT.Observe(rtt.Seconds())
 	}
+	wh.rpc.OnLost = func() {
+		pingLost.Inc()
+	}
+
+	wh.rpc.Handle(protoj.CmdPunch, func(cmd *protoj.StreamCmd) (*protoj.StreamCmd, error) {
+		return nil, wh.onPunch(cmd)
+	})
+
+	wh.rpc.Handle(protoj.CmdHello, func(cmd *protoj.StreamCmd) (*protoj.StreamCmd, error) {
+		log.Printf("sessionholder server hello, caps:%v", cmd.Caps)
+		return nil, nil
+	})
+
+	wh.rpc.Handle(protoj.CmdGoaway, func(cmd *protoj.StreamCmd) (*protoj.StreamCmd, error) {
+		wh.onGoaway(cmd)
+		return nil, nil
+	})
 
 	return wh
 }
 
 // buildCmdWS build a websocket dedicated to recv command
-func buildCmdWS() (*sessionholder, error) {
-	log.Println("buildCmdWS")
+func buildCmdWS(addr string) (*sessionholder, error) {
+	log.Println("buildCmdWS to relay:", addr)
+	start := time.Now()
 	tlsConf := &tls.Config{
 		InsecureSkipVerify: true,
-		NextProtos:         []string{"quic-echo-example"},
+		NextProtos:         protoj.NextProtos(),
 	}
-	session, err := quic.DialAddr(quicAddr, tlsConf, nil)
+	session, err := dialServer(addr, tlsConf)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Println("buildCmdWS quic.DialAddr ok, try to open stream")
+	log.Printf("buildCmdWS dial ok, remote:%s, try to open stream", session.RemoteAddr())
 	stream, err := session.OpenStreamSync(context.Background())
 	if err != nil {
 		session.CloseWithError(0, "OpenStreamSync failed")
@@ -60,8 +94,27 @@ func buildCmdWS() (*sessionholder, error) {
 
 	log.Println("buildCmdWS OpenStreamSync ok, try to send stream header")
 	var header = &protoj.CmdStreamHeader{
-		Role: "es",
-		DUID: deviceID,
+		Role:    "es",
+		DUID:    deviceID,
+		Policy:  devPolicy.advertise(),
+		Version: protoj.CmdVersion,
+		Caps:    []string{protoj.CapEnvelope, protoj.CapLinkReply},
+
+		Tags:   devInfo.Tags,
+		Hidden: devInfo.Hidden,
+		Meta:   deviceMeta(),
+	}
+
+	// direct path need the relay session on the shared udp socket
+	if p2pConn != nil && transport.IsQuic(session) {
+		header.P2P = true
+		header.Addrs = localCandidates()
+		header.Caps = append(header.Caps, protoj.CapP2P)
+	}
+
+	if devKey != nil {
+		header.PubKey = devKey.PublicString()
+		header.Caps = append(header.Caps, protoj.CapE2E)
 	}
 
 	err = protoj.StreamSendJSON(stream, header)
@@ -70,136 +123,178 @@ func buildCmdWS() (*sessionholder, error) {
 		return nil, err
 	}
 
+	handshakeTime.Observe(time.Since(start).Seconds())
 	log.Println("buildCmdWS ok")
 	wh := newHolder(deviceID, session, stream)
 	return wh, nil
 }
 
+// dialServer dial quic server, fallback to tcp if quic is blocked,
+// quic use the shared udp socket if p2p enabled
+func dialServer(addr string, tlsConf *tls.Config) (transport.Session, error) {
+	params := &transport.DialParams{
+		Addr:       addr,
+		TLSConfig:  tlsConf,
+		QuicConfig: transportConfig.QuicConfig(),
+		Mode:       transportMode,
+	}
+
+	if p2pConn != nil {
+		params.PacketConn = p2pConn
+	}
+
+	return transport.Dial(params)
+}
+
 // cmdwsService long run service, never return
 func cmdwsService() {
+	first := true
+	bo := backoff.New(devInfo.RetryMin, devInfo.RetryMax)
 	// never return
 	for {
 		// build/re-build command websocket
-		wh, err := buildCmdWS()
+		wh, err := relays.connect()
 		if err != nil {
-			log.Println("cmdwsService reconnect later, buildCmdWS failed:", err)
-			time.Sleep(10 * time.Second)
+			delay := bo.Next()
+			log.Printf("cmdwsService all relays failed:%v, reconnect in %v", err, delay)
+			connectsTotal.Inc("failed")
+			time.Sleep(delay)
 			continue
 		}
 
+		bo.Reset()
+		connectsTotal.Inc("ok")
+		if !first {
+			reconnects.Inc()
+		}
+		first = false
+
+		connected.Set(1)
 		wh.loop()
+		connected.Set(0)
+		setHealth(protoj.LinkHealth{})
+
+		// all devices lose the relay at the same time when it restart,
+		// spread their reconnects
+		delay := bo.Next()
+		log.Printf("cmdwsService session lost, reconnect in %v", delay)
+		time.Sleep(delay)
 	}
 }
 
-// onPong update waiting response ping counter
-func (wh *sessionholder) onPong(data []byte) {
-	wh.waitingPingCount = 0
-}
-
-// keepalive send ping message peer, and counter
+// keepalive send ping message peer, close the session if peer not response
 func (wh *sessionholder) keepalive() {
 	if wh.stream == nil {
 		return
 	}
 
-	// too many un-response ping, close the websocket connection
-	if wh.waitingPingCount > 3 {
-		if wh.sess != nil {
-			log.Println("sessionholder keepalive failed, close:", wh.uuid)
-			wh.sess.CloseWithError(0, "keepalive failed")
-		}
-		return
+	err := wh.rpc.Keepalive()
+	if err == protoj.ErrKeepalive {
+		log.Println("sessionholder keepalive failed, close:", wh.uuid)
+		keepaliveTimeouts.Inc()
+		wh.sess.CloseWithError(0, "keepalive failed")
+	} else if err != nil {
+		log.Println("sessionholder send ping error:", err)
 	}
 
-	var ping = &protoj.StreamCmd{
-		Cmd: "ping",
+	setHealth(wh.rpc.Health())
+	if h, changed := wh.rpc.HealthChanged(); changed {
+		log.Printf("sessionholder link health %s, conn:%+v", h, wh.sess.Stats())
 	}
-
-	err := protoj.StreamSendJSON(wh.stream, ping)
-	if err != nil {
-		log.Println("streamSendJSON ping error:", err)
-		return
-	}
-
-	wh.waitingPingCount++
 }
 
 // loop read command websocket and process command
 func (wh *sessionholder) loop() {
 	log.Println("sessionholder.loop start")
 	// save to map, for keep-alive
+	holderLock.Lock()
 	holderMap[wh.uuid] = wh
+	holderLock.Unlock()
 	sess := wh.sess
 
 	go wh.serveCmdStream()
 
 	for {
 		// TODO: accept streams
-		stream, err := sess.AcceptStream(context.Background())
+		stream, err := sess.AcceptStream(wh.ctx)
 		if err != nil {
 			log.Println("sess.AcceptStream failed:", err)
 			break
 		}
 
 		// TODO: service link stream
-		go onPairRequest(stream)
+		go onPairRequest(stream, nil)
 	}
 
-	// remove from map
-	delete(holderMap, wh.uuid)
+	// remove from map, unless replaced by the new session already
+	holderLock.Lock()
+	if holderMap[wh.uuid] == wh {
+		delete(holderMap, wh.uuid)
+	}
+	holderLock.Unlock()
 }
 
-func (wh *sessionholder) serveCmdStream() {
-	stream := wh.stream
-	for {
-		message, err := protoj.StreamReadJSON(stream)
-		if err != nil {
-			log.Println("serveCmdStream streamReadJSON failed:", err)
-			break
-		}
+// onGoaway relay is draining, reconnect now, to the alternate relay if
+// given. Link streams already open keep going on the old session
+func (wh *sessionholder) onGoaway(cmd *protoj.StreamCmd) {
+	log.Printf("sessionholder relay:%s goaway, reason:%s, alternate relay:%s", wh.relay, cmd.Reason, cmd.Relay)
+	goaways.Inc()
+	relays.goaway(wh.relay, cmd.Relay)
+	wh.cancel()
+}
 
-		var cmd = &protoj.StreamCmd{}
-		err = json.Unmarshal(message, cmd)
-		if err == nil {
-			//log.Printf("sessionholder serveCmdStream get a json cmd:%+v", cmd)
-			if cmd.Cmd == "pong" {
-				wh.onPong(nil)
-			} else if cmd.Cmd == "ping" {
-				// reply pong
-				cmd.Cmd = "pong"
-				protoj.StreamSendJSON(stream, cmd)
-			}
-		} else {
-			//
-			log.Println("sessionholder serveCmdStream json.Unmarshal failed:", err)
-		}
-	}
+func (wh *sessionholder) serveCmdStream() {
+	err := wh.rpc.Serve()
+	log.Println("serveCmdStream exit:", err)
 }
 
 // onPairRequest connect to local port via tcp,
 // and then connect to server via websocket, bridge the two connections.
-func onPairRequest(stream quic.Stream) {
+func onPairRequest(stream transport.Stream, grant *punchGrant) {
 	log.Println("onPairRequest, pair link stream")
 	defer stream.Close()
-	// TODO: read LinkStreamHeader
-	message, err := protoj.StreamReadJSON(stream)
+
+	result := "error"
+	defer func() {
+		linkStreams.Inc(result)
+	}()
+
+	header, err := protoj.ReadLinkHeader(stream)
 	if err != nil {
-		log.Errorf("onPairRequest streamReadJSON failed:%v", err)
+		log.Errorf("onPairRequest read link header failed:%v", err)
 		return
 	}
 
-	var header = &protoj.LinkStreamHeader{}
-	err = json.Unmarshal(message, header)
+	// target port
+	port := header.Port
+
+	err = devPolicy.check(header.Host, port)
+	if err == nil && grant != nil && (port != grant.port || header.Host != "") {
+		// direct session, the server did not check the acl for this
+		err = fmt.Errorf("direct session not granted to %s:%d", header.Host, port)
+	}
+
 	if err != nil {
-		log.Errorf("onPairRequest json.UnMarshal failed:%v", err)
+		log.Errorf("onPairRequest refused:%v", err)
+		result = "refused"
+		replyLinkStream(stream, header, protoj.LinkReplyRefused, err.Error())
 		return
 	}
 
-	// target port
-	port := header.Port
+	if header.E2E && devKey == nil {
+		log.Errorf("onPairRequest refused, e2e not enabled")
+		result = "refused"
+		replyLinkStream(stream, header, protoj.LinkReplyRefused, "e2e not enabled")
+		return
+	}
 
-	// only allow connect to local host
-	address := fmt.Sprintf("127.0.0.1:%d", port)
+	// connect to local host, unless server ask us to be an exit node
+	host := "127.0.0.1"
+	if header.Host != "" {
+		host = header.Host
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(port))
 
 	log.Printf("onPairRequest, try link to:%s", address)
 
@@ -207,18 +302,43 @@ func onPairRequest(stream quic.Stream) {
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		log.Errorf("onPairRequest connect to address:%s failed:%v", address, err)
+		result = "dial_failed"
+		replyLinkStream(stream, header, protoj.LinkReplyDialFailed, err.Error())
+		return
+	}
+
+	err = replyLinkStream(stream, header, protoj.LinkReplyOK, "")
+	if err != nil {
+		log.Errorf("onPairRequest reply failed:%v", err)
+		conn.Close()
 		return
 	}
 
 	// ensure the tcp connection will closed final
 	defer conn.Close()
+
+	var link io.ReadWriteCloser = &countedLink{stream}
+	if header.E2E {
+		stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+		link, err = e2e.Server(link, devKey)
+		if err != nil {
+			log.Errorf("onPairRequest e2e handshake failed:%v", err)
+			return
+		}
+
+		stream.SetReadDeadline(time.Time{})
+	}
+
+	// e2e link send its close record before the stream close
+	defer link.Close()
+
 	quicbuf := make([]byte, 64*1024)
 
 	// receive stream message and forward to tcp
 	go func() {
 		defer conn.Close()
 		for {
-			n, err := stream.Read(quicbuf)
+			n, err := link.Read(quicbuf)
 			if err != nil {
 				log.Println("onPairRequest ws read error:", err)
 				break
@@ -245,12 +365,28 @@ func onPairRequest(stream quic.Stream) {
 			break
 		}
 
-		_, err = stream.Write(tcpbuf[:n])
+		_, err = link.Write(tcpbuf[:n])
 		if err != nil {
 			log.Println("onPairRequest ws write error:", err)
 			break
 		}
 	}
 
+	result = "ok"
 	log.Println("onPairRequest, pair link stream end")
 }
+
+// replyLinkStream send link stream reply if the header ask for it, in
+// the version of the header
+func replyLinkStream(stream transport.Stream, header *protoj.LinkStreamHeader, code int, reason string) error {
+	if !header.Reply {
+		return nil
+	}
+
+	var reply = &protoj.LinkStreamReply{
+		Code:   code,
+		Reason: reason,
+	}
+
+	return protoj.WriteLinkReply(stream, reply, header.Version())
+}
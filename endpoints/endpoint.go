@@ -1,6 +1,10 @@
 package endpoints
 
 import (
+	"lxquic/e2e"
+	"lxquic/protoj"
+	"lxquic/transport"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -9,43 +13,151 @@ import (
 var (
 	// the device id
 	deviceID string
-	// quic server address
-	quicAddr string
+	// relays to register to
+	relays *relayList
+	// transport mode, auto, quic or tcp
+	transportMode string
+	// keepalive and quic parameters
+	transportConfig *transport.Config
+	// local ports and lan targets that link stream can dial
+	devPolicy *policy
+	// e2e static key, nil if e2e not enabled
+	devKey *e2e.KeyPair
+	// discovery information reported to server
+	devInfo *Params
 	// base websocket url
 
 	// map keep all current websocket
 	// use for keep-alive
-	holderMap = make(map[string]*sessionholder)
+	holderMap  = make(map[string]*sessionholder)
+	holderLock sync.Mutex
 )
 
 // Params parameters
 type Params struct {
 	// device id
 	UUID string
-	// quic server address
-	QuicAddr string
+	// quic server addresses, tried in RelayOrder, the last working one
+	// is tried first
+	QuicAddrs []string
+	// RelayOrderPriority or RelayOrderRandom, empty means priority
+	RelayOrder string
+	// reconnect delay grow from RetryMin to RetryMax, with full jitter
+	RetryMin time.Duration
+	RetryMax time.Duration
+	// local ports that link stream can dial, empty means none
+	AllowPorts []int
+	// all local ports can be dialed, AllowPorts is ignored
+	AllowAllPorts bool
+	// lan targets that this device can dial as exit node,
+	// host[:port] or CIDR[:port]
+	LANTargets []string
+	// enable peer-to-peer direct path
+	P2P bool
+	// e2e static key file, created if not exist, empty means e2e disabled
+	KeyFile string
+	// transport mode, auto, quic or tcp, empty means auto
+	Transport string
+	// keepalive and quic parameters, nil means transport.DefaultConfig
+	Config *transport.Config
+
+	// agent version, reported for discovery
+	Version string
+	// tags for discovery
+	Tags []string
+	// not listed to ec
+	Hidden bool
+	// user defined labels, reported for discovery, acl and routing use
+	// the labels assigned on server
+	Labels map[string]string
+	// services exposed by the device
+	Services []protoj.Service
+
+	// metrics listen address, serve /metrics, empty means disable
+	MetricsAddr string
 }
 
 // keepalive send ping to all websocket holder
 func keepalive() {
 	for {
-		time.Sleep(time.Second * 5)
+		time.Sleep(transportConfig.KeepaliveInterval)
 
-		for _, v := range holderMap {
+		for _, v := range getHolders() {
 			v.keepalive()
 		}
 	}
 }
 
+// getHolders all holders, for keepalive
+func getHolders() []*sessionholder {
+	holderLock.Lock()
+	defer holderLock.Unlock()
+
+	holders := make([]*sessionholder, 0, len(holderMap))
+	for _, h := range holderMap {
+		holders = append(holders, h)
+	}
+
+	return holders
+}
+
 // Run run endpoint server and
 // wait for server's command
 func Run(params *Params) {
 	deviceID = params.UUID
-	quicAddr = params.QuicAddr
+	transportMode = params.Transport
+	devInfo = params
+
+	transportConfig = params.Config
+	if transportConfig == nil {
+		transportConfig = transport.DefaultConfig()
+	}
+
+	var err error
+	relays, err = newRelayList(params.QuicAddrs, params.RelayOrder)
+	if err != nil {
+		log.Fatal("endpoint run, invalid relays:", err)
+	}
+
+	if params.RetryMin <= 0 || params.RetryMax < params.RetryMin {
+		log.Fatalf("endpoint run, invalid retry delay, min:%v, max:%v", params.RetryMin, params.RetryMax)
+	}
+
+	devPolicy, err = newPolicy(params.AllowPorts, params.AllowAllPorts, params.LANTargets)
+	if err != nil {
+		log.Fatal("endpoint run, invalid policy:", err)
+	}
+
+	if params.AllowAllPorts {
+		log.Println("endpoint run, all local ports can be dialed")
+	} else if len(params.AllowPorts) == 0 {
+		// before -ports was required, no ports meant all ports
+		log.Warn("endpoint run, no -ports specify, every local port is refused since this version, use -ports '*' to allow all as before")
+	}
+
+	if params.KeyFile != "" {
+		devKey, err = e2e.LoadOrCreateKey(params.KeyFile)
+		if err != nil {
+			log.Fatal("endpoint run, load e2e key failed:", err)
+		}
+
+		log.Printf("endpoint run, e2e public key:%s", devKey.PublicString())
+	}
+
+	if params.P2P {
+		err = startP2P()
+		if err != nil {
+			log.Fatal("endpoint run, startP2P failed:", err)
+		}
+	}
+
+	if params.MetricsAddr != "" {
+		startMetrics(params.MetricsAddr)
+	}
 
 	// keep-alive goroutine
 	go keepalive()
 
-	log.Printf("endpoint run, device uuid:%s", deviceID)
+	log.Printf("endpoint run, device uuid:%s, policy:%+v", deviceID, devPolicy.advertise())
 	cmdwsService()
 }
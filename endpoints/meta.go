@@ -0,0 +1,54 @@
+package endpoints
+
+import (
+	"lxquic/protoj"
+	"net"
+	"os"
+	"runtime"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// localIPs addresses of local interfaces, loopback and link-local excluded
+func localIPs() []net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Println("localIPs net.InterfaceAddrs failed:", err)
+		return nil
+	}
+
+	var ips []net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		ips = append(ips, ipnet.IP)
+	}
+
+	return ips
+}
+
+// deviceMeta metadata reported on registration, collected every time
+// since addresses may change
+func deviceMeta() *protoj.DeviceMeta {
+	meta := &protoj.DeviceMeta{
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Agent:    devInfo.Version,
+		Labels:   devInfo.Labels,
+		Services: devInfo.Services,
+	}
+
+	hostname, err := os.Hostname()
+	if err == nil {
+		meta.Hostname = hostname
+	}
+
+	for _, ip := range localIPs() {
+		meta.IPs = append(meta.IPs, ip.String())
+	}
+
+	return meta
+}
@@ -0,0 +1,67 @@
+package endpoints
+
+import (
+	"io"
+
+	"lxquic/metrics"
+	"lxquic/protoj"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	connected     = metrics.NewGauge("lxquic_agent_connected", "1 if the agent is connected to server.")
+	connectsTotal = metrics.NewCounter("lxquic_agent_connects_total", "Attempts to connect server by result.", "result")
+	reconnects    = metrics.NewCounter("lxquic_agent_reconnects_total", "Connections to server after the first one.")
+	goaways       = metrics.NewCounter("lxquic_agent_goaways_total", "Goaway received from draining server.")
+	handshakeTime = metrics.NewHistogram("lxquic_agent_handshake_seconds", "Time to dial server and send cmd stream header.", nil)
+
+	linkStreams = metrics.NewCounter("lxquic_agent_link_streams_total", "Link streams from server by result.", "result")
+	bytesTotal  = metrics.NewCounter("lxquic_agent_bytes_total", "Link stream bytes by direction, in is from server.", "direction")
+
+	pingRTT           = metrics.NewHistogram("lxquic_agent_ping_rtt_seconds", "Keepalive ping round trip time.", nil)
+	pingLost          = metrics.NewCounter("lxquic_agent_ping_lost_total", "Keepalive pings not answered before the next one.")
+	keepaliveTimeouts = metrics.NewCounter("lxquic_agent_keepalive_timeouts_total", "Sessions closed by keepalive timeout.")
+
+	// smoothed, of the current session
+	healthRTT    = metrics.NewGauge("lxquic_agent_rtt_seconds", "Smoothed keepalive round trip time.")
+	healthJitter = metrics.NewGauge("lxquic_agent_jitter_seconds", "Keepalive round trip time jitter.")
+	healthLoss   = metrics.NewGauge("lxquic_agent_ping_loss_ratio", "Ratio of recent keepalive pings lost.")
+)
+
+// setHealth set health gauges
+func setHealth(h protoj.LinkHealth) {
+	healthRTT.Set(h.RTT / 1000)
+	healthJitter.Set(h.Jitter / 1000)
+	healthLoss.Set(h.Loss)
+}
+
+// countedLink count bytes of link stream
+type countedLink struct {
+	io.ReadWriteCloser
+}
+
+func (cl *countedLink) Read(p []byte) (int, error) {
+	n, err := cl.ReadWriteCloser.Read(p)
+	if n > 0 {
+		bytesTotal.Add(float64(n), "in")
+	}
+	return n, err
+}
+
+func (cl *countedLink) Write(p []byte) (int, error) {
+	n, err := cl.ReadWriteCloser.Write(p)
+	if n > 0 {
+		bytesTotal.Add(float64(n), "out")
+	}
+	return n, err
+}
+
+// startMetrics serve /metrics on separate listener
+func startMetrics(addr string) {
+	log.Printf("metrics listen at:%s", addr)
+	go func() {
+		err := metrics.ListenAndServe(addr)
+		log.Fatalln("metrics ListenAndServe failed:", err)
+	}()
+}
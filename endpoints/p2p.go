@@ -0,0 +1,183 @@
+package endpoints
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"lxquic/protoj"
+	"lxquic/transport"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// how long a punch token is valid
+	punchTokenTTL = 30 * time.Second
+)
+
+var (
+	// udp socket shared by the relay session and direct sessions,
+	// so that the address observed by server is the one to punch
+	p2pConn *net.UDPConn
+
+	punchLock   sync.Mutex
+	punchTokens = make(map[string]*punchGrant)
+)
+
+// punchGrant what the server allow a direct session of the token to do
+type punchGrant struct {
+	expire time.Time
+	// the only port link streams can go to
+	port int
+}
+
+// startP2P create the shared udp socket, and listen direct sessions on it
+func startP2P() error {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return err
+	}
+
+	listener, err := quic.Listen(conn, transport.GenerateTLSConfig(protoj.NextProtos()), transportConfig.QuicConfig())
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	p2pConn = conn
+	log.Printf("startP2P listen direct session at:%s", conn.LocalAddr())
+
+	go acceptDirectSessions(transport.WrapQuicListener(listener))
+	return nil
+}
+
+// localCandidates local addresses with the p2p port, for peers
+// on the same network
+func localCandidates() []string {
+	port := strconv.Itoa(p2pConn.LocalAddr().(*net.UDPAddr).Port)
+
+	var candidates []string
+	for _, ip := range localIPs() {
+		candidates = append(candidates, net.JoinHostPort(ip.String(), port))
+	}
+
+	return candidates
+}
+
+// onPunch server tell us an ec want a direct session, remember
+// the token, and punch holes to the ec
+func (wh *sessionholder) onPunch(cmd *protoj.StreamCmd) error {
+	log.Printf("sessionholder.onPunch, peer addrs:%v, port:%d", cmd.Addrs, cmd.Port)
+	if p2pConn == nil || cmd.Token == "" {
+		return fmt.Errorf("direct path not enabled")
+	}
+
+	// the server checked its acl for this port only
+	if cmd.Port <= 0 {
+		log.Println("sessionholder.onPunch no port granted, ignore")
+		return fmt.Errorf("no port granted")
+	}
+
+	now := time.Now()
+	punchLock.Lock()
+	for k, v := range punchTokens {
+		if now.After(v.expire) {
+			delete(punchTokens, k)
+		}
+	}
+	punchTokens[cmd.Token] = &punchGrant{expire: now.Add(punchTokenTTL), port: cmd.Port}
+	punchLock.Unlock()
+
+	for _, a := range cmd.Addrs {
+		go transport.Punch(p2pConn, a)
+	}
+
+	return nil
+}
+
+// consumePunchToken check and remove the token, nil if invalid
+func consumePunchToken(token string) *punchGrant {
+	punchLock.Lock()
+	defer punchLock.Unlock()
+
+	grant, ok := punchTokens[token]
+	if !ok {
+		return nil
+	}
+
+	delete(punchTokens, token)
+	if time.Now().After(grant.expire) {
+		return nil
+	}
+
+	return grant
+}
+
+func acceptDirectSessions(listener transport.Listener) {
+	for {
+		sess, err := listener.Accept(context.Background())
+		if err != nil {
+			log.Println("acceptDirectSessions listener.Accept failed:", err)
+			return
+		}
+
+		go serveDirectSession(sess)
+	}
+}
+
+// serveDirectSession the first stream carry the token, and then
+// serve link streams the same as relay's
+func serveDirectSession(sess transport.Session) {
+	log.Printf("serveDirectSession, new direct session from:%s", sess.RemoteAddr())
+	defer sess.CloseWithError(0, "direct session end")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	stream, err := sess.AcceptStream(ctx)
+	cancel()
+	if err != nil {
+		log.Println("serveDirectSession sess.AcceptStream failed:", err)
+		return
+	}
+
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	message, err := protoj.StreamReadJSON(stream)
+	if err != nil {
+		log.Println("serveDirectSession streamReadJSON failed:", err)
+		return
+	}
+
+	stream.SetReadDeadline(time.Time{})
+
+	var header = &protoj.CmdStreamHeader{}
+	err = json.Unmarshal(message, header)
+	if err != nil {
+		log.Println("serveDirectSession json.Unmarshal failed:", err)
+		return
+	}
+
+	var grant *punchGrant
+	if header.Role == "p2p" {
+		grant = consumePunchToken(header.DUID)
+	}
+
+	if grant == nil {
+		log.Printf("serveDirectSession invalid role:%s or token, from:%s", header.Role, sess.RemoteAddr())
+		return
+	}
+
+	log.Printf("serveDirectSession direct session ok, from:%s, port:%d", sess.RemoteAddr(), grant.port)
+	for {
+		linkStream, err := sess.AcceptStream(context.Background())
+		if err != nil {
+			log.Println("serveDirectSession sess.AcceptStream failed:", err)
+			break
+		}
+
+		go onPairRequest(linkStream, grant)
+	}
+}
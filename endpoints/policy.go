@@ -0,0 +1,169 @@
+package endpoints
+
+import (
+	"fmt"
+	"lxquic/protoj"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// policy device side allow list, decide which local ports
+// and lan targets can be dialed by link streams
+type policy struct {
+	// allowed local ports, empty means none unless allPorts
+	ports    []int
+	allPorts bool
+	// allowed lan targets
+	targets []*policyTarget
+}
+
+// policyTarget a lan target, host or CIDR, with optional port
+type policyTarget struct {
+	spec string
+
+	host  string
+	ipnet *net.IPNet
+	// 0 means any port
+	port int
+}
+
+// newPolicy create policy from allowed ports and lan target specs,
+// lan target spec format: host[:port] or CIDR[:port], no local port is
+// allowed unless listed or allPorts
+func newPolicy(ports []int, allPorts bool, targets []string) (*policy, error) {
+	p := &policy{
+		ports:    ports,
+		allPorts: allPorts,
+	}
+
+	for _, spec := range targets {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		t, err := parsePolicyTarget(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		p.targets = append(p.targets, t)
+	}
+
+	return p, nil
+}
+
+func parsePolicyTarget(spec string) (*policyTarget, error) {
+	t := &policyTarget{spec: spec}
+
+	var err error
+	if slash := strings.Index(spec, "/"); slash >= 0 {
+		// CIDR, the port follows the prefix length
+		cidr := spec
+		if colon := strings.LastIndex(spec[slash:], ":"); colon >= 0 {
+			cidr = spec[:slash+colon]
+			t.port, err = parsePort(spec[slash+colon+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid lan target %s: %v", spec, err)
+			}
+		}
+
+		_, t.ipnet, err = net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid lan target %s: %v", spec, err)
+		}
+
+		return t, nil
+	}
+
+	host, port, err := net.SplitHostPort(spec)
+	if err != nil {
+		// no port
+		t.host = strings.Trim(spec, "[]")
+		return t, nil
+	}
+
+	t.host = host
+	t.port, err = parsePort(port)
+	if err != nil {
+		return nil, fmt.Errorf("invalid lan target %s: %v", spec, err)
+	}
+
+	return t, nil
+}
+
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+
+	if port <= 0 || port > 65535 {
+		return 0, fmt.Errorf("port %d out of range", port)
+	}
+
+	return port, nil
+}
+
+func (t *policyTarget) match(host string, port int) bool {
+	if t.port != 0 && t.port != port {
+		return false
+	}
+
+	if t.ipnet != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && t.ipnet.Contains(ip)
+	}
+
+	if t.host == host {
+		return true
+	}
+
+	// compare ip in canonical form, e.g. ipv6
+	ip1 := net.ParseIP(t.host)
+	ip2 := net.ParseIP(host)
+	return ip1 != nil && ip2 != nil && ip1.Equal(ip2)
+}
+
+// check return an error describe the reason if the target is not allowed,
+// empty host means local host, so does the unspecified address, dialing
+// 0.0.0.0 or :: connect to the local host
+func (p *policy) check(host string, port int) error {
+	ip := net.ParseIP(host)
+	if host == "" || host == "localhost" || (ip != nil && (ip.IsLoopback() || ip.IsUnspecified())) {
+		if p.allPorts {
+			return nil
+		}
+
+		for _, allowed := range p.ports {
+			if allowed == port {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("local port %d not allowed", port)
+	}
+
+	for _, t := range p.targets {
+		if t.match(host, port) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("lan target %s not allowed", net.JoinHostPort(host, strconv.Itoa(port)))
+}
+
+// advertise convert to the form that advertised to server
+func (p *policy) advertise() *protoj.DevicePolicy {
+	dp := &protoj.DevicePolicy{
+		Ports:    p.ports,
+		AllPorts: p.allPorts,
+	}
+
+	for _, t := range p.targets {
+		dp.Targets = append(dp.Targets, t.spec)
+	}
+
+	return dp
+}
@@ -0,0 +1,38 @@
+package endpoints
+
+import "testing"
+
+func TestPolicyLocalPorts(t *testing.T) {
+	deny, err := newPolicy(nil, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if deny.check("", 22) == nil || deny.check("127.0.0.1", 80) == nil {
+		t.Error("local port allowed without -ports")
+	}
+
+	all, _ := newPolicy(nil, true, nil)
+	if all.check("", 22) != nil || all.check("::1", 8080) != nil {
+		t.Error("local port denied with all ports allowed")
+	}
+
+	listed, _ := newPolicy([]int{22}, false, []string{"10.0.0.0/8:80"})
+	if listed.check("localhost", 22) != nil || listed.check("localhost", 23) == nil {
+		t.Error("listed ports not honored")
+	}
+
+	if listed.check("10.1.2.3", 80) != nil || listed.check("10.1.2.3", 22) == nil {
+		t.Error("lan targets not honored")
+	}
+
+	// the unspecified address reach the local host, not a lan target
+	open, _ := newPolicy([]int{22}, false, []string{"0.0.0.0/0", "::/0"})
+	if open.check("0.0.0.0", 23) == nil || open.check("::", 23) == nil {
+		t.Error("local port reached via unspecified address")
+	}
+
+	if open.check("0.0.0.0", 22) != nil || open.check("10.1.2.3", 23) != nil {
+		t.Error("unspecified address not checked as local host")
+	}
+}
@@ -0,0 +1,153 @@
+package endpoints
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// relay orders
+const (
+	// RelayOrderPriority try relays in the given order
+	RelayOrderPriority = "priority"
+	// RelayOrderRandom try relays in random order, spread devices
+	RelayOrderRandom = "random"
+)
+
+// relayList relays that the device can register to, the last working
+// one is tried first
+type relayList struct {
+	addrs  []string
+	random bool
+
+	lock sync.Mutex
+	// last working relay, empty if none
+	sticky string
+	// relay that told us to go away, tried last until another one works
+	avoid string
+	rand  *rand.Rand
+}
+
+func newRelayList(addrs []string, order string) (*relayList, error) {
+	rl := &relayList{
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for _, a := range addrs {
+		if a != "" {
+			rl.addrs = append(rl.addrs, a)
+		}
+	}
+
+	if len(rl.addrs) == 0 {
+		return nil, fmt.Errorf("no relay address")
+	}
+
+	switch order {
+	case "", RelayOrderPriority:
+	case RelayOrderRandom:
+		rl.random = true
+	default:
+		return nil, fmt.Errorf("invalid relay order:%s", order)
+	}
+
+	return rl, nil
+}
+
+// order relays to try in this round, the sticky one first, and then the
+// others by priority or shuffled
+func (rl *relayList) order() []string {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	addrs := append([]string{}, rl.addrs...)
+	if rl.random {
+		rl.rand.Shuffle(len(addrs), func(i, j int) {
+			addrs[i], addrs[j] = addrs[j], addrs[i]
+		})
+	}
+
+	var result []string
+	if rl.sticky != "" {
+		result = append(result, rl.sticky)
+	}
+
+	for _, a := range addrs {
+		if a != rl.sticky && a != rl.avoid {
+			result = append(result, a)
+		}
+	}
+
+	if rl.avoid != "" && rl.avoid != rl.sticky {
+		result = append(result, rl.avoid)
+	}
+
+	return result
+}
+
+// succeeded stick to the relay
+func (rl *relayList) succeeded(addr string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	if rl.sticky != addr {
+		log.Printf("relayList stick to relay:%s", addr)
+	}
+
+	rl.sticky = addr
+	if addr != rl.avoid {
+		rl.avoid = ""
+	}
+}
+
+// goaway the relay from is draining, stick to the alternate relay to if
+// not empty, it is added to the list if unknown. from is tried last
+func (rl *relayList) goaway(from string, to string) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	rl.avoid = from
+	if to == "" {
+		if rl.sticky == from {
+			rl.sticky = ""
+		}
+		return
+	}
+
+	known := false
+	for _, a := range rl.addrs {
+		if a == to {
+			known = true
+			break
+		}
+	}
+
+	if !known {
+		rl.addrs = append(rl.addrs, to)
+	}
+
+	log.Printf("relayList relay:%s going away, move to:%s", from, to)
+	rl.sticky = to
+}
+
+// connect try relays of this round in order, the address is resolved
+// again on every attempt, so that dns changes are followed
+func (rl *relayList) connect() (*sessionholder, error) {
+	var lastErr error
+	for _, addr := range rl.order() {
+		wh, err := buildCmdWS(addr)
+		if err == nil {
+			wh.relay = addr
+			rl.succeeded(addr)
+			return wh, nil
+		}
+
+		log.Printf("relayList connect to relay:%s failed:%v", addr, err)
+		lastErr = err
+	}
+
+	return nil, lastErr
+}
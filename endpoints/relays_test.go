@@ -0,0 +1,86 @@
+package endpoints
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestRelayListInvalid(t *testing.T) {
+	if _, err := newRelayList([]string{"", ""}, ""); err == nil {
+		t.Error("empty relay list accepted")
+	}
+
+	if _, err := newRelayList([]string{"a"}, "fastest"); err == nil {
+		t.Error("invalid order accepted")
+	}
+}
+
+func TestRelayOrderPriority(t *testing.T) {
+	rl, err := newRelayList([]string{"a", "", "b", "c"}, RelayOrderPriority)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var steps = []struct {
+		op    func()
+		order []string
+	}{
+		{func() {}, []string{"a", "b", "c"}},
+		// the working one first
+		{func() { rl.succeeded("b") }, []string{"b", "a", "c"}},
+		// going away without alternate, tried last
+		{func() { rl.goaway("b", "") }, []string{"a", "c", "b"}},
+		{func() { rl.succeeded("c") }, []string{"c", "a", "b"}},
+		// the alternate is added and stuck to
+		{func() { rl.goaway("c", "d") }, []string{"d", "a", "b", "c"}},
+		{func() { rl.goaway("d", "a") }, []string{"a", "b", "c", "d"}},
+		// back to the one avoided, it is not avoided any more
+		{func() { rl.succeeded("d") }, []string{"d", "a", "b", "c"}},
+	}
+
+	for i, s := range steps {
+		s.op()
+		order := rl.order()
+		if !reflect.DeepEqual(order, s.order) {
+			t.Fatalf("step %d order %v, want %v", i, order, s.order)
+		}
+	}
+}
+
+func TestRelayOrderRandom(t *testing.T) {
+	addrs := []string{"a", "b", "c", "d"}
+	rl, err := newRelayList(addrs, RelayOrderRandom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.rand = rand.New(rand.NewSource(1))
+
+	// devices spread over all relays
+	first := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		order := rl.order()
+		first[order[0]]++
+
+		sorted := append([]string{}, order...)
+		sort.Strings(sorted)
+		if !reflect.DeepEqual(sorted, addrs) {
+			t.Fatalf("order %v is not a permutation of %v", order, addrs)
+		}
+	}
+
+	if len(first) != len(addrs) {
+		t.Fatalf("first relays %v, not spread", first)
+	}
+
+	// sticky first and the one going away last, whatever the shuffle
+	rl.succeeded("c")
+	rl.goaway("a", "")
+	for i := 0; i < 20; i++ {
+		order := rl.order()
+		if order[0] != "c" || order[len(order)-1] != "a" || len(order) != len(addrs) {
+			t.Fatalf("order %v, want c first and a last", order)
+		}
+	}
+}
@@ -0,0 +1,378 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// a minimal prometheus text exposition, counters, gauges and histograms
+// with labels, all registered to the default registry
+
+var (
+	regLock sync.Mutex
+	// in register order
+	registry []metric
+	names    = make(map[string]bool)
+)
+
+// DefBuckets default histogram buckets, in seconds
+var DefBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func register(name string, m metric) {
+	regLock.Lock()
+	defer regLock.Unlock()
+
+	if names[name] {
+		panic("metrics: duplicate metric " + name)
+	}
+
+	names[name] = true
+	registry = append(registry, m)
+}
+
+// series one combination of label values
+type series struct {
+	labels []string
+	value  float64
+	// histogram only
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// vec metric with label names, series are created on first use
+type vec struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+
+	lock   sync.Mutex
+	series map[string]*series
+}
+
+func newVec(name string, help string, typ string, labelNames []string) *vec {
+	return &vec{
+		name:       name,
+		help:       help,
+		typ:        typ,
+		labelNames: labelNames,
+		series:     make(map[string]*series),
+	}
+}
+
+// get the series, must hold the lock
+func (v *vec) get(labelValues []string) *series {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expect %d label values, got %d", v.name, len(v.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: append([]string{}, labelValues...)}
+		v.series[key] = s
+	}
+
+	return s
+}
+
+// sorted series, must hold the lock
+func (v *vec) sorted() []*series {
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	result := make([]*series, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, v.series[k])
+	}
+
+	return result
+}
+
+func (v *vec) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", v.name, escapeHelp(v.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", v.name, v.typ)
+}
+
+func (v *vec) write(w io.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labelNames, s.labels, "", ""), formatValue(s.value))
+	}
+}
+
+// Counter a value that only go up
+type Counter struct {
+	v *vec
+}
+
+// NewCounter create and register counter
+func NewCounter(name string, help string, labelNames ...string) *Counter {
+	c := &Counter{v: newVec(name, help, "counter", labelNames)}
+	register(name, c.v)
+	return c
+}
+
+// Inc add 1
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add add delta, negative delta is ignored
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+
+	c.v.lock.Lock()
+	c.v.get(labelValues).value += delta
+	c.v.lock.Unlock()
+}
+
+// Gauge a value that can go up and down
+type Gauge struct {
+	v *vec
+}
+
+// NewGauge create and register gauge
+func NewGauge(name string, help string, labelNames ...string) *Gauge {
+	g := &Gauge{v: newVec(name, help, "gauge", labelNames)}
+	register(name, g.v)
+	return g
+}
+
+// Set set the value
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.v.lock.Lock()
+	g.v.get(labelValues).value = value
+	g.v.lock.Unlock()
+}
+
+// Add add delta, can be negative
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.v.lock.Lock()
+	g.v.get(labelValues).value += delta
+	g.v.lock.Unlock()
+}
+
+// Inc add 1
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec sub 1
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Histogram count observations in buckets
+type Histogram struct {
+	v       *vec
+	buckets []float64
+}
+
+// NewHistogram create and register histogram, nil buckets means DefBuckets
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+
+	h := &Histogram{
+		v:       newVec(name, help, "histogram", labelNames),
+		buckets: append([]float64{}, buckets...),
+	}
+	sort.Float64s(h.buckets)
+
+	register(name, h)
+	return h
+}
+
+// Observe add an observation
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.v.lock.Lock()
+	defer h.v.lock.Unlock()
+
+	s := h.v.get(labelValues)
+	if s.counts == nil {
+		s.counts = make([]uint64, len(h.buckets))
+	}
+
+	for i, b := range h.buckets {
+		if value <= b {
+			s.counts[i]++
+		}
+	}
+
+	s.sum += value
+	s.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.v.lock.Lock()
+	defer h.v.lock.Unlock()
+
+	h.v.writeHeader(w)
+	for _, s := range h.v.sorted() {
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.v.name, formatLabels(h.v.labelNames, s.labels, "le", formatValue(b)), s.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.v.name, formatLabels(h.v.labelNames, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.v.name, formatLabels(h.v.labelNames, s.labels, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.v.name, formatLabels(h.v.labelNames, s.labels, "", ""), s.count)
+	}
+}
+
+// gaugeFunc gauge that read its value when scraped
+type gaugeFunc struct {
+	v  *vec
+	fn func() float64
+}
+
+// NewGaugeFunc create and register gauge that call fn when scraped
+func NewGaugeFunc(name string, help string, fn func() float64) {
+	register(name, &gaugeFunc{v: newVec(name, help, "gauge", nil), fn: fn})
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	g.v.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", g.v.name, formatValue(g.fn()))
+}
+
+// Sample one series of a counter func
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// counterFunc counter that read its series when scraped, the caller keep
+// the values, so the series go away with the things they count
+type counterFunc struct {
+	v  *vec
+	fn func() []Sample
+}
+
+// NewCounterFunc create and register counter that call fn when scraped
+func NewCounterFunc(name string, help string, fn func() []Sample, labelNames ...string) {
+	register(name, &counterFunc{v: newVec(name, help, "counter", labelNames), fn: fn})
+}
+
+func (c *counterFunc) write(w io.Writer) {
+	samples := c.fn()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].LabelValues, "\xff") < strings.Join(samples[j].LabelValues, "\xff")
+	})
+
+	c.v.writeHeader(w)
+	for _, s := range samples {
+		if len(s.LabelValues) != len(c.v.labelNames) {
+			panic(fmt.Sprintf("metrics: %s expect %d label values, got %d", c.v.name, len(c.v.labelNames), len(s.LabelValues)))
+		}
+
+		fmt.Fprintf(w, "%s%s %s\n", c.v.name, formatLabels(c.v.labelNames, s.LabelValues, "", ""), formatValue(s.Value))
+	}
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// formatLabels {a="1",b="2"}, with an extra label if name is not empty
+func formatLabels(names []string, values []string, extraName string, extraValue string) string {
+	if len(names) == 0 && extraName == "" {
+		return ""
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+
+		sb.WriteString(n)
+		sb.WriteString(`="`)
+		sb.WriteString(escapeLabel(values[i]))
+		sb.WriteByte('"')
+	}
+
+	if extraName != "" {
+		if len(names) > 0 {
+			sb.WriteByte(',')
+		}
+
+		sb.WriteString(extraName)
+		sb.WriteString(`="`)
+		sb.WriteString(extraValue)
+		sb.WriteByte('"')
+	}
+
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// WriteTo write all metrics in text exposition format
+func WriteTo(w io.Writer) {
+	regLock.Lock()
+	metrics := append([]metric{}, registry...)
+	regLock.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// Handler http handler of /metrics
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// ListenAndServe serve /metrics on addr, never return unless failed
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	return http.ListenAndServe(addr, mux)
+}
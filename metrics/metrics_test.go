@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLabelEscape(t *testing.T) {
+	c := &Counter{v: newVec("test_escape_total", "Help with \\ and\nnewline.", "counter", []string{"name"})}
+	c.Add(2, `a\b"c`+"\nd")
+
+	var sb strings.Builder
+	c.v.write(&sb)
+
+	want := "# HELP test_escape_total Help with \\\\ and\\nnewline.\n" +
+		"# TYPE test_escape_total counter\n" +
+		`test_escape_total{name="a\\b\"c\nd"} 2` + "\n"
+	if sb.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", sb.String(), want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := &Histogram{
+		v:       newVec("test_seconds", "Test histogram.", "histogram", []string{"role"}),
+		buckets: []float64{0.1, 1},
+	}
+
+	h.Observe(0.05, "ec")
+	h.Observe(0.5, "ec")
+	h.Observe(5, "ec")
+	h.Observe(1, "es")
+
+	var sb strings.Builder
+	h.write(&sb)
+
+	want := `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{role="ec",le="0.1"} 1
+test_seconds_bucket{role="ec",le="1"} 2
+test_seconds_bucket{role="ec",le="+Inf"} 3
+test_seconds_sum{role="ec"} 5.55
+test_seconds_count{role="ec"} 3
+test_seconds_bucket{role="es",le="0.1"} 0
+test_seconds_bucket{role="es",le="1"} 1
+test_seconds_bucket{role="es",le="+Inf"} 1
+test_seconds_sum{role="es"} 1
+test_seconds_count{role="es"} 1
+`
+	if sb.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", sb.String(), want)
+	}
+}
+
+func TestCounterFunc(t *testing.T) {
+	var samples []Sample
+	c := &counterFunc{
+		v:  newVec("test_bytes_total", "Test counter func.", "counter", []string{"device", "direction"}),
+		fn: func() []Sample { return samples },
+	}
+
+	samples = []Sample{
+		{LabelValues: []string{"dev2", "in"}, Value: 3},
+		{LabelValues: []string{"dev1", "out"}, Value: 2},
+		{LabelValues: []string{"dev1", "in"}, Value: 1},
+	}
+
+	var sb strings.Builder
+	c.write(&sb)
+
+	want := `# HELP test_bytes_total Test counter func.
+# TYPE test_bytes_total counter
+test_bytes_total{device="dev1",direction="in"} 1
+test_bytes_total{device="dev1",direction="out"} 2
+test_bytes_total{device="dev2",direction="in"} 3
+`
+	if sb.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", sb.String(), want)
+	}
+
+	// a device that left has no series
+	samples = []Sample{{LabelValues: []string{"dev2", "in"}, Value: 3}}
+	sb.Reset()
+	c.write(&sb)
+	if strings.Contains(sb.String(), "dev1") {
+		t.Fatalf("series of gone device still written:\n%s", sb.String())
+	}
+}
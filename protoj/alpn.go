@@ -0,0 +1,57 @@
+package protoj
+
+// alpn protocol identifiers
+const (
+	// ALPNLegacy used before versioned alpn, the same as lxquic/1
+	ALPNLegacy = "quic-echo-example"
+	// ALPNv1 json cmd stream
+	ALPNv1 = "lxquic/1"
+	// ALPNv2 server send hello with capabilities after cmd stream header
+	ALPNv2 = "lxquic/2"
+)
+
+// capabilities, a feature is enabled only when both sides support it
+const (
+	// CapEnvelope cmd stream versioned envelope
+	CapEnvelope = "envelope"
+	// CapLinkReply px link stream reply
+	CapLinkReply = "linkreply"
+	// CapLinkHeader ec link streams start with a header, and the server
+	// reply on them instead of notifying on the cmd stream
+	CapLinkHeader = "linkheader"
+	// CapP2P peer-to-peer direct path
+	CapP2P = "p2p"
+	// CapE2E end-to-end encrypted link streams
+	CapE2E = "e2e"
+)
+
+// CmdHello server's first command on lxquic/2 cmd stream
+const CmdHello = "hello"
+
+// NextProtos alpn list in preference order
+func NextProtos() []string {
+	return []string{ALPNv2, ALPNv1, ALPNLegacy}
+}
+
+// HasCap if the capability is in list
+func HasCap(caps []string, c string) bool {
+	for _, v := range caps {
+		if v == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IntersectCaps capabilities in both lists, keep the order of a
+func IntersectCaps(a []string, b []string) []string {
+	var result []string
+	for _, v := range a {
+		if HasCap(b, v) {
+			result = append(result, v)
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,21 @@
+package protoj
+
+// RoleRelay cmd stream role of a peer relay in the cluster, Token of the
+// header is the cluster secret
+const RoleRelay = "relay"
+
+// CmdLocate relay ask peer relay if the device is connected to it,
+// args is LocateArgs, result is LocateResult
+const CmdLocate = "locate"
+
+// LocateArgs device to locate
+type LocateArgs struct {
+	DUID string `json:"duid"`
+}
+
+// LocateResult whether the device is connected to the relay
+type LocateResult struct {
+	Found bool `json:"found"`
+	// cluster address of the relay
+	Relay string `json:"relay,omitempty"`
+}
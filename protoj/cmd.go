@@ -0,0 +1,301 @@
+package protoj
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cmd stream protocol versions
+const (
+	// CmdVersionJSON 2 bytes length and json, the original framing
+	CmdVersionJSON = 1
+	// CmdVersionEnvelope versioned binary envelope, tlv payload
+	CmdVersionEnvelope = 2
+	// CmdVersion the highest version supported
+	CmdVersion = CmdVersionEnvelope
+)
+
+// envelope message types, unknown types are decoded by the cmd in payload
+const (
+	MsgCmd     = 0
+	MsgPing    = 1
+	MsgPong    = 2
+	MsgLinkErr = 3
+	MsgDenied  = 4
+	MsgPunch   = 5
+	// link stream messages, see WriteLinkHeader
+	MsgLinkHeader = 6
+	MsgLinkReply  = 7
+	MsgHello      = 8
+	MsgGoaway     = 9
+)
+
+const (
+	// version(1) | type(1) | request id(4) | payload length(4)
+	envelopeHeaderLen = 10
+	// MaxMsgSize max payload of an envelope
+	MaxMsgSize = 1024 * 1024
+)
+
+var (
+	msgTypes = map[string]uint8{
+		"ping":     MsgPing,
+		"pong":     MsgPong,
+		CmdLinkErr: MsgLinkErr,
+		CmdDenied:  MsgDenied,
+		CmdPunch:   MsgPunch,
+		CmdHello:   MsgHello,
+		CmdGoaway:  MsgGoaway,
+	}
+
+	msgCmds = map[uint8]string{
+		MsgPing:    "ping",
+		MsgPong:    "pong",
+		MsgLinkErr: CmdLinkErr,
+		MsgDenied:  CmdDenied,
+		MsgPunch:   CmdPunch,
+		MsgHello:   CmdHello,
+		MsgGoaway:  CmdGoaway,
+	}
+)
+
+// CmdCodec read and write StreamCmd on cmd stream.
+//
+// version is negotiated per direction: a writer that switch to the envelope
+// send a json frame of zero length followed by the version byte, a reader
+// switch when it see that marker, and upgrade its writer too. old peers
+// never send the marker, so they keep talking json
+type CmdCodec struct {
+	rw io.ReadWriter
+
+	wlock        sync.Mutex
+	writeVersion uint8
+	// read by one goroutine only
+	readVersion uint8
+	// messages skipped since they can not be decoded
+	decodeErrors uint64
+}
+
+// NewCmdCodec create a codec in json framing
+func NewCmdCodec(rw io.ReadWriter) *CmdCodec {
+	c := &CmdCodec{
+		rw:           rw,
+		writeVersion: CmdVersionJSON,
+		readVersion:  CmdVersionJSON,
+	}
+
+	return c
+}
+
+// Upgrade switch writer to the envelope, the peer should have
+// declared it support the envelope
+func (c *CmdCodec) Upgrade() error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	return c.upgradeLocked(CmdVersion)
+}
+
+func (c *CmdCodec) upgradeLocked(version uint8) error {
+	if c.writeVersion >= version {
+		return nil
+	}
+
+	_, err := c.rw.Write([]byte{0, 0, version})
+	if err != nil {
+		return err
+	}
+
+	c.writeVersion = version
+	return nil
+}
+
+// Version the version of read direction
+func (c *CmdCodec) Version() uint8 {
+	return c.readVersion
+}
+
+// Envelope if the writer has switched to the envelope
+func (c *CmdCodec) Envelope() bool {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	return c.writeVersion >= CmdVersionEnvelope
+}
+
+// SendCmd send the command, with request id 0
+func (c *CmdCodec) SendCmd(cmd *StreamCmd) error {
+	return c.Send(cmd, 0)
+}
+
+// Send send the command with request id, request id is dropped
+// if the writer is still in json framing
+func (c *CmdCodec) Send(cmd *StreamCmd, reqID uint32) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	if c.writeVersion == CmdVersionJSON {
+		return StreamSendJSON(c.rw, cmd)
+	}
+
+	typ := msgTypes[cmd.Cmd]
+	buf, err := appendEnvelope(nil, c.writeVersion, typ, reqID, encodeCmd(cmd, typ))
+	if err != nil {
+		return err
+	}
+
+	_, err = c.rw.Write(buf)
+	return err
+}
+
+// appendEnvelope append header and payload of an envelope to buf
+func appendEnvelope(buf []byte, version uint8, typ uint8, reqID uint32, payload []byte) ([]byte, error) {
+	if len(payload) > MaxMsgSize {
+		return nil, fmt.Errorf("envelope payload too large:%d", len(payload))
+	}
+
+	var hdr [envelopeHeaderLen]byte
+	hdr[0] = version
+	hdr[1] = typ
+	binary.BigEndian.PutUint32(hdr[2:6], reqID)
+	binary.BigEndian.PutUint32(hdr[6:10], uint32(len(payload)))
+
+	buf = append(buf, hdr[:]...)
+	return append(buf, payload...), nil
+}
+
+// DecodeErrors number of messages skipped by ReadCmd
+func (c *CmdCodec) DecodeErrors() uint64 {
+	return atomic.LoadUint64(&c.decodeErrors)
+}
+
+// ReadCmd read next command and its request id, version markers are
+// consumed silently, and messages that can not be decoded are logged and
+// skipped since the framing is still intact, not safe for concurrent use
+func (c *CmdCodec) ReadCmd() (*StreamCmd, uint32, error) {
+	for {
+		if c.readVersion == CmdVersionJSON {
+			message, err := StreamReadJSON(c.rw)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			if len(message) > 0 {
+				var cmd = &StreamCmd{}
+				err = json.Unmarshal(message, cmd)
+				if err != nil {
+					c.onDecodeError(MsgCmd, err)
+					continue
+				}
+
+				return cmd, 0, nil
+			}
+
+			err = c.onMarker()
+			if err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+
+		var hdr [envelopeHeaderLen]byte
+		_, err := io.ReadFull(c.rw, hdr[:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		version, typ, reqID, n, err := ParseEnvelopeHeader(hdr[:])
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if version != c.readVersion {
+			return nil, 0, fmt.Errorf("cmd envelope version %d, expect %d", version, c.readVersion)
+		}
+
+		payload := make([]byte, n)
+		_, err = io.ReadFull(c.rw, payload)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		cmd, err := DecodeCmd(typ, payload)
+		if err != nil {
+			c.onDecodeError(typ, err)
+			continue
+		}
+
+		return cmd, reqID, nil
+	}
+}
+
+func (c *CmdCodec) onDecodeError(typ uint8, err error) {
+	n := atomic.AddUint64(&c.decodeErrors, 1)
+	log.Printf("CmdCodec skip message type %d, version %d, decode failed:%v, %d skipped",
+		typ, c.readVersion, err, n)
+}
+
+// onMarker a zero length json frame, the version byte follows
+func (c *CmdCodec) onMarker() error {
+	var vb [1]byte
+	_, err := io.ReadFull(c.rw, vb[:])
+	if err != nil {
+		return err
+	}
+
+	version := vb[0]
+	if version <= CmdVersionJSON || version > CmdVersion {
+		return fmt.Errorf("cmd stream unsupported version:%d", version)
+	}
+
+	c.readVersion = version
+
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+
+	return c.upgradeLocked(version)
+}
+
+// ParseEnvelopeHeader parse and check the envelope header
+func ParseEnvelopeHeader(hdr []byte) (version uint8, typ uint8, reqID uint32, n uint32, err error) {
+	if len(hdr) < envelopeHeaderLen {
+		return 0, 0, 0, 0, fmt.Errorf("cmd envelope header too short:%d", len(hdr))
+	}
+
+	version = hdr[0]
+	typ = hdr[1]
+	reqID = binary.BigEndian.Uint32(hdr[2:6])
+	n = binary.BigEndian.Uint32(hdr[6:10])
+
+	if version <= CmdVersionJSON || version > CmdVersion {
+		return 0, 0, 0, 0, fmt.Errorf("cmd envelope unsupported version:%d", version)
+	}
+
+	if n > MaxMsgSize {
+		return 0, 0, 0, 0, fmt.Errorf("cmd envelope payload too large:%d", n)
+	}
+
+	return version, typ, reqID, n, nil
+}
+
+// DecodeCmd decode envelope payload to command, the type fill the cmd
+// if the payload does not carry one
+func DecodeCmd(typ uint8, payload []byte) (*StreamCmd, error) {
+	var cmd = &StreamCmd{}
+	err := decodeCmdFields(payload, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if cmd.Cmd == "" {
+		cmd.Cmd = msgCmds[typ]
+	}
+
+	return cmd, nil
+}
@@ -0,0 +1,203 @@
+//go:build go1.18
+// +build go1.18
+
+package protoj
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+)
+
+// jsonFrame a json frame of the original framing
+func jsonFrame(payload string) []byte {
+	b := make([]byte, 2+len(payload))
+	binary.LittleEndian.PutUint16(b, uint16(len(payload)))
+	copy(b[2:], payload)
+	return b
+}
+
+// envelope an envelope of the payload, n is the declared length
+func envelope(version uint8, typ uint8, reqID uint32, n uint32, payload string) []byte {
+	b := make([]byte, envelopeHeaderLen+len(payload))
+	b[0] = version
+	b[1] = typ
+	binary.BigEndian.PutUint32(b[2:6], reqID)
+	binary.BigEndian.PutUint32(b[6:10], n)
+	copy(b[envelopeHeaderLen:], payload)
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+// payload of the cmd as Send encode it
+func payload(cmd *StreamCmd, typ uint8) string {
+	return string(encodeCmd(cmd, typ))
+}
+
+func cmdSeeds() [][]byte {
+	marker := []byte{0, 0, CmdVersionEnvelope}
+	ping := payload(&StreamCmd{Cmd: "ping", Seq: 1, Time: 2}, MsgPing)
+	punch := payload(&StreamCmd{Cmd: CmdPunch, Addrs: []string{"1.2.3.4:5"}, Token: "t"}, MsgPunch)
+	status := payload(&StreamCmd{Cmd: "status", Reason: "r"}, MsgCmd)
+	hello := payload(&StreamCmd{Cmd: CmdHello, Caps: []string{CapEnvelope, CapP2P}}, MsgCmd)
+	goaway := payload(&StreamCmd{Cmd: CmdGoaway, Relay: "1.2.3.4:5"}, MsgGoaway)
+	return [][]byte{
+		// json frames
+		jsonFrame(`{"cmd":"ping","seq":1,"time":2}`),
+		jsonFrame(`{"cmd":"punch","addrs":["1.2.3.4:5"],"token":"t"}`),
+		jsonFrame(`{"cmd":`),
+		jsonFrame(`[]`),
+		// upgrade marker, then envelopes
+		marker,
+		concat(marker, envelope(CmdVersionEnvelope, MsgPing, 7, uint32(len(ping)), ping)),
+		concat(marker, envelope(CmdVersionEnvelope, MsgPunch, 1, uint32(len(punch)), punch)),
+		concat(marker, envelope(CmdVersionEnvelope, MsgCmd, 0, uint32(len(status)), status)),
+		concat(marker, envelope(CmdVersionEnvelope, MsgCmd, 1, uint32(len(hello)), hello)),
+		concat(marker, envelope(CmdVersionEnvelope, MsgGoaway, 0, uint32(len(goaway)), goaway)),
+		concat(jsonFrame(`{"cmd":"ping"}`), marker, envelope(CmdVersionEnvelope, MsgPong, 3, 0, ``)),
+		// unknown tag, truncated field, bad varint
+		concat(marker, envelope(CmdVersionEnvelope, MsgCmd, 0, 3, "\x63\x01x")),
+		concat(marker, envelope(CmdVersionEnvelope, MsgCmd, 0, 3, "\x01\x05x")),
+		concat(marker, envelope(CmdVersionEnvelope, MsgPing, 0, 4, "\x0a\x02\xff\xff")),
+		// unsupported versions
+		{0, 0, CmdVersionJSON},
+		{0, 0, 0xff},
+		concat(marker, envelope(CmdVersionEnvelope+1, MsgPing, 0, 0, ``)),
+		// oversized lengths
+		concat(marker, envelope(CmdVersionEnvelope, MsgCmd, 0, MaxMsgSize+1, ``)),
+		concat(marker, envelope(CmdVersionEnvelope, MsgCmd, 0, 0xffffffff, ``)),
+		{0xff, 0xff},
+		// truncated headers and payloads
+		concat(marker, envelope(CmdVersionEnvelope, MsgPing, 0, 2, ``)[:5]),
+		concat(marker, envelope(CmdVersionEnvelope, MsgPing, 0, 100, ping)),
+		{0},
+		{0, 0},
+		{},
+	}
+}
+
+func FuzzParseEnvelopeHeader(f *testing.F) {
+	for _, seed := range cmdSeeds() {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, hdr []byte) {
+		version, _, _, n, err := ParseEnvelopeHeader(hdr)
+		if err != nil {
+			return
+		}
+
+		if len(hdr) < envelopeHeaderLen {
+			t.Fatalf("short header %d accepted", len(hdr))
+		}
+
+		if version <= CmdVersionJSON || version > CmdVersion {
+			t.Fatalf("version %d accepted", version)
+		}
+
+		if n > MaxMsgSize {
+			t.Fatalf("length %d accepted", n)
+		}
+	})
+}
+
+// rwBuffer read from the input, writes are discarded
+type rwBuffer struct {
+	io.Reader
+}
+
+func (rwBuffer) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func FuzzReadCmd(f *testing.F) {
+	for _, seed := range cmdSeeds() {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		codec := NewCmdCodec(rwBuffer{bytes.NewReader(data)})
+		for i := 0; i < len(data)+1; i++ {
+			cmd, _, err := codec.ReadCmd()
+			if err != nil {
+				return
+			}
+
+			if cmd == nil {
+				t.Fatal("nil cmd without error")
+			}
+
+			// what was read can be sent again
+			err = codec.Send(cmd, 0)
+			if err != nil {
+				t.Fatalf("send decoded cmd failed:%v", err)
+			}
+		}
+
+		t.Fatal("ReadCmd does not stop at the end of input")
+	})
+}
+
+func FuzzDecodeCmd(f *testing.F) {
+	f.Add(uint8(MsgPing), []byte(payload(&StreamCmd{Cmd: "ping", Seq: 1, Time: -2}, MsgPing)))
+	f.Add(uint8(MsgCmd), []byte(payload(&StreamCmd{Cmd: CmdPunch, Addrs: []string{"", "a"}, Port: 22}, MsgCmd)))
+	f.Add(uint8(MsgCmd), []byte(payload(&StreamCmd{Cmd: "x", Data: []byte(`{}`), Error: "e"}, MsgCmd)))
+	f.Add(uint8(MsgCmd), []byte("\x02\x0a\x80\x80\x80\x80\x80\x80\x80\x80\x80\x01"))
+
+	f.Fuzz(func(t *testing.T, typ uint8, data []byte) {
+		cmd, err := DecodeCmd(typ, data)
+		if err != nil {
+			return
+		}
+
+		// encoding is stable once decoded
+		first := encodeCmd(cmd, MsgCmd)
+		again, err := DecodeCmd(MsgCmd, first)
+		if err != nil {
+			t.Fatalf("decode encoded cmd %+v failed:%v", cmd, err)
+		}
+
+		if !bytes.Equal(first, encodeCmd(again, MsgCmd)) {
+			t.Fatalf("cmd %+v changed to %+v", cmd, again)
+		}
+	})
+}
+
+func FuzzReadLinkHeader(f *testing.F) {
+	h := &LinkStreamHeader{Port: 22, Host: "h", DUID: "d", Reply: true, E2E: true, Role: "ec"}
+	var env bytes.Buffer
+	WriteLinkHeader(&env, h, CmdVersionEnvelope)
+
+	f.Add(env.Bytes())
+	f.Add(jsonFrame(`{"port":22,"duid":"d","reply":true}`))
+	f.Add([]byte{0, 0, CmdVersionEnvelope})
+	f.Add(concat([]byte{0, 0, CmdVersionEnvelope}, envelope(CmdVersionEnvelope, MsgLinkReply, 0, 0, ``)))
+	f.Add(concat([]byte{0, 0, CmdVersionJSON}, envelope(CmdVersionEnvelope, MsgLinkHeader, 0, 0, ``)))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h, err := ReadLinkHeader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		// what was read can be sent again in its version
+		var buf bytes.Buffer
+		err = WriteLinkHeader(&buf, h, h.Version())
+		if err != nil {
+			t.Fatalf("write header %+v failed:%v", h, err)
+		}
+
+		again, err := ReadLinkHeader(&buf)
+		if err != nil {
+			t.Fatalf("read written header %+v failed:%v", h, err)
+		}
+
+		if *again != *h {
+			t.Fatalf("header %+v changed to %+v", h, again)
+		}
+	})
+}
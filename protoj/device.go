@@ -0,0 +1,60 @@
+package protoj
+
+import "time"
+
+// CmdList ec or px list online devices, args is ListFilter,
+// result is []DeviceInfo
+const CmdList = "list"
+
+// ListFilter filter of device list, empty fields match all
+type ListFilter struct {
+	// device has the tag
+	Tag string `json:"tag,omitempty"`
+	// glob pattern of device id
+	Pattern string `json:"pattern,omitempty"`
+	// label selector, e.g. env=prod,region!=eu,gpu
+	Selector string `json:"selector,omitempty"`
+}
+
+// DeviceInfo online device
+type DeviceInfo struct {
+	DUID  string      `json:"duid"`
+	Tags  []string    `json:"tags,omitempty"`
+	Agent string      `json:"agent,omitempty"`
+	Meta  *DeviceMeta `json:"meta,omitempty"`
+	// labels assigned on server, that label selectors match
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// registered at
+	Since      time.Time `json:"since"`
+	RemoteAddr string    `json:"remote"`
+	// cmd stream round trip time in milliseconds, 0 if unknown
+	RTT int64 `json:"rtt"`
+	// keepalive measured rtt, jitter and loss
+	Health *LinkHealth `json:"health,omitempty"`
+
+	P2P bool `json:"p2p,omitempty"`
+	E2E bool `json:"e2e,omitempty"`
+}
+
+// DeviceMeta metadata that es report on registration
+type DeviceMeta struct {
+	Hostname string `json:"hostname,omitempty"`
+	OS       string `json:"os,omitempty"`
+	Arch     string `json:"arch,omitempty"`
+	Agent    string `json:"agent,omitempty"`
+	// local addresses, loopback excluded
+	IPs []string `json:"ips,omitempty"`
+	// user defined labels, listed only, acl and routing use the labels
+	// assigned on server
+	Labels map[string]string `json:"labels,omitempty"`
+	// services exposed by the device
+	Services []Service `json:"services,omitempty"`
+}
+
+// Service a service exposed by device
+type Service struct {
+	Name  string `json:"name"`
+	Port  int    `json:"port"`
+	Proto string `json:"proto,omitempty"`
+}
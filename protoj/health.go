@@ -0,0 +1,139 @@
+package protoj
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// recent pings that loss is computed over
+	lossWindow = 20
+)
+
+// LinkHealth session health measured by keepalive pings, times are
+// in milliseconds
+type LinkHealth struct {
+	// smoothed round trip time, 0 if unknown
+	RTT float64 `json:"rtt"`
+	// round trip time of the last answered ping
+	LastRTT float64 `json:"last_rtt"`
+	// mean deviation between consecutive round trip times
+	Jitter float64 `json:"jitter"`
+	// ratio of recent pings not answered before the next ping, 0 to 1
+	Loss float64 `json:"loss"`
+
+	Sent uint64 `json:"sent"`
+	Lost uint64 `json:"lost"`
+}
+
+func (h LinkHealth) String() string {
+	return fmt.Sprintf("rtt:%.1fms, jitter:%.1fms, loss:%.0f%%, sent:%d, lost:%d",
+		h.RTT, h.Jitter, h.Loss*100, h.Sent, h.Lost)
+}
+
+// healthStats the state behind LinkHealth, not thread safe
+type healthStats struct {
+	srtt    time.Duration
+	lastRTT time.Duration
+	jitter  time.Duration
+
+	// ring of recent pings, true if lost
+	window [lossWindow]bool
+	pos    int
+	n      int
+
+	sent uint64
+	lost uint64
+
+	// last reported, for change detection
+	reported     LinkHealth
+	reportedLost int
+	hasReport    bool
+}
+
+// observe an answered ping, srtt as tcp, jitter as rtp
+func (hs *healthStats) observe(rtt time.Duration) {
+	if hs.srtt == 0 {
+		hs.srtt = rtt
+	} else {
+		hs.srtt = (7*hs.srtt + rtt) / 8
+
+		d := rtt - hs.lastRTT
+		if d < 0 {
+			d = -d
+		}
+		hs.jitter += (d - hs.jitter) / 16
+	}
+
+	hs.lastRTT = rtt
+	hs.record(false)
+}
+
+// record the outcome of a ping
+func (hs *healthStats) record(lost bool) {
+	hs.window[hs.pos] = lost
+	hs.pos = (hs.pos + 1) % lossWindow
+	if hs.n < lossWindow {
+		hs.n++
+	}
+
+	hs.sent++
+	if lost {
+		hs.lost++
+	}
+}
+
+// windowLost lost pings in the window
+func (hs *healthStats) windowLost() int {
+	var lost int
+	for i := 0; i < hs.n; i++ {
+		if hs.window[i] {
+			lost++
+		}
+	}
+
+	return lost
+}
+
+func (hs *healthStats) snapshot() LinkHealth {
+	lost := hs.windowLost()
+	h := LinkHealth{
+		RTT:     durationMS(hs.srtt),
+		LastRTT: durationMS(hs.lastRTT),
+		Jitter:  durationMS(hs.jitter),
+		Sent:    hs.sent,
+		Lost:    hs.lost,
+	}
+
+	if hs.n > 0 {
+		h.Loss = float64(lost) / float64(hs.n)
+	}
+
+	return h
+}
+
+// changed if rtt moved by a quarter and 5ms, or lost pings in the
+// window changed, since the last report, and mark it reported
+func (hs *healthStats) changed() (LinkHealth, bool) {
+	h := hs.snapshot()
+	if h.Sent == 0 {
+		return h, false
+	}
+
+	last := hs.reported
+	lost := hs.windowLost()
+	moved := h.RTT-last.RTT > 5 && h.RTT > last.RTT*1.25 ||
+		last.RTT-h.RTT > 5 && h.RTT < last.RTT*0.75
+	if hs.hasReport && !moved && lost == hs.reportedLost {
+		return h, false
+	}
+
+	hs.reported = h
+	hs.reportedLost = lost
+	hs.hasReport = true
+	return h, true
+}
+
+func durationMS(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -3,16 +3,69 @@ package protoj
 import (
 	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net"
-
-	quic "github.com/lucas-clemente/quic-go"
 )
 
 // LinkStreamHeader link stream first packet
 type LinkStreamHeader struct {
 	Port int    `json:"port"`
 	Host string `json:"host,omitempty"`
+	// DUID px link stream only, use the device as exit node
+	DUID string `json:"duid,omitempty"`
+	// Reply ask the dialing side to send a LinkStreamReply
+	Reply bool `json:"reply,omitempty"`
+	// E2E link payload is end-to-end encrypted, handshake follows the reply
+	E2E bool `json:"e2e,omitempty"`
+	// Role relay forwarded link stream only, the role of the origin client,
+	// DUID is the target device
+	Role string `json:"role,omitempty"`
+
+	// version the header was read in, 0 if built locally
+	version uint8
+}
+
+// Version version the header was read in, the reply should be written in,
+// json for headers not read by ReadLinkHeader
+func (h *LinkStreamHeader) Version() uint8 {
+	if h.version == 0 {
+		return CmdVersionJSON
+	}
+
+	return h.version
+}
+
+// link stream reply code
+const (
+	// LinkReplyOK target connected
+	LinkReplyOK = 0
+	// LinkReplyRefused target refused by policy
+	LinkReplyRefused = 1
+	// LinkReplyDialFailed connect to target failed
+	LinkReplyDialFailed = 2
+	// LinkReplyNoDevice target device not online
+	LinkReplyNoDevice = 3
+	// LinkReplyDenied client not allowed to the device by server acl
+	LinkReplyDenied = 4
+)
+
+// LinkStreamReply link stream reply, send by the dialing side
+// before any data if the header ask for it
+type LinkStreamReply struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// DevicePolicy targets that a device allow to dial,
+// advertised to server on registration
+type DevicePolicy struct {
+	// allowed local ports, empty means none unless AllPorts
+	Ports []int `json:"ports,omitempty"`
+	// all local ports allowed, devices before it allow all if Ports empty
+	AllPorts bool `json:"all_ports,omitempty"`
+	// allowed lan targets, host[:port] or CIDR[:port]
+	Targets []string `json:"targets,omitempty"`
 }
 
 // CmdStreamHeader cmd stream first packet
@@ -20,15 +73,84 @@ type CmdStreamHeader struct {
 	Role string `json:"role"`
 	DUID string `json:"duid"`
 	Port int    `json:"port,omitempty"`
+
+	// es only, the device dial policy
+	Policy *DevicePolicy `json:"policy,omitempty"`
+
+	// support peer-to-peer direct path
+	P2P bool `json:"p2p,omitempty"`
+	// es only, local udp addresses as direct path candidates
+	Addrs []string `json:"addrs,omitempty"`
+
+	// es only, base64 e2e static public key, empty means e2e not supported
+	PubKey string `json:"pubkey,omitempty"`
+	// ec only, link streams are end-to-end encrypted
+	E2E bool `json:"e2e,omitempty"`
+
+	// highest cmd stream version supported, 0 means json only
+	Version int `json:"ver,omitempty"`
+	// capabilities of client, lxquic/2 only
+	Caps []string `json:"caps,omitempty"`
+
+	// es only, tags for discovery
+	Tags []string `json:"tags,omitempty"`
+	// es only, not listed to ec, px can still see it
+	Hidden bool `json:"hidden,omitempty"`
+	// es only, device metadata
+	Meta *DeviceMeta `json:"meta,omitempty"`
+
+	// relay only, cluster address of the dialing relay
+	Relay string `json:"relay,omitempty"`
+	// relay only, the cluster secret
+	Token string `json:"token,omitempty"`
 }
 
+// commands that server notify client
+const (
+	// CmdLinkErr a link stream failed, Code is the link reply code
+	CmdLinkErr = "linkerr"
+	// CmdDenied registration refused, session will be closed
+	CmdDenied = "denied"
+	// CmdPunch ec request hole punching, server tell ec and es the
+	// peer's addresses and the token, non-zero Code means unavailable
+	CmdPunch = "punch"
+	// CmdGoaway server is draining, reconnect now, to Relay if not empty,
+	// link streams already open keep going until the grace period end
+	CmdGoaway = "goaway"
+)
+
 // StreamCmd command
 type StreamCmd struct {
 	Cmd string `json:"cmd"`
+
+	Code   int    `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// punch only, peer's addresses and the token for direct session
+	Addrs []string `json:"addrs,omitempty"`
+	Token string   `json:"token,omitempty"`
+	// punch to es only, the device port that the token allow
+	Port int `json:"port,omitempty"`
+
+	// goaway only, alternate relay address to reconnect
+	Relay string `json:"relay,omitempty"`
+
+	// hello only, capabilities enabled for the session
+	Caps []string `json:"caps,omitempty"`
+
+	// ping and pong only, pong echo the sequence and send time of ping,
+	// unix nanoseconds
+	Seq  uint32 `json:"seq,omitempty"`
+	Time int64  `json:"time,omitempty"`
+
+	// rpc only, method specific arguments or result
+	Data json.RawMessage `json:"data,omitempty"`
+	// rpc response only, why the call failed
+	Error string `json:"error,omitempty"`
 }
 
 // StreamReadJSON read json buffer
-func StreamReadJSON(stream quic.Stream) ([]byte, error) {
+func StreamReadJSON(stream io.Reader) ([]byte, error) {
 	var lenb [2]byte
 	_, err := io.ReadFull(stream, lenb[0:])
 	if err != nil {
@@ -46,27 +168,28 @@ func StreamReadJSON(stream quic.Stream) ([]byte, error) {
 }
 
 // StreamSendJSON send json object
-func StreamSendJSON(stream quic.Stream, j interface{}) error {
+func StreamSendJSON(stream io.Writer, j interface{}) error {
 	message, err := json.Marshal(j)
 	if err != nil {
 		return err
 	}
 
-	var lenb [2]byte
-	binary.LittleEndian.PutUint16(lenb[0:], uint16(len(message)))
+	return writeJSONFrame(stream, message)
+}
 
-	// register via cmd stream
-	_, err = stream.Write(lenb[0:2])
-	if err != nil {
-		return err
+// writeJSONFrame write length and message at once, the length is
+// uint16, refuse larger message instead of truncating it
+func writeJSONFrame(w io.Writer, message []byte) error {
+	if len(message) > 0xffff {
+		return fmt.Errorf("json message too large:%d", len(message))
 	}
 
-	_, err = stream.Write(message)
-	if err != nil {
-		return err
-	}
+	var buf = make([]byte, 2+len(message))
+	binary.LittleEndian.PutUint16(buf[0:], uint16(len(message)))
+	copy(buf[2:], message)
 
-	return nil
+	_, err := w.Write(buf)
+	return err
 }
 
 // WriteAll a function that ensure all bytes write out
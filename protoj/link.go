@@ -0,0 +1,133 @@
+package protoj
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// link stream header and reply are sent in json framing, or in the
+// envelope after the same upgrade marker as the cmd stream. readers accept
+// both, writers use the envelope only if the peer negotiated it, and a
+// reply is written in the version its header came in
+
+// LinkVersion version of link messages to a peer with the capabilities
+func LinkVersion(caps []string) uint8 {
+	if HasCap(caps, CapEnvelope) {
+		return CmdVersionEnvelope
+	}
+
+	return CmdVersionJSON
+}
+
+// WriteLinkHeader send the link stream header in the version
+func WriteLinkHeader(w io.Writer, h *LinkStreamHeader, version uint8) error {
+	if version < CmdVersionEnvelope {
+		return StreamSendJSON(w, h)
+	}
+
+	return writeLinkMsg(w, version, MsgLinkHeader, encodeLinkHeader(h))
+}
+
+// ReadLinkHeader read the link stream header in either version, the
+// version is kept in the header for the reply
+func ReadLinkHeader(r io.Reader) (*LinkStreamHeader, error) {
+	payload, version, err := readLinkMsg(r, MsgLinkHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	var h = &LinkStreamHeader{version: version}
+	if version == CmdVersionJSON {
+		err = json.Unmarshal(payload, h)
+	} else {
+		err = decodeLinkHeader(payload, h)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// WriteLinkReply send the link stream reply in the version
+func WriteLinkReply(w io.Writer, reply *LinkStreamReply, version uint8) error {
+	if version < CmdVersionEnvelope {
+		return StreamSendJSON(w, reply)
+	}
+
+	return writeLinkMsg(w, version, MsgLinkReply, encodeLinkReply(reply))
+}
+
+// ReadLinkReply read the link stream reply in either version
+func ReadLinkReply(r io.Reader) (*LinkStreamReply, error) {
+	payload, version, err := readLinkMsg(r, MsgLinkReply)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply = &LinkStreamReply{}
+	if version == CmdVersionJSON {
+		err = json.Unmarshal(payload, reply)
+	} else {
+		err = decodeLinkReply(payload, reply)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// writeLinkMsg write marker and envelope at once
+func writeLinkMsg(w io.Writer, version uint8, typ uint8, payload []byte) error {
+	buf, err := appendEnvelope([]byte{0, 0, version}, version, typ, 0, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf)
+	return err
+}
+
+// readLinkMsg read a json frame, or a marker and an envelope of the type,
+// return the payload and its version
+func readLinkMsg(r io.Reader, typ uint8) ([]byte, uint8, error) {
+	message, err := StreamReadJSON(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(message) > 0 {
+		return message, CmdVersionJSON, nil
+	}
+
+	var buf [1 + envelopeHeaderLen]byte
+	_, err = io.ReadFull(r, buf[:])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	version, t, _, n, err := ParseEnvelopeHeader(buf[1:])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if version != buf[0] {
+		return nil, 0, fmt.Errorf("link envelope version %d, marker %d", version, buf[0])
+	}
+
+	if t != typ {
+		return nil, 0, fmt.Errorf("link envelope type %d, expect %d", t, typ)
+	}
+
+	payload := make([]byte, n)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return payload, version, nil
+}
@@ -0,0 +1,145 @@
+package protoj
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestCmdEnvelopeRoundTrip(t *testing.T) {
+	var cmds = []*StreamCmd{
+		{Cmd: "ping", Seq: 7, Time: 1600000000000000000},
+		{Cmd: CmdPunch, Code: 2, Addrs: []string{"1.2.3.4:5", "[::1]:6"}, Token: "t", Port: 22},
+		{Cmd: CmdDenied, Reason: "bad token"},
+		{Cmd: CmdHello, Caps: []string{CapEnvelope, CapLinkReply}},
+		{Cmd: CmdGoaway, Reason: "draining", Relay: "relay2:443"},
+		{Cmd: "list", Data: json.RawMessage(`{"tag":"lab"}`), Error: "failed"},
+		{Cmd: "status", Code: 1600000000, Reason: "ok"},
+		{Cmd: CmdLinkErr, Code: -1},
+	}
+
+	var buf bytes.Buffer
+	codec := NewCmdCodec(&buf)
+	err := codec.Upgrade()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, cmd := range cmds {
+		err = codec.Send(cmd, uint32(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// no json in the envelope
+	if bytes.Contains(buf.Bytes(), []byte(`"cmd"`)) {
+		t.Fatalf("envelope carry json:%q", buf.Bytes())
+	}
+
+	for i, want := range cmds {
+		cmd, reqID, err := codec.ReadCmd()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reqID != uint32(i) || !reflect.DeepEqual(cmd, want) {
+			t.Errorf("read %d %+v, want %d %+v", reqID, cmd, i, want)
+		}
+	}
+}
+
+func TestDecodeCmdSkipUnknown(t *testing.T) {
+	// a field from a later version, then a known one
+	payload := append([]byte{0x63, 2, 'x', 'y'}, encodeCmd(&StreamCmd{Reason: "r"}, MsgGoaway)...)
+	cmd, err := DecodeCmd(MsgGoaway, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Cmd != CmdGoaway || cmd.Reason != "r" {
+		t.Fatalf("decoded %+v", cmd)
+	}
+
+	for _, bad := range [][]byte{
+		{cmdTagReason, 5, 'x'},
+		{cmdTagSeq, 0},
+		{cmdTagSeq, 5, 0xff, 0xff, 0xff, 0xff, 0x7f},
+		{cmdTagCmd, 0x80},
+	} {
+		_, err = DecodeCmd(MsgCmd, bad)
+		if err == nil {
+			t.Errorf("payload % x decoded", bad)
+		}
+	}
+}
+
+func TestLinkHeaderVersions(t *testing.T) {
+	h := &LinkStreamHeader{Port: 22, Host: "10.0.0.1", DUID: "dev1", Reply: true, E2E: true, Role: "px"}
+
+	for _, version := range []uint8{CmdVersionJSON, CmdVersionEnvelope} {
+		var buf bytes.Buffer
+		err := WriteLinkHeader(&buf, h, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := ReadLinkHeader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got.Version() != version {
+			t.Errorf("header read in version %d, want %d", got.Version(), version)
+		}
+
+		got.version = 0
+		if *got != *h {
+			t.Errorf("version %d header %+v, want %+v", version, got, h)
+		}
+
+		// the reply follow the header's version
+		err = WriteLinkReply(&buf, &LinkStreamReply{Code: LinkReplyDenied, Reason: "acl"}, version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply, err := ReadLinkReply(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if reply.Code != LinkReplyDenied || reply.Reason != "acl" {
+			t.Errorf("version %d reply %+v", version, reply)
+		}
+	}
+}
+
+func TestLinkJSONCompat(t *testing.T) {
+	// peers before the envelope read a plain json frame
+	var buf bytes.Buffer
+	err := WriteLinkReply(&buf, &LinkStreamReply{Code: LinkReplyNoDevice}, CmdVersionJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := StreamReadJSON(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reply = &LinkStreamReply{}
+	err = json.Unmarshal(message, reply)
+	if err != nil || reply.Code != LinkReplyNoDevice {
+		t.Fatalf("json reply %s, err:%v", message, err)
+	}
+
+	// a header where the reply is expected is refused
+	buf.Reset()
+	WriteLinkHeader(&buf, &LinkStreamHeader{Port: 22}, CmdVersionEnvelope)
+	_, err = ReadLinkReply(&buf)
+	if err == nil {
+		t.Fatal("link header read as reply")
+	}
+}
@@ -0,0 +1,395 @@
+package protoj
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// response carry the request id with this bit set, so that request
+	// ids allocated by both sides never collide
+	reqIDResponse = 1 << 31
+	// unanswered pings before the peer is considered dead, by default
+	defaultMaxMisses = 3
+	// notifications read but not handled yet, the reading stop when full
+	notifyQueueLen = 64
+)
+
+var (
+	// ErrRPCUnsupported peer still talk json, request id is unavailable
+	ErrRPCUnsupported = fmt.Errorf("rpc not supported by peer")
+	// ErrRPCTimeout no response in time
+	ErrRPCTimeout = fmt.Errorf("rpc timeout")
+	// ErrKeepalive too many pings without pong
+	ErrKeepalive = fmt.Errorf("keepalive failed")
+)
+
+// Handler handle a command from peer. for a request the returned command
+// is the response, and an error is sent back as the response's error. for
+// a notification a non-nil result is sent as another notification, e.g.
+// ping to pong. every request run on its own goroutine, and can block or
+// Call. notifications run in order on one goroutine, so they should not
+// block. ping and pong run on the reading goroutine, so that a slow
+// handler does not look like a lost ping
+type Handler func(cmd *StreamCmd) (*StreamCmd, error)
+
+// RPC request/response and notifications over the cmd stream
+type RPC struct {
+	codec *CmdCodec
+
+	// OnRTT called when keepalive measure a round trip time, OnLost when
+	// a ping is lost, set before Serve
+	OnRTT  func(rtt time.Duration)
+	OnLost func()
+	// unanswered pings before Keepalive fail, set before Serve
+	MaxMisses int
+
+	handlers map[string]Handler
+
+	lock    sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan *StreamCmd
+	err     error
+
+	waitingPing int32
+	// smoothed round trip time, nanoseconds
+	rtt int64
+
+	pingLock sync.Mutex
+	pingSeq  uint32
+	// unanswered pings, sequence to send time
+	pingSent map[uint32]time.Time
+	health   healthStats
+}
+
+// NewRPC create rpc on the codec, ping and pong are handled already
+func NewRPC(codec *CmdCodec) *RPC {
+	r := &RPC{
+		codec:     codec,
+		MaxMisses: defaultMaxMisses,
+		handlers:  make(map[string]Handler),
+		pending:   make(map[uint32]chan *StreamCmd),
+		pingSent:  make(map[uint32]time.Time),
+	}
+
+	r.Handle("ping", func(cmd *StreamCmd) (*StreamCmd, error) {
+		return &StreamCmd{Cmd: "pong", Seq: cmd.Seq, Time: cmd.Time}, nil
+	})
+
+	r.Handle("pong", func(cmd *StreamCmd) (*StreamCmd, error) {
+		r.onPong(cmd)
+		return nil, nil
+	})
+
+	return r
+}
+
+// Handle register handler of the command, must be called before Serve
+func (r *RPC) Handle(cmd string, h Handler) {
+	r.handlers[cmd] = h
+}
+
+// Notify send command that expect no response
+func (r *RPC) Notify(cmd *StreamCmd) error {
+	return r.codec.SendCmd(cmd)
+}
+
+// Keepalive send a ping, fail with ErrKeepalive if too many pings
+// are not answered. pings not answered before the next one are lost
+func (r *RPC) Keepalive() error {
+	if atomic.LoadInt32(&r.waitingPing) > int32(r.MaxMisses) {
+		return ErrKeepalive
+	}
+
+	now := time.Now()
+
+	r.pingLock.Lock()
+	lost := len(r.pingSent)
+	for seq := range r.pingSent {
+		delete(r.pingSent, seq)
+		r.health.record(true)
+	}
+
+	r.pingSeq++
+	if r.pingSeq == 0 {
+		r.pingSeq = 1
+	}
+
+	seq := r.pingSeq
+	r.pingSent[seq] = now
+	r.pingLock.Unlock()
+
+	if r.OnLost != nil {
+		for i := 0; i < lost; i++ {
+			r.OnLost()
+		}
+	}
+
+	// counted before sending, the pong may come before Notify return
+	atomic.AddInt32(&r.waitingPing, 1)
+	err := r.Notify(&StreamCmd{Cmd: "ping", Seq: seq, Time: now.UnixNano()})
+	if err != nil {
+		atomic.AddInt32(&r.waitingPing, -1)
+		r.pingLock.Lock()
+		delete(r.pingSent, seq)
+		r.pingLock.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+func (r *RPC) onPong(cmd *StreamCmd) {
+	atomic.StoreInt32(&r.waitingPing, 0)
+
+	r.pingLock.Lock()
+	seq := cmd.Seq
+	if seq == 0 {
+		// old peer echo nothing, the stream is ordered so the pong
+		// answer the oldest ping
+		for s := range r.pingSent {
+			if seq == 0 || s < seq {
+				seq = s
+			}
+		}
+	}
+
+	sentAt, ok := r.pingSent[seq]
+	if !ok {
+		// answer of a ping counted as lost
+		r.pingLock.Unlock()
+		return
+	}
+
+	delete(r.pingSent, seq)
+	rtt := time.Since(sentAt)
+	r.health.observe(rtt)
+	atomic.StoreInt64(&r.rtt, int64(r.health.srtt))
+	r.pingLock.Unlock()
+
+	if r.OnRTT != nil {
+		r.OnRTT(rtt)
+	}
+}
+
+// RTT smoothed round trip time measured by keepalive, 0 if unknown
+func (r *RPC) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&r.rtt))
+}
+
+// Health rtt, jitter and loss measured by keepalive
+func (r *RPC) Health() LinkHealth {
+	r.pingLock.Lock()
+	defer r.pingLock.Unlock()
+
+	return r.health.snapshot()
+}
+
+// HealthChanged return the health and true if it changed notably since
+// the last time it returned true, for logging
+func (r *RPC) HealthChanged() (LinkHealth, bool) {
+	r.pingLock.Lock()
+	defer r.pingLock.Unlock()
+
+	return r.health.changed()
+}
+
+// Call send request and wait the response
+func (r *RPC) Call(cmd *StreamCmd, timeout time.Duration) (*StreamCmd, error) {
+	if !r.codec.Envelope() {
+		return nil, ErrRPCUnsupported
+	}
+
+	ch := make(chan *StreamCmd, 1)
+
+	r.lock.Lock()
+	if r.err != nil {
+		r.lock.Unlock()
+		return nil, r.err
+	}
+
+	r.nextID = (r.nextID + 1) &^ reqIDResponse
+	if r.nextID == 0 {
+		r.nextID = 1
+	}
+
+	reqID := r.nextID
+	r.pending[reqID] = ch
+	r.lock.Unlock()
+
+	defer func() {
+		r.lock.Lock()
+		delete(r.pending, reqID)
+		r.lock.Unlock()
+	}()
+
+	err := r.codec.Send(cmd, reqID)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, r.closedErr()
+		}
+
+		if resp.Error != "" {
+			return resp, fmt.Errorf("rpc %s failed:%s", cmd.Cmd, resp.Error)
+		}
+
+		return resp, nil
+	case <-timer.C:
+		return nil, ErrRPCTimeout
+	}
+}
+
+// Invoke call method with arguments, and decode the result into result,
+// result can be nil if the method has no result
+func (r *RPC) Invoke(method string, args interface{}, result interface{}, timeout time.Duration) error {
+	cmd, err := NewRPCCmd(method, args)
+	if err != nil {
+		return err
+	}
+
+	resp, err := r.Call(cmd, timeout)
+	if err != nil {
+		return err
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return resp.Bind(result)
+}
+
+// Serve read and dispatch commands until the stream failed, pending
+// calls fail with the same error
+func (r *RPC) Serve() error {
+	notify := make(chan *StreamCmd, notifyQueueLen)
+	defer close(notify)
+	go func() {
+		for cmd := range notify {
+			r.dispatch(cmd, 0)
+		}
+	}()
+
+	var err error
+	for {
+		var cmd *StreamCmd
+		var reqID uint32
+		cmd, reqID, err = r.codec.ReadCmd()
+		if err != nil {
+			break
+		}
+
+		if reqID&reqIDResponse != 0 {
+			r.onResponse(reqID&^reqIDResponse, cmd)
+			continue
+		}
+
+		switch {
+		case reqID != 0:
+			go r.dispatch(cmd, reqID)
+		case cmd.Cmd == "ping" || cmd.Cmd == "pong":
+			r.dispatch(cmd, 0)
+		default:
+			notify <- cmd
+		}
+	}
+
+	r.lock.Lock()
+	r.err = err
+	for id, ch := range r.pending {
+		close(ch)
+		delete(r.pending, id)
+	}
+	r.lock.Unlock()
+
+	return err
+}
+
+func (r *RPC) closedErr() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.err
+}
+
+func (r *RPC) onResponse(reqID uint32, cmd *StreamCmd) {
+	r.lock.Lock()
+	ch, ok := r.pending[reqID]
+	r.lock.Unlock()
+
+	if !ok {
+		// caller gave up
+		return
+	}
+
+	select {
+	case ch <- cmd:
+	default:
+	}
+}
+
+func (r *RPC) dispatch(cmd *StreamCmd, reqID uint32) {
+	h, ok := r.handlers[cmd.Cmd]
+	if !ok {
+		if reqID != 0 {
+			r.codec.Send(&StreamCmd{Cmd: cmd.Cmd, Error: "unknown cmd"}, reqID|reqIDResponse)
+		}
+		return
+	}
+
+	resp, err := h(cmd)
+	if reqID == 0 {
+		if resp != nil {
+			r.Notify(resp)
+		}
+		return
+	}
+
+	if resp == nil {
+		resp = &StreamCmd{Cmd: cmd.Cmd}
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	r.codec.Send(resp, reqID|reqIDResponse)
+}
+
+// NewRPCCmd create command of method with encoded arguments
+func NewRPCCmd(method string, args interface{}) (*StreamCmd, error) {
+	var cmd = &StreamCmd{
+		Cmd: method,
+	}
+
+	if args != nil {
+		data, err := json.Marshal(args)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd.Data = data
+	}
+
+	return cmd, nil
+}
+
+// Bind decode the arguments or result of rpc command
+func (cmd *StreamCmd) Bind(v interface{}) error {
+	if len(cmd.Data) == 0 {
+		return fmt.Errorf("cmd %s has no data", cmd.Cmd)
+	}
+
+	return json.Unmarshal(cmd.Data, v)
+}
@@ -0,0 +1,197 @@
+package protoj
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// rpcPair rpc on both ends of a pipe, served, handlers of b are set by
+// setup, the envelope is enabled if upgrade
+func rpcPair(t *testing.T, upgrade bool, setup func(b *RPC)) (*RPC, *RPC, net.Conn) {
+	ca, cb := net.Pipe()
+	t.Cleanup(func() {
+		ca.Close()
+		cb.Close()
+	})
+
+	a := NewRPC(NewCmdCodec(ca))
+	b := NewRPC(NewCmdCodec(cb))
+	if setup != nil {
+		setup(b)
+	}
+
+	go a.Serve()
+	go b.Serve()
+
+	if upgrade {
+		err := a.codec.Upgrade()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// b switch when it read the marker
+		deadline := time.Now().Add(time.Second)
+		for !b.codec.Envelope() {
+			if time.Now().After(deadline) {
+				t.Fatal("peer not upgraded")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	return a, b, ca
+}
+
+type echoArgs struct {
+	N     int           `json:"n"`
+	Delay time.Duration `json:"delay"`
+}
+
+func TestRPCCorrelation(t *testing.T) {
+	a, _, _ := rpcPair(t, true, func(b *RPC) {
+		b.Handle("echo", func(cmd *StreamCmd) (*StreamCmd, error) {
+			var args echoArgs
+			err := cmd.Bind(&args)
+			if err != nil {
+				return nil, err
+			}
+
+			// later requests are answered first
+			time.Sleep(args.Delay)
+			return NewRPCCmd("echo", &args)
+		})
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+
+			var result echoArgs
+			err := a.Invoke("echo", &echoArgs{N: n, Delay: time.Duration(10-n) * 5 * time.Millisecond}, &result, time.Second)
+			if err == nil && result.N != n {
+				err = fmt.Errorf("call %d got the response of %d", n, result.N)
+			}
+			errs <- err
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRPCTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	a, _, _ := rpcPair(t, true, func(b *RPC) {
+		b.Handle("slow", func(cmd *StreamCmd) (*StreamCmd, error) {
+			<-release
+			return nil, nil
+		})
+	})
+
+	start := time.Now()
+	_, err := a.Call(&StreamCmd{Cmd: "slow"}, 50*time.Millisecond)
+	if err != ErrRPCTimeout {
+		t.Fatalf("slow call err:%v", err)
+	}
+
+	if time.Since(start) > time.Second {
+		t.Fatalf("timeout after %v", time.Since(start))
+	}
+
+	// the slow handler does not hold back pings
+	err = a.Keepalive()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&a.waitingPing) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no pong while a handler is blocked")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRPCUnknownCmd(t *testing.T) {
+	a, _, _ := rpcPair(t, true, nil)
+
+	resp, err := a.Call(&StreamCmd{Cmd: "nope"}, time.Second)
+	if err == nil {
+		t.Fatal("unknown cmd call ok")
+	}
+
+	if resp == nil || resp.Error != "unknown cmd" {
+		t.Fatalf("unknown cmd response %+v, err:%v", resp, err)
+	}
+}
+
+func TestRPCHandlerError(t *testing.T) {
+	a, _, _ := rpcPair(t, true, func(b *RPC) {
+		b.Handle("fail", func(cmd *StreamCmd) (*StreamCmd, error) {
+			return nil, fmt.Errorf("no way")
+		})
+	})
+
+	resp, err := a.Call(&StreamCmd{Cmd: "fail"}, time.Second)
+	if err == nil || resp == nil || resp.Error != "no way" {
+		t.Fatalf("response %+v, err:%v", resp, err)
+	}
+}
+
+func TestRPCStreamEnd(t *testing.T) {
+	called := make(chan struct{})
+	a, _, conn := rpcPair(t, true, func(b *RPC) {
+		b.Handle("hang", func(cmd *StreamCmd) (*StreamCmd, error) {
+			close(called)
+			select {}
+		})
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := a.Call(&StreamCmd{Cmd: "hang"}, 10*time.Second)
+		done <- err
+	}()
+
+	<-called
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if err == nil || err == ErrRPCTimeout {
+			t.Fatalf("pending call err:%v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending call not failed when the stream end")
+	}
+
+	// later calls fail at once
+	_, err := a.Call(&StreamCmd{Cmd: "hang"}, 10*time.Second)
+	if err == nil {
+		t.Fatal("call ok after the stream end")
+	}
+}
+
+func TestRPCUnsupported(t *testing.T) {
+	a, _, _ := rpcPair(t, false, nil)
+
+	_, err := a.Call(&StreamCmd{Cmd: "echo"}, time.Second)
+	if err != ErrRPCUnsupported {
+		t.Fatalf("call without envelope err:%v", err)
+	}
+}
@@ -0,0 +1,279 @@
+package protoj
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// envelope payload is a list of fields, tag(1) | length(uvarint) | value.
+// integers are varints, signed ones zigzag, bools one byte, repeated
+// fields repeat the tag. zero values are omitted, unknown tags skipped,
+// so fields can be added without a new version
+
+// StreamCmd field tags
+const (
+	cmdTagCmd    = 1
+	cmdTagCode   = 2
+	cmdTagReason = 3
+	cmdTagAddr   = 4
+	cmdTagToken  = 5
+	cmdTagCap    = 6
+	cmdTagData   = 7
+	cmdTagError  = 8
+	cmdTagPort   = 9
+	cmdTagSeq    = 10
+	cmdTagTime   = 11
+	cmdTagRelay  = 12
+)
+
+// LinkStreamHeader field tags
+const (
+	linkTagPort  = 1
+	linkTagHost  = 2
+	linkTagDUID  = 3
+	linkTagReply = 4
+	linkTagE2E   = 5
+	linkTagRole  = 6
+)
+
+// LinkStreamReply field tags
+const (
+	replyTagCode   = 1
+	replyTagReason = 2
+)
+
+var errTLVLength = errors.New("tlv invalid field length")
+
+// tlvWriter append fields to buf
+type tlvWriter struct {
+	buf []byte
+}
+
+func (w *tlvWriter) field(tag uint8, v []byte) {
+	var lb [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lb[:], uint64(len(v)))
+
+	w.buf = append(w.buf, tag)
+	w.buf = append(w.buf, lb[:n]...)
+	w.buf = append(w.buf, v...)
+}
+
+func (w *tlvWriter) str(tag uint8, s string) {
+	if s != "" {
+		w.field(tag, []byte(s))
+	}
+}
+
+// strs repeated field, empty elements are kept
+func (w *tlvWriter) strs(tag uint8, ss []string) {
+	for _, s := range ss {
+		w.field(tag, []byte(s))
+	}
+}
+
+func (w *tlvWriter) int(tag uint8, v int64) {
+	if v != 0 {
+		var b [binary.MaxVarintLen64]byte
+		w.field(tag, b[:binary.PutVarint(b[:], v)])
+	}
+}
+
+func (w *tlvWriter) uint(tag uint8, v uint64) {
+	if v != 0 {
+		var b [binary.MaxVarintLen64]byte
+		w.field(tag, b[:binary.PutUvarint(b[:], v)])
+	}
+}
+
+func (w *tlvWriter) bool(tag uint8, v bool) {
+	if v {
+		w.field(tag, []byte{1})
+	}
+}
+
+// readTLV call fn with each field of payload, in order
+func readTLV(payload []byte, fn func(tag uint8, v []byte) error) error {
+	for len(payload) > 0 {
+		tag := payload[0]
+		n, k := binary.Uvarint(payload[1:])
+		if k <= 0 {
+			return errTLVLength
+		}
+
+		payload = payload[1+k:]
+		if n > uint64(len(payload)) {
+			return fmt.Errorf("tlv field %d truncated, length %d", tag, n)
+		}
+
+		err := fn(tag, payload[:n])
+		if err != nil {
+			return fmt.Errorf("tlv field %d:%v", tag, err)
+		}
+
+		payload = payload[n:]
+	}
+
+	return nil
+}
+
+func tlvInt(v []byte) (int, error) {
+	x, n := binary.Varint(v)
+	if n <= 0 || n != len(v) {
+		return 0, errTLVLength
+	}
+
+	if x > math.MaxInt32 || x < math.MinInt32 {
+		return 0, fmt.Errorf("int out of range:%d", x)
+	}
+
+	return int(x), nil
+}
+
+func tlvInt64(v []byte) (int64, error) {
+	x, n := binary.Varint(v)
+	if n <= 0 || n != len(v) {
+		return 0, errTLVLength
+	}
+
+	return x, nil
+}
+
+func tlvUint32(v []byte) (uint32, error) {
+	x, n := binary.Uvarint(v)
+	if n <= 0 || n != len(v) {
+		return 0, errTLVLength
+	}
+
+	if x > math.MaxUint32 {
+		return 0, fmt.Errorf("uint32 out of range:%d", x)
+	}
+
+	return uint32(x), nil
+}
+
+func tlvBool(v []byte) (bool, error) {
+	if len(v) != 1 || v[0] > 1 {
+		return false, errors.New("invalid bool")
+	}
+
+	return v[0] == 1, nil
+}
+
+// encodeCmd payload of the command, the cmd is left out if the
+// message type already tell it
+func encodeCmd(cmd *StreamCmd, typ uint8) []byte {
+	var w tlvWriter
+	if typ == MsgCmd {
+		w.str(cmdTagCmd, cmd.Cmd)
+	}
+
+	w.int(cmdTagCode, int64(cmd.Code))
+	w.str(cmdTagReason, cmd.Reason)
+	w.strs(cmdTagAddr, cmd.Addrs)
+	w.str(cmdTagToken, cmd.Token)
+	w.int(cmdTagPort, int64(cmd.Port))
+	w.str(cmdTagRelay, cmd.Relay)
+	w.strs(cmdTagCap, cmd.Caps)
+	w.uint(cmdTagSeq, uint64(cmd.Seq))
+	w.int(cmdTagTime, cmd.Time)
+	if len(cmd.Data) > 0 {
+		w.field(cmdTagData, cmd.Data)
+	}
+	w.str(cmdTagError, cmd.Error)
+
+	return w.buf
+}
+
+// decodeCmdFields decode the payload into cmd, Data is opaque to the
+// codec, rpc methods encode it as json
+func decodeCmdFields(payload []byte, cmd *StreamCmd) error {
+	return readTLV(payload, func(tag uint8, v []byte) error {
+		var err error
+		switch tag {
+		case cmdTagCmd:
+			cmd.Cmd = string(v)
+		case cmdTagCode:
+			cmd.Code, err = tlvInt(v)
+		case cmdTagReason:
+			cmd.Reason = string(v)
+		case cmdTagAddr:
+			cmd.Addrs = append(cmd.Addrs, string(v))
+		case cmdTagToken:
+			cmd.Token = string(v)
+		case cmdTagPort:
+			cmd.Port, err = tlvInt(v)
+		case cmdTagRelay:
+			cmd.Relay = string(v)
+		case cmdTagCap:
+			cmd.Caps = append(cmd.Caps, string(v))
+		case cmdTagSeq:
+			cmd.Seq, err = tlvUint32(v)
+		case cmdTagTime:
+			cmd.Time, err = tlvInt64(v)
+		case cmdTagData:
+			cmd.Data = append([]byte(nil), v...)
+		case cmdTagError:
+			cmd.Error = string(v)
+		}
+
+		return err
+	})
+}
+
+func encodeLinkHeader(h *LinkStreamHeader) []byte {
+	var w tlvWriter
+	w.int(linkTagPort, int64(h.Port))
+	w.str(linkTagHost, h.Host)
+	w.str(linkTagDUID, h.DUID)
+	w.bool(linkTagReply, h.Reply)
+	w.bool(linkTagE2E, h.E2E)
+	w.str(linkTagRole, h.Role)
+
+	return w.buf
+}
+
+func decodeLinkHeader(payload []byte, h *LinkStreamHeader) error {
+	return readTLV(payload, func(tag uint8, v []byte) error {
+		var err error
+		switch tag {
+		case linkTagPort:
+			h.Port, err = tlvInt(v)
+		case linkTagHost:
+			h.Host = string(v)
+		case linkTagDUID:
+			h.DUID = string(v)
+		case linkTagReply:
+			h.Reply, err = tlvBool(v)
+		case linkTagE2E:
+			h.E2E, err = tlvBool(v)
+		case linkTagRole:
+			h.Role = string(v)
+		}
+
+		return err
+	})
+}
+
+func encodeLinkReply(reply *LinkStreamReply) []byte {
+	var w tlvWriter
+	w.int(replyTagCode, int64(reply.Code))
+	w.str(replyTagReason, reply.Reason)
+
+	return w.buf
+}
+
+func decodeLinkReply(payload []byte, reply *LinkStreamReply) error {
+	return readTLV(payload, func(tag uint8, v []byte) error {
+		var err error
+		switch tag {
+		case replyTagCode:
+			reply.Code, err = tlvInt(v)
+		case replyTagReason:
+			reply.Reason = string(v)
+		}
+
+		return err
+	})
+}
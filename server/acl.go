@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// labelTerm one term of label selector, k=v, k!=v, k or !k
+type labelTerm struct {
+	key   string
+	value string
+	// compare value, otherwise only check the key exists
+	hasValue bool
+	not      bool
+}
+
+// labelSelector all terms must match, empty selector match all
+type labelSelector []labelTerm
+
+// parseSelector parse comma separated terms, "*" or "" match all
+func parseSelector(s string) (labelSelector, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || s == "*" {
+		return nil, nil
+	}
+
+	var sel labelSelector
+	for _, t := range strings.Split(s, ",") {
+		t = strings.TrimSpace(t)
+		var term labelTerm
+		if i := strings.Index(t, "!="); i >= 0 {
+			term = labelTerm{key: t[:i], value: t[i+2:], hasValue: true, not: true}
+		} else if i := strings.Index(t, "="); i >= 0 {
+			term = labelTerm{key: t[:i], value: t[i+1:], hasValue: true}
+		} else if strings.HasPrefix(t, "!") {
+			term = labelTerm{key: t[1:], not: true}
+		} else {
+			term = labelTerm{key: t}
+		}
+
+		term.key = strings.TrimSpace(term.key)
+		term.value = strings.TrimSpace(term.value)
+		if term.key == "" {
+			return nil, fmt.Errorf("invalid label selector term:%s", t)
+		}
+
+		sel = append(sel, term)
+	}
+
+	return sel, nil
+}
+
+func (sel labelSelector) match(labels map[string]string) bool {
+	for _, t := range sel {
+		v, ok := labels[t.key]
+		matched := ok
+		if t.hasValue {
+			matched = ok && v == t.value
+		}
+
+		if matched == t.not {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ACLRule allow or deny a role to reach devices that match the selector
+type ACLRule struct {
+	Allow bool `json:"allow"`
+	// ec, px or *
+	Role string `json:"role"`
+	// label selector of devices, * means all
+	Selector string `json:"selector"`
+	// empty means all ports
+	Ports []int `json:"ports,omitempty"`
+
+	sel labelSelector
+}
+
+func (r *ACLRule) String() string {
+	action := "deny"
+	if r.Allow {
+		action = "allow"
+	}
+
+	ports := "*"
+	if len(r.Ports) > 0 {
+		var ss []string
+		for _, p := range r.Ports {
+			ss = append(ss, strconv.Itoa(p))
+		}
+		ports = strings.Join(ss, ",")
+	}
+
+	selector := r.Selector
+	if selector == "" {
+		selector = "*"
+	}
+
+	return fmt.Sprintf("%s %s %s %s", action, r.Role, selector, ports)
+}
+
+// compile check the rule and parse its selector
+func (r *ACLRule) compile() error {
+	switch r.Role {
+	case "ec", "px", "*":
+	default:
+		return fmt.Errorf("invalid acl role:%s", r.Role)
+	}
+
+	for _, p := range r.Ports {
+		if p <= 0 || p > 65535 {
+			return fmt.Errorf("invalid acl port:%d", p)
+		}
+	}
+
+	var err error
+	r.sel, err = parseSelector(r.Selector)
+	return err
+}
+
+func (r *ACLRule) matchDevice(role string, ee *esEndpoint) bool {
+	if r.Role != "*" && r.Role != role {
+		return false
+	}
+
+	return r.sel.match(ee.labels())
+}
+
+// parseACLRule parse "allow|deny role selector [ports]"
+func parseACLRule(line string) (*ACLRule, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 3 || len(fields) > 4 {
+		return nil, fmt.Errorf("invalid acl rule:%s", line)
+	}
+
+	r := &ACLRule{
+		Role:     fields[1],
+		Selector: fields[2],
+	}
+
+	switch fields[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return nil, fmt.Errorf("invalid acl action:%s", fields[0])
+	}
+
+	if len(fields) == 4 && fields[3] != "*" {
+		for _, p := range strings.Split(fields[3], ",") {
+			port, err := strconv.Atoi(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid acl port:%s", p)
+			}
+
+			r.Ports = append(r.Ports, port)
+		}
+	}
+
+	err := r.compile()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// acl rules are checked in order, the first matched one decide,
+// allow if none matched
+type acl struct {
+	lock  sync.RWMutex
+	rules []*ACLRule
+}
+
+// loadACL load rules from file, one rule a line, # for comment
+func loadACL(path string) (*acl, error) {
+	a := &acl{}
+	if path == "" {
+		return a, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []*ACLRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		r, err := parseACLRule(line)
+		if err != nil {
+			return nil, err
+		}
+
+		rules = append(rules, r)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	a.rules = rules
+	return a, nil
+}
+
+// setRules replace all rules
+func (a *acl) setRules(rules []*ACLRule) error {
+	for _, r := range rules {
+		err := r.compile()
+		if err != nil {
+			return err
+		}
+	}
+
+	a.lock.Lock()
+	a.rules = rules
+	a.lock.Unlock()
+
+	return nil
+}
+
+// save write rules to file, atomically
+func (a *acl) save(path string) error {
+	var sb strings.Builder
+	for _, r := range a.getRules() {
+		sb.WriteString(r.String())
+		sb.WriteString("\n")
+	}
+
+	tmp := path + ".tmp"
+	err := ioutil.WriteFile(tmp, []byte(sb.String()), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// getRules a copy of the rules
+func (a *acl) getRules() []*ACLRule {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	return append([]*ACLRule{}, a.rules...)
+}
+
+// check if the role can link to the port of device
+func (a *acl) check(role string, ee *esEndpoint, port int) error {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, r := range a.rules {
+		if !r.matchDevice(role, ee) {
+			continue
+		}
+
+		if len(r.Ports) > 0 && !containsPort(r.Ports, port) {
+			continue
+		}
+
+		if r.Allow {
+			return nil
+		}
+
+		return denied("device %s port %d denied by acl", ee.devID, port)
+	}
+
+	return nil
+}
+
+// visible if the device is listed to the role, device denied on all
+// ports is invisible. a port scoped allow before the deny still make
+// the device visible, a port scoped deny hide nothing
+func (a *acl) visible(role string, ee *esEndpoint) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+
+	for _, r := range a.rules {
+		if !r.matchDevice(role, ee) {
+			continue
+		}
+
+		if len(r.Ports) > 0 {
+			if r.Allow {
+				return true
+			}
+			continue
+		}
+
+		return r.Allow
+	}
+
+	return true
+}
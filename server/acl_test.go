@@ -0,0 +1,94 @@
+package server
+
+import (
+	"testing"
+
+	"lxquic/protoj"
+)
+
+func testACL(t *testing.T, lines ...string) *acl {
+	a := &acl{}
+	for _, line := range lines {
+		r, err := parseACLRule(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		a.rules = append(a.rules, r)
+	}
+
+	return a
+}
+
+// testRegistry in memory registry for the test
+func testRegistry(t *testing.T) *registry {
+	r, err := loadRegistry("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := devRegistry
+	devRegistry = r
+	t.Cleanup(func() { devRegistry = old })
+
+	return r
+}
+
+// labeledES device known by the registry with labels assigned
+func labeledES(t *testing.T, devID string, labels map[string]string) *esEndpoint {
+	es := &esEndpoint{
+		devID:       devID,
+		cmdEndpoint: newCmdEndpoint("es", devID, &fakeSession{}, nil, protoj.NewCmdCodec(nil), nil),
+	}
+
+	devRegistry.online(devID, "192.0.2.1:1000", nil, nil)
+	devRegistry.setLabels(devID, labels)
+	return es
+}
+
+func TestACLVisible(t *testing.T) {
+	testRegistry(t)
+	prod := labeledES(t, "a", map[string]string{"env": "prod"})
+	dev := labeledES(t, "b", map[string]string{"env": "dev"})
+
+	a := testACL(t, "allow ec env=prod 22", "deny ec *")
+	if !a.visible("ec", prod) {
+		t.Error("device allowed on port 22 is invisible")
+	}
+
+	if a.visible("ec", dev) {
+		t.Error("device denied on all ports is visible")
+	}
+
+	if a.check("ec", prod, 22) != nil || a.check("ec", prod, 80) == nil {
+		t.Error("check does not honor the port")
+	}
+
+	a = testACL(t, "deny ec env=prod 22", "allow ec *")
+	if !a.visible("ec", prod) {
+		t.Error("port scoped deny hide the device")
+	}
+
+	a = testACL(t, "deny px env=prod", "allow * * 22")
+	if a.visible("px", prod) || !a.visible("ec", prod) {
+		t.Error("role is not honored")
+	}
+}
+
+func TestACLReportedLabels(t *testing.T) {
+	testRegistry(t)
+
+	// the device claim env=prod, the admin did not assign it
+	claimed := labeledES(t, "a", map[string]string{"env": "dev"})
+	claimed.meta = &protoj.DeviceMeta{Labels: map[string]string{"env": "prod"}}
+
+	a := testACL(t, "allow ec env=prod", "deny ec *")
+	if a.check("ec", claimed, 22) == nil || a.visible("ec", claimed) {
+		t.Fatal("acl match the labels reported by device")
+	}
+
+	devRegistry.setLabels("a", map[string]string{"env": "prod"})
+	if a.check("ec", claimed, 22) != nil {
+		t.Fatal("acl does not match the labels assigned")
+	}
+}
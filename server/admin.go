@@ -0,0 +1,590 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"lxquic/protoj"
+	"lxquic/transport"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	adminPrefix = "/api/v1/"
+	// max request body of admin api
+	adminMaxBody = 1024 * 1024
+)
+
+var (
+	serverParams *Params
+	startTime    = time.Now()
+)
+
+// SessionInfo a es, ec or px session
+type SessionInfo struct {
+	Role       string    `json:"role"`
+	ID         string    `json:"id"`
+	RemoteAddr string    `json:"remote"`
+	Protocol   string    `json:"protocol"`
+	Since      time.Time `json:"since"`
+	// seconds
+	Duration int64 `json:"duration"`
+	// milliseconds, 0 if unknown
+	RTT      int64 `json:"rtt"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+	// keepalive measured rtt, jitter and loss
+	Health *protoj.LinkHealth `json:"health,omitempty"`
+	// connection level stats of the session
+	Conn transport.SessionStats `json:"conn"`
+
+	// es only
+	Meta *protoj.DeviceMeta `json:"meta,omitempty"`
+	// ec only, the target of link streams
+	Device string `json:"device,omitempty"`
+	Port   int    `json:"port,omitempty"`
+}
+
+// MappingInfo link streams of ec go to the port of device
+type MappingInfo struct {
+	ID     string `json:"id"`
+	Device string `json:"device"`
+	Port   int    `json:"port"`
+}
+
+// ServerInfo build and config information
+type ServerInfo struct {
+	Version   string    `json:"version"`
+	GoVersion string    `json:"go_version"`
+	OS        string    `json:"os"`
+	Arch      string    `json:"arch"`
+	StartTime time.Time `json:"start_time"`
+	Protocols []string  `json:"protocols"`
+
+	ListenAddr    string          `json:"listen"`
+	TCPListenAddr string          `json:"tcp_listen,omitempty"`
+	ProxyEnabled  bool            `json:"proxy_enabled"`
+	ACLFile       string          `json:"acl_file,omitempty"`
+	Egress        *EgressParams   `json:"egress,omitempty"`
+	Resolver      *ResolverParams `json:"resolver,omitempty"`
+	Cluster       *ClusterParams  `json:"cluster,omitempty"`
+
+	Draining    bool  `json:"draining"`
+	ActiveLinks int64 `json:"active_links"`
+}
+
+// DrainRequest drain the server, tell clients the alternate relay
+type DrainRequest struct {
+	Relay string `json:"relay,omitempty"`
+	// seconds to wait link streams, 0 means default
+	Grace int `json:"grace,omitempty"`
+}
+
+// adminRoutes handlers of admin api by path under adminPrefix, a path
+// end with / serve the resources under it. all of them require the token
+var adminRoutes = []struct {
+	path    string
+	handler http.HandlerFunc
+}{
+	{"info", adminInfo},
+	{"sessions", adminSessions},
+	{"sessions/", adminSession},
+	{"mappings", adminMappings},
+	{"mappings/", adminMapping},
+	{"acl", adminACL},
+	{"drain", adminDrain},
+	{"devices", adminDevices},
+	{"devices/", adminDevice},
+}
+
+// adminHandler admin api, openapi.json is served without the token
+func adminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminPrefix+"openapi.json", adminOpenAPI)
+	for _, route := range adminRoutes {
+		mux.Handle(adminPrefix+route.path, adminAuth(token, route.handler))
+	}
+
+	return mux
+}
+
+// startAdmin serve admin api on separate listener, token is required
+func startAdmin(params *Params) {
+	if params.AdminToken == "" {
+		log.Fatalln("admin api requires a token")
+	}
+
+	srv := &http.Server{
+		Addr:              params.AdminAddr,
+		Handler:           adminHandler(params.AdminToken),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	log.Printf("admin api listen at:%s", params.AdminAddr)
+	go func() {
+		err := srv.ListenAndServe()
+		log.Fatalln("admin api ListenAndServe failed:", err)
+	}()
+}
+
+// adminAuth check bearer token
+func adminAuth(token string, h http.HandlerFunc) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, expected) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		h(w, r)
+	})
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, code int, msg string) {
+	writeAdminJSON(w, code, map[string]string{"error": msg})
+}
+
+func readAdminJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, adminMaxBody))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+func adminOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPISpec))
+}
+
+func adminInfo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+
+	info := &ServerInfo{
+		Version:   serverParams.Version,
+		GoVersion: runtime.Version(),
+		OS:        runtime.GOOS,
+		Arch:      runtime.GOARCH,
+		StartTime: startTime,
+		Protocols: protoj.NextProtos(),
+
+		ListenAddr:    serverParams.ListenAddr,
+		TCPListenAddr: serverParams.TCPListenAddr,
+		ProxyEnabled:  serverParams.ProxyToken != "",
+		ACLFile:       serverParams.ACLFile,
+		Egress:        serverParams.Egress,
+		Resolver:      serverParams.Resolver,
+		Cluster:       serverParams.Cluster,
+
+		Draining:    isDraining(),
+		ActiveLinks: serverDrain.links(),
+	}
+
+	writeAdminJSON(w, http.StatusOK, info)
+}
+
+// allSessions es, ec and px sessions, sorted by role and id
+func allSessions() []*SessionInfo {
+	mapLock.Lock()
+	defer mapLock.Unlock()
+
+	sessions := make([]*SessionInfo, 0, len(esmap)+len(ecmap)+len(pxmap))
+	for _, es := range esmap {
+		si := es.sessionInfo()
+		si.Meta = es.meta
+		sessions = append(sessions, si)
+	}
+
+	for _, ec := range ecmap {
+		si := ec.sessionInfo()
+		si.Device, si.Port = ec.target()
+		sessions = append(sessions, si)
+	}
+
+	for _, px := range pxmap {
+		sessions = append(sessions, px.sessionInfo())
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Role != sessions[j].Role {
+			return sessions[i].Role < sessions[j].Role
+		}
+
+		return sessions[i].ID < sessions[j].ID
+	})
+
+	return sessions
+}
+
+func adminSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, allSessions())
+}
+
+// adminSession DELETE sessions/{role}/{id} kick the device or client
+func adminSession(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, adminPrefix+"sessions/"), "/", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		writeAdminError(w, http.StatusNotFound, "expect sessions/{role}/{id}")
+		return
+	}
+
+	role, id := parts[0], parts[1]
+	if !kickSession(role, id) {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("%s session %s not found", role, id))
+		return
+	}
+
+	log.Printf("admin kick %s session:%s", role, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// kickSession close the session, false if not found
+func kickSession(role string, id string) bool {
+	var ce *cmdEndpoint
+
+	mapLock.Lock()
+	switch role {
+	case "es":
+		if es, ok := esmap[id]; ok {
+			ce = &es.cmdEndpoint
+		}
+	case "ec", "px":
+		index, err := strconv.Atoi(id)
+		if err != nil {
+			break
+		}
+
+		if ec, ok := ecmap[index]; ok && role == "ec" {
+			ce = &ec.cmdEndpoint
+		} else if px, ok := pxmap[index]; ok && role == "px" {
+			ce = &px.cmdEndpoint
+		}
+	}
+	mapLock.Unlock()
+
+	if ce == nil {
+		return false
+	}
+
+	ce.sess.CloseWithError(0, "kicked by admin")
+	return true
+}
+
+func adminMappings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+
+	mapLock.Lock()
+	mappings := make([]*MappingInfo, 0, len(ecmap))
+	for _, ec := range ecmap {
+		m := &MappingInfo{ID: strconv.Itoa(ec.index)}
+		m.Device, m.Port = ec.target()
+		mappings = append(mappings, m)
+	}
+	mapLock.Unlock()
+
+	sort.Slice(mappings, func(i, j int) bool {
+		return mappings[i].ID < mappings[j].ID
+	})
+
+	writeAdminJSON(w, http.StatusOK, mappings)
+}
+
+// adminMapping PUT mappings/{id} change the target of ec's new link streams
+func adminMapping(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		methodNotAllowed(w)
+		return
+	}
+
+	index, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, adminPrefix+"mappings/"))
+	if err != nil {
+		writeAdminError(w, http.StatusNotFound, "expect mappings/{id}")
+		return
+	}
+
+	var m = &MappingInfo{}
+	err = readAdminJSON(w, r, m)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if m.Device == "" || m.Port <= 0 || m.Port > 65535 {
+		writeAdminError(w, http.StatusBadRequest, "invalid device or port")
+		return
+	}
+
+	mapLock.Lock()
+	ec, ok := ecmap[index]
+	mapLock.Unlock()
+
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, fmt.Sprintf("ec session %d not found", index))
+		return
+	}
+
+	ec.setTarget(m.Device, m.Port)
+	log.Printf("admin change ec %d mapping to %s:%d", index, m.Device, m.Port)
+
+	m.ID = strconv.Itoa(index)
+	writeAdminJSON(w, http.StatusOK, m)
+}
+
+// adminACL GET or PUT the acl rules, PUT also save them to acl file
+func adminACL(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, devACL.getRules())
+	case http.MethodPut:
+		var rules []*ACLRule
+		err := readAdminJSON(w, r, &rules)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		err = devACL.setRules(rules)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if serverParams.ACLFile != "" {
+			err = devACL.save(serverParams.ACLFile)
+			if err != nil {
+				writeAdminError(w, http.StatusInternalServerError, fmt.Sprintf("acl applied but save failed:%v", err))
+				return
+			}
+		}
+
+		log.Printf("admin replace acl, %d rules", len(rules))
+		writeAdminJSON(w, http.StatusOK, devACL.getRules())
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// adminDrain POST drain the server in background, the process keep running
+func adminDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w)
+		return
+	}
+
+	var req = &DrainRequest{}
+	if r.ContentLength != 0 {
+		err := readAdminJSON(w, r, req)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if req.Grace < 0 {
+		writeAdminError(w, http.StatusBadRequest, "invalid grace")
+		return
+	}
+
+	if req.Grace == 0 {
+		req.Grace = int(DefaultDrainGrace / time.Second)
+	}
+
+	if isDraining() {
+		writeAdminError(w, http.StatusConflict, "already draining")
+		return
+	}
+
+	log.Printf("admin drain, relay:%s, grace:%ds", req.Relay, req.Grace)
+	go Drain(req.Relay, time.Duration(req.Grace)*time.Second)
+
+	writeAdminJSON(w, http.StatusAccepted, req)
+}
+
+const (
+	// default and max events of device history
+	historyDefaultLimit = 100
+	historyMaxLimit     = 10000
+)
+
+// adminDevices GET known devices, online=true|false filter them
+func adminDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+
+	records := devRegistry.list()
+
+	online := r.URL.Query().Get("online")
+	if online != "" {
+		want, err := strconv.ParseBool(online)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid online")
+			return
+		}
+
+		filtered := records[:0]
+		for _, d := range records {
+			if d.Online == want {
+				filtered = append(filtered, d)
+			}
+		}
+		records = filtered
+	}
+
+	writeAdminJSON(w, http.StatusOK, records)
+}
+
+// adminDevice GET or DELETE devices/{id}, GET devices/{id}/history
+func adminDevice(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, adminPrefix+"devices/"), "/", 2)
+	devID := parts[0]
+	if devID == "" {
+		writeAdminError(w, http.StatusNotFound, "expect devices/{id}")
+		return
+	}
+
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "history":
+			adminDeviceHistory(w, r, devID)
+		case "labels":
+			adminDeviceLabels(w, r, devID)
+		default:
+			writeAdminError(w, http.StatusNotFound, "expect devices/{id}/history or devices/{id}/labels")
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		d := devRegistry.get(devID)
+		if d == nil {
+			writeAdminError(w, http.StatusNotFound, fmt.Sprintf("device %s unknown", devID))
+			return
+		}
+
+		writeAdminJSON(w, http.StatusOK, d)
+	case http.MethodDelete:
+		if !devRegistry.remove(devID) {
+			writeAdminError(w, http.StatusConflict, fmt.Sprintf("device %s unknown or online", devID))
+			return
+		}
+
+		log.Printf("admin forget device:%s", devID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// adminDeviceLabels GET or PUT the labels assigned to device, that acl
+// and label routing match
+func adminDeviceLabels(w http.ResponseWriter, r *http.Request, devID string) {
+	switch r.Method {
+	case http.MethodGet:
+		d := devRegistry.get(devID)
+		if d == nil {
+			writeAdminError(w, http.StatusNotFound, fmt.Sprintf("device %s unknown", devID))
+			return
+		}
+
+		labels := d.Labels
+		if labels == nil {
+			labels = map[string]string{}
+		}
+
+		writeAdminJSON(w, http.StatusOK, labels)
+	case http.MethodPut:
+		var labels map[string]string
+		err := readAdminJSON(w, r, &labels)
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		for k, v := range labels {
+			if k == "" || strings.ContainsAny(k, "=,!") || strings.ContainsAny(v, "=,") {
+				writeAdminError(w, http.StatusBadRequest, fmt.Sprintf("invalid label %s=%s", k, v))
+				return
+			}
+		}
+
+		if !devRegistry.setLabels(devID, labels) {
+			writeAdminError(w, http.StatusNotFound, fmt.Sprintf("device %s unknown", devID))
+			return
+		}
+
+		if labels == nil {
+			labels = map[string]string{}
+		}
+
+		log.Printf("admin assign device:%s labels:%v", devID, labels)
+		writeAdminJSON(w, http.StatusOK, labels)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// adminDeviceHistory the latest online and offline events of device
+func adminDeviceHistory(w http.ResponseWriter, r *http.Request, devID string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+
+	limit := historyDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > historyMaxLimit {
+			writeAdminError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+
+		limit = n
+	}
+
+	events, err := devRegistry.historyOf(devID, limit)
+	if err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,484 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"lxquic/protoj"
+	"lxquic/transport"
+)
+
+const testAdminToken = "secret"
+
+// fakeSession record why it is closed
+type fakeSession struct {
+	transport.Session
+
+	lock   sync.Mutex
+	closed []string
+}
+
+func (fs *fakeSession) CloseWithError(code uint64, reason string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	fs.closed = append(fs.closed, reason)
+	return nil
+}
+
+func (fs *fakeSession) Protocol() string {
+	return "test"
+}
+
+func (fs *fakeSession) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1000}
+}
+
+func (fs *fakeSession) Stats() transport.SessionStats {
+	return transport.SessionStats{Transport: "quic"}
+}
+
+func (fs *fakeSession) closeReasons() []string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	return append([]string{}, fs.closed...)
+}
+
+// testAdmin admin api over an es dev1 and an ec 7 linked to dev1:22
+func testAdmin(t *testing.T) (*httptest.Server, *esEndpoint, *ecEndpoint) {
+	dir, err := ioutil.TempDir("", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	reg, err := loadRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { reg.history.Close() })
+
+	oldParams, oldACL, oldRegistry := serverParams, devACL, devRegistry
+	serverParams = &Params{ACLFile: filepath.Join(dir, "acl")}
+	devACL = &acl{}
+	devRegistry = reg
+	t.Cleanup(func() {
+		serverParams, devACL, devRegistry = oldParams, oldACL, oldRegistry
+	})
+
+	es := &esEndpoint{
+		devID:       "dev1",
+		meta:        &protoj.DeviceMeta{Hostname: "box1"},
+		cmdEndpoint: newCmdEndpoint("es", "dev1", &fakeSession{}, nil, protoj.NewCmdCodec(nil), nil),
+	}
+	ec := &ecEndpoint{
+		index:       7,
+		targetDevID: "dev1",
+		targetPort:  22,
+		cmdEndpoint: newCmdEndpoint("ec", "7", &fakeSession{}, nil, protoj.NewCmdCodec(nil), nil),
+	}
+
+	mapLock.Lock()
+	esmap[es.devID] = es
+	ecmap[ec.index] = ec
+	mapLock.Unlock()
+	t.Cleanup(func() {
+		mapLock.Lock()
+		delete(esmap, es.devID)
+		delete(ecmap, ec.index)
+		mapLock.Unlock()
+	})
+
+	srv := httptest.NewServer(adminHandler(testAdminToken))
+	t.Cleanup(srv.Close)
+
+	return srv, es, ec
+}
+
+// adminDo request the admin api with the token, decode the json result
+// into v if not nil, return the status code
+func adminDo(t *testing.T, srv *httptest.Server, method string, path string, body string, v interface{}) int {
+	req, err := http.NewRequest(method, srv.URL+adminPrefix+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no content has no body
+	if v != nil && len(data) > 0 {
+		err = json.Unmarshal(data, v)
+		if err != nil {
+			t.Fatalf("%s %s: %v, body:%s", method, path, err, data)
+		}
+	}
+
+	return resp.StatusCode
+}
+
+func TestAdminAuth(t *testing.T) {
+	srv, _, _ := testAdmin(t)
+
+	for _, route := range adminRoutes {
+		for _, auth := range []string{"", "Bearer wrong", "Bearer " + testAdminToken + "x", testAdminToken} {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+adminPrefix+route.path, nil)
+			if auth != "" {
+				req.Header.Set("Authorization", auth)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var result map[string]string
+			json.NewDecoder(resp.Body).Decode(&result)
+			resp.Body.Close()
+
+			if resp.StatusCode != http.StatusUnauthorized || result["error"] == "" {
+				t.Errorf("%s with %q: status %d, body %v", route.path, auth, resp.StatusCode, result)
+			}
+		}
+
+		code := adminDo(t, srv, http.MethodGet, route.path, "", nil)
+		if code == http.StatusUnauthorized {
+			t.Errorf("%s with the token: status %d", route.path, code)
+		}
+	}
+
+	resp, err := http.Get(srv.URL + adminPrefix + "openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("openapi.json without token: status %d", resp.StatusCode)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	srv, es, _ := testAdmin(t)
+
+	var sessions []*SessionInfo
+	code := adminDo(t, srv, http.MethodGet, "sessions", "", &sessions)
+	if code != http.StatusOK || len(sessions) != 2 {
+		t.Fatalf("status %d, sessions %+v", code, sessions)
+	}
+
+	ec, device := sessions[0], sessions[1]
+	if ec.Role != "ec" || ec.ID != "7" || ec.Device != "dev1" || ec.Port != 22 {
+		t.Errorf("ec session %+v", ec)
+	}
+
+	if device.Role != "es" || device.ID != "dev1" || device.Meta == nil || device.Meta.Hostname != "box1" ||
+		device.RemoteAddr != "192.0.2.1:1000" || device.Protocol != "test" || device.Conn.Transport != "quic" {
+		t.Errorf("es session %+v", device)
+	}
+
+	code = adminDo(t, srv, http.MethodPost, "sessions", "", nil)
+	if code != http.StatusMethodNotAllowed {
+		t.Errorf("POST sessions: status %d", code)
+	}
+
+	// kick
+	var tests = []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{http.MethodGet, "sessions/es/dev1", http.StatusMethodNotAllowed},
+		{http.MethodDelete, "sessions/es", http.StatusNotFound},
+		{http.MethodDelete, "sessions/es/nope", http.StatusNotFound},
+		{http.MethodDelete, "sessions/px/7", http.StatusNotFound},
+		{http.MethodDelete, "sessions/es/dev1", http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		code := adminDo(t, srv, tt.method, tt.path, "", nil)
+		if code != tt.code {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, code, tt.code)
+		}
+	}
+
+	reasons := es.sess.(*fakeSession).closeReasons()
+	if !reflect.DeepEqual(reasons, []string{"kicked by admin"}) {
+		t.Errorf("es session closed for %v", reasons)
+	}
+}
+
+func TestAdminMappings(t *testing.T) {
+	srv, _, ec := testAdmin(t)
+
+	var mappings []*MappingInfo
+	code := adminDo(t, srv, http.MethodGet, "mappings", "", &mappings)
+	if code != http.StatusOK || !reflect.DeepEqual(mappings, []*MappingInfo{{ID: "7", Device: "dev1", Port: 22}}) {
+		t.Fatalf("status %d, mappings %+v", code, mappings)
+	}
+
+	var tests = []struct {
+		path string
+		body string
+		code int
+	}{
+		{"mappings/x", `{"device":"dev2","port":80}`, http.StatusNotFound},
+		{"mappings/99", `{"device":"dev2","port":80}`, http.StatusNotFound},
+		{"mappings/7", `{"device":"dev2","port":0}`, http.StatusBadRequest},
+		{"mappings/7", `{"device":"","port":80}`, http.StatusBadRequest},
+		{"mappings/7", `{"device":"dev2","port":80,"extra":1}`, http.StatusBadRequest},
+		{"mappings/7", `{`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		var result map[string]interface{}
+		code := adminDo(t, srv, http.MethodPut, tt.path, tt.body, &result)
+		if code != tt.code || result["error"] == nil {
+			t.Errorf("PUT %s %s: status %d, body %v, want %d", tt.path, tt.body, code, result, tt.code)
+		}
+	}
+
+	if dev, port := ec.target(); dev != "dev1" || port != 22 {
+		t.Fatalf("target %s:%d changed by bad requests", dev, port)
+	}
+
+	var m MappingInfo
+	code = adminDo(t, srv, http.MethodPut, "mappings/7", `{"device":"dev2","port":80}`, &m)
+	if code != http.StatusOK || m != (MappingInfo{ID: "7", Device: "dev2", Port: 80}) {
+		t.Fatalf("status %d, mapping %+v", code, m)
+	}
+
+	if dev, port := ec.target(); dev != "dev2" || port != 80 {
+		t.Fatalf("target %s:%d, want dev2:80", dev, port)
+	}
+}
+
+func TestAdminACL(t *testing.T) {
+	srv, _, _ := testAdmin(t)
+
+	var rules []*ACLRule
+	code := adminDo(t, srv, http.MethodGet, "acl", "", &rules)
+	if code != http.StatusOK || len(rules) != 0 {
+		t.Fatalf("status %d, rules %+v", code, rules)
+	}
+
+	for _, body := range []string{
+		`[{"allow":true,"role":"es","selector":"*"}]`,
+		`[{"allow":true,"role":"ec","selector":"*","ports":[70000]}]`,
+		`{"allow":true}`,
+	} {
+		code := adminDo(t, srv, http.MethodPut, "acl", body, nil)
+		if code != http.StatusBadRequest {
+			t.Errorf("PUT acl %s: status %d", body, code)
+		}
+	}
+
+	body := `[{"allow":true,"role":"ec","selector":"env=prod","ports":[22]},{"allow":false,"role":"*","selector":"*"}]`
+	code = adminDo(t, srv, http.MethodPut, "acl", body, &rules)
+	if code != http.StatusOK || len(rules) != 2 || !rules[0].Allow || rules[0].Selector != "env=prod" || rules[1].Role != "*" {
+		t.Fatalf("status %d, rules %+v", code, rules)
+	}
+
+	rules = nil
+	adminDo(t, srv, http.MethodGet, "acl", "", &rules)
+	if len(rules) != 2 || !reflect.DeepEqual(rules[0].Ports, []int{22}) {
+		t.Fatalf("rules after PUT %+v", rules)
+	}
+
+	saved, err := ioutil.ReadFile(serverParams.ACLFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(saved, []byte("allow ec env=prod 22")) || !bytes.Contains(saved, []byte("deny * *")) {
+		t.Fatalf("acl file:\n%s", saved)
+	}
+
+	code = adminDo(t, srv, http.MethodDelete, "acl", "", nil)
+	if code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE acl: status %d", code)
+	}
+}
+
+func TestAdminDrain(t *testing.T) {
+	srv, _, _ := testAdmin(t)
+
+	flushed := make(chan struct{})
+	d := &drainer{
+		poll:      5 * time.Millisecond,
+		endpoints: func() []*cmdEndpoint { return nil },
+		flush: func() error {
+			close(flushed)
+			return nil
+		},
+	}
+
+	old := serverDrain
+	serverDrain = d
+	t.Cleanup(func() { serverDrain = old })
+
+	for _, body := range []string{`{"grace":-1}`, `{"relay":1}`, `{`} {
+		code := adminDo(t, srv, http.MethodPost, "drain", body, nil)
+		if code != http.StatusBadRequest {
+			t.Errorf("POST drain %s: status %d", body, code)
+		}
+	}
+
+	code := adminDo(t, srv, http.MethodGet, "drain", "", nil)
+	if code != http.StatusMethodNotAllowed {
+		t.Errorf("GET drain: status %d", code)
+	}
+
+	var req DrainRequest
+	code = adminDo(t, srv, http.MethodPost, "drain", `{"relay":"relay2:4433"}`, &req)
+	if code != http.StatusAccepted || req.Relay != "relay2:4433" || req.Grace != int(DefaultDrainGrace/time.Second) {
+		t.Fatalf("status %d, drain %+v", code, req)
+	}
+
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Fatal("drain not done")
+	}
+
+	var info ServerInfo
+	adminDo(t, srv, http.MethodGet, "info", "", &info)
+	if !info.Draining {
+		t.Error("info not draining")
+	}
+
+	code = adminDo(t, srv, http.MethodPost, "drain", "", nil)
+	if code != http.StatusConflict {
+		t.Errorf("drain again: status %d", code)
+	}
+}
+
+// specRoute the route that serve the path of openapi spec
+func specRoute(path string) string {
+	path = strings.TrimPrefix(path, "/")
+	if i := strings.Index(path, "/"); i >= 0 {
+		return path[:i+1]
+	}
+
+	return path
+}
+
+func TestAdminOpenAPI(t *testing.T) {
+	srv, _, _ := testAdmin(t)
+
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+
+	err := json.Unmarshal([]byte(openAPISpec), &spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var specRoutes, routes []string
+	seen := make(map[string]bool)
+	for path, methods := range spec.Paths {
+		if r := specRoute(path); !seen[r] {
+			seen[r] = true
+			specRoutes = append(specRoutes, r)
+		}
+
+		// every documented method is served, a bad body keep it harmless
+		url := strings.NewReplacer("{role}", "es", "{id}", "nope").Replace(strings.TrimPrefix(path, "/"))
+		for method := range methods {
+			if method == "parameters" {
+				continue
+			}
+
+			m := strings.ToUpper(method)
+			body := ""
+			if m == http.MethodPut || m == http.MethodPost {
+				body = "{"
+			}
+
+			var result interface{}
+			code := adminDo(t, srv, m, url, body, &result)
+			if code == http.StatusMethodNotAllowed || code == http.StatusUnauthorized || code == http.StatusInternalServerError {
+				t.Errorf("%s %s: status %d, body %v", m, path, code, result)
+			}
+		}
+	}
+
+	for _, route := range adminRoutes {
+		routes = append(routes, route.path)
+	}
+
+	sort.Strings(specRoutes)
+	sort.Strings(routes)
+	if !reflect.DeepEqual(specRoutes, routes) {
+		t.Fatalf("openapi paths served by %v, routes %v", specRoutes, routes)
+	}
+}
+
+func TestAdminDeviceLabels(t *testing.T) {
+	srv, es, _ := testAdmin(t)
+
+	code := adminDo(t, srv, http.MethodGet, "devices/dev1/labels", "", nil)
+	if code != http.StatusNotFound {
+		t.Fatalf("labels of unknown device: status %d", code)
+	}
+
+	devRegistry.online("dev1", "192.0.2.1:1000", nil, es.meta)
+
+	var tests = []struct {
+		method string
+		body   string
+		code   int
+	}{
+		{http.MethodPut, `{"env=x":"prod"}`, http.StatusBadRequest},
+		{http.MethodPut, `{"env":"a,b"}`, http.StatusBadRequest},
+		{http.MethodPut, `["env"]`, http.StatusBadRequest},
+		{http.MethodDelete, "", http.StatusMethodNotAllowed},
+		{http.MethodPut, `{"env":"prod"}`, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		code := adminDo(t, srv, tt.method, "devices/dev1/labels", tt.body, nil)
+		if code != tt.code {
+			t.Errorf("%s labels %s: status %d, want %d", tt.method, tt.body, code, tt.code)
+		}
+	}
+
+	var labels map[string]string
+	code = adminDo(t, srv, http.MethodGet, "devices/dev1/labels", "", &labels)
+	if code != http.StatusOK || !reflect.DeepEqual(labels, map[string]string{"env": "prod"}) {
+		t.Fatalf("status %d, labels %v", code, labels)
+	}
+
+	if !reflect.DeepEqual(es.labels(), labels) {
+		t.Fatalf("device labels %v", es.labels())
+	}
+
+	var d DeviceRecord
+	adminDo(t, srv, http.MethodGet, "devices/dev1", "", &d)
+	if d.Labels["env"] != "prod" {
+		t.Fatalf("device record %+v", d)
+	}
+}
@@ -0,0 +1,526 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"lxquic/protoj"
+	"lxquic/transport"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// peerRPCTimeout timeout of rpc to peer relay
+	peerRPCTimeout = 3 * time.Second
+	// peerLinkTimeout timeout to wait peer relay's link reply
+	peerLinkTimeout = 10 * time.Second
+	// peerLookupTimeout how long a lookup wait the static peers in all
+	peerLookupTimeout = 5 * time.Second
+	// notFoundTTL how long a device not found stays not found, so that
+	// link streams to an offline device do not ask the directory each
+	notFoundTTL = 5 * time.Second
+)
+
+// ClusterParams relays of a cluster forward link streams to the relay
+// that the device is connected to
+type ClusterParams struct {
+	// address that peer relays dial to reach this relay, also identify
+	// this relay in the directory
+	Addr string `json:"addr"`
+	// static peer relays, asked by the default directory
+	Peers []string `json:"peers,omitempty"`
+	// shared secret of the relays, required
+	Token string `json:"-"`
+	// device directory, nil means ask the static peers
+	Directory Directory `json:"-"`
+}
+
+// cluster of this relay, nil if not in a cluster
+var cluster *relayCluster
+
+type relayCluster struct {
+	addr  string
+	token string
+	dir   Directory
+
+	peersLock sync.Mutex
+	peers     map[string]*peerRelay
+
+	// devices not found recently, and when to ask again
+	notFoundLock sync.Mutex
+	notFound     map[string]time.Time
+}
+
+func newCluster(params *ClusterParams) (*relayCluster, error) {
+	if params.Token == "" {
+		return nil, fmt.Errorf("cluster requires a token")
+	}
+
+	c := &relayCluster{
+		addr:  params.Addr,
+		token: params.Token,
+		dir:   params.Directory,
+		peers: make(map[string]*peerRelay),
+
+		notFound: make(map[string]time.Time),
+	}
+
+	if c.dir == nil {
+		c.dir = newPeerDirectory(c, params.Peers)
+	}
+
+	return c, nil
+}
+
+// register the device is connected to this relay
+func (c *relayCluster) register(devID string) {
+	err := c.dir.Register(devID, c.addr)
+	if err != nil {
+		log.Errorf("cluster register device:%s failed:%v", devID, err)
+	}
+}
+
+// unregister the device left this relay
+func (c *relayCluster) unregister(devID string) {
+	err := c.dir.Unregister(devID, c.addr)
+	if err != nil {
+		log.Errorf("cluster unregister device:%s failed:%v", devID, err)
+	}
+}
+
+// locate the peer relay that the device is connected to, empty if
+// not found, label selectors are routed to local devices only
+func (c *relayCluster) locate(devID string) string {
+	if strings.HasPrefix(devID, labelPrefix) {
+		return ""
+	}
+
+	if c.recentlyNotFound(devID) {
+		clusterLookups.Inc("cached")
+		return ""
+	}
+
+	relay, err := c.dir.Lookup(devID)
+	if err != nil {
+		log.Errorf("cluster lookup device:%s failed:%v", devID, err)
+		clusterLookups.Inc("error")
+		return ""
+	}
+
+	if relay == "" || relay == c.addr {
+		clusterLookups.Inc("not_found")
+		c.setNotFound(devID)
+		return ""
+	}
+
+	clusterLookups.Inc("found")
+	return relay
+}
+
+// recentlyNotFound if the device was not found within notFoundTTL
+func (c *relayCluster) recentlyNotFound(devID string) bool {
+	c.notFoundLock.Lock()
+	defer c.notFoundLock.Unlock()
+
+	expire, ok := c.notFound[devID]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(expire) {
+		delete(c.notFound, devID)
+		return false
+	}
+
+	return true
+}
+
+// setNotFound remember the device is not found, expired ones are removed
+func (c *relayCluster) setNotFound(devID string) {
+	now := time.Now()
+
+	c.notFoundLock.Lock()
+	defer c.notFoundLock.Unlock()
+
+	for k, v := range c.notFound {
+		if now.After(v) {
+			delete(c.notFound, k)
+		}
+	}
+
+	c.notFound[devID] = now.Add(notFoundTTL)
+}
+
+// locateRelay the peer relay of the device, empty if not in a cluster
+func locateRelay(devID string) string {
+	if cluster == nil {
+		return ""
+	}
+
+	return cluster.locate(devID)
+}
+
+func (c *relayCluster) peer(addr string) *peerRelay {
+	c.peersLock.Lock()
+	defer c.peersLock.Unlock()
+
+	p, ok := c.peers[addr]
+	if !ok {
+		p = &peerRelay{addr: addr, cluster: c}
+		c.peers[addr] = p
+	}
+
+	return p
+}
+
+// peerRelay session to a peer relay, dialed on demand and redialed
+// if closed
+type peerRelay struct {
+	addr    string
+	cluster *relayCluster
+
+	lock sync.Mutex
+	sess transport.Session
+	rpc  *protoj.RPC
+	// closed when the dial in progress end, nil if not dialing
+	dialing chan struct{}
+	dialErr error
+}
+
+// session the live session to the peer, dial if none, callers at the
+// same time share one dial
+func (p *peerRelay) session() (transport.Session, *protoj.RPC, error) {
+	p.lock.Lock()
+	if p.sess != nil && p.sess.Context().Err() == nil {
+		sess, rpc := p.sess, p.rpc
+		p.lock.Unlock()
+		return sess, rpc, nil
+	}
+
+	if p.dialing != nil {
+		dialing := p.dialing
+		p.lock.Unlock()
+
+		<-dialing
+		p.lock.Lock()
+		sess, rpc, err := p.sess, p.rpc, p.dialErr
+		p.lock.Unlock()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return sess, rpc, nil
+	}
+
+	dialing := make(chan struct{})
+	p.dialing = dialing
+	p.lock.Unlock()
+
+	sess, rpc, err := p.dial()
+
+	p.lock.Lock()
+	p.sess, p.rpc, p.dialErr = sess, rpc, err
+	p.dialing = nil
+	p.lock.Unlock()
+	close(dialing)
+
+	return sess, rpc, err
+}
+
+// dial a session to the peer and start its cmd stream
+func (p *peerRelay) dial() (transport.Session, *protoj.RPC, error) {
+	log.Printf("peerRelay dial relay:%s", p.addr)
+	sess, err := transport.Dial(&transport.DialParams{
+		Addr: p.addr,
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         protoj.NextProtos(),
+		},
+		QuicConfig: serverParams.Transport.QuicConfig(),
+		Mode:       transport.ModeQuic,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stream, err := sess.OpenStreamSync(context.Background())
+	if err != nil {
+		sess.CloseWithError(0, "OpenStreamSync failed")
+		return nil, nil, err
+	}
+
+	var header = &protoj.CmdStreamHeader{
+		Role:    protoj.RoleRelay,
+		Relay:   p.cluster.addr,
+		Token:   p.cluster.token,
+		Version: protoj.CmdVersion,
+		Caps:    []string{protoj.CapEnvelope},
+	}
+
+	err = protoj.StreamSendJSON(stream, header)
+	if err != nil {
+		sess.CloseWithError(0, "StreamSendJSON failed")
+		return nil, nil, err
+	}
+
+	// peer relay support the envelope, rpc can be called at once
+	codec := protoj.NewCmdCodec(stream)
+	err = codec.Upgrade()
+	if err != nil {
+		sess.CloseWithError(0, "codec upgrade failed")
+		return nil, nil, err
+	}
+
+	rpc := protoj.NewRPC(codec)
+	go func() {
+		err := rpc.Serve()
+		log.Printf("peerRelay relay:%s cmd stream exit:%v", p.addr, err)
+		sess.CloseWithError(0, "cmd stream closed")
+	}()
+
+	return sess, rpc, nil
+}
+
+// locate ask the peer whether the device is connected to it
+func (p *peerRelay) locate(devID string) (bool, error) {
+	_, rpc, err := p.session()
+	if err != nil {
+		return false, err
+	}
+
+	var result = &protoj.LocateResult{}
+	err = rpc.Invoke(protoj.CmdLocate, &protoj.LocateArgs{DUID: devID}, result, peerRPCTimeout)
+	if err != nil {
+		return false, err
+	}
+
+	return result.Found, nil
+}
+
+// openLink open a link stream to the device via the peer, the peer reply
+// before any data
+func (p *peerRelay) openLink(header *protoj.LinkStreamHeader) (transport.Stream, error) {
+	sess, _, err := p.session()
+	if err != nil {
+		return nil, &linkError{code: protoj.LinkReplyDialFailed, reason: fmt.Sprintf("dial relay %s failed:%v", p.addr, err)}
+	}
+
+	stream, err := sess.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, &linkError{code: protoj.LinkReplyDialFailed, reason: fmt.Sprintf("open relay %s stream failed:%v", p.addr, err)}
+	}
+
+	// peer relays support the envelope, as the cmd stream assume
+	header.Reply = true
+	err = protoj.WriteLinkHeader(stream, header, protoj.CmdVersionEnvelope)
+	if err != nil {
+		stream.Close()
+		return nil, &linkError{code: protoj.LinkReplyDialFailed, reason: fmt.Sprintf("send relay %s link header failed:%v", p.addr, err)}
+	}
+
+	stream.SetReadDeadline(time.Now().Add(peerLinkTimeout))
+	reply, err := protoj.ReadLinkReply(stream)
+	if err != nil {
+		stream.Close()
+		return nil, &linkError{code: protoj.LinkReplyDialFailed, reason: fmt.Sprintf("read relay %s link reply failed:%v", p.addr, err)}
+	}
+
+	stream.SetReadDeadline(time.Time{})
+	if reply.Code != protoj.LinkReplyOK {
+		stream.Close()
+		return nil, &linkError{code: reply.Code, reason: "relay: " + reply.Reason}
+	}
+
+	return stream, nil
+}
+
+// openPeerLink open a link stream to the device on the peer relay
+func openPeerLink(relay string, header *protoj.LinkStreamHeader) (transport.Stream, error) {
+	return cluster.peer(relay).openLink(header)
+}
+
+// peerDirectory the default directory, devices of this relay are known,
+// others are located by asking the static peers, for small clusters
+type peerDirectory struct {
+	local *MemoryDirectory
+	peers []*peerRelay
+}
+
+func newPeerDirectory(c *relayCluster, peers []string) *peerDirectory {
+	pd := &peerDirectory{
+		local: NewMemoryDirectory(),
+	}
+
+	for _, addr := range peers {
+		if addr != "" && addr != c.addr {
+			pd.peers = append(pd.peers, c.peer(addr))
+		}
+	}
+
+	return pd
+}
+
+// Register the device is connected to this relay
+func (pd *peerDirectory) Register(devID string, relay string) error {
+	return pd.local.Register(devID, relay)
+}
+
+// Unregister the device left this relay
+func (pd *peerDirectory) Unregister(devID string, relay string) error {
+	return pd.local.Unregister(devID, relay)
+}
+
+// Lookup ask all peers at once, the first one that has the device win,
+// peers that do not answer in peerLookupTimeout are not waited
+func (pd *peerDirectory) Lookup(devID string) (string, error) {
+	relay, _ := pd.local.Lookup(devID)
+	if relay != "" || len(pd.peers) == 0 {
+		return relay, nil
+	}
+
+	found := make(chan string, len(pd.peers))
+	for _, p := range pd.peers {
+		go func(p *peerRelay) {
+			ok, err := p.locate(devID)
+			if err != nil {
+				log.Printf("peerDirectory locate device:%s on relay:%s failed:%v", devID, p.addr, err)
+			}
+
+			if ok {
+				found <- p.addr
+			} else {
+				found <- ""
+			}
+		}(p)
+	}
+
+	timeout := time.NewTimer(peerLookupTimeout)
+	defer timeout.Stop()
+
+	for range pd.peers {
+		select {
+		case relay := <-found:
+			if relay != "" {
+				return relay, nil
+			}
+		case <-timeout.C:
+			return "", fmt.Errorf("lookup device:%s timeout", devID)
+		}
+	}
+
+	return "", nil
+}
+
+// serveRelay serve the session of a peer relay, answer locate requests
+// and link streams forwarded to local devices
+func serveRelay(sess transport.Session, stream transport.Stream, codec *protoj.CmdCodec, header *protoj.CmdStreamHeader) {
+	log.Printf("serveRelay, got a peer relay:%s", header.Relay)
+	if cluster == nil || subtle.ConstantTimeCompare([]byte(header.Token), []byte(cluster.token)) != 1 {
+		log.Printf("serveRelay peer relay:%s cluster token not match", header.Relay)
+		denySession(sess, codec, "cluster token not match")
+		return
+	}
+
+	rpc := protoj.NewRPC(codec)
+	rpc.Handle(protoj.CmdLocate, func(cmd *protoj.StreamCmd) (*protoj.StreamCmd, error) {
+		var args = &protoj.LocateArgs{}
+		err := cmd.Bind(args)
+		if err != nil {
+			return nil, err
+		}
+
+		var result = &protoj.LocateResult{
+			Found: getES(args.DUID) != nil,
+			Relay: cluster.addr,
+		}
+
+		return protoj.NewRPCCmd(protoj.CmdLocate, result)
+	})
+
+	go func() {
+		err := rpc.Serve()
+		log.Printf("serveRelay peer relay:%s cmd stream exit:%v", header.Relay, err)
+		sess.CloseWithError(0, "cmd stream closed")
+	}()
+
+	for {
+		linkStream, err := sess.AcceptStream(context.Background())
+		if err != nil {
+			log.Printf("serveRelay peer relay:%s sess.AcceptStream failed:%v", header.Relay, err)
+			return
+		}
+
+		linkOpened.Inc(protoj.RoleRelay)
+		go serveRelayStream(linkStream)
+	}
+}
+
+// serveRelayStream link the stream forwarded by peer relay to the local
+// device, acl is checked by the role of the origin client
+func serveRelayStream(stream transport.Stream) {
+	defer trackLink()()
+	defer stream.Close()
+
+	header, err := protoj.ReadLinkHeader(stream)
+	if err != nil {
+		log.Errorf("serveRelayStream read link header failed:%v", err)
+		return
+	}
+
+	log.Printf("serveRelayStream, %s link to device:%s port:%d", header.Role, header.DUID, header.Port)
+	if header.Role != "ec" && header.Role != "px" {
+		replyRelayStream(stream, header, refused("unknown origin role:%s", header.Role))
+		return
+	}
+
+	es := getES(header.DUID)
+	if es == nil {
+		replyRelayStream(stream, header, deviceOffline(header.DUID))
+		return
+	}
+
+	if header.E2E && es.pubKey == "" {
+		replyRelayStream(stream, header, &linkError{code: protoj.LinkReplyRefused, reason: "device not support e2e"})
+		return
+	}
+
+	err = devACL.check(header.Role, es, header.Port)
+	if err != nil {
+		log.Printf("serveRelayStream, device:%s, %v", es.devID, err)
+		replyRelayStream(stream, header, err)
+		return
+	}
+
+	esStream, err := openESLink(es, &protoj.LinkStreamHeader{Port: header.Port, Host: header.Host, E2E: header.E2E})
+	if err != nil {
+		log.Printf("serveRelayStream, device:%s open link failed:%v", es.devID, err)
+		replyRelayStream(stream, header, err)
+		return
+	}
+
+	err = replyRelayStream(stream, header, nil)
+	if err != nil {
+		log.Errorf("serveRelayStream reply failed:%v", err)
+		esStream.Close()
+		return
+	}
+
+	bridgeStreams(stream, esStream)
+	onLinkClosed(protoj.RoleRelay, nil)
+	log.Printf("serveRelayStream, link stream end, device:%s", es.devID)
+}
+
+// replyRelayStream send link stream reply to peer relay, a nil error
+// means ok
+func replyRelayStream(stream transport.Stream, header *protoj.LinkStreamHeader, err error) error {
+	if err != nil {
+		onLinkClosed(protoj.RoleRelay, err)
+	}
+
+	return protoj.WriteLinkReply(stream, linkReply(err), header.Version())
+}
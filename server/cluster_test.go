@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"testing"
+	"time"
+
+	"lxquic/protoj"
+	"lxquic/transport"
+)
+
+// startTestDevice a device that echo every link stream, and a session
+// to it as if the device connected to the relay
+func startTestDevice(t *testing.T) transport.Session {
+	listener, err := transport.ListenQuic("127.0.0.1:0", transport.GenerateTLSConfig(protoj.NextProtos()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		sess, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+
+		for {
+			stream, err := sess.AcceptStream(context.Background())
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer stream.Close()
+				_, err := protoj.ReadLinkHeader(stream)
+				if err != nil {
+					return
+				}
+
+				io.Copy(stream, stream)
+			}()
+		}
+	}()
+
+	sess, err := transport.Dial(&transport.DialParams{
+		Addr: listener.Addr().String(),
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         protoj.NextProtos(),
+		},
+		Mode: transport.ModeQuic,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sess.CloseWithError(0, "test end") })
+
+	return sess
+}
+
+// TestClusterForward relay b forward link streams to the device on relay a,
+// both share a memory directory, relay a is the one this process serve
+func TestClusterForward(t *testing.T) {
+	serverParams = &Params{}
+	devACL = &acl{}
+	devRegistry, _ = loadRegistry("")
+
+	listener, err := transport.ListenQuic("127.0.0.1:0", transport.GenerateTLSConfig(protoj.NextProtos()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			sess, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+
+			go onAcceptSession(sess)
+		}
+	}()
+
+	dir := NewMemoryDirectory()
+	addrA := listener.Addr().String()
+	cluster, err = newCluster(&ClusterParams{Addr: addrA, Token: "secret", Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { cluster = nil }()
+
+	b, err := newCluster(&ClusterParams{Addr: "127.0.0.1:1", Token: "secret", Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	es := &esEndpoint{devID: "dev1"}
+	es.role, es.id = "es", es.devID
+	es.sess = startTestDevice(t)
+	es.stats = &linkStats{}
+	mapLock.Lock()
+	esmap[es.devID] = es
+	mapLock.Unlock()
+	defer func() {
+		mapLock.Lock()
+		delete(esmap, es.devID)
+		mapLock.Unlock()
+	}()
+
+	cluster.register(es.devID)
+
+	if relay := b.locate(es.devID); relay != addrA {
+		t.Fatalf("locate device got relay:%q, expect %q", relay, addrA)
+	}
+
+	stream, err := b.peer(addrA).openLink(&protoj.LinkStreamHeader{DUID: es.devID, Port: 22, Role: "ec"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = stream.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf [4]byte
+	_, err = io.ReadFull(stream, buf[:])
+	if err != nil || string(buf[:]) != "ping" {
+		t.Fatalf("echo got %q, %v", buf[:], err)
+	}
+	stream.Close()
+
+	// the device left after b looked it up
+	_, err = b.peer(addrA).openLink(&protoj.LinkStreamHeader{DUID: "dev2", Port: 22, Role: "ec"})
+	if le, ok := err.(*linkError); !ok || le.code != protoj.LinkReplyNoDevice {
+		t.Fatalf("link to offline device got %v", err)
+	}
+
+	// not found is cached
+	if relay := b.locate("dev2"); relay != "" {
+		t.Fatalf("locate offline device got relay:%q", relay)
+	}
+
+	dir.Register("dev2", addrA)
+	if relay := b.locate("dev2"); relay != "" {
+		t.Fatalf("locate within not found ttl got relay:%q", relay)
+	}
+
+	b.notFoundLock.Lock()
+	b.notFound["dev2"] = time.Now()
+	b.notFoundLock.Unlock()
+	if relay := b.locate("dev2"); relay != addrA {
+		t.Fatalf("locate after not found ttl got relay:%q", relay)
+	}
+}
+
+// TestClusterToken relays with another token are denied
+func TestClusterToken(t *testing.T) {
+	serverParams = &Params{}
+	devACL = &acl{}
+	devRegistry, _ = loadRegistry("")
+
+	listener, err := transport.ListenQuic("127.0.0.1:0", transport.GenerateTLSConfig(protoj.NextProtos()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		for {
+			sess, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+
+			go onAcceptSession(sess)
+		}
+	}()
+
+	dir := NewMemoryDirectory()
+	addrA := listener.Addr().String()
+	cluster, err = newCluster(&ClusterParams{Addr: addrA, Token: "secret", Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { cluster = nil }()
+
+	b, err := newCluster(&ClusterParams{Addr: "127.0.0.1:1", Token: "secrets", Directory: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = b.peer(addrA).locate("dev1")
+	if err == nil {
+		t.Fatal("relay with wrong token is served")
+	}
+}
@@ -0,0 +1,168 @@
+package server
+
+import (
+	"lxquic/protoj"
+	"lxquic/transport"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// cmdEndpoint the cmd stream part shared by es, ec and px
+type cmdEndpoint struct {
+	// es, ec or px, and device id of es or index of ec and px
+	role string
+	id   string
+	// for log
+	name string
+
+	sess   transport.Session
+	stream transport.Stream
+	// cmd stream is written by keepalive, handlers and link streams
+	rpc *protoj.RPC
+
+	since time.Time
+	stats *linkStats
+	// capabilities negotiated for the session
+	caps []string
+
+	keepaliveConf Keepalive
+	// only touched by keepalive goroutine
+	nextPing time.Time
+}
+
+// linkStats bytes of link streams, in is from the endpoint
+type linkStats struct {
+	bytesIn  int64
+	bytesOut int64
+}
+
+func newCmdEndpoint(role string, id string, sess transport.Session, stream transport.Stream, codec *protoj.CmdCodec, caps []string) cmdEndpoint {
+	ka := roleKeepalive[role]
+	now := time.Now()
+	ce := cmdEndpoint{
+		role:   role,
+		id:     id,
+		name:   role + "Endpoint:" + id,
+		sess:   sess,
+		stream: stream,
+		rpc:    protoj.NewRPC(codec),
+		since:  now,
+		stats:  &linkStats{},
+		caps:   caps,
+
+		keepaliveConf: ka,
+		nextPing:      now.Add(ka.Interval),
+	}
+
+	ce.rpc.MaxMisses = ka.Misses
+
+	ce.rpc.OnRTT = func(rtt time.Duration) {
+		pingRTT.Observe(rtt.Seconds(), role)
+	}
+	ce.rpc.OnLost = func() {
+		pingLost.Inc(role)
+	}
+
+	return ce
+}
+
+// countedStream count bytes of link stream into endpoint's stats and
+// the role's, both resolved when the stream is opened
+type countedStream struct {
+	transport.Stream
+	stats *linkStats
+	role  *linkStats
+}
+
+func (ce *cmdEndpoint) countStream(stream transport.Stream) transport.Stream {
+	return &countedStream{Stream: stream, stats: ce.stats, role: roleBytes[ce.role]}
+}
+
+func (cs *countedStream) Read(p []byte) (int, error) {
+	n, err := cs.Stream.Read(p)
+	if n > 0 {
+		atomic.AddInt64(&cs.stats.bytesIn, int64(n))
+		atomic.AddInt64(&cs.role.bytesIn, int64(n))
+	}
+	return n, err
+}
+
+func (cs *countedStream) Write(p []byte) (int, error) {
+	n, err := cs.Stream.Write(p)
+	if n > 0 {
+		atomic.AddInt64(&cs.stats.bytesOut, int64(n))
+		atomic.AddInt64(&cs.role.bytesOut, int64(n))
+	}
+	return n, err
+}
+
+// sessionInfo the endpoint's session for admin
+func (ce *cmdEndpoint) sessionInfo() *SessionInfo {
+	return &SessionInfo{
+		Role:       ce.role,
+		ID:         ce.id,
+		RemoteAddr: ce.sess.RemoteAddr().String(),
+		Protocol:   ce.sess.Protocol(),
+		Since:      ce.since,
+		Duration:   int64(time.Since(ce.since) / time.Second),
+		RTT:        int64(ce.rpc.RTT() / time.Millisecond),
+		BytesIn:    atomic.LoadInt64(&ce.stats.bytesIn),
+		BytesOut:   atomic.LoadInt64(&ce.stats.bytesOut),
+		Health:     ce.health(),
+		Conn:       ce.sess.Stats(),
+	}
+}
+
+// hasCap if the capability is enabled for the session
+func (ce *cmdEndpoint) hasCap(c string) bool {
+	return protoj.HasCap(ce.caps, c)
+}
+
+// linkVersion version of link headers and replies to the peer
+func (ce *cmdEndpoint) linkVersion() uint8 {
+	return protoj.LinkVersion(ce.caps)
+}
+
+// health nil until a ping answered or lost
+func (ce *cmdEndpoint) health() *protoj.LinkHealth {
+	h := ce.rpc.Health()
+	if h.Sent == 0 {
+		return nil
+	}
+
+	return &h
+}
+
+// sendCmd send command via cmd stream
+func (ce *cmdEndpoint) sendCmd(cmd *protoj.StreamCmd) error {
+	return ce.rpc.Notify(cmd)
+}
+
+// keepalive send ping message peer, close the session if peer not response
+func (ce *cmdEndpoint) keepalive() {
+	if ce.stream == nil {
+		log.Printf("%s.keepalive stream == nil", ce.name)
+		return
+	}
+
+	err := ce.rpc.Keepalive()
+	if err == protoj.ErrKeepalive {
+		log.Printf("%s.keepalive keepalive failed, close", ce.name)
+		keepaliveTimeouts.Inc(ce.role)
+		ce.sess.CloseWithError(0, "keepalive failed")
+	} else if err != nil {
+		log.Printf("%s.keepalive send ping error:%v", ce.name, err)
+	}
+
+	if h, changed := ce.rpc.HealthChanged(); changed {
+		log.Printf("%s.keepalive link health %s", ce.name, h)
+	}
+}
+
+// serveCmdStream serve commands until the cmd stream failed
+func (ce *cmdEndpoint) serveCmdStream() {
+	err := ce.rpc.Serve()
+	log.Printf("%s.serveCmdStream exit:%v", ce.name, err)
+}
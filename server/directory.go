@@ -0,0 +1,60 @@
+package server
+
+import (
+	"sync"
+)
+
+// Directory record which relay each device is connected to, shared by the
+// relays of a cluster. relays are identified by their cluster address
+type Directory interface {
+	// Register the device is connected to the relay
+	Register(devID string, relay string) error
+	// Unregister the device left the relay, ignored if the device has
+	// registered to another relay since
+	Unregister(devID string, relay string) error
+	// Lookup the relay that the device is connected to, empty if not found
+	Lookup(devID string) (string, error)
+}
+
+// MemoryDirectory directory in memory, relays in the same process can
+// share one, e.g. for local testing
+type MemoryDirectory struct {
+	lock    sync.Mutex
+	devices map[string]string
+}
+
+// NewMemoryDirectory create an empty directory
+func NewMemoryDirectory() *MemoryDirectory {
+	return &MemoryDirectory{
+		devices: make(map[string]string),
+	}
+}
+
+// Register the device is connected to the relay
+func (md *MemoryDirectory) Register(devID string, relay string) error {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+
+	md.devices[devID] = relay
+	return nil
+}
+
+// Unregister the device left the relay
+func (md *MemoryDirectory) Unregister(devID string, relay string) error {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+
+	if md.devices[devID] == relay {
+		delete(md.devices, devID)
+	}
+
+	return nil
+}
+
+// Lookup the relay that the device is connected to
+func (md *MemoryDirectory) Lookup(devID string) (string, error) {
+	md.lock.Lock()
+	defer md.lock.Unlock()
+
+	return md.devices[devID], nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"lxquic/protoj"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultDrainGrace time link streams can keep going after goaway
+	DefaultDrainGrace = 30 * time.Second
+	// defaultDrainPoll interval to check whether link streams all end
+	defaultDrainPoll = 500 * time.Millisecond
+)
+
+// drainer draining state of the server, and what it drain
+type drainer struct {
+	// 1 if the server is draining, new sessions are refused
+	draining int32
+	// link streams being served
+	activeLinks int64
+
+	// interval to check whether link streams all end
+	poll time.Duration
+	// sessions told to go away, and closed after grace
+	endpoints func() []*cmdEndpoint
+	// save the registry before exit
+	flush func() error
+}
+
+// serverDrain drainer of the server's sessions and registry
+var serverDrain = &drainer{
+	poll:      defaultDrainPoll,
+	endpoints: allEndpoints,
+	flush: func() error {
+		return devRegistry.flush()
+	},
+}
+
+// isDraining whether the server is draining
+func isDraining() bool {
+	return serverDrain.isDraining()
+}
+
+// trackLink count a link stream being served, call the returned
+// function when the link stream end
+func trackLink() func() {
+	return serverDrain.trackLink()
+}
+
+// Drain stop accepting new sessions, tell all clients to go away, to relay
+// if not empty, then wait link streams to end at most grace before close
+// all sessions. Only the first call drain, later calls return at once
+func Drain(relay string, grace time.Duration) {
+	serverDrain.drain(relay, grace)
+}
+
+func (d *drainer) isDraining() bool {
+	return atomic.LoadInt32(&d.draining) == 1
+}
+
+func (d *drainer) links() int64 {
+	return atomic.LoadInt64(&d.activeLinks)
+}
+
+func (d *drainer) trackLink() func() {
+	atomic.AddInt64(&d.activeLinks, 1)
+	return func() {
+		atomic.AddInt64(&d.activeLinks, -1)
+	}
+}
+
+func (d *drainer) drain(relay string, grace time.Duration) {
+	if !atomic.CompareAndSwapInt32(&d.draining, 0, 1) {
+		log.Println("Drain already draining")
+		return
+	}
+
+	endpoints := d.endpoints()
+	log.Printf("Drain start, %d sessions, %d link streams, relay:%s, grace:%s",
+		len(endpoints), d.links(), relay, grace)
+
+	var cmd = &protoj.StreamCmd{
+		Cmd:    protoj.CmdGoaway,
+		Reason: "server draining",
+		Relay:  relay,
+	}
+
+	for _, ce := range endpoints {
+		err := ce.sendCmd(cmd)
+		if err != nil {
+			log.Printf("%s.Drain send goaway failed:%v", ce.name, err)
+		}
+	}
+
+	deadline := time.Now().Add(grace)
+	for d.links() > 0 && time.Now().Before(deadline) {
+		time.Sleep(d.poll)
+	}
+
+	left := d.links()
+	if left > 0 {
+		log.Printf("Drain grace period end, %d link streams left", left)
+	}
+
+	// clients may reconnect at once, close those that still here
+	for _, ce := range d.endpoints() {
+		ce.sess.CloseWithError(0, "server draining")
+	}
+
+	err := d.flush()
+	if err != nil {
+		log.Errorf("Drain save registry failed:%v", err)
+	}
+
+	log.Println("Drain done")
+}
@@ -0,0 +1,164 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"lxquic/protoj"
+)
+
+// drainEndpoint endpoint whose cmd stream is read by the test
+func drainEndpoint(t *testing.T) (*cmdEndpoint, *fakeSession, chan *protoj.StreamCmd) {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	sess := &fakeSession{}
+	ce := newCmdEndpoint("es", "dev1", sess, local, protoj.NewCmdCodec(local), nil)
+
+	cmds := make(chan *protoj.StreamCmd, 8)
+	go func() {
+		codec := protoj.NewCmdCodec(remote)
+		for {
+			cmd, _, err := codec.ReadCmd()
+			if err != nil {
+				return
+			}
+			cmds <- cmd
+		}
+	}()
+
+	return &ce, sess, cmds
+}
+
+// testDrainer drainer of the endpoint and a registry in a temp dir
+func testDrainer(t *testing.T, ce *cmdEndpoint) (*drainer, string) {
+	dir, err := ioutil.TempDir("", "drain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	r, err := loadRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.history.Close() })
+
+	r.online("dev1", "192.0.2.1:1000", nil, nil)
+
+	d := &drainer{
+		poll:      5 * time.Millisecond,
+		endpoints: func() []*cmdEndpoint { return []*cmdEndpoint{ce} },
+		flush:     r.flush,
+	}
+
+	old := serverDrain
+	serverDrain = d
+	t.Cleanup(func() { serverDrain = old })
+
+	return d, dir
+}
+
+func TestDrainRefuseSessions(t *testing.T) {
+	ce, _, cmds := drainEndpoint(t)
+	d, _ := testDrainer(t, ce)
+
+	sess := &fakeSession{}
+	onAcceptSession(sess)
+	if reasons := sess.closeReasons(); len(reasons) != 1 || reasons[0] == "server draining" {
+		t.Fatalf("session closed for %v before draining", reasons)
+	}
+
+	d.drain("", time.Second)
+	<-cmds
+
+	sess = &fakeSession{}
+	onAcceptSession(sess)
+	if reasons := sess.closeReasons(); len(reasons) == 0 || reasons[0] != "server draining" {
+		t.Fatalf("session closed for %v while draining", reasons)
+	}
+}
+
+func TestDrainGoaway(t *testing.T) {
+	ce, sess, cmds := drainEndpoint(t)
+	d, dir := testDrainer(t, ce)
+
+	endLink := trackLink()
+	done := make(chan struct{})
+	go func() {
+		d.drain("relay2:4433", 10*time.Second)
+		close(done)
+	}()
+
+	select {
+	case cmd := <-cmds:
+		if cmd.Cmd != protoj.CmdGoaway || cmd.Relay != "relay2:4433" {
+			t.Fatalf("got %+v, want goaway to relay2:4433", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no goaway")
+	}
+
+	// the link stream keep the session
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-done:
+		t.Fatal("drain done with a link stream going")
+	default:
+	}
+
+	if len(sess.closeReasons()) != 0 {
+		t.Fatal("session closed with a link stream going")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, registryFile)); err == nil {
+		t.Fatal("registry flushed before the link stream end")
+	}
+
+	endLink()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drain not done after the link stream end")
+	}
+
+	if reasons := sess.closeReasons(); len(reasons) != 1 || reasons[0] != "server draining" {
+		t.Fatalf("session closed for %v", reasons)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, registryFile)); err != nil {
+		t.Fatalf("registry not flushed:%v", err)
+	}
+
+	// later calls return at once
+	d.drain("", 10*time.Second)
+	if n := len(sess.closeReasons()); n != 1 {
+		t.Fatalf("session closed %d times", n)
+	}
+}
+
+func TestDrainGrace(t *testing.T) {
+	ce, sess, _ := drainEndpoint(t)
+	d, _ := testDrainer(t, ce)
+
+	// a link stream that never end
+	d.trackLink()
+
+	start := time.Now()
+	d.drain("", 100*time.Millisecond)
+	elapsed := time.Since(start)
+	if elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Fatalf("drain took %v with grace 100ms", elapsed)
+	}
+
+	if len(sess.closeReasons()) != 1 {
+		t.Fatal("session not closed after grace")
+	}
+}
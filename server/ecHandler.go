@@ -2,107 +2,108 @@ package server
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"io"
 	"lxquic/protoj"
+	"lxquic/transport"
+	"strconv"
+	"sync"
 
-	"github.com/lucas-clemente/quic-go"
 	log "github.com/sirupsen/logrus"
 )
 
 type ecEndpoint struct {
 	index int
 
+	// target can be changed by admin, guarded by targetLock
+	targetLock  sync.Mutex
 	targetPort  int
 	targetDevID string
 
-	sess   quic.Session
-	stream quic.Stream
+	// support peer-to-peer direct path
+	p2p bool
+	// link streams are end-to-end encrypted
+	e2e bool
+	// link streams start with a header and are replied on
+	linkHeader bool
 
-	waitingPingCount int
+	cmdEndpoint
 }
 
-// keepalive send ping message peer, and counter
-func (ee *ecEndpoint) keepalive() {
-	if ee.stream == nil {
-		log.Println("ecEndpoint.keepalive ee.stream == nil")
-		return
+// replyLinkStream tell ec the result of its link stream, on the stream
+// if ec send link headers, ec before that only learn of failures by a
+// notification on the cmd stream, which can not tell the streams apart
+func (ee *ecEndpoint) replyLinkStream(stream transport.Stream, err error) error {
+	if err != nil {
+		onLinkClosed("ec", err)
 	}
 
-	// too many un-response ping, close the websocket connection
-	if ee.waitingPingCount > 3 {
-		if ee.sess != nil {
-			log.Println("ecEndpoint.keepalive keepalive failed, close, index:", ee.index)
-			ee.sess.CloseWithError(0, "keepalive failed")
-		}
-		return
+	reply := linkReply(err)
+	if ee.linkHeader {
+		return protoj.WriteLinkReply(stream, reply, ee.linkVersion())
 	}
 
-	var ping = &protoj.StreamCmd{
-		Cmd: "ping",
+	if err == nil {
+		return nil
 	}
 
-	err := protoj.StreamSendJSON(ee.stream, ping)
-	if err != nil {
-		log.Println("ecEndpoint.keepalive streamSendJSON ping error:", err)
-		return
+	return ee.sendCmd(&protoj.StreamCmd{
+		Cmd:    protoj.CmdLinkErr,
+		Code:   reply.Code,
+		Reason: reply.Reason,
+	})
+}
+
+// readLinkHeader read the header of ec link stream, the target is still
+// decided by the cmd stream header or admin
+func (ee *ecEndpoint) readLinkHeader(stream transport.Stream) error {
+	if !ee.linkHeader {
+		return nil
 	}
 
-	ee.waitingPingCount++
+	_, err := protoj.ReadLinkHeader(stream)
+	return err
 }
 
-func serveEC(sess quic.Session, stream quic.Stream, header *protoj.CmdStreamHeader) {
+func serveEC(sess transport.Session, stream transport.Stream, codec *protoj.CmdCodec, header *protoj.CmdStreamHeader) {
 	log.Printf("serveEC, got a ec endpoint:%+v", header)
 	ec := &ecEndpoint{
 		index:       ecIndex,
 		targetDevID: header.DUID,
 		targetPort:  header.Port,
-		sess:        sess,
-		stream:      stream,
+		cmdEndpoint: newCmdEndpoint("ec", strconv.Itoa(ecIndex), sess, stream, codec, header.Caps),
 	}
+	ec.p2p = header.P2P && ec.hasCap(protoj.CapP2P)
+	ec.e2e = header.E2E && ec.hasCap(protoj.CapE2E)
+	ec.linkHeader = ec.hasCap(protoj.CapLinkHeader)
 	ecIndex++
 
+	ec.rpc.Handle(protoj.CmdPunch, func(*protoj.StreamCmd) (*protoj.StreamCmd, error) {
+		go ec.onPunchRequest()
+		return nil, nil
+	})
+
+	ec.rpc.Handle(protoj.CmdList, func(cmd *protoj.StreamCmd) (*protoj.StreamCmd, error) {
+		return onListRequest(cmd, "ec")
+	})
+
+	mapLock.Lock()
 	ecmap[ec.index] = ec
+	mapLock.Unlock()
+	onlineEndpoints.Inc("ec")
+	defer sessionEvents(&ec.cmdEndpoint, header.DUID, header.Port)()
 
 	defer func() {
+		onlineEndpoints.Dec("ec")
+		mapLock.Lock()
 		delete(ecmap, ec.index)
+		mapLock.Unlock()
 	}()
 
 	go ec.serveCmdStream()
 	ec.acceptLinkStream()
 }
 
-// onPong update waiting response ping counter
-func (ee *ecEndpoint) onPong(data []byte) {
-	ee.waitingPingCount = 0
-}
-
-func (ee *ecEndpoint) serveCmdStream() {
-	stream := ee.stream
-	for {
-		message, err := protoj.StreamReadJSON(stream)
-		if err != nil {
-			log.Println("ecEndpoint.serveCmdStream streamReadJSON failed:", err)
-			break
-		}
-
-		var cmd = &protoj.StreamCmd{}
-		err = json.Unmarshal(message, cmd)
-		if err == nil {
-			//log.Printf("ecEndPoint.serveCmdStream get json:%+v", cmd)
-			if cmd.Cmd == "pong" {
-				ee.onPong(nil)
-			} else if cmd.Cmd == "ping" {
-				// reply pong
-				cmd.Cmd = "pong"
-				protoj.StreamSendJSON(stream, cmd)
-			}
-		} else {
-			log.Println("ecEndPoint.serveCmdStream json.Unmarshal failed:", err)
-		}
-	}
-}
-
 func (ee *ecEndpoint) acceptLinkStream() {
 	log.Println("ecEndpoint.acceptLinkStream wait link stream")
 	sess := ee.sess
@@ -113,54 +114,202 @@ func (ee *ecEndpoint) acceptLinkStream() {
 			return
 		}
 
-		es, ok := esmap[ee.targetDevID]
-		if !ok {
-			log.Printf("ecEndpoint.acceptLinkStream, not device found for:%s, close stream", ee.targetDevID)
-			ecStream.Close()
-			continue
+		linkOpened.Inc("ec")
+		devID, port := ee.target()
+		go ee.serveLinkStream(devID, port, ecStream)
+	}
+}
+
+// serveLinkStream link the stream to the device, on this relay or a peer
+// relay, the peer relay lookup may be slow so it is not done by the
+// accepting loop
+func (ee *ecEndpoint) serveLinkStream(devID string, port int, ecStream transport.Stream) {
+	err := ee.readLinkHeader(ecStream)
+	if err != nil {
+		log.Printf("ecEndpoint.serveLinkStream read link header failed:%v", err)
+		ecStream.Close()
+		return
+	}
+
+	es := routeES(devID, "ec", port)
+	if es == nil {
+		// the device may be on a peer relay
+		if relay := locateRelay(devID); relay != "" {
+			forwardEE(ee, relay, devID, port, ee.countStream(ecStream))
+			return
 		}
 
-		go pairEE(ee, es, ecStream)
+		log.Printf("ecEndpoint.acceptLinkStream, not device found for:%s, close stream", devID)
+		ee.replyLinkStream(ecStream, deviceOffline(devID))
+		ecStream.Close()
+		return
 	}
+
+	pairEE(ee, es, port, ee.countStream(ecStream))
 }
 
-func pairEE(ec *ecEndpoint, es *esEndpoint, ecStream quic.Stream) {
-	log.Printf("pairEE ec start link stream, target dev:%s, target port:%d", ec.targetDevID, ec.targetPort)
-	defer ecStream.Close()
-	sess := es.sess
-	if sess == nil {
-		log.Println("pairEE, sess is nil, discard")
+// target the device and port that link streams go to
+func (ee *ecEndpoint) target() (string, int) {
+	ee.targetLock.Lock()
+	defer ee.targetLock.Unlock()
+
+	return ee.targetDevID, ee.targetPort
+}
+
+func (ee *ecEndpoint) setTarget(devID string, port int) {
+	ee.targetLock.Lock()
+	defer ee.targetLock.Unlock()
+
+	ee.targetDevID = devID
+	ee.targetPort = port
+}
+
+func pairEE(ec *ecEndpoint, es *esEndpoint, port int, ecStream transport.Stream) {
+	defer trackLink()()
+
+	log.Printf("pairEE ec start link stream, target dev:%s, target port:%d", es.devID, port)
+
+	var err error
+	closeTunnel := tunnelEvents(&ec.cmdEndpoint, Event{Device: es.devID, Port: port})
+	defer func() {
+		closeTunnel(err)
+	}()
+
+	if ec.e2e && es.pubKey == "" {
+		log.Printf("pairEE, target dev:%s not support e2e, discard", es.devID)
+		err = &linkError{code: protoj.LinkReplyRefused, reason: "device not support e2e"}
+		ec.replyLinkStream(ecStream, err)
+		ecStream.Close()
 		return
 	}
 
-	esStream, err := sess.OpenStreamSync(context.Background())
+	err = devACL.check("ec", es, port)
 	if err != nil {
-		log.Printf("pairEE, sess OpenStreamSync failed:%v, discard", err)
+		log.Printf("pairEE, target dev:%s, %v, discard", es.devID, err)
+		ec.replyLinkStream(ecStream, err)
+		ecStream.Close()
 		return
 	}
 
-	defer esStream.Close()
-	log.Printf("sess.OpenStreamSync ok, target dev:%s", ec.targetDevID)
+	var header = &protoj.LinkStreamHeader{
+		Port: port,
+		E2E:  ec.e2e,
+	}
+
+	esStream, err := openESLink(es, header)
+	if err != nil {
+		log.Printf("pairEE, target dev:%s, open link failed:%v, discard", es.devID, err)
+		ec.replyLinkStream(ecStream, err)
+		ecStream.Close()
+		return
+	}
+
+	err = ec.replyLinkStream(ecStream, nil)
+	if err != nil {
+		log.Printf("pairEE, target dev:%s, reply ec failed:%v, discard", es.devID, err)
+		ecStream.Close()
+		esStream.Close()
+		return
+	}
+
+	bridgeStreams(ecStream, esStream)
+	onLinkClosed("ec", nil)
+	log.Printf("pairEE ec link stream end, target dev:%s, target port:%d", es.devID, port)
+}
+
+// forwardEE link the ec stream to the device on the peer relay
+func forwardEE(ec *ecEndpoint, relay string, devID string, port int, ecStream transport.Stream) {
+	defer trackLink()()
+
+	log.Printf("forwardEE ec start link stream, target dev:%s on relay:%s, target port:%d", devID, relay, port)
+
+	var err error
+	closeTunnel := tunnelEvents(&ec.cmdEndpoint, Event{Device: devID, Port: port, Relay: relay})
+	defer func() {
+		closeTunnel(err)
+	}()
 
 	var header = &protoj.LinkStreamHeader{
-		Port: ec.targetPort,
+		Port: port,
+		DUID: devID,
+		E2E:  ec.e2e,
+		Role: "ec",
 	}
 
-	protoj.StreamSendJSON(esStream, header)
+	peerStream, err := openPeerLink(relay, header)
 	if err != nil {
-		log.Printf("pairEE, esStream StreamSendJSON failed:%v, discard", err)
+		log.Printf("forwardEE, target dev:%s on relay:%s, open link failed:%v, discard", devID, relay, err)
+		ec.replyLinkStream(ecStream, err)
+		ecStream.Close()
 		return
 	}
 
-	log.Printf("protoj.StreamSendJSON ok, target dev:%s", ec.targetDevID)
+	err = ec.replyLinkStream(ecStream, nil)
+	if err != nil {
+		log.Printf("forwardEE, target dev:%s on relay:%s, reply ec failed:%v, discard", devID, relay, err)
+		ecStream.Close()
+		peerStream.Close()
+		return
+	}
+
+	bridgeStreams(ecStream, peerStream)
+	onLinkClosed("ec", nil)
+	log.Printf("forwardEE ec link stream end, target dev:%s on relay:%s, target port:%d", devID, relay, port)
+}
+
+// bridgeStreams copy data between the two streams, until one of them end
+func bridgeStreams(a transport.Stream, b transport.Stream) {
+	defer a.Close()
+	defer b.Close()
 
 	go func() {
-		defer esStream.Close()
-		defer ecStream.Close()
+		defer a.Close()
+		defer b.Close()
 
-		io.Copy(esStream, ecStream)
+		io.Copy(b, a)
 	}()
 
-	io.Copy(ecStream, esStream)
-	log.Printf("pairEE ec link stream end, target dev:%s, target port:%d", ec.targetDevID, ec.targetPort)
+	io.Copy(a, b)
+}
+
+// openESLink open a link stream to es endpoint and send the link header,
+// if the es has advertised its policy, wait for the es's reply
+func openESLink(es *esEndpoint, header *protoj.LinkStreamHeader) (transport.Stream, error) {
+	sess := es.sess
+	if sess == nil {
+		return nil, &linkError{code: protoj.LinkReplyNoDevice, reason: "device session is nil"}
+	}
+
+	esStream, err := sess.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, &linkError{code: protoj.LinkReplyDialFailed, reason: fmt.Sprintf("open device stream failed:%v", err)}
+	}
+
+	log.Printf("sess.OpenStreamSync ok, target dev:%s", es.devID)
+
+	// es that negotiated the reply will reply
+	header.Reply = es.hasCap(protoj.CapLinkReply)
+	err = protoj.WriteLinkHeader(esStream, header, es.linkVersion())
+	if err != nil {
+		esStream.Close()
+		return nil, &linkError{code: protoj.LinkReplyDialFailed, reason: fmt.Sprintf("send device link header failed:%v", err)}
+	}
+
+	log.Printf("openESLink send link header ok, target dev:%s", es.devID)
+	if !header.Reply {
+		return es.countStream(esStream), nil
+	}
+
+	reply, err := protoj.ReadLinkReply(esStream)
+	if err != nil {
+		esStream.Close()
+		return nil, &linkError{code: protoj.LinkReplyDialFailed, reason: fmt.Sprintf("read device link reply failed:%v", err)}
+	}
+
+	if reply.Code != protoj.LinkReplyOK {
+		esStream.Close()
+		return nil, &linkError{code: reply.Code, reason: "device: " + reply.Reason}
+	}
+
+	return es.countStream(esStream), nil
 }
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"lxquic/protoj"
+)
+
+func TestECReplyLinkStream(t *testing.T) {
+	es := &esEndpoint{devID: "dev1"}
+	a := testACL(t, "deny ec *")
+	aclErr := a.check("ec", es, 22)
+
+	var tests = []struct {
+		err  error
+		code int
+	}{
+		{nil, protoj.LinkReplyOK},
+		{aclErr, protoj.LinkReplyDenied},
+		{deviceOffline("dev1"), protoj.LinkReplyNoDevice},
+		{refused("device not support e2e"), protoj.LinkReplyRefused},
+	}
+
+	for _, caps := range [][]string{nil, {protoj.CapEnvelope}} {
+		for _, tt := range tests {
+			// ec that send link headers get the reply on the link stream
+			local, remote := net.Pipe()
+			ec := &ecEndpoint{linkHeader: true}
+			ec.caps = caps
+			go func() {
+				ec.replyLinkStream(local, tt.err)
+				local.Close()
+			}()
+
+			b, err := ioutil.ReadAll(remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the envelope only to ec that negotiated it
+			envelope := bytes.HasPrefix(b, []byte{0, 0, protoj.CmdVersionEnvelope})
+			if envelope != (caps != nil) {
+				t.Errorf("caps %v, reply % x", caps, b)
+			}
+
+			reply, err := protoj.ReadLinkReply(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reply.Code != tt.code {
+				t.Errorf("err %v, reply %+v, want code %d", tt.err, reply, tt.code)
+			}
+			remote.Close()
+		}
+	}
+}
+
+func TestECReplyLegacy(t *testing.T) {
+	// ec before link headers learn of the failure on the cmd stream
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	ec := &ecEndpoint{
+		cmdEndpoint: newCmdEndpoint("ec", "1", nil, local, protoj.NewCmdCodec(local), nil),
+	}
+
+	go func() {
+		ec.replyLinkStream(nil, deviceOffline("dev1"))
+		// success is not notified
+		ec.replyLinkStream(nil, nil)
+		local.Close()
+	}()
+
+	codec := protoj.NewCmdCodec(remote)
+	cmd, _, err := codec.ReadCmd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Cmd != protoj.CmdLinkErr || cmd.Code != protoj.LinkReplyNoDevice {
+		t.Fatalf("notification %+v", cmd)
+	}
+
+	cmd, _, err = codec.ReadCmd()
+	if err == nil {
+		t.Fatalf("notification of success %+v", cmd)
+	}
+}
@@ -0,0 +1,353 @@
+package server
+
+import (
+	"fmt"
+	"lxquic/protoj"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EgressParams px egress policy parameters
+type EgressParams struct {
+	// allow private, loopback and link-local targets
+	AllowPrivate bool
+	// CIDRs always allowed, even if they are private
+	AllowCIDRs []string
+	// CIDRs always denied
+	DenyCIDRs []string
+	// if not empty, only these domains (and their sub-domains) are allowed
+	AllowDomains []string
+	// domains (and their sub-domains) always denied
+	DenyDomains []string
+	// if not empty, only these ports are allowed
+	AllowPorts []int
+	// ports always denied
+	DenyPorts []int
+}
+
+// egressPolicy decide which targets px link stream can connect to
+type egressPolicy struct {
+	allowPrivate bool
+
+	allowNets []*net.IPNet
+	denyNets  []*net.IPNet
+
+	allowDomains []string
+	denyDomains  []string
+
+	allowPorts []int
+	denyPorts  []int
+}
+
+// linkError link stream failed, with a reply code report to client
+type linkError struct {
+	code   int
+	reason string
+}
+
+func (e *linkError) Error() string {
+	return e.reason
+}
+
+func refused(format string, a ...interface{}) error {
+	return &linkError{code: protoj.LinkReplyRefused, reason: fmt.Sprintf(format, a...)}
+}
+
+func denied(format string, a ...interface{}) error {
+	return &linkError{code: protoj.LinkReplyDenied, reason: fmt.Sprintf(format, a...)}
+}
+
+// linkReply reply of the link stream that failed with err, ok if nil
+func linkReply(err error) *protoj.LinkStreamReply {
+	var reply = &protoj.LinkStreamReply{
+		Code: protoj.LinkReplyOK,
+	}
+
+	if err != nil {
+		reply.Code = protoj.LinkReplyDialFailed
+		reply.Reason = err.Error()
+		if le, ok := err.(*linkError); ok {
+			reply.Code = le.code
+		}
+	}
+
+	return reply
+}
+
+func newEgressPolicy(params *EgressParams) (*egressPolicy, error) {
+	ep := &egressPolicy{}
+	if params == nil {
+		return ep, nil
+	}
+
+	ep.allowPrivate = params.AllowPrivate
+	ep.allowPorts = params.AllowPorts
+	ep.denyPorts = params.DenyPorts
+
+	var err error
+	ep.allowNets, err = parseCIDRs(params.AllowCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	ep.denyNets, err = parseCIDRs(params.DenyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+
+	ep.allowDomains = normalizeDomains(params.AllowDomains)
+	ep.denyDomains = normalizeDomains(params.DenyDomains)
+
+	return ep, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+
+		_, ipnet, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %s: %v", c, err)
+		}
+
+		nets = append(nets, ipnet)
+	}
+
+	return nets, nil
+}
+
+func normalizeDomains(domains []string) []string {
+	var result []string
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		d = strings.TrimPrefix(d, "*.")
+		d = strings.Trim(d, ".")
+		if d != "" {
+			result = append(result, d)
+		}
+	}
+
+	return result
+}
+
+// matchDomain match the domain itself and its sub-domains
+func matchDomain(host string, domains []string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsPort(ports []int, port int) bool {
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// privateNets not reachable on the internet, or reach the relay itself
+var privateNets = mustParseCIDRs(
+	"0.0.0.0/8",      // this network
+	"10.0.0.0/8",     // private
+	"100.64.0.0/10",  // CGNAT
+	"127.0.0.0/8",    // loopback
+	"169.254.0.0/16", // link-local, cloud metadata
+	"172.16.0.0/12",  // private
+	"192.0.0.0/24",   // ietf protocol assignments
+	"192.168.0.0/16", // private
+	"198.18.0.0/15",  // benchmarking
+	"224.0.0.0/4",    // multicast
+	"240.0.0.0/4",    // reserved, and 255.255.255.255 broadcast
+	"::/128",         // unspecified
+	"::1/128",        // loopback
+	"64:ff9b:1::/48", // local-use NAT64
+	"fc00::/7",       // unique local
+	"fe80::/10",      // link-local
+	"fec0::/10",      // site-local, deprecated
+	"ff00::/8",       // multicast
+)
+
+var (
+	// NAT64 well-known prefix, the ipv4 is the last 4 bytes
+	nat64Net = mustParseCIDRs("64:ff9b::/96")[0]
+	// 6to4, the ipv4 is bytes 2 to 6
+	sixToFourNet = mustParseCIDRs("2002::/16")[0]
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+
+	return nets
+}
+
+// embeddedIPv4 the ipv4 address carried by NAT64, 6to4 and
+// ipv4-compatible addresses, they reach that ipv4 through a gateway
+func embeddedIPv4(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return nil
+	}
+
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return nil
+	}
+
+	switch {
+	case nat64Net.Contains(ip16):
+		return net.IPv4(ip16[12], ip16[13], ip16[14], ip16[15])
+	case sixToFourNet.Contains(ip16):
+		return net.IPv4(ip16[2], ip16[3], ip16[4], ip16[5])
+	}
+
+	// ::a.b.c.d, but not :: and ::1
+	for _, b := range ip16[:12] {
+		if b != 0 {
+			return nil
+		}
+	}
+
+	if ip16[12] == 0 && ip16[13] == 0 && ip16[14] == 0 {
+		return nil
+	}
+
+	return net.IPv4(ip16[12], ip16[13], ip16[14], ip16[15])
+}
+
+// isPrivateIP loopback, private, link-local, reserved and multicast,
+// ipv4 mapped addresses are checked as ipv4
+func isPrivateIP(ip net.IP) bool {
+	return containsIP(privateNets, ip)
+}
+
+// checkTarget check the host name and port, before resolving
+func (ep *egressPolicy) checkTarget(host string, port int) error {
+	if port <= 0 || port > 65535 {
+		return refused("port %d out of range", port)
+	}
+
+	if containsPort(ep.denyPorts, port) {
+		return refused("port %d denied", port)
+	}
+
+	if len(ep.allowPorts) > 0 && !containsPort(ep.allowPorts, port) {
+		return refused("port %d not allowed", port)
+	}
+
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	if matchDomain(host, ep.denyDomains) {
+		return refused("domain %s denied", host)
+	}
+
+	if len(ep.allowDomains) > 0 && !matchDomain(host, ep.allowDomains) {
+		return refused("domain %s not allowed", host)
+	}
+
+	return nil
+}
+
+// checkIP check the resolved ip, and the ipv4 embedded in it
+func (ep *egressPolicy) checkIP(ip net.IP) error {
+	if v4 := embeddedIPv4(ip); v4 != nil {
+		err := ep.checkIP(v4)
+		if err != nil {
+			return refused("address %s embed %v", ip, err)
+		}
+	}
+
+	if containsIP(ep.denyNets, ip) {
+		return refused("address %s denied", ip)
+	}
+
+	if containsIP(ep.allowNets, ip) {
+		return nil
+	}
+
+	if !ep.allowPrivate && isPrivateIP(ip) {
+		return refused("private address %s not allowed", ip)
+	}
+
+	return nil
+}
+
+// resolve check the target, resolve it, and check every address,
+// the caller should dial the returned addresses only, never the
+// host name again, to defeat dns rebinding
+func (ep *egressPolicy) resolve(host string, port int) ([]net.IP, error) {
+	err := ep.checkTarget(host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ips, err = pxResolver.lookup(host)
+		if err != nil {
+			return nil, &linkError{code: protoj.LinkReplyDialFailed, reason: fmt.Sprintf("resolve %s failed:%v", host, err)}
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, &linkError{code: protoj.LinkReplyDialFailed, reason: fmt.Sprintf("no address for %s", host)}
+	}
+
+	// refuse if any address is denied, the name may be a rebinding one
+	for _, ip := range ips {
+		err = ep.checkIP(ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return ips, nil
+}
+
+// dial resolve and dial the target
+func (ep *egressPolicy) dial(host string, port int) (net.Conn, error) {
+	ips, err := ep.resolve(host, port)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+
+	conn, err := dialHappyEyeballs(addrs, 10*time.Second)
+	if err != nil {
+		return nil, &linkError{code: protoj.LinkReplyDialFailed, reason: err.Error()}
+	}
+
+	return conn, nil
+}
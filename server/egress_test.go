@@ -0,0 +1,223 @@
+package server
+
+import (
+	"bytes"
+	"lxquic/protoj"
+	"lxquic/transport"
+	"net"
+	"testing"
+)
+
+func TestEgressCheckIP(t *testing.T) {
+	var tests = []struct {
+		params *EgressParams
+		ip     string
+		denied bool
+	}{
+		{nil, "8.8.8.8", false},
+		{nil, "2001:4860:4860::8888", false},
+		{nil, "127.0.0.1", true},
+		{nil, "10.1.2.3", true},
+		{nil, "172.16.0.1", true},
+		{nil, "192.168.1.1", true},
+		{nil, "100.64.0.1", true},
+		{nil, "169.254.169.254", true},
+		{nil, "0.0.0.0", true},
+		{nil, "255.255.255.255", true},
+		{nil, "198.18.0.1", true},
+		{nil, "240.0.0.1", true},
+		{nil, "224.0.0.1", true},
+		{nil, "::", true},
+		{nil, "::1", true},
+		{nil, "fe80::1", true},
+		{nil, "fec0::1", true},
+		{nil, "fd00::1", true},
+		{nil, "::ffff:127.0.0.1", true},
+
+		// ipv4 embedded in ipv6
+		{nil, "64:ff9b::7f00:1", true},
+		{nil, "64:ff9b::a9fe:a9fe", true},
+		{nil, "64:ff9b::808:808", false},
+		{nil, "2002:7f00:1::1", true},
+		{nil, "2002:a9fe:a9fe::", true},
+		{nil, "2002:808:808::1", false},
+		{nil, "::127.0.0.1", true},
+		{nil, "::10.0.0.1", true},
+
+		{&EgressParams{AllowPrivate: true}, "10.1.2.3", false},
+
+		// deny beat allow
+		{&EgressParams{AllowCIDRs: []string{"10.0.0.0/8"}}, "10.2.0.1", false},
+		{&EgressParams{AllowCIDRs: []string{"10.0.0.0/8"}, DenyCIDRs: []string{"10.1.0.0/16"}}, "10.1.2.3", true},
+		{&EgressParams{AllowPrivate: true, DenyCIDRs: []string{"8.8.8.0/24"}}, "8.8.8.8", true},
+		{&EgressParams{AllowPrivate: true, DenyCIDRs: []string{"169.254.169.254/32"}}, "64:ff9b::a9fe:a9fe", true},
+	}
+
+	for _, tt := range tests {
+		ep, err := newEgressPolicy(tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ep.checkIP(net.ParseIP(tt.ip))
+		if (err != nil) != tt.denied {
+			t.Errorf("%s with %+v: err %v, denied %v", tt.ip, tt.params, err, tt.denied)
+		}
+	}
+}
+
+func TestEgressCheckTarget(t *testing.T) {
+	var tests = []struct {
+		params *EgressParams
+		host   string
+		port   int
+		denied bool
+	}{
+		{nil, "example.com", 443, false},
+		{nil, "example.com", 0, true},
+		{nil, "example.com", 65536, true},
+
+		// ports
+		{&EgressParams{DenyPorts: []int{25}}, "example.com", 25, true},
+		{&EgressParams{DenyPorts: []int{25}}, "example.com", 443, false},
+		{&EgressParams{AllowPorts: []int{80, 443}}, "example.com", 443, false},
+		{&EgressParams{AllowPorts: []int{80, 443}}, "example.com", 22, true},
+		{&EgressParams{AllowPorts: []int{25}, DenyPorts: []int{25}}, "example.com", 25, true},
+
+		// domains and their sub-domains
+		{&EgressParams{AllowDomains: []string{"example.com"}}, "example.com", 443, false},
+		{&EgressParams{AllowDomains: []string{"example.com"}}, "api.Example.com.", 443, false},
+		{&EgressParams{AllowDomains: []string{"example.com"}}, "badexample.com", 443, true},
+		{&EgressParams{AllowDomains: []string{"example.com"}}, "example.org", 443, true},
+		{&EgressParams{DenyDomains: []string{"*.evil.com"}}, "a.b.evil.com", 443, true},
+		{&EgressParams{DenyDomains: []string{"*.evil.com"}}, "evil.com", 443, true},
+		{&EgressParams{DenyDomains: []string{"evil.com"}}, "notevil.com", 443, false},
+		{&EgressParams{AllowDomains: []string{"evil.com"}, DenyDomains: []string{"evil.com"}}, "evil.com", 443, true},
+
+		// literal ip are checked after resolving only
+		{&EgressParams{AllowDomains: []string{"example.com"}}, "8.8.8.8", 443, false},
+	}
+
+	for _, tt := range tests {
+		ep, err := newEgressPolicy(tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = ep.checkTarget(tt.host, tt.port)
+		if (err != nil) != tt.denied {
+			t.Errorf("%s:%d with %+v: err %v, denied %v", tt.host, tt.port, tt.params, err, tt.denied)
+		}
+	}
+}
+
+// stubResolver make pxResolver ask the stub dns
+func stubResolver(t *testing.T, sd *stubDNS) {
+	res, err := newResolver(&ResolverParams{Upstreams: []string{"udp://" + sd.serveUDP(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := pxResolver
+	pxResolver = res
+	t.Cleanup(func() { pxResolver = old })
+}
+
+func TestEgressResolve(t *testing.T) {
+	ep, err := newEgressPolicy(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		addrs  [][4]byte
+		host   string
+		denied bool
+	}{
+		{[][4]byte{{8, 8, 8, 8}}, "public.lxquic.test", false},
+		{[][4]byte{{127, 0, 0, 1}}, "private.lxquic.test", true},
+		// a public address does not make the private one safe
+		{[][4]byte{{8, 8, 8, 8}, {127, 0, 0, 1}}, "rebind.lxquic.test", true},
+		{[][4]byte{{169, 254, 169, 254}, {8, 8, 4, 4}}, "metadata.lxquic.test", true},
+		{nil, "127.0.0.1", true},
+		{nil, "64:ff9b::7f00:1", true},
+	}
+
+	for _, tt := range tests {
+		stubResolver(t, &stubDNS{ttl: 30, addrs: tt.addrs})
+
+		ips, err := ep.resolve(tt.host, 443)
+		if (err != nil) != tt.denied {
+			t.Errorf("%s: ips %v, err %v, denied %v", tt.host, ips, err, tt.denied)
+		}
+
+		if err != nil && len(ips) > 0 {
+			t.Errorf("%s: denied but return ips %v", tt.host, ips)
+		}
+	}
+}
+
+// replyRecorder record what is written to the stream
+type replyRecorder struct {
+	transport.Stream
+	buf bytes.Buffer
+}
+
+func (rr *replyRecorder) Write(p []byte) (int, error) {
+	return rr.buf.Write(p)
+}
+
+func (rr *replyRecorder) reply(t *testing.T) *protoj.LinkStreamReply {
+	reply, err := protoj.ReadLinkReply(&rr.buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reply
+}
+
+func TestEgressReplyCode(t *testing.T) {
+	stubResolver(t, &stubDNS{ttl: 30, addrs: [][4]byte{{127, 0, 0, 1}}})
+
+	// a port nobody listen
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedPort := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	var tests = []struct {
+		params *EgressParams
+		host   string
+		port   int
+		code   int
+	}{
+		{nil, "127.0.0.1", 80, protoj.LinkReplyRefused},
+		{nil, "private.lxquic.test", 80, protoj.LinkReplyRefused},
+		{&EgressParams{DenyPorts: []int{25}}, "example.com", 25, protoj.LinkReplyRefused},
+		{&EgressParams{AllowPrivate: true}, "127.0.0.1", closedPort, protoj.LinkReplyDialFailed},
+	}
+
+	for _, tt := range tests {
+		ep, err := newEgressPolicy(tt.params)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := ep.dial(tt.host, tt.port)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s:%d dial ok", tt.host, tt.port)
+			continue
+		}
+
+		rr := &replyRecorder{}
+		replyPXStream(rr, &protoj.LinkStreamHeader{Host: tt.host, Port: tt.port, Reply: true}, err)
+
+		reply := rr.reply(t)
+		if reply.Code != tt.code || reply.Reason == "" {
+			t.Errorf("%s:%d reply %+v, want code %d", tt.host, tt.port, reply, tt.code)
+		}
+	}
+}
@@ -1,25 +1,44 @@
 package server
 
 import (
-	"encoding/json"
 	"lxquic/protoj"
+	"lxquic/transport"
 	"sync"
+	"time"
 
-	"github.com/lucas-clemente/quic-go"
 	log "github.com/sirupsen/logrus"
 )
 
 type esEndpoint struct {
 	devID string
 
-	sess   quic.Session
-	stream quic.Stream
+	// dial policy advertised by es, nil if es not advertise
+	policy *protoj.DevicePolicy
 
-	waitingPingCount int
+	// support peer-to-peer direct path, and its local candidates
+	p2p   bool
+	addrs []string
+
+	// e2e static public key, empty if es not support e2e
+	pubKey string
+
+	// discovery information
+	meta   *protoj.DeviceMeta
+	tags   []string
+	hidden bool
+
+	cmdEndpoint
 
 	wg sync.WaitGroup
 }
 
+// labels assigned to the device by admin, nil if none. the labels the
+// device report are listed only, an agent can not claim labels to be
+// routed to or allowed by acl
+func (ee *esEndpoint) labels() map[string]string {
+	return devRegistry.labelsOf(ee.devID)
+}
+
 func (ee *esEndpoint) close() {
 	stream := ee.stream
 	if stream != nil {
@@ -32,45 +51,31 @@ func (ee *esEndpoint) close() {
 	}
 }
 
-// keepalive send ping message peer, and counter
-func (ee *esEndpoint) keepalive() {
-	if ee.stream == nil {
-		log.Println("esEndpoint.keepalive ee.stream == nil")
-		return
-	}
-
-	// too many un-response ping, close the websocket connection
-	if ee.waitingPingCount > 3 {
-		if ee.sess != nil {
-			log.Println("esEndpoint.keepalive keepalive failed, close:", ee.devID)
-			ee.sess.CloseWithError(0, "keepalive failed")
-		}
-		return
-	}
+func serveES(sess transport.Session, stream transport.Stream, codec *protoj.CmdCodec, header *protoj.CmdStreamHeader) {
+	log.Printf("serveES, got a es endpoint:%+v", header)
+	es := &esEndpoint{
+		devID:  header.DUID,
+		policy: header.Policy,
+		addrs:  header.Addrs,
+		meta:   header.Meta,
+		tags:   header.Tags,
+		hidden: header.Hidden,
 
-	var ping = &protoj.StreamCmd{
-		Cmd: "ping",
+		cmdEndpoint: newCmdEndpoint("es", header.DUID, sess, stream, codec, header.Caps),
 	}
 
-	err := protoj.StreamSendJSON(ee.stream, ping)
-	if err != nil {
-		log.Println("esEndpoint.keepalive streamSendJSON ping error:", err)
-		return
+	es.p2p = header.P2P && es.hasCap(protoj.CapP2P)
+	if es.hasCap(protoj.CapE2E) {
+		// ec that ask for e2e are refused by devices without key
+		es.pubKey = header.PubKey
 	}
 
-	ee.waitingPingCount++
-}
-
-func serveES(sess quic.Session, stream quic.Stream, header *protoj.CmdStreamHeader) {
-	log.Printf("serveES, got a es endpoint:%+v", header)
-	es := &esEndpoint{
-		devID:  header.DUID,
-		sess:   sess,
-		stream: stream,
+	if es.policy != nil {
+		log.Printf("serveES, es:%s policy:%+v", es.devID, es.policy)
 	}
 
-	old, ok := esmap[es.devID]
-	if ok {
+	old := getES(es.devID)
+	if old != nil {
 		log.Println("serveES wait old es endpoint exit:", es.devID)
 		old.close()
 		// wait
@@ -79,44 +84,41 @@ func serveES(sess quic.Session, stream quic.Stream, header *protoj.CmdStreamHead
 	}
 
 	es.wg.Add(1)
+	mapLock.Lock()
 	esmap[es.devID] = es
+	mapLock.Unlock()
+	onlineEndpoints.Inc("es")
+	devRegistry.online(es.devID, sess.RemoteAddr().String(), es.tags, es.meta)
+	emitEvent(&Event{
+		Type:       EventDeviceOnline,
+		Role:       "es",
+		Session:    es.id,
+		RemoteAddr: sess.RemoteAddr().String(),
+		Device:     es.devID,
+	})
+	if cluster != nil {
+		cluster.register(es.devID)
+	}
 
 	defer func() {
+		onlineEndpoints.Dec("es")
+		mapLock.Lock()
 		delete(esmap, es.devID)
+		mapLock.Unlock()
+		if cluster != nil {
+			cluster.unregister(es.devID)
+		}
+		devRegistry.offline(es.devID, es.since)
+		emitEvent(&Event{
+			Type:       EventDeviceOffline,
+			Role:       "es",
+			Session:    es.id,
+			RemoteAddr: sess.RemoteAddr().String(),
+			Device:     es.devID,
+			Duration:   int64(time.Since(es.since) / time.Second),
+		})
 		es.wg.Done()
 	}()
 
 	es.serveCmdStream()
 }
-
-// onPong update waiting response ping counter
-func (ee *esEndpoint) onPong(data []byte) {
-	ee.waitingPingCount = 0
-}
-
-func (ee *esEndpoint) serveCmdStream() {
-	stream := ee.stream
-	for {
-		message, err := protoj.StreamReadJSON(stream)
-		if err != nil {
-			log.Println("esEndpoint.serveCmdStream streamReadJSON failed:", err)
-			break
-		}
-
-		var cmd = &protoj.StreamCmd{}
-		err = json.Unmarshal(message, cmd)
-		if err == nil {
-			//log.Printf("esEndPoint.serveCmdStream get json:%+v", cmd)
-			if cmd.Cmd == "pong" {
-				ee.onPong(nil)
-			} else if cmd.Cmd == "ping" {
-				// reply pong
-				cmd.Cmd = "pong"
-				protoj.StreamSendJSON(stream, cmd)
-			}
-		} else {
-			//
-			log.Println("esEndPoint.serveCmdStream json.Unmarshal failed:", err)
-		}
-	}
-}
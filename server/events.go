@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lxquic/backoff"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// event types
+const (
+	EventDeviceOnline  = "device.online"
+	EventDeviceOffline = "device.offline"
+	// ec or px session
+	EventSessionOpen  = "session.open"
+	EventSessionClose = "session.close"
+	// ec or px link stream, or ec direct path to device
+	EventTunnelOpen  = "tunnel.open"
+	EventTunnelClose = "tunnel.close"
+)
+
+const (
+	// DefaultEventBuffer events queued per webhook, new events are dropped
+	// when full
+	DefaultEventBuffer = 1024
+
+	webhookTimeout     = 10 * time.Second
+	webhookMaxAttempts = 5
+	webhookRetryMin    = time.Second
+	webhookRetryMax    = 30 * time.Second
+)
+
+// EventsParams where events go, events are disabled if no sink
+type EventsParams struct {
+	// webhook urls, each get every event, POST as json
+	Webhooks []string
+	// hmac-sha256 key to sign webhook requests, empty means unsigned
+	Secret string
+	// append events as json lines, empty means disable
+	File string
+	// events queued per webhook, 0 means DefaultEventBuffer
+	Buffer int
+}
+
+// Event device online or offline, session or tunnel open or close
+type Event struct {
+	// unique in the relay, the same on retries
+	ID   string    `json:"id"`
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+
+	Role       string `json:"role,omitempty"`
+	Session    string `json:"session,omitempty"`
+	RemoteAddr string `json:"remote,omitempty"`
+	Device     string `json:"device,omitempty"`
+	Port       int    `json:"port,omitempty"`
+	// tunnel only, target host of px or lan target of device
+	Host string `json:"host,omitempty"`
+	// the peer relay that the device is connected to
+	Relay string `json:"relay,omitempty"`
+	// tunnel only, peer-to-peer direct path, the relay only see the
+	// punch, so it is open at punch and close when the ec session end
+	Direct bool `json:"direct,omitempty"`
+
+	// close events only, seconds since open
+	Duration int64 `json:"duration,omitempty"`
+	// tunnel close only, ok, refused, no_device, dial_failed or error
+	Result string `json:"result,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// eventSink where events go, send must not block
+type eventSink interface {
+	send(ev *Event)
+}
+
+var (
+	// nil if events disabled
+	eventSinks []eventSink
+	eventSeq   uint64
+)
+
+// setupEvents create sinks of params
+func setupEvents(params *EventsParams) error {
+	if params == nil {
+		return nil
+	}
+
+	if params.File != "" {
+		sink, err := newFileSink(params.File)
+		if err != nil {
+			return err
+		}
+
+		eventSinks = append(eventSinks, sink)
+	}
+
+	buffer := params.Buffer
+	if buffer <= 0 {
+		buffer = DefaultEventBuffer
+	}
+
+	for _, url := range params.Webhooks {
+		eventSinks = append(eventSinks, newWebhookSink(url, params.Secret, buffer))
+	}
+
+	return nil
+}
+
+// emitEvent send event to all sinks, id and time are filled
+func emitEvent(ev *Event) {
+	if len(eventSinks) == 0 {
+		return
+	}
+
+	ev.ID = strconv.FormatInt(startTime.Unix(), 10) + "-" + strconv.FormatUint(atomic.AddUint64(&eventSeq, 1), 10)
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	for _, s := range eventSinks {
+		s.send(ev)
+	}
+}
+
+// tunnelEvents emit tunnel open event of ec or px, ev tell the target,
+// the returned function emit the close event, a nil error means ok
+func tunnelEvents(ce *cmdEndpoint, ev Event) func(err error) {
+	start := time.Now()
+	ev.Role = ce.role
+	ev.Session = ce.id
+	ev.RemoteAddr = ce.sess.RemoteAddr().String()
+
+	open := ev
+	open.Type = EventTunnelOpen
+	emitEvent(&open)
+
+	return func(err error) {
+		closed := ev
+		closed.Type = EventTunnelClose
+		closed.Duration = int64(time.Since(start) / time.Second)
+		closed.Result = linkResult(err)
+		if err != nil {
+			closed.Reason = err.Error()
+		}
+
+		emitEvent(&closed)
+	}
+}
+
+// sessionEvents emit session open event of ec or px endpoint, the returned
+// function emit the close event
+func sessionEvents(ce *cmdEndpoint, devID string, port int) func() {
+	ev := Event{
+		Role:       ce.role,
+		Session:    ce.id,
+		RemoteAddr: ce.sess.RemoteAddr().String(),
+		Device:     devID,
+		Port:       port,
+	}
+
+	open := ev
+	open.Type = EventSessionOpen
+	emitEvent(&open)
+
+	return func() {
+		closed := ev
+		closed.Type = EventSessionClose
+		closed.Duration = int64(time.Since(ce.since) / time.Second)
+		emitEvent(&closed)
+	}
+}
+
+// fileSink append events as json lines
+type fileSink struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{f: f}, nil
+}
+
+func (fs *fileSink) send(ev *Event) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	_, err = fs.f.Write(append(line, '\n'))
+	if err != nil {
+		eventsDropped.Inc("file")
+		log.Errorf("fileSink write event failed:%v", err)
+	}
+}
+
+// webhookSink POST events to url one by one in order, failed deliveries
+// are retried with backoff, events are dropped if the queue is full
+type webhookSink struct {
+	url    string
+	secret []byte
+	queue  chan *Event
+	client *http.Client
+}
+
+func newWebhookSink(url string, secret string, buffer int) *webhookSink {
+	ws := &webhookSink{
+		url:    url,
+		queue:  make(chan *Event, buffer),
+		client: &http.Client{Timeout: webhookTimeout},
+	}
+
+	if secret != "" {
+		ws.secret = []byte(secret)
+	}
+
+	go ws.run()
+	return ws
+}
+
+func (ws *webhookSink) send(ev *Event) {
+	select {
+	case ws.queue <- ev:
+	default:
+		eventsDropped.Inc("webhook")
+		log.Printf("webhookSink %s queue full, drop event:%s %s", ws.url, ev.Type, ev.ID)
+	}
+}
+
+func (ws *webhookSink) run() {
+	for ev := range ws.queue {
+		body, err := json.Marshal(ev)
+		if err != nil {
+			continue
+		}
+
+		ws.deliver(ev, body)
+	}
+}
+
+// deliver post the event until it is accepted, refused, or attempts
+// run out
+func (ws *webhookSink) deliver(ev *Event, body []byte) {
+	bo := backoff.New(webhookRetryMin, webhookRetryMax)
+	for {
+		retry, err := ws.post(ev, body)
+		if err == nil {
+			webhookDeliveries.Inc("ok")
+			return
+		}
+
+		if !retry || bo.Attempt() >= webhookMaxAttempts-1 {
+			webhookDeliveries.Inc("failed")
+			log.Errorf("webhookSink %s deliver event:%s %s failed:%v, drop", ws.url, ev.Type, ev.ID, err)
+			return
+		}
+
+		webhookDeliveries.Inc("retry")
+		delay := bo.Next()
+		log.Printf("webhookSink %s deliver event:%s %s failed:%v, retry in %v", ws.url, ev.Type, ev.ID, err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// post the event once, retry is true if the failure may be temporary
+func (ws *webhookSink) post(ev *Event, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, ws.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Lxquic-Event", ev.Type)
+	req.Header.Set("X-Lxquic-Event-Id", ev.ID)
+	req.Header.Set("X-Lxquic-Timestamp", ts)
+	if ws.secret != nil {
+		req.Header.Set("X-Lxquic-Signature", "sha256="+SignEvent(ws.secret, ts, body))
+	}
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+
+	err = fmt.Errorf("http status %d", resp.StatusCode)
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, err
+}
+
+// SignEvent hex hmac-sha256 of timestamp, a dot and the body, receivers
+// compare it with the X-Lxquic-Signature header after "sha256=", and
+// reject stale timestamps
+func SignEvent(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRecorder record events posted to it, status decide the reply of
+// each post, 200 if nil
+type webhookRecorder struct {
+	lock   sync.Mutex
+	events []*Event
+	posts  int
+	status func(posts int) int
+	// received a post, before reply
+	received chan *http.Request
+	// blocked until closed if not nil
+	release chan struct{}
+}
+
+func (wr *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	if wr.received != nil {
+		wr.received <- r
+	}
+
+	if wr.release != nil {
+		<-wr.release
+	}
+
+	wr.lock.Lock()
+	wr.posts++
+	status := http.StatusOK
+	if wr.status != nil {
+		status = wr.status(wr.posts)
+	}
+
+	if status == http.StatusOK {
+		var ev = &Event{}
+		json.Unmarshal(body, ev)
+		wr.events = append(wr.events, ev)
+	}
+	wr.lock.Unlock()
+
+	w.WriteHeader(status)
+}
+
+func (wr *webhookRecorder) delivered() []*Event {
+	wr.lock.Lock()
+	defer wr.lock.Unlock()
+
+	return append([]*Event{}, wr.events...)
+}
+
+func waitDelivered(t *testing.T, wr *webhookRecorder, n int, timeout time.Duration) []*Event {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if events := wr.delivered(); len(events) >= n {
+			return events
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("%d events delivered, expect %d", len(wr.delivered()), n)
+	return nil
+}
+
+func TestWebhookSignature(t *testing.T) {
+	var lock sync.Mutex
+	var checked string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(r.Header.Get("X-Lxquic-Timestamp") + "." + string(body)))
+		expect := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+		lock.Lock()
+		if r.Header.Get("X-Lxquic-Signature") != expect {
+			checked = "signature not match"
+		} else if r.Header.Get("X-Lxquic-Event") != EventTunnelOpen || r.Header.Get("X-Lxquic-Event-Id") != "1-1" {
+			checked = "event headers not match"
+		} else {
+			checked = "ok"
+		}
+		lock.Unlock()
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	ws := newWebhookSink(server.URL, "secret", 1)
+	body, _ := json.Marshal(&Event{ID: "1-1", Type: EventTunnelOpen})
+	retry, err := ws.post(&Event{ID: "1-1", Type: EventTunnelOpen}, body)
+	if err != nil || retry {
+		t.Fatalf("post got retry:%v, err:%v", retry, err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if checked != "ok" {
+		t.Fatal(checked)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	wr := &webhookRecorder{
+		status: func(posts int) int {
+			if posts == 1 {
+				return http.StatusServiceUnavailable
+			}
+			if posts == 3 {
+				return http.StatusBadRequest
+			}
+			return http.StatusOK
+		},
+	}
+	server := httptest.NewServer(wr)
+	defer server.Close()
+
+	ws := newWebhookSink(server.URL, "", 4)
+	ws.send(&Event{ID: "1", Type: EventDeviceOnline})
+	ws.send(&Event{ID: "2", Type: EventDeviceOffline})
+	ws.send(&Event{ID: "3", Type: EventDeviceOnline})
+
+	// 503 is retried after webhookRetryMin, 400 is not
+	events := waitDelivered(t, wr, 2, webhookRetryMin+5*time.Second)
+	if events[0].ID != "1" || events[1].ID != "3" {
+		t.Fatalf("delivered %s %s, expect 1 3", events[0].ID, events[1].ID)
+	}
+
+	wr.lock.Lock()
+	posts := wr.posts
+	wr.lock.Unlock()
+	if posts != 4 {
+		t.Fatalf("%d posts, expect 4", posts)
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	wr := &webhookRecorder{
+		received: make(chan *http.Request, 8),
+		release:  make(chan struct{}),
+	}
+	server := httptest.NewServer(wr)
+	defer server.Close()
+
+	ws := newWebhookSink(server.URL, "", 1)
+	ws.send(&Event{ID: "1"})
+	// the first is being delivered, the second wait in the queue, the
+	// third is dropped
+	<-wr.received
+	ws.send(&Event{ID: "2"})
+	ws.send(&Event{ID: "3"})
+	close(wr.release)
+
+	waitDelivered(t, wr, 2, 5*time.Second)
+	time.Sleep(100 * time.Millisecond)
+	events := wr.delivered()
+	if len(events) != 2 || events[0].ID != "1" || events[1].ID != "2" {
+		t.Fatalf("delivered %d events, expect 1 and 2", len(events))
+	}
+}
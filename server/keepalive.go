@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// keepalive loop check endpoints every tick, ping the ones due
+	keepaliveTick = time.Second
+)
+
+// Keepalive cmd stream keepalive of a role
+type Keepalive struct {
+	Interval time.Duration
+	// unanswered pings before the session is closed
+	Misses int
+}
+
+func (ka Keepalive) String() string {
+	return fmt.Sprintf("%v/%d", ka.Interval, ka.Misses)
+}
+
+// keepalive of es, ec and px
+var roleKeepalive = DefaultKeepalive()
+
+// DefaultKeepalive devices are often on cellular links, ping them less
+// often and tolerate more misses
+func DefaultKeepalive() map[string]Keepalive {
+	return map[string]Keepalive{
+		"es": {Interval: 15 * time.Second, Misses: 4},
+		"ec": {Interval: 5 * time.Second, Misses: 3},
+		"px": {Interval: 5 * time.Second, Misses: 3},
+	}
+}
+
+// ParseKeepalive parse "role=interval/misses", comma separated, e.g.
+// es=30s/4,ec=5s/3, misses can be omitted
+func ParseKeepalive(spec string) (map[string]Keepalive, error) {
+	result := make(map[string]Keepalive)
+	if strings.TrimSpace(spec) == "" {
+		return result, nil
+	}
+
+	defaults := DefaultKeepalive()
+	for _, item := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid keepalive:%s, expect role=interval/misses", item)
+		}
+
+		role := kv[0]
+		ka, ok := defaults[role]
+		if !ok {
+			return nil, fmt.Errorf("invalid keepalive role:%s", role)
+		}
+
+		value := kv[1]
+		if i := strings.Index(value, "/"); i >= 0 {
+			misses, err := strconv.Atoi(value[i+1:])
+			if err != nil || misses < 1 {
+				return nil, fmt.Errorf("invalid keepalive misses:%s", item)
+			}
+
+			ka.Misses = misses
+			value = value[:i]
+		}
+
+		interval, err := time.ParseDuration(value)
+		if err != nil || interval < keepaliveTick {
+			return nil, fmt.Errorf("invalid keepalive interval:%s", item)
+		}
+
+		ka.Interval = interval
+		result[role] = ka
+	}
+
+	return result, nil
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"lxquic/protoj"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// labelPrefix device id of this prefix is a label selector, the online
+// device that match it with the lowest rtt is chosen
+const labelPrefix = "label:"
+
+// routeES find the device that role link to, by device id or label selector,
+// devices selected by label must allow role to link to port, and hidden
+// ones are selected for px only
+func routeES(target string, role string, port int) *esEndpoint {
+	if !strings.HasPrefix(target, labelPrefix) {
+		return getES(target)
+	}
+
+	sel, err := parseSelector(strings.TrimPrefix(target, labelPrefix))
+	if err != nil {
+		return nil
+	}
+
+	mapLock.Lock()
+	defer mapLock.Unlock()
+
+	var best *esEndpoint
+	for _, es := range esmap {
+		if es.hidden && role != "px" {
+			continue
+		}
+
+		if !sel.match(es.labels()) || devACL.check(role, es, port) != nil {
+			continue
+		}
+
+		// unknown rtt is the worst
+		if best == nil || rttOrder(es) < rttOrder(best) {
+			best = es
+		}
+	}
+
+	return best
+}
+
+func rttOrder(ee *esEndpoint) time.Duration {
+	rtt := ee.rpc.RTT()
+	if rtt == 0 {
+		return time.Hour
+	}
+
+	return rtt
+}
+
+// onListRequest list online devices visible to role, hidden devices are
+// only listed to px, which is authenticated by proxy token
+func onListRequest(cmd *protoj.StreamCmd, role string) (*protoj.StreamCmd, error) {
+	var filter = &protoj.ListFilter{}
+	if len(cmd.Data) > 0 {
+		err := cmd.Bind(filter)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if filter.Pattern != "" {
+		// check the pattern once, so that a bad one is reported
+		_, err := path.Match(filter.Pattern, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sel, err := parseSelector(filter.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	return protoj.NewRPCCmd(protoj.CmdList, listDevices(filter, sel, role))
+}
+
+// listDevices online devices match the filter, sorted by device id
+func listDevices(filter *protoj.ListFilter, sel labelSelector, role string) []protoj.DeviceInfo {
+	mapLock.Lock()
+	defer mapLock.Unlock()
+
+	devices := make([]protoj.DeviceInfo, 0, len(esmap))
+	for _, es := range esmap {
+		if es.hidden && role != "px" {
+			continue
+		}
+
+		if !devACL.visible(role, es) || !sel.match(es.labels()) || !es.match(filter) {
+			continue
+		}
+
+		devices = append(devices, es.info())
+	}
+
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].DUID < devices[j].DUID
+	})
+
+	return devices
+}
+
+// match if device match the filter
+func (ee *esEndpoint) match(filter *protoj.ListFilter) bool {
+	if filter.Tag != "" {
+		found := false
+		for _, t := range ee.tags {
+			if t == filter.Tag {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return false
+		}
+	}
+
+	if filter.Pattern != "" {
+		ok, _ := path.Match(filter.Pattern, ee.devID)
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// info device information for discovery
+func (ee *esEndpoint) info() protoj.DeviceInfo {
+	info := protoj.DeviceInfo{
+		DUID:       ee.devID,
+		Tags:       ee.tags,
+		Meta:       ee.meta,
+		Labels:     ee.labels(),
+		Since:      ee.since,
+		RemoteAddr: ee.sess.RemoteAddr().String(),
+		RTT:        int64(ee.rpc.RTT() / time.Millisecond),
+		Health:     ee.health(),
+		P2P:        ee.p2p,
+		E2E:        ee.pubKey != "",
+	}
+
+	if ee.meta != nil {
+		info.Agent = ee.meta.Agent
+	}
+
+	return info
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"testing"
+
+	"lxquic/protoj"
+)
+
+// withES put the devices online for the test
+func withES(t *testing.T, devices ...*esEndpoint) {
+	mapLock.Lock()
+	for _, es := range devices {
+		esmap[es.devID] = es
+	}
+	mapLock.Unlock()
+
+	t.Cleanup(func() {
+		mapLock.Lock()
+		for _, es := range devices {
+			delete(esmap, es.devID)
+		}
+		mapLock.Unlock()
+	})
+}
+
+func TestRouteESLabels(t *testing.T) {
+	testRegistry(t)
+
+	old := devACL
+	devACL = testACL(t, "allow * *")
+	t.Cleanup(func() { devACL = old })
+
+	prod := labeledES(t, "prod1", map[string]string{"env": "prod"})
+	// claim the label, not assigned
+	claimed := labeledES(t, "claimed1", nil)
+	claimed.meta = &protoj.DeviceMeta{Labels: map[string]string{"env": "prod"}}
+	hidden := labeledES(t, "hidden1", map[string]string{"env": "prod"})
+	hidden.hidden = true
+	withES(t, prod, claimed, hidden)
+
+	if es := routeES("label:env=prod", "ec", 22); es != prod {
+		t.Fatalf("ec routed to %v, want prod1", es)
+	}
+
+	sel, _ := parseSelector("env=prod")
+	devices := listDevices(&protoj.ListFilter{}, sel, "ec")
+	if len(devices) != 1 || devices[0].DUID != "prod1" || devices[0].Labels["env"] != "prod" {
+		t.Fatalf("ec list %+v", devices)
+	}
+
+	// hidden devices are routed for px only
+	devRegistry.setLabels("prod1", nil)
+	if es := routeES("label:env=prod", "ec", 22); es != nil {
+		t.Fatalf("ec routed to %s", es.devID)
+	}
+
+	if es := routeES("label:env=prod", "px", 22); es != hidden {
+		t.Fatalf("px routed to %v, want hidden1", es)
+	}
+
+	// the device id still route
+	if es := routeES("claimed1", "ec", 22); es != claimed {
+		t.Fatalf("ec routed to %v by device id", es)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"lxquic/metrics"
+	"lxquic/protoj"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	onlineEndpoints = metrics.NewGauge("lxquic_server_online", "Online endpoints by role.", "role")
+	sessionsTotal   = metrics.NewCounter("lxquic_server_sessions_total", "Sessions accepted by negotiated protocol.", "protocol")
+	handshakeTime   = metrics.NewHistogram("lxquic_server_handshake_seconds", "Time from session accepted to cmd stream header read.", nil)
+
+	linkOpened = metrics.NewCounter("lxquic_server_link_streams_opened_total", "Link streams opened by ec, px and peer relays.", "role")
+	linkClosed = metrics.NewCounter("lxquic_server_link_streams_closed_total", "Link streams closed by role and result.", "role", "result")
+
+	pingRTT           = metrics.NewHistogram("lxquic_server_ping_rtt_seconds", "Keepalive ping round trip time by role.", nil, "role")
+	pingLost          = metrics.NewCounter("lxquic_server_ping_lost_total", "Keepalive pings not answered before the next one, by role.", "role")
+	keepaliveTimeouts = metrics.NewCounter("lxquic_server_keepalive_timeouts_total", "Sessions closed by keepalive timeout, by role.", "role")
+
+	eventsDropped     = metrics.NewCounter("lxquic_server_events_dropped_total", "Events dropped by sink, webhook queue full or file write failed.", "sink")
+	webhookDeliveries = metrics.NewCounter("lxquic_server_webhook_deliveries_total", "Webhook posts by result, ok, retry or failed.", "result")
+
+	resolverLookups    = metrics.NewCounter("lxquic_server_resolver_lookups_total", "px target name lookups by result, cached, ok or failed.", "result")
+	resolverLookupTime = metrics.NewHistogram("lxquic_server_resolver_lookup_seconds", "px target name lookup time, cache hits not included.", nil)
+
+	clusterLookups = metrics.NewCounter("lxquic_server_cluster_lookups_total", "Lookups of devices not on this relay in the cluster directory, by result.", "result")
+)
+
+// per-device metrics, devices may be many
+var metricsPerDevice bool
+
+// roleBytes link stream bytes by role, added by every Read and Write so
+// they are atomics, turned into series when scraped
+var roleBytes = map[string]*linkStats{
+	"es": {},
+	"ec": {},
+	"px": {},
+}
+
+func init() {
+	metrics.NewCounterFunc("lxquic_server_bytes_total", "Link stream bytes by role and direction, in is from the endpoint.", roleBytesSamples, "role", "direction")
+	metrics.NewCounterFunc("lxquic_server_device_bytes_total", "Link stream bytes of online devices by direction, only if per-device metrics enabled.", deviceBytesSamples, "device", "direction")
+}
+
+func roleBytesSamples() []metrics.Sample {
+	samples := make([]metrics.Sample, 0, 2*len(roleBytes))
+	for role, stats := range roleBytes {
+		samples = append(samples, stats.samples(role)...)
+	}
+
+	return samples
+}
+
+// deviceBytesSamples read the bytes of the current device sessions, a
+// device that left has no series, and start from 0 when it is back
+func deviceBytesSamples() []metrics.Sample {
+	if !metricsPerDevice {
+		return nil
+	}
+
+	mapLock.Lock()
+	defer mapLock.Unlock()
+
+	samples := make([]metrics.Sample, 0, 2*len(esmap))
+	for devID, es := range esmap {
+		samples = append(samples, es.stats.samples(devID)...)
+	}
+
+	return samples
+}
+
+func (ls *linkStats) samples(label string) []metrics.Sample {
+	return []metrics.Sample{
+		{LabelValues: []string{label, "in"}, Value: float64(atomic.LoadInt64(&ls.bytesIn))},
+		{LabelValues: []string{label, "out"}, Value: float64(atomic.LoadInt64(&ls.bytesOut))},
+	}
+}
+
+// linkResult result label of link stream
+func linkResult(err error) string {
+	if err == nil {
+		return "ok"
+	}
+
+	le, ok := err.(*linkError)
+	if !ok {
+		return "error"
+	}
+
+	switch le.code {
+	case protoj.LinkReplyRefused:
+		return "refused"
+	case protoj.LinkReplyDenied:
+		return "denied"
+	case protoj.LinkReplyNoDevice:
+		return "no_device"
+	case protoj.LinkReplyDialFailed:
+		return "dial_failed"
+	}
+
+	return "error"
+}
+
+// onLinkClosed count the link stream by result
+func onLinkClosed(role string, err error) {
+	linkClosed.Inc(role, linkResult(err))
+}
+
+// startMetrics serve /metrics on separate listener
+func startMetrics(addr string) {
+	log.Printf("metrics listen at:%s", addr)
+	go func() {
+		err := metrics.ListenAndServe(addr)
+		log.Fatalln("metrics ListenAndServe failed:", err)
+	}()
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"lxquic/transport"
+	"testing"
+)
+
+// nopStream discard writes
+type nopStream struct {
+	transport.Stream
+}
+
+func (nopStream) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestDeviceBytesSamples(t *testing.T) {
+	old := metricsPerDevice
+	metricsPerDevice = true
+	defer func() { metricsPerDevice = old }()
+
+	es := &esEndpoint{devID: "metrics-dev"}
+	es.role, es.id = "es", es.devID
+	es.stats = &linkStats{}
+
+	stream := es.countStream(&nopStream{})
+	stream.Write(make([]byte, 10))
+
+	mapLock.Lock()
+	esmap[es.devID] = es
+	mapLock.Unlock()
+
+	found := false
+	for _, s := range deviceBytesSamples() {
+		if s.LabelValues[0] == es.devID && s.LabelValues[1] == "out" {
+			found = s.Value == 10
+		}
+	}
+
+	if !found {
+		t.Fatalf("device out bytes not 10: %+v", deviceBytesSamples())
+	}
+
+	mapLock.Lock()
+	delete(esmap, es.devID)
+	mapLock.Unlock()
+
+	for _, s := range deviceBytesSamples() {
+		if s.LabelValues[0] == es.devID {
+			t.Fatalf("series of the device that left: %+v", s)
+		}
+	}
+}
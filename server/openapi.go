@@ -0,0 +1,285 @@
+package server
+
+// openAPISpec description of admin api
+const openAPISpec = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "lxquic admin api",
+    "version": "1"
+  },
+  "servers": [{"url": "/api/v1"}],
+  "security": [{"bearer": []}],
+  "paths": {
+    "/info": {
+      "get": {
+        "summary": "build and config information",
+        "responses": {
+          "200": {"description": "ok", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/ServerInfo"}}}}
+        }
+      }
+    },
+    "/sessions": {
+      "get": {
+        "summary": "list es, ec and px sessions",
+        "responses": {
+          "200": {"description": "ok", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Session"}}}}}
+        }
+      }
+    },
+    "/sessions/{role}/{id}": {
+      "delete": {
+        "summary": "kick a device or client",
+        "parameters": [
+          {"name": "role", "in": "path", "required": true, "schema": {"type": "string", "enum": ["es", "ec", "px"]}},
+          {"name": "id", "in": "path", "required": true, "description": "device id of es, index of ec and px", "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "204": {"description": "session closed"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/mappings": {
+      "get": {
+        "summary": "list the device and port that link streams of every ec go to",
+        "responses": {
+          "200": {"description": "ok", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Mapping"}}}}}
+        }
+      }
+    },
+    "/mappings/{id}": {
+      "put": {
+        "summary": "change the target of new link streams of an ec",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Mapping"}}}},
+        "responses": {
+          "200": {"description": "ok", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Mapping"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/acl": {
+      "get": {
+        "summary": "list acl rules, in order",
+        "responses": {
+          "200": {"description": "ok", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ACLRule"}}}}}
+        }
+      },
+      "put": {
+        "summary": "replace acl rules, and save them to the acl file if any",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ACLRule"}}}}},
+        "responses": {
+          "200": {"description": "ok", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/ACLRule"}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/devices": {
+      "get": {
+        "summary": "list known devices, online or not",
+        "parameters": [
+          {"name": "online", "in": "query", "schema": {"type": "boolean"}, "description": "only online or offline devices"}
+        ],
+        "responses": {
+          "200": {"description": "ok", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/DeviceRecord"}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/devices/{id}": {
+      "parameters": [
+        {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+      ],
+      "get": {
+        "summary": "get a known device",
+        "responses": {
+          "200": {"description": "ok", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DeviceRecord"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "delete": {
+        "summary": "forget an offline device, its history is kept",
+        "responses": {
+          "204": {"description": "forgotten"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/devices/{id}/history": {
+      "get": {
+        "summary": "latest online and offline events of the device, oldest first",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}},
+          {"name": "limit", "in": "query", "schema": {"type": "integer", "default": 100, "maximum": 10000}}
+        ],
+        "responses": {
+          "200": {"description": "ok", "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/HistoryEvent"}}}}},
+          "400": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/devices/{id}/labels": {
+      "parameters": [
+        {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+      ],
+      "get": {
+        "summary": "labels assigned to the device, that acl and label routing match",
+        "responses": {
+          "200": {"description": "ok", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Labels"}}}},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      },
+      "put": {
+        "summary": "replace the labels assigned to a known device, the labels it report are not used by acl and routing",
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Labels"}}}},
+        "responses": {
+          "200": {"description": "ok", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Labels"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/drain": {
+      "post": {
+        "summary": "stop accepting sessions, tell clients to go away, close sessions after link streams end or the grace period",
+        "requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Drain"}}}},
+        "responses": {
+          "202": {"description": "draining started", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Drain"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "409": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearer": {"type": "http", "scheme": "bearer"}
+    },
+    "responses": {
+      "Error": {"description": "error", "content": {"application/json": {"schema": {"type": "object", "properties": {"error": {"type": "string"}}}}}}
+    },
+    "schemas": {
+      "ServerInfo": {
+        "type": "object",
+        "properties": {
+          "version": {"type": "string"},
+          "go_version": {"type": "string"},
+          "os": {"type": "string"},
+          "arch": {"type": "string"},
+          "start_time": {"type": "string", "format": "date-time"},
+          "protocols": {"type": "array", "items": {"type": "string"}},
+          "listen": {"type": "string"},
+          "tcp_listen": {"type": "string"},
+          "proxy_enabled": {"type": "boolean"},
+          "acl_file": {"type": "string"},
+          "egress": {"type": "object"},
+          "resolver": {"type": "object"},
+          "cluster": {"type": "object", "properties": {"addr": {"type": "string"}, "peers": {"type": "array", "items": {"type": "string"}}}},
+          "draining": {"type": "boolean"},
+          "active_links": {"type": "integer"}
+        }
+      },
+      "DeviceRecord": {
+        "type": "object",
+        "properties": {
+          "duid": {"type": "string"},
+          "first_seen": {"type": "string", "format": "date-time"},
+          "last_seen": {"type": "string", "format": "date-time"},
+          "online": {"type": "boolean"},
+          "remote": {"type": "string"},
+          "tags": {"type": "array", "items": {"type": "string"}},
+          "meta": {"type": "object", "description": "reported by the device"},
+          "labels": {"$ref": "#/components/schemas/Labels"}
+        }
+      },
+      "Labels": {
+        "type": "object",
+        "description": "labels assigned by admin, key to value",
+        "additionalProperties": {"type": "string"}
+      },
+      "HistoryEvent": {
+        "type": "object",
+        "properties": {
+          "time": {"type": "string", "format": "date-time"},
+          "duid": {"type": "string"},
+          "event": {"type": "string", "enum": ["online", "offline"]},
+          "remote": {"type": "string"},
+          "duration": {"type": "integer", "description": "offline only, seconds online"},
+          "reason": {"type": "string"}
+        }
+      },
+      "Drain": {
+        "type": "object",
+        "properties": {
+          "relay": {"type": "string", "description": "alternate relay address clients reconnect to"},
+          "grace": {"type": "integer", "description": "seconds to wait link streams, default 30"}
+        }
+      },
+      "Session": {
+        "type": "object",
+        "properties": {
+          "role": {"type": "string", "enum": ["es", "ec", "px"]},
+          "id": {"type": "string"},
+          "remote": {"type": "string"},
+          "protocol": {"type": "string"},
+          "since": {"type": "string", "format": "date-time"},
+          "duration": {"type": "integer", "description": "seconds"},
+          "rtt": {"type": "integer", "description": "smoothed, milliseconds, 0 if unknown"},
+          "bytes_in": {"type": "integer"},
+          "bytes_out": {"type": "integer"},
+          "health": {"$ref": "#/components/schemas/LinkHealth"},
+          "conn": {"$ref": "#/components/schemas/ConnStats"},
+          "meta": {"type": "object", "description": "es only, device metadata"},
+          "device": {"type": "string", "description": "ec only"},
+          "port": {"type": "integer", "description": "ec only"}
+        }
+      },
+      "LinkHealth": {
+        "type": "object",
+        "description": "measured by keepalive pings, absent until the first ping answered or lost",
+        "properties": {
+          "rtt": {"type": "number", "description": "smoothed round trip time, milliseconds"},
+          "last_rtt": {"type": "number", "description": "milliseconds"},
+          "jitter": {"type": "number", "description": "milliseconds"},
+          "loss": {"type": "number", "description": "ratio of recent pings lost, 0 to 1"},
+          "sent": {"type": "integer"},
+          "lost": {"type": "integer"}
+        }
+      },
+      "ConnStats": {
+        "type": "object",
+        "properties": {
+          "transport": {"type": "string", "enum": ["quic", "tcp"]},
+          "tls_version": {"type": "string"},
+          "datagrams": {"type": "boolean", "description": "quic only"},
+          "streams": {"type": "integer", "description": "tcp only"},
+          "bytes_in": {"type": "integer", "description": "tcp only"},
+          "bytes_out": {"type": "integer", "description": "tcp only"}
+        }
+      },
+      "Mapping": {
+        "type": "object",
+        "required": ["device", "port"],
+        "properties": {
+          "id": {"type": "string", "readOnly": true},
+          "device": {"type": "string", "description": "device id, or label:selector"},
+          "port": {"type": "integer", "minimum": 1, "maximum": 65535}
+        }
+      },
+      "ACLRule": {
+        "type": "object",
+        "required": ["allow", "role", "selector"],
+        "properties": {
+          "allow": {"type": "boolean"},
+          "role": {"type": "string", "enum": ["ec", "px", "*"]},
+          "selector": {"type": "string", "description": "label selector, e.g. env=prod,region!=eu, * for all"},
+          "ports": {"type": "array", "items": {"type": "integer"}, "description": "empty means all ports"}
+        }
+      }
+    }
+  }
+}
+`
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"lxquic/protoj"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// es confirm the punch in this time
+const punchConfirmTimeout = 5 * time.Second
+
+// onPunchRequest ec request a direct path to its target device, tell both
+// sides the peer's observed addresses at the same time, so that they can
+// punch holes simultaneously
+func (ee *ecEndpoint) onPunchRequest() {
+	var reply = &protoj.StreamCmd{
+		Cmd: protoj.CmdPunch,
+	}
+
+	devID, port := ee.target()
+	es := routeES(devID, "ec", port)
+	if es == nil {
+		reply.Code = protoj.LinkReplyNoDevice
+		reply.Reason = "device offline"
+		ee.sendCmd(reply)
+		return
+	}
+
+	if !ee.p2p || !es.p2p {
+		reply.Code = protoj.LinkReplyRefused
+		reply.Reason = "peer-to-peer not supported"
+		ee.sendCmd(reply)
+		return
+	}
+
+	// the direct session bypass the relay, check the acl now, es only
+	// accept the port of the token
+	err := devACL.check("ec", es, port)
+	if err != nil {
+		log.Printf("ecEndpoint.onPunchRequest, dev:%s, %v", es.devID, err)
+		reply.Code = protoj.LinkReplyRefused
+		reply.Reason = err.Error()
+		ee.sendCmd(reply)
+		return
+	}
+
+	token, err := newPunchToken()
+	if err != nil {
+		log.Println("ecEndpoint.onPunchRequest newPunchToken failed:", err)
+		return
+	}
+
+	ecAddr := ee.sess.RemoteAddr().String()
+	esAddrs := append([]string{es.sess.RemoteAddr().String()}, es.addrs...)
+
+	log.Printf("ecEndpoint.onPunchRequest, ec:%s, dev:%s, es:%v", ecAddr, es.devID, esAddrs)
+
+	// es first, it should be ready when ec's packets arrive, es that
+	// support rpc confirm it has taken the token
+	var punch = &protoj.StreamCmd{
+		Cmd:   protoj.CmdPunch,
+		Addrs: []string{ecAddr},
+		Token: token,
+		Port:  port,
+	}
+
+	_, err = es.rpc.Call(punch, punchConfirmTimeout)
+	if err == protoj.ErrRPCUnsupported {
+		err = es.sendCmd(punch)
+	}
+
+	if err != nil {
+		log.Println("ecEndpoint.onPunchRequest es punch failed:", err)
+		reply.Code = protoj.LinkReplyRefused
+		reply.Reason = fmt.Sprintf("device punch failed:%v", err)
+		ee.sendCmd(reply)
+		return
+	}
+
+	reply.Addrs = esAddrs
+	reply.Token = token
+	ee.sendCmd(reply)
+
+	if len(eventSinks) == 0 {
+		return
+	}
+
+	// the relay does not see the direct session end, the ec session is
+	// the closest it knows
+	closeTunnel := tunnelEvents(&ee.cmdEndpoint, Event{Device: es.devID, Port: port, Direct: true})
+	go func() {
+		<-ee.sess.Context().Done()
+		closeTunnel(nil)
+	}()
+}
+
+func newPunchToken() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b[:]), nil
+}
@@ -2,12 +2,11 @@ package server
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
 	"lxquic/protoj"
+	"lxquic/transport"
 	"net"
+	"strconv"
 
-	"github.com/lucas-clemente/quic-go"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -16,92 +15,41 @@ type pxEndpoint struct {
 
 	proxyToken string
 
-	sess   quic.Session
-	stream quic.Stream
-
-	waitingPingCount int
-}
-
-// keepalive send ping message peer, and counter
-func (ee *pxEndpoint) keepalive() {
-	if ee.stream == nil {
-		log.Println("pxEndpoint.keepalive ee.stream == nil")
-		return
-	}
-
-	// too many un-response ping, close the websocket connection
-	if ee.waitingPingCount > 3 {
-		if ee.sess != nil {
-			log.Println("pxEndpoint.keepalive keepalive failed, close, index:", ee.index)
-			ee.sess.CloseWithError(0, "keepalive failed")
-		}
-		return
-	}
-
-	var ping = &protoj.StreamCmd{
-		Cmd: "ping",
-	}
-
-	err := protoj.StreamSendJSON(ee.stream, ping)
-	if err != nil {
-		log.Println("pxEndpoint.keepalive streamSendJSON ping error:", err)
-		return
-	}
-
-	ee.waitingPingCount++
-}
-
-// onPong update waiting response ping counter
-func (ee *pxEndpoint) onPong(data []byte) {
-	ee.waitingPingCount = 0
-}
-
-func (ee *pxEndpoint) serveCmdStream() {
-	stream := ee.stream
-	for {
-		message, err := protoj.StreamReadJSON(stream)
-		if err != nil {
-			log.Println("pxEndpoint.serveCmdStream streamReadJSON failed:", err)
-			break
-		}
-
-		var cmd = &protoj.StreamCmd{}
-		err = json.Unmarshal(message, cmd)
-		if err == nil {
-			//log.Printf("ecEndPoint.serveCmdStream get json:%+v", cmd)
-			if cmd.Cmd == "pong" {
-				ee.onPong(nil)
-			} else if cmd.Cmd == "ping" {
-				// reply pong
-				cmd.Cmd = "pong"
-				protoj.StreamSendJSON(stream, cmd)
-			}
-		} else {
-			log.Println("pxEndpoint.serveCmdStream json.Unmarshal failed:", err)
-		}
-	}
+	cmdEndpoint
 }
 
-func servePX(sess quic.Session, stream quic.Stream, header *protoj.CmdStreamHeader) {
+func servePX(sess transport.Session, stream transport.Stream, codec *protoj.CmdCodec, header *protoj.CmdStreamHeader) {
 	log.Printf("servePX, got a px endpoint:%+v", header)
 	if header.DUID != proxyToken {
 		log.Printf("servePX proxy token not match %s != %s", header.DUID, proxyToken)
+		denySession(sess, codec, "proxy token not match")
 		return
 	}
 
 	px := &pxEndpoint{
 		index:      ecIndex,
 		proxyToken: header.DUID,
-		sess:       sess,
-		stream:     stream,
+
+		cmdEndpoint: newCmdEndpoint("px", strconv.Itoa(ecIndex), sess, stream, codec, header.Caps),
 	}
 
 	ecIndex++
 
+	px.rpc.Handle(protoj.CmdList, func(cmd *protoj.StreamCmd) (*protoj.StreamCmd, error) {
+		return onListRequest(cmd, "px")
+	})
+
+	mapLock.Lock()
 	pxmap[px.index] = px
+	mapLock.Unlock()
+	onlineEndpoints.Inc("px")
+	defer sessionEvents(&px.cmdEndpoint, "", 0)()
 
 	defer func() {
+		onlineEndpoints.Dec("px")
+		mapLock.Lock()
 		delete(pxmap, px.index)
+		mapLock.Unlock()
 	}()
 
 	go px.serveCmdStream()
@@ -118,36 +66,50 @@ func (ee *pxEndpoint) acceptPXStream() {
 			return
 		}
 
-		go servePXStream(ecStream)
+		linkOpened.Inc("px")
+		go servePXStream(&ee.cmdEndpoint, ee.countStream(ecStream))
 	}
 }
 
-func servePXStream(stream quic.Stream) {
+func servePXStream(px *cmdEndpoint, stream transport.Stream) {
+	defer trackLink()()
 	defer stream.Close()
 
-	// read LinkStreamHeader
-	message, err := protoj.StreamReadJSON(stream)
+	header, err := protoj.ReadLinkHeader(stream)
 	if err != nil {
-		log.Errorf("servePXStream streamReadJSON failed:%v", err)
+		log.Errorf("servePXStream read link header failed:%v", err)
 		return
 	}
 
-	var header = &protoj.LinkStreamHeader{}
-	err = json.Unmarshal(message, header)
-	if err != nil {
-		log.Errorf("servePXStream json.UnMarshal failed:%v", err)
+	// px that did not negotiate the reply would not read it
+	header.Reply = header.Reply && px.hasCap(protoj.CapLinkReply)
+
+	if header.DUID != "" {
+		// use the device as exit node
+		servePXDeviceStream(px, stream, header)
 		return
 	}
 
-	// only allow connect to local host
-	address := fmt.Sprintf("%s:%d", header.Host, header.Port)
-
+	address := net.JoinHostPort(header.Host, strconv.Itoa(header.Port))
 	log.Printf("servePXStream, try link to:%s", address)
 
-	// connect to local network via tcp
-	conn, err := net.Dial("tcp", address)
+	closeTunnel := tunnelEvents(px, Event{Host: header.Host, Port: header.Port})
+	defer func() {
+		closeTunnel(err)
+	}()
+
+	// connect to target via tcp, subject to egress policy
+	conn, err := pxEgress.dial(header.Host, header.Port)
 	if err != nil {
 		log.Errorf("servePXStream connect to address:%s failed:%v", address, err)
+		replyPXStream(stream, header, err)
+		return
+	}
+
+	err = replyPXStream(stream, header, nil)
+	if err != nil {
+		log.Errorf("servePXStream reply failed:%v", err)
+		conn.Close()
 		return
 	}
 
@@ -194,5 +156,100 @@ func servePXStream(stream quic.Stream) {
 		}
 	}
 
+	onLinkClosed("px", nil)
 	log.Println("servePXStream, pair link stream end")
 }
+
+// servePXDeviceStream link the px stream to the device specified by header
+func servePXDeviceStream(px *cmdEndpoint, stream transport.Stream, header *protoj.LinkStreamHeader) {
+	log.Printf("servePXStream, try link to:%s:%d via device:%s", header.Host, header.Port, header.DUID)
+	es := routeES(header.DUID, "px", header.Port)
+	if es == nil {
+		// the device may be on a peer relay
+		if relay := locateRelay(header.DUID); relay != "" {
+			forwardPXDeviceStream(px, stream, header, relay)
+			return
+		}
+
+		log.Printf("servePXStream, not device found for:%s, close stream", header.DUID)
+		replyPXStream(stream, header, deviceOffline(header.DUID))
+		return
+	}
+
+	var err error
+	closeTunnel := tunnelEvents(px, Event{Device: es.devID, Host: header.Host, Port: header.Port})
+	defer func() {
+		closeTunnel(err)
+	}()
+
+	err = devACL.check("px", es, header.Port)
+	if err != nil {
+		log.Printf("servePXStream, device:%s, %v", es.devID, err)
+		replyPXStream(stream, header, err)
+		return
+	}
+
+	esStream, err := openESLink(es, &protoj.LinkStreamHeader{Port: header.Port, Host: header.Host})
+	if err != nil {
+		log.Printf("servePXStream, device:%s open link failed:%v", header.DUID, err)
+		replyPXStream(stream, header, err)
+		return
+	}
+
+	err = replyPXStream(stream, header, nil)
+	if err != nil {
+		log.Errorf("servePXStream reply failed:%v", err)
+		esStream.Close()
+		return
+	}
+
+	bridgeStreams(stream, esStream)
+	onLinkClosed("px", nil)
+	log.Printf("servePXStream, device link stream end, device:%s", header.DUID)
+}
+
+// forwardPXDeviceStream link the px stream to the device on the peer relay
+func forwardPXDeviceStream(px *cmdEndpoint, stream transport.Stream, header *protoj.LinkStreamHeader, relay string) {
+	var err error
+	closeTunnel := tunnelEvents(px, Event{Device: header.DUID, Host: header.Host, Port: header.Port, Relay: relay})
+	defer func() {
+		closeTunnel(err)
+	}()
+
+	peerStream, err := openPeerLink(relay, &protoj.LinkStreamHeader{
+		Port: header.Port,
+		Host: header.Host,
+		DUID: header.DUID,
+		Role: "px",
+	})
+	if err != nil {
+		log.Printf("servePXStream, device:%s on relay:%s open link failed:%v", header.DUID, relay, err)
+		replyPXStream(stream, header, err)
+		return
+	}
+
+	err = replyPXStream(stream, header, nil)
+	if err != nil {
+		log.Errorf("servePXStream reply failed:%v", err)
+		peerStream.Close()
+		return
+	}
+
+	bridgeStreams(stream, peerStream)
+	onLinkClosed("px", nil)
+	log.Printf("servePXStream, device link stream end, device:%s on relay:%s", header.DUID, relay)
+}
+
+// replyPXStream send link stream reply to px client if the header ask for it,
+// a nil error means ok
+func replyPXStream(stream transport.Stream, header *protoj.LinkStreamHeader, err error) error {
+	if err != nil {
+		onLinkClosed("px", err)
+	}
+
+	if !header.Reply {
+		return nil
+	}
+
+	return protoj.WriteLinkReply(stream, linkReply(err), header.Version())
+}
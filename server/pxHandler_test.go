@@ -0,0 +1,160 @@
+package server
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"lxquic/protoj"
+	"lxquic/transport"
+)
+
+// pipeSessions client and server sessions over the mux, closed at cleanup
+func pipeSessions(t *testing.T) (transport.Session, transport.Session) {
+	client, server := transport.Pipe("test")
+	t.Cleanup(func() {
+		client.CloseWithError(0, "test end")
+		server.CloseWithError(0, "test end")
+	})
+
+	return client, server
+}
+
+// pipeES device connected to the server over the mux, the device side
+// session is returned too
+func pipeES(t *testing.T, devID string, caps []string) (*esEndpoint, transport.Session) {
+	device, server := pipeSessions(t)
+	es := &esEndpoint{
+		devID:       devID,
+		cmdEndpoint: newCmdEndpoint("es", devID, server, nil, protoj.NewCmdCodec(nil), caps),
+	}
+
+	withES(t, es)
+	return es, device
+}
+
+// serveDevice accept a link stream on the device session, reply with
+// code if asked, and echo if ok. the header is sent when read
+func serveDevice(sess transport.Session, code int) <-chan *protoj.LinkStreamHeader {
+	headers := make(chan *protoj.LinkStreamHeader, 1)
+	go func() {
+		stream, err := sess.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		defer stream.Close()
+
+		header, err := protoj.ReadLinkHeader(stream)
+		if err != nil {
+			return
+		}
+		headers <- header
+
+		if header.Reply {
+			protoj.WriteLinkReply(stream, &protoj.LinkStreamReply{Code: code, Reason: "not allowed"}, header.Version())
+		}
+
+		if code == protoj.LinkReplyOK {
+			io.Copy(stream, stream)
+		}
+	}()
+
+	return headers
+}
+
+func TestPXDeviceStream(t *testing.T) {
+	testRegistry(t)
+
+	envelope := []string{protoj.CapLinkReply, protoj.CapEnvelope}
+	var tests = []struct {
+		name   string
+		duid   string
+		acl    string
+		esCaps []string
+		pxCaps []string
+		// device reply
+		device int
+		// px get
+		code   int
+		reason string
+	}{
+		{"envelope", "dev1", "allow px *", envelope, envelope, protoj.LinkReplyOK, protoj.LinkReplyOK, ""},
+		{"json", "dev1", "allow px *", []string{protoj.CapLinkReply}, []string{protoj.CapLinkReply}, protoj.LinkReplyOK, protoj.LinkReplyOK, ""},
+		{"device no reply", "dev1", "allow px *", nil, envelope, protoj.LinkReplyOK, protoj.LinkReplyOK, ""},
+		{"device refused", "dev1", "allow px *", envelope, envelope, protoj.LinkReplyRefused, protoj.LinkReplyRefused, "device: not allowed"},
+		{"offline", "dev2", "allow px *", envelope, envelope, protoj.LinkReplyOK, protoj.LinkReplyNoDevice, ""},
+		{"acl", "dev1", "deny px *", envelope, envelope, protoj.LinkReplyOK, protoj.LinkReplyDenied, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := devACL
+			devACL = testACL(t, tt.acl)
+			t.Cleanup(func() { devACL = old })
+
+			_, device := pipeES(t, "dev1", tt.esCaps)
+			headers := serveDevice(device, tt.device)
+
+			client, server := pipeSessions(t)
+			px := newCmdEndpoint("px", "1", server, nil, protoj.NewCmdCodec(nil), tt.pxCaps)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			stream, err := client.OpenStreamSync(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer stream.Close()
+
+			header := &protoj.LinkStreamHeader{Port: 22, Host: "127.0.0.1", DUID: tt.duid, Reply: true}
+			err = protoj.WriteLinkHeader(stream, header, protoj.LinkVersion(tt.pxCaps))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pxStream, err := server.AcceptStream(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go servePXStream(&px, pxStream)
+
+			stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+			reply, err := protoj.ReadLinkReply(stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if reply.Code != tt.code || !strings.HasPrefix(reply.Reason, tt.reason) {
+				t.Fatalf("reply %+v, want code %d reason %q", reply, tt.code, tt.reason)
+			}
+
+			if tt.code != protoj.LinkReplyOK {
+				return
+			}
+
+			// the device get the target, not the device id
+			got := <-headers
+			if got.Port != 22 || got.Host != "127.0.0.1" || got.DUID != "" {
+				t.Errorf("device got header %+v", got)
+			}
+
+			if got.Version() != protoj.LinkVersion(tt.esCaps) {
+				t.Errorf("device got header in version %d, caps %v", got.Version(), tt.esCaps)
+			}
+
+			_, err = stream.Write([]byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(stream, buf)
+			if err != nil || string(buf) != "hello" {
+				t.Fatalf("echo %q, err:%v", buf, err)
+			}
+		})
+	}
+}
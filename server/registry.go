@@ -0,0 +1,434 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"lxquic/protoj"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	registryFile = "devices.json"
+	historyFile  = "history.jsonl"
+	// history file is rotated to history.jsonl.1 when larger
+	historyMaxSize = 16 * 1024 * 1024
+	// interval to save devices and last seen of online devices
+	registryFlushInterval = 10 * time.Second
+)
+
+// history events
+const (
+	EventOnline  = "online"
+	EventOffline = "offline"
+)
+
+// DeviceRecord a device ever registered to this relay
+type DeviceRecord struct {
+	DUID      string    `json:"duid"`
+	FirstSeen time.Time `json:"first_seen"`
+	// last time the device was online, updated periodically while online
+	LastSeen   time.Time `json:"last_seen"`
+	Online     bool      `json:"online"`
+	RemoteAddr string    `json:"remote"`
+
+	Tags []string           `json:"tags,omitempty"`
+	Meta *protoj.DeviceMeta `json:"meta,omitempty"`
+	// labels assigned by admin, acl and label routing use them instead of
+	// the labels in Meta, which any agent can claim
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// HistoryEvent a device went online or offline
+type HistoryEvent struct {
+	Time       time.Time `json:"time"`
+	DUID       string    `json:"duid"`
+	Event      string    `json:"event"`
+	RemoteAddr string    `json:"remote,omitempty"`
+	// offline only, seconds online
+	Duration int64 `json:"duration,omitempty"`
+	// offline only, why it is known offline
+	Reason string `json:"reason,omitempty"`
+}
+
+// registry of known devices, saved in dir if not empty, otherwise
+// in memory only
+type registry struct {
+	dir string
+
+	lock    sync.Mutex
+	devices map[string]*DeviceRecord
+	// changes not saved yet
+	dirty   uint64
+	history *os.File
+
+	// one flush at a time, they share the temp file
+	flushLock sync.Mutex
+}
+
+// devices known by this relay, in memory until the saved ones are loaded
+var devRegistry = &registry{devices: make(map[string]*DeviceRecord)}
+
+// loadRegistry load devices saved in dir, devices that were online when
+// the relay stopped are offline since their last seen
+func loadRegistry(dir string) (*registry, error) {
+	r := &registry{
+		dir:     dir,
+		devices: make(map[string]*DeviceRecord),
+	}
+
+	if dir == "" {
+		return r, nil
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, registryFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if len(data) > 0 {
+		var records []*DeviceRecord
+		err = json.Unmarshal(data, &records)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range records {
+			r.devices[d.DUID] = d
+		}
+	}
+
+	r.history, err = os.OpenFile(filepath.Join(dir, historyFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range r.devices {
+		if !d.Online {
+			continue
+		}
+
+		d.Online = false
+		r.dirty++
+		r.appendHistory(&HistoryEvent{
+			Time:       d.LastSeen,
+			DUID:       d.DUID,
+			Event:      EventOffline,
+			RemoteAddr: d.RemoteAddr,
+			Reason:     "relay restarted",
+		})
+	}
+
+	log.Printf("loadRegistry %d devices from %s", len(r.devices), dir)
+	return r, r.flush()
+}
+
+// online the device registered
+func (r *registry) online(devID string, remoteAddr string, tags []string, meta *protoj.DeviceMeta) {
+	now := time.Now()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, ok := r.devices[devID]
+	if !ok {
+		d = &DeviceRecord{DUID: devID, FirstSeen: now}
+		r.devices[devID] = d
+	}
+
+	d.LastSeen = now
+	d.Online = true
+	d.RemoteAddr = remoteAddr
+	d.Tags = tags
+	d.Meta = meta
+	r.dirty++
+
+	r.appendHistory(&HistoryEvent{
+		Time:       now,
+		DUID:       devID,
+		Event:      EventOnline,
+		RemoteAddr: remoteAddr,
+	})
+}
+
+// offline the device registered at since left
+func (r *registry) offline(devID string, since time.Time) {
+	now := time.Now()
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, ok := r.devices[devID]
+	if !ok {
+		return
+	}
+
+	d.LastSeen = now
+	d.Online = false
+	r.dirty++
+
+	r.appendHistory(&HistoryEvent{
+		Time:       now,
+		DUID:       devID,
+		Event:      EventOffline,
+		RemoteAddr: d.RemoteAddr,
+		Duration:   int64(now.Sub(since) / time.Second),
+	})
+}
+
+// get a copy of the device record, nil if unknown
+func (r *registry) get(devID string) *DeviceRecord {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, ok := r.devices[devID]
+	if !ok {
+		return nil
+	}
+
+	c := *d
+	return &c
+}
+
+// labelsOf labels assigned to the device, nil if none
+func (r *registry) labelsOf(devID string) map[string]string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, ok := r.devices[devID]
+	if !ok {
+		return nil
+	}
+
+	// replaced as a whole, never changed in place
+	return d.Labels
+}
+
+// setLabels assign labels to the device, false if unknown
+func (r *registry) setLabels(devID string, labels map[string]string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, ok := r.devices[devID]
+	if !ok {
+		return false
+	}
+
+	if len(labels) == 0 {
+		labels = nil
+	}
+
+	d.Labels = labels
+	r.dirty++
+	return true
+}
+
+// list copies of device records, sorted by device id
+func (r *registry) list() []*DeviceRecord {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	records := make([]*DeviceRecord, 0, len(r.devices))
+	for _, d := range r.devices {
+		c := *d
+		records = append(records, &c)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].DUID < records[j].DUID
+	})
+
+	return records
+}
+
+// remove forget the device, false if unknown or online
+func (r *registry) remove(devID string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	d, ok := r.devices[devID]
+	if !ok || d.Online {
+		return false
+	}
+
+	delete(r.devices, devID)
+	r.dirty++
+	return true
+}
+
+// appendHistory write the event as a json line, lock must be held
+func (r *registry) appendHistory(ev *HistoryEvent) {
+	if r.history == nil {
+		return
+	}
+
+	line, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+
+	_, err = r.history.Write(append(line, '\n'))
+	if err != nil {
+		log.Errorf("registry write history failed:%v", err)
+		return
+	}
+
+	info, err := r.history.Stat()
+	if err != nil || info.Size() < historyMaxSize {
+		return
+	}
+
+	r.history.Close()
+	path := filepath.Join(r.dir, historyFile)
+	err = os.Rename(path, path+".1")
+	if err != nil {
+		log.Errorf("registry rotate history failed:%v", err)
+	}
+
+	r.history, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		log.Errorf("registry reopen history failed:%v", err)
+		r.history = nil
+	}
+}
+
+// historyOf the latest events of the device, oldest first, at most limit
+func (r *registry) historyOf(devID string, limit int) ([]*HistoryEvent, error) {
+	events := make([]*HistoryEvent, 0)
+	if r.dir == "" {
+		return events, nil
+	}
+
+	path := filepath.Join(r.dir, historyFile)
+	for _, p := range []string{path + ".1", path} {
+		f, err := os.Open(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var ev = &HistoryEvent{}
+			if json.Unmarshal(scanner.Bytes(), ev) != nil || ev.DUID != devID {
+				continue
+			}
+
+			events = append(events, ev)
+			if len(events) > limit {
+				events = events[1:]
+			}
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return events, nil
+}
+
+// flush save devices if changed, last seen of online devices is
+// updated, so that it is close to the truth if the relay crash
+func (r *registry) flush() error {
+	if r.dir == "" {
+		return nil
+	}
+
+	r.flushLock.Lock()
+	defer r.flushLock.Unlock()
+
+	now := time.Now()
+
+	r.lock.Lock()
+	for _, d := range r.devices {
+		if d.Online {
+			d.LastSeen = now
+			r.dirty++
+		}
+	}
+
+	if r.dirty == 0 {
+		r.lock.Unlock()
+		return nil
+	}
+
+	records := make([]*DeviceRecord, 0, len(r.devices))
+	for _, d := range r.devices {
+		records = append(records, d)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].DUID < records[j].DUID
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	changes := r.dirty
+	r.lock.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(r.dir, registryFile)
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return err
+	}
+
+	// changes made during the write are saved next time
+	r.lock.Lock()
+	r.dirty -= changes
+	r.lock.Unlock()
+
+	return nil
+}
+
+// flushLoop save devices periodically
+func (r *registry) flushLoop() {
+	if r.dir == "" {
+		return
+	}
+
+	for {
+		time.Sleep(registryFlushInterval)
+
+		err := r.flush()
+		if err != nil {
+			log.Errorf("registry flush failed:%v", err)
+		}
+	}
+}
+
+// deviceOffline link error of device not online, tell since when if known
+func deviceOffline(devID string) error {
+	reason := "device offline"
+	if d := devRegistry.get(devID); d != nil && !d.Online {
+		reason = "device offline since " + d.LastSeen.UTC().Format(time.RFC3339)
+	}
+
+	return &linkError{code: protoj.LinkReplyNoDevice, reason: reason}
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRegistryFlushFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := loadRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.history.Close()
+
+	r.online("dev1", "192.0.2.1:1000", nil, nil)
+	r.offline("dev1", time.Now())
+
+	// a directory in the way, the rename fail
+	path := filepath.Join(dir, registryFile)
+	err = os.MkdirAll(filepath.Join(path, "busy"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.flush(); err == nil {
+		t.Fatal("flush ok with the file path taken by a directory")
+	}
+
+	os.RemoveAll(path)
+
+	// still dirty, the device is saved by the next flush
+	if err = r.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadRegistry(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.history.Close()
+
+	if loaded.get("dev1") == nil {
+		t.Fatal("device not saved after the failed flush")
+	}
+
+	if r.dirty != 0 {
+		t.Fatalf("dirty %d after saved", r.dirty)
+	}
+}
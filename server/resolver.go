@@ -0,0 +1,429 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// max cached names, expired entries are evicted when full
+	resolverCacheMax = 4096
+	// delay before starting next connection attempt, RFC 8305
+	happyEyeballsDelay = 250 * time.Millisecond
+)
+
+// ResolverParams px dns resolver parameters
+type ResolverParams struct {
+	// upstream dns servers, udp://host[:port], tcp://host[:port] or host[:port],
+	// empty means use system resolver
+	Upstreams []string
+	// max cache ttl, 0 means no cache, answers from upstreams are cached
+	// no longer than their record ttl
+	CacheTTL time.Duration
+	// timeout of every lookup
+	Timeout time.Duration
+	// "ipv4", "ipv6", or empty for no preference
+	Prefer string
+}
+
+type resolverUpstream struct {
+	network string
+	address string
+}
+
+type resolverEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+// resolver resolve px target names, with cache and custom upstreams
+type resolver struct {
+	r *net.Resolver
+
+	upstreams []*resolverUpstream
+	// round robin index of upstreams
+	next uint32
+
+	ttl     time.Duration
+	timeout time.Duration
+	prefer  string
+
+	mu    sync.Mutex
+	cache map[string]*resolverEntry
+}
+
+func newResolver(params *ResolverParams) (*resolver, error) {
+	res := &resolver{
+		timeout: 5 * time.Second,
+		cache:   make(map[string]*resolverEntry),
+		r:       net.DefaultResolver,
+	}
+
+	if params == nil {
+		return res, nil
+	}
+
+	res.ttl = params.CacheTTL
+	if params.Timeout > 0 {
+		res.timeout = params.Timeout
+	}
+
+	switch params.Prefer {
+	case "", "ipv4", "ipv6":
+		res.prefer = params.Prefer
+	default:
+		return nil, fmt.Errorf("invalid resolver prefer:%s", params.Prefer)
+	}
+
+	for _, u := range params.Upstreams {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+
+		upstream, err := parseUpstream(u)
+		if err != nil {
+			return nil, err
+		}
+
+		res.upstreams = append(res.upstreams, upstream)
+	}
+
+	if len(res.upstreams) > 0 {
+		res.r = &net.Resolver{
+			PreferGo: true,
+			Dial:     res.dialUpstream,
+		}
+	}
+
+	return res, nil
+}
+
+func parseUpstream(spec string) (*resolverUpstream, error) {
+	upstream := &resolverUpstream{network: "udp"}
+	address := spec
+	if i := strings.Index(spec, "://"); i >= 0 {
+		upstream.network = spec[:i]
+		address = spec[i+3:]
+	}
+
+	if upstream.network != "udp" && upstream.network != "tcp" {
+		return nil, fmt.Errorf("invalid dns upstream %s: unsupported network", spec)
+	}
+
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "53")
+	}
+
+	upstream.address = address
+	return upstream, nil
+}
+
+// dialUpstream replace the system dns server with our upstreams, if the upstream
+// is tcp, go resolver will use dns over tcp since the conn is not a PacketConn.
+// responses are read through a conn that record their ttl, if the lookup
+// ask for it
+func (res *resolver) dialUpstream(ctx context.Context, network, address string) (net.Conn, error) {
+	i := atomic.AddUint32(&res.next, 1)
+	upstream := res.upstreams[int(i)%len(res.upstreams)]
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, upstream.network, upstream.address)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, ok := ctx.Value(ttlRecorderKey{}).(*ttlRecorder)
+	if !ok {
+		return conn, nil
+	}
+
+	if uc, ok := conn.(*net.UDPConn); ok {
+		return &ttlPacketConn{UDPConn: uc, rec: rec}, nil
+	}
+
+	return &ttlStreamConn{Conn: conn, rec: rec}, nil
+}
+
+// lookup resolve host to ips, ordered by preference
+func (res *resolver) lookup(host string) ([]net.IP, error) {
+	key := strings.ToLower(host)
+
+	if res.ttl > 0 {
+		res.mu.Lock()
+		entry, ok := res.cache[key]
+		res.mu.Unlock()
+
+		if ok && time.Now().Before(entry.expire) {
+			resolverLookups.Inc("cached")
+			log.Printf("resolver lookup %s cached:%v", host, entry.ips)
+			return entry.ips, nil
+		}
+	}
+
+	start := time.Now()
+	rec := &ttlRecorder{}
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), ttlRecorderKey{}, rec), res.timeout)
+	addrs, err := res.r.LookupIPAddr(ctx, host)
+	cancel()
+
+	elapsed := time.Since(start)
+	resolverLookupTime.Observe(elapsed.Seconds())
+	if err != nil {
+		resolverLookups.Inc("failed")
+		log.Printf("resolver lookup %s failed, took:%v, error:%v", host, elapsed, err)
+		return nil, err
+	}
+
+	resolverLookups.Inc("ok")
+
+	var ips []net.IP
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+
+	ips = sortByPrefer(ips, res.prefer)
+	log.Printf("resolver lookup %s took:%v, result:%v", host, elapsed, ips)
+
+	// system resolver does not tell the record ttl
+	ttl := res.ttl
+	if recTTL, ok := rec.min(); ok && recTTL < ttl {
+		ttl = recTTL
+	}
+
+	if ttl > 0 && len(ips) > 0 {
+		res.mu.Lock()
+		if len(res.cache) >= resolverCacheMax {
+			res.evictLocked()
+		}
+
+		res.cache[key] = &resolverEntry{ips: ips, expire: time.Now().Add(ttl)}
+		res.mu.Unlock()
+	}
+
+	return ips, nil
+}
+
+// ttlRecorderKey context key of the lookup's ttlRecorder
+type ttlRecorderKey struct{}
+
+// ttlRecorder min ttl of the answers of a lookup, a and aaaa are looked
+// up by different conns at the same time
+type ttlRecorder struct {
+	lock sync.Mutex
+	ttl  uint32
+	seen bool
+}
+
+// record the answers of the dns response
+func (tr *ttlRecorder) record(msg []byte) {
+	var p dnsmessage.Parser
+	_, err := p.Start(msg)
+	if err != nil {
+		return
+	}
+
+	err = p.SkipAllQuestions()
+	if err != nil {
+		return
+	}
+
+	for {
+		h, err := p.AnswerHeader()
+		if err != nil {
+			return
+		}
+
+		tr.lock.Lock()
+		if !tr.seen || h.TTL < tr.ttl {
+			tr.ttl, tr.seen = h.TTL, true
+		}
+		tr.lock.Unlock()
+
+		err = p.SkipAnswer()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// min the min ttl of answers, false if no answer seen
+func (tr *ttlRecorder) min() (time.Duration, bool) {
+	tr.lock.Lock()
+	defer tr.lock.Unlock()
+
+	return time.Duration(tr.ttl) * time.Second, tr.seen
+}
+
+// ttlPacketConn udp upstream conn, every read is a response, it is still a
+// PacketConn, so go resolver keep using udp framing
+type ttlPacketConn struct {
+	*net.UDPConn
+	rec *ttlRecorder
+}
+
+func (tc *ttlPacketConn) Read(b []byte) (int, error) {
+	n, err := tc.UDPConn.Read(b)
+	if n > 0 {
+		tc.rec.record(b[:n])
+	}
+
+	return n, err
+}
+
+// ttlStreamConn tcp upstream conn, responses are 2 bytes length prefixed
+// and may span reads
+type ttlStreamConn struct {
+	net.Conn
+	rec *ttlRecorder
+	buf []byte
+}
+
+func (tc *ttlStreamConn) Read(b []byte) (int, error) {
+	n, err := tc.Conn.Read(b)
+	tc.buf = append(tc.buf, b[:n]...)
+	for len(tc.buf) >= 2 {
+		size := int(binary.BigEndian.Uint16(tc.buf))
+		if len(tc.buf) < 2+size {
+			break
+		}
+
+		tc.rec.record(tc.buf[2 : 2+size])
+		tc.buf = tc.buf[2+size:]
+	}
+
+	return n, err
+}
+
+// evictLocked remove expired entries, or all if none expired
+func (res *resolver) evictLocked() {
+	now := time.Now()
+	for k, v := range res.cache {
+		if now.After(v.expire) {
+			delete(res.cache, k)
+		}
+	}
+
+	if len(res.cache) >= resolverCacheMax {
+		res.cache = make(map[string]*resolverEntry)
+	}
+}
+
+// sortByPrefer put the preferred family first, and then interleave
+// the two families, as RFC 8305 suggested
+func sortByPrefer(ips []net.IP, prefer string) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	primary, secondary := v6, v4
+	if prefer == "ipv4" || (prefer == "" && len(ips) > 0 && ips[0].To4() != nil) {
+		primary, secondary = v4, v6
+	}
+
+	result := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			result = append(result, primary[i])
+		}
+
+		if i < len(secondary) {
+			result = append(result, secondary[i])
+		}
+	}
+
+	return result
+}
+
+// dialHappyEyeballs dial the addresses in order, start next attempt when
+// the previous one failed or after a short delay, the first connected wins
+func dialHappyEyeballs(addrs []string, timeout time.Duration) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address to dial")
+	}
+
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	results := make(chan dialResult, len(addrs))
+	var d net.Dialer
+	next := 0
+	pending := 0
+	var firstErr error
+
+	startNext := func() {
+		address := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := d.DialContext(ctx, "tcp", address)
+			results <- dialResult{conn: conn, err: err}
+		}()
+	}
+
+	startNext()
+	timer := time.NewTimer(happyEyeballsDelay)
+	defer timer.Stop()
+
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the late comers
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						late := <-results
+						if late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+
+				return r.conn, nil
+			}
+
+			if firstErr == nil {
+				firstErr = r.err
+			}
+
+			// previous one failed, start next at once
+			if next < len(addrs) {
+				startNext()
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(happyEyeballsDelay)
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				startNext()
+				timer.Reset(happyEyeballsDelay)
+			}
+		}
+	}
+
+	return nil, firstErr
+}
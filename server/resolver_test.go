@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// stubDNS answer every a query with the addresses, 192.0.2.1 if none,
+// and the ttl, aaaa queries get no answer
+type stubDNS struct {
+	ttl     uint32
+	addrs   [][4]byte
+	queries int32
+}
+
+func (sd *stubDNS) answer(query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil
+	}
+
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	atomic.AddInt32(&sd.queries, 1)
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(q)
+	b.StartAnswers()
+	if q.Type == dnsmessage.TypeA {
+		addrs := sd.addrs
+		if len(addrs) == 0 {
+			addrs = [][4]byte{{192, 0, 2, 1}}
+		}
+
+		for _, a := range addrs {
+			b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: sd.ttl},
+				dnsmessage.AResource{A: a})
+		}
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+
+	return msg
+}
+
+func (sd *stubDNS) serveUDP(t *testing.T) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			if msg := sd.answer(buf[:n]); msg != nil {
+				conn.WriteTo(msg, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func (sd *stubDNS) serveTCP(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				for {
+					var lenb [2]byte
+					if _, err := io.ReadFull(conn, lenb[:]); err != nil {
+						return
+					}
+
+					query := make([]byte, binary.BigEndian.Uint16(lenb[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+
+					msg := sd.answer(query)
+					if msg == nil {
+						return
+					}
+
+					// split the response, so it span reads
+					binary.BigEndian.PutUint16(lenb[:], uint16(len(msg)))
+					conn.Write(append(lenb[:], msg[:3]...))
+					time.Sleep(time.Millisecond)
+					conn.Write(msg[3:])
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func testResolverTTL(t *testing.T, upstream string, sd *stubDNS) {
+	res, err := newResolver(&ResolverParams{Upstreams: []string{upstream}, CacheTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ips, err := res.lookup("stub.lxquic.test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ips) != 1 || !ips[0].Equal(net.IPv4(192, 0, 2, 1)) {
+		t.Fatalf("lookup got %v", ips)
+	}
+
+	queries := atomic.LoadInt32(&sd.queries)
+	_, err = res.lookup("STUB.lxquic.test.")
+	if err != nil || atomic.LoadInt32(&sd.queries) != queries {
+		t.Fatalf("lookup not cached, err:%v", err)
+	}
+
+	res.mu.Lock()
+	expire := res.cache["stub.lxquic.test."].expire
+	res.mu.Unlock()
+
+	left := time.Until(expire)
+	if left > time.Duration(sd.ttl)*time.Second || left < time.Duration(sd.ttl-2)*time.Second {
+		t.Fatalf("cached for %v, record ttl %ds", left, sd.ttl)
+	}
+}
+
+func TestResolverUDPRecordTTL(t *testing.T) {
+	sd := &stubDNS{ttl: 30}
+	testResolverTTL(t, "udp://"+sd.serveUDP(t), sd)
+}
+
+func TestResolverTCPRecordTTL(t *testing.T) {
+	sd := &stubDNS{ttl: 30}
+	testResolverTTL(t, "tcp://"+sd.serveTCP(t), sd)
+}
+
+func TestResolverZeroTTL(t *testing.T) {
+	sd := &stubDNS{ttl: 0}
+	res, err := newResolver(&ResolverParams{Upstreams: []string{"udp://" + sd.serveUDP(t)}, CacheTTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err = res.lookup("stub.lxquic.test.")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	res.mu.Lock()
+	defer res.mu.Unlock()
+	if len(res.cache) != 0 {
+		t.Fatal("answer of ttl 0 is cached")
+	}
+}
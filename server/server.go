@@ -2,18 +2,13 @@ package server
 
 import (
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/tls"
-	"crypto/x509"
 	"lxquic/protoj"
-	"math/big"
+	"lxquic/transport"
+	"sync"
 	"time"
 
 	"encoding/json"
-	"encoding/pem"
 
-	"github.com/lucas-clemente/quic-go"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -23,24 +18,83 @@ var (
 	esmap      = make(map[string]*esEndpoint)
 	pxmap      = make(map[int]*pxEndpoint)
 	proxyToken string
+	pxEgress   *egressPolicy
+	pxResolver *resolver
 )
 
-// keepalive send ping to all websocket
+// acl of link streams to devices
+var devACL *acl
+
+// protocolHandler serve the cmd stream of a negotiated protocol
+type protocolHandler func(sess transport.Session, stream transport.Stream, codec *protoj.CmdCodec, h *protoj.CmdStreamHeader)
+
+var (
+	protocolHandlers = map[string]protocolHandler{
+		protoj.ALPNv2: serveV2,
+		protoj.ALPNv1: serveV1,
+		// clients before versioned alpn
+		protoj.ALPNLegacy: serveV1,
+		// websocket clients before subprotocol
+		"": serveV1,
+	}
+
+	// capabilities of server
+	serverCaps = []string{
+		protoj.CapEnvelope,
+		protoj.CapLinkReply,
+		protoj.CapLinkHeader,
+		protoj.CapP2P,
+		protoj.CapE2E,
+	}
+)
+
+// mapLock guard esmap, ecmap and pxmap, they are changed by session
+// goroutines, and read by keepalive and rpc handlers
+var mapLock sync.Mutex
+
+// getES the online device, nil if offline
+func getES(devID string) *esEndpoint {
+	mapLock.Lock()
+	defer mapLock.Unlock()
+
+	return esmap[devID]
+}
+
+// allEndpoints es and px, then ec endpoints online
+func allEndpoints() []*cmdEndpoint {
+	mapLock.Lock()
+	defer mapLock.Unlock()
+
+	endpoints := make([]*cmdEndpoint, 0, len(esmap)+len(pxmap)+len(ecmap))
+	// first keepalive all xport/web-ssh websocket
+	for _, v := range esmap {
+		endpoints = append(endpoints, &v.cmdEndpoint)
+	}
+
+	for _, v := range pxmap {
+		endpoints = append(endpoints, &v.cmdEndpoint)
+	}
+
+	// then keepalive pair websocket
+	for _, v := range ecmap {
+		endpoints = append(endpoints, &v.cmdEndpoint)
+	}
+
+	return endpoints
+}
+
+// keepalive send ping to all websocket, each at the interval of its role
 func keepalive() {
 	for {
-		time.Sleep(time.Second * 5)
-
-		// first keepalive all xport/web-ssh websocket
-		for _, v := range esmap {
-			v.keepalive()
-		}
+		time.Sleep(keepaliveTick)
 
-		for _, v := range pxmap {
-			v.keepalive()
-		}
+		now := time.Now()
+		for _, v := range allEndpoints() {
+			if now.Before(v.nextPing) {
+				continue
+			}
 
-		// then keepalive pair websocket
-		for _, v := range ecmap {
+			v.nextPing = now.Add(v.keepaliveConf.Interval)
 			v.keepalive()
 		}
 	}
@@ -52,63 +106,159 @@ type Params struct {
 	ListenAddr string
 
 	ProxyToken string
+
+	// px egress policy
+	Egress *EgressParams
+	// px dns resolver
+	Resolver *ResolverParams
+
+	// websocket over tls fallback listen address, for clients that udp
+	// is blocked, empty means disable
+	TCPListenAddr string
+
+	// acl file of link streams to devices, empty means allow all
+	ACLFile string
+
+	// admin api listen address, empty means disable
+	AdminAddr string
+	// bearer token of admin api, required if admin api enabled
+	AdminToken string
+	// server version, reported by admin api
+	Version string
+
+	// quic transport parameters, nil means quic-go's defaults
+	Transport *transport.Config
+	// cmd stream keepalive by role, missing roles use DefaultKeepalive
+	Keepalive map[string]Keepalive
+
+	// metrics listen address, serve /metrics, empty means disable
+	MetricsAddr string
+	// bytes of link streams per device, may be many series
+	MetricsPerDevice bool
+
+	// relay cluster, nil or empty Addr means standalone
+	Cluster *ClusterParams
+
+	// directory that known devices and their history saved in,
+	// empty means memory only
+	RegistryDir string
+
+	// webhooks and file that events go to, nil means disable
+	Events *EventsParams
 }
 
 // CreateQuicServer start http server
 func CreateQuicServer(params *Params) {
+	for role, ka := range params.Keepalive {
+		roleKeepalive[role] = ka
+	}
+
 	// start keepalive goroutine
 	go keepalive()
 
 	proxyToken = params.ProxyToken
+	serverParams = params
 
-	log.Printf("quic server listen at:%s", params.ListenAddr)
+	var err error
+	pxEgress, err = newEgressPolicy(params.Egress)
+	if err != nil {
+		log.Fatalln("newEgressPolicy failed:", err)
+	}
 
-	listener, err := quic.ListenAddr(params.ListenAddr, generateTLSConfig(), nil)
+	pxResolver, err = newResolver(params.Resolver)
 	if err != nil {
-		log.Fatalln("quic.ListenAddr failed:", err)
+		log.Fatalln("newResolver failed:", err)
 	}
 
-	for {
-		sess, err := listener.Accept(context.Background())
+	devACL, err = loadACL(params.ACLFile)
+	if err != nil {
+		log.Fatalln("loadACL failed:", err)
+	}
+
+	if params.Cluster != nil && params.Cluster.Addr != "" {
+		cluster, err = newCluster(params.Cluster)
 		if err != nil {
-			log.Fatalln("listener.Accept failed:", err)
+			log.Fatalln("newCluster failed:", err)
 		}
 
-		go onAcceptSession(sess)
+		log.Printf("cluster relay:%s, peers:%v", params.Cluster.Addr, params.Cluster.Peers)
 	}
-}
 
-// Setup a bare-bones TLS config for the server
-func generateTLSConfig() *tls.Config {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	devRegistry, err = loadRegistry(params.RegistryDir)
 	if err != nil {
-		panic(err)
+		log.Fatalln("loadRegistry failed:", err)
 	}
-	template := x509.Certificate{SerialNumber: big.NewInt(1)}
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+
+	go devRegistry.flushLoop()
+
+	err = setupEvents(params.Events)
 	if err != nil {
-		panic(err)
+		log.Fatalln("setupEvents failed:", err)
+	}
+
+	metricsPerDevice = params.MetricsPerDevice
+	if params.MetricsAddr != "" {
+		startMetrics(params.MetricsAddr)
+	}
+
+	if params.AdminAddr != "" {
+		startAdmin(params)
 	}
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
 
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	log.Printf("quic server listen at:%s", params.ListenAddr)
+
+	tlsConf := transport.GenerateTLSConfig(protoj.NextProtos())
+	listener, err := transport.ListenQuic(params.ListenAddr, tlsConf, params.Transport.QuicConfig())
 	if err != nil {
-		panic(err)
+		log.Fatalln("quic.ListenAddr failed:", err)
 	}
-	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"quic-echo-example"},
+
+	if params.TCPListenAddr != "" {
+		log.Printf("tcp fallback server listen at:%s", params.TCPListenAddr)
+		tcpListener, err := transport.ListenTCP(params.TCPListenAddr, tlsConf)
+		if err != nil {
+			log.Fatalln("transport.ListenTCP failed:", err)
+		}
+
+		go acceptSessions(tcpListener)
 	}
+
+	acceptSessions(listener)
 }
 
-func onAcceptSession(sess quic.Session) {
+func acceptSessions(listener transport.Listener) {
+	for {
+		sess, err := listener.Accept(context.Background())
+		if err != nil {
+			log.Fatalln("listener.Accept failed:", err)
+		}
+
+		go onAcceptSession(sess)
+	}
+}
+
+func onAcceptSession(sess transport.Session) {
 	log.Println("onAcceptSession quic server accept a new session")
+	acceptAt := time.Now()
 	defer func() {
 		log.Println("quic server onAcceptSession exit")
 		sess.CloseWithError(0, "out of scope")
 	}()
 
+	if isDraining() {
+		log.Println("onAcceptSession server draining, refuse")
+		sess.CloseWithError(0, "server draining")
+		return
+	}
+
+	handler, ok := protocolHandlers[sess.Protocol()]
+	if !ok {
+		log.Errorf("onAcceptSession unsupported protocol:%s", sess.Protocol())
+		return
+	}
+
+	sessionsTotal.Inc(sess.Protocol())
+
 	stream, err := sess.AcceptStream(context.Background())
 	if err != nil {
 		log.Println("onAcceptSession sess.AcceptStream failed:", err)
@@ -128,15 +278,115 @@ func onAcceptSession(sess quic.Session) {
 		return
 	}
 
+	handshakeTime.Observe(time.Since(acceptAt).Seconds())
+
+	handler(sess, stream, protoj.NewCmdCodec(stream), h)
+}
+
+// serveV2 tell the client capabilities enabled for the session, and
+// then serve the role with them
+func serveV2(sess transport.Session, stream transport.Stream, codec *protoj.CmdCodec, h *protoj.CmdStreamHeader) {
+	h.Caps = protoj.IntersectCaps(serverCaps, h.Caps)
+
+	err := upgradeCodec(codec, h)
+	if err != nil {
+		log.Errorf("serveV2 codec.Upgrade failed:%v", err)
+		return
+	}
+
+	var hello = &protoj.StreamCmd{
+		Cmd:  protoj.CmdHello,
+		Caps: h.Caps,
+	}
+
+	err = codec.SendCmd(hello)
+	if err != nil {
+		log.Errorf("serveV2 send hello failed:%v", err)
+		return
+	}
+
+	serveRole(sess, stream, codec, h)
+}
+
+// serveV1 clients before lxquic/2 send no capabilities, the features are
+// implied by the header fields they used before
+func serveV1(sess transport.Session, stream transport.Stream, codec *protoj.CmdCodec, h *protoj.CmdStreamHeader) {
+	h.Caps = legacyCaps(h)
+
+	err := upgradeCodec(codec, h)
+	if err != nil {
+		log.Errorf("serveV1 codec.Upgrade failed:%v", err)
+		return
+	}
+
+	serveRole(sess, stream, codec, h)
+}
+
+// legacyCaps capabilities implied by the header of a client before lxquic/2
+func legacyCaps(h *protoj.CmdStreamHeader) []string {
+	var caps []string
+	if h.Version >= protoj.CmdVersionEnvelope {
+		caps = append(caps, protoj.CapEnvelope)
+	}
+
+	// es that advertise policy reply, ec and px ask for it per stream
+	if h.Role != "es" || h.Policy != nil {
+		caps = append(caps, protoj.CapLinkReply)
+	}
+
+	if h.P2P {
+		caps = append(caps, protoj.CapP2P)
+	}
+
+	if h.E2E || h.PubKey != "" {
+		caps = append(caps, protoj.CapE2E)
+	}
+
+	return caps
+}
+
+// upgradeCodec peer that support the envelope get it at once, others keep json
+func upgradeCodec(codec *protoj.CmdCodec, h *protoj.CmdStreamHeader) error {
+	if !protoj.HasCap(h.Caps, protoj.CapEnvelope) {
+		return nil
+	}
+
+	return codec.Upgrade()
+}
+
+// serveRole dispatch by role, features not in h.Caps are off
+func serveRole(sess transport.Session, stream transport.Stream, codec *protoj.CmdCodec, h *protoj.CmdStreamHeader) {
 	switch h.Role {
 	case "es":
-		serveES(sess, stream, h)
+		serveES(sess, stream, codec, h)
 		break
 	case "ec":
-		serveEC(sess, stream, h)
+		serveEC(sess, stream, codec, h)
 		break
 	case "px":
-		servePX(sess, stream, h)
+		servePX(sess, stream, codec, h)
+		break
+	case protoj.RoleRelay:
+		serveRelay(sess, stream, codec, h)
 		break
 	}
 }
+
+// denySession tell the client why it is refused, and then wait the client
+// to close the session, so that the notification will not be discarded
+func denySession(sess transport.Session, codec *protoj.CmdCodec, reason string) {
+	var cmd = &protoj.StreamCmd{
+		Cmd:    protoj.CmdDenied,
+		Reason: reason,
+	}
+
+	err := codec.SendCmd(cmd)
+	if err != nil {
+		return
+	}
+
+	select {
+	case <-sess.Context().Done():
+	case <-time.After(3 * time.Second):
+	}
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"lxquic/protoj"
+	"reflect"
+	"testing"
+)
+
+func TestLegacyCaps(t *testing.T) {
+	var tests = []struct {
+		header *protoj.CmdStreamHeader
+		caps   []string
+	}{
+		{&protoj.CmdStreamHeader{Role: "es"}, nil},
+		{&protoj.CmdStreamHeader{Role: "es", Policy: &protoj.DevicePolicy{}, PubKey: "key"},
+			[]string{protoj.CapLinkReply, protoj.CapE2E}},
+		{&protoj.CmdStreamHeader{Role: "ec", Version: protoj.CmdVersionEnvelope, P2P: true},
+			[]string{protoj.CapEnvelope, protoj.CapLinkReply, protoj.CapP2P}},
+		{&protoj.CmdStreamHeader{Role: "px", Version: protoj.CmdVersionJSON},
+			[]string{protoj.CapLinkReply}},
+	}
+
+	for i, tt := range tests {
+		caps := legacyCaps(tt.header)
+		if !reflect.DeepEqual(caps, tt.caps) {
+			t.Errorf("%d: caps %v, want %v", i, caps, tt.caps)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package transport
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// Config transport parameters shared by server, qes and qec
+type Config struct {
+	// cmd stream ping interval, and unanswered pings before the
+	// session is closed
+	KeepaliveInterval time.Duration
+	KeepaliveMisses   int
+
+	// quic handshake must finish in
+	HandshakeTimeout time.Duration
+	// quic session closed if idle for, the smaller one of both sides
+	IdleTimeout time.Duration
+	// quic level ping, keep nat mapping alive even if cmd stream keepalive
+	// is slow
+	QuicKeepAlive bool
+
+	// max receive window of a stream and the whole session, bytes
+	StreamWindow uint64
+	ConnWindow   uint64
+	// max streams that peer can open at the same time
+	MaxStreams int64
+}
+
+// DefaultConfig the same as quic-go's defaults, keepalive 5s and 3 misses
+func DefaultConfig() *Config {
+	return &Config{
+		KeepaliveInterval: 5 * time.Second,
+		KeepaliveMisses:   3,
+
+		HandshakeTimeout: 5 * time.Second,
+		IdleTimeout:      30 * time.Second,
+
+		StreamWindow: 6 * 1024 * 1024,
+		ConnWindow:   15 * 1024 * 1024,
+		MaxStreams:   100,
+	}
+}
+
+// RegisterFlags register quic flags of the config, the values in c are
+// the defaults
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.HandshakeTimeout, "handshake-timeout", c.HandshakeTimeout, "specify quic handshake timeout")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "specify quic max idle timeout, the smaller one of both sides is used")
+	fs.BoolVar(&c.QuicKeepAlive, "quic-keepalive", c.QuicKeepAlive, "enable quic level keepalive ping")
+	fs.Uint64Var(&c.StreamWindow, "stream-window", c.StreamWindow, "specify quic max stream receive window, bytes")
+	fs.Uint64Var(&c.ConnWindow, "conn-window", c.ConnWindow, "specify quic max connection receive window, bytes")
+	fs.Int64Var(&c.MaxStreams, "max-streams", c.MaxStreams, "specify quic max incoming streams")
+}
+
+// RegisterKeepaliveFlags register cmd stream keepalive flags, server
+// has its own per-role ones
+func (c *Config) RegisterKeepaliveFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.KeepaliveInterval, "keepalive", c.KeepaliveInterval, "specify cmd stream keepalive interval")
+	fs.IntVar(&c.KeepaliveMisses, "keepalive-misses", c.KeepaliveMisses, "specify unanswered keepalive pings before the session is closed")
+}
+
+// Validate check the values
+func (c *Config) Validate() error {
+	if c.KeepaliveInterval < time.Second {
+		return fmt.Errorf("keepalive interval %v too small", c.KeepaliveInterval)
+	}
+
+	if c.KeepaliveMisses < 1 {
+		return fmt.Errorf("keepalive misses %d must be positive", c.KeepaliveMisses)
+	}
+
+	if c.HandshakeTimeout <= 0 || c.IdleTimeout <= 0 {
+		return fmt.Errorf("handshake and idle timeout must be positive")
+	}
+
+	if c.StreamWindow == 0 || c.ConnWindow < c.StreamWindow {
+		return fmt.Errorf("connection window %d must be no less than stream window %d", c.ConnWindow, c.StreamWindow)
+	}
+
+	if c.MaxStreams < 1 {
+		return fmt.Errorf("max streams %d must be positive", c.MaxStreams)
+	}
+
+	return nil
+}
+
+// QuicConfig map to quic.Config, nil config means quic-go's defaults
+func (c *Config) QuicConfig() *quic.Config {
+	if c == nil {
+		return nil
+	}
+
+	return &quic.Config{
+		HandshakeIdleTimeout: c.HandshakeTimeout,
+		MaxIdleTimeout:       c.IdleTimeout,
+		KeepAlive:            c.QuicKeepAlive,
+
+		// start small, grow up to the max
+		InitialStreamReceiveWindow:     minUint64(c.StreamWindow, initialStreamWindow),
+		MaxStreamReceiveWindow:         c.StreamWindow,
+		InitialConnectionReceiveWindow: minUint64(c.ConnWindow, initialConnWindow),
+		MaxConnectionReceiveWindow:     c.ConnWindow,
+		MaxIncomingStreams:             c.MaxStreams,
+	}
+}
+
+const (
+	// quic-go's initial windows
+	initialStreamWindow = 512 * 1024
+	initialConnWindow   = 768 * 1024
+)
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
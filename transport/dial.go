@@ -0,0 +1,144 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	log "github.com/sirupsen/logrus"
+)
+
+// dial modes
+const (
+	// ModeAuto try quic first, fallback to tls over tcp
+	ModeAuto = "auto"
+	// ModeQuic quic only
+	ModeQuic = "quic"
+	// ModeTCP websocket over tls only
+	ModeTCP = "tcp"
+)
+
+const (
+	// quic dial timeout in auto mode, a blocked udp fail fast
+	quicProbeTimeout = 5 * time.Second
+	tcpDialTimeout   = 10 * time.Second
+	// how long to keep using tcp after quic failed, then try quic again
+	rememberTCP = 10 * time.Minute
+)
+
+var (
+	// server address -> time until which tcp is preferred
+	preferLock sync.Mutex
+	preferTCP  = make(map[string]time.Time)
+)
+
+// DialParams parameters of Dial
+type DialParams struct {
+	// server address, the same host:port for udp and tcp
+	Addr      string
+	TLSConfig *tls.Config
+	// quic config, nil for default
+	QuicConfig *quic.Config
+	// dial quic on the udp socket, nil means a new one
+	PacketConn net.PacketConn
+	// ModeAuto, ModeQuic or ModeTCP, empty means ModeAuto
+	Mode string
+}
+
+// Dial dial server by the mode, in auto mode, try quic first and fallback
+// to tcp, the one worked is remembered, so that the next dial to the same
+// server will not wait quic to time out again
+func Dial(params *DialParams) (Session, error) {
+	switch params.Mode {
+	case ModeQuic:
+		return dialQuic(params, 0)
+	case ModeTCP:
+		return DialTCP(params.Addr, params.TLSConfig, tcpDialTimeout)
+	case "", ModeAuto:
+	default:
+		return nil, fmt.Errorf("invalid transport mode:%s", params.Mode)
+	}
+
+	if tcpPreferred(params.Addr) {
+		sess, err := DialTCP(params.Addr, params.TLSConfig, tcpDialTimeout)
+		if err == nil {
+			return sess, nil
+		}
+
+		log.Printf("transport.Dial tcp to %s failed:%v, try quic", params.Addr, err)
+		sess, err = dialQuic(params, quicProbeTimeout)
+		if err != nil {
+			return nil, err
+		}
+
+		setPreferTCP(params.Addr, false)
+		return sess, nil
+	}
+
+	sess, err := dialQuic(params, quicProbeTimeout)
+	if err == nil {
+		return sess, nil
+	}
+
+	log.Printf("transport.Dial quic to %s failed:%v, fallback to tcp", params.Addr, err)
+	sess, tcpErr := DialTCP(params.Addr, params.TLSConfig, tcpDialTimeout)
+	if tcpErr != nil {
+		return nil, fmt.Errorf("quic:%v, tcp:%v", err, tcpErr)
+	}
+
+	setPreferTCP(params.Addr, true)
+	return sess, nil
+}
+
+func dialQuic(params *DialParams, timeout time.Duration) (Session, error) {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if params.PacketConn == nil {
+		sess, err := quic.DialAddrContext(ctx, params.Addr, params.TLSConfig, params.QuicConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		return WrapQuic(sess), nil
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp", params.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sess, err := quic.DialContext(ctx, params.PacketConn, raddr, params.Addr, params.TLSConfig, params.QuicConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return WrapQuic(sess), nil
+}
+
+func tcpPreferred(addr string) bool {
+	preferLock.Lock()
+	defer preferLock.Unlock()
+
+	until, ok := preferTCP[addr]
+	return ok && time.Now().Before(until)
+}
+
+func setPreferTCP(addr string, prefer bool) {
+	preferLock.Lock()
+	defer preferLock.Unlock()
+
+	if prefer {
+		preferTCP[addr] = time.Now().Add(rememberTCP)
+	} else {
+		delete(preferTCP, addr)
+	}
+}
@@ -0,0 +1,606 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// a minimal stream multiplexer, used over the tls/websocket connection
+// when quic is not available.
+//
+// frame: type(1) | stream id(4) | length or window delta(4) | payload
+//
+// every stream has its own receive window, the sender stop when the
+// window is used up, so that a slow stream never block the others
+
+const (
+	frameOpen   = 1
+	frameData   = 2
+	frameFin    = 3
+	frameReset  = 4
+	frameWindow = 5
+	// stream id field is the error code, payload is the reason
+	frameGoAway = 6
+
+	frameHeaderLen = 9
+	// max payload of a data frame
+	maxFramePayload = 16 * 1024
+	// receive window of every stream
+	streamWindow = 256 * 1024
+	// streams opened by peer but not yet accepted
+	acceptBacklog = 256
+)
+
+var (
+	errStreamReset  = fmt.Errorf("stream reset by peer")
+	errStreamClosed = fmt.Errorf("write to closed stream")
+	errFlowControl  = fmt.Errorf("stream flow control violated")
+)
+
+// SessionError session closed with code and reason
+type SessionError struct {
+	Code   uint64
+	Reason string
+	// closed by peer
+	Remote bool
+}
+
+func (e *SessionError) Error() string {
+	if e.Remote {
+		return fmt.Sprintf("session closed by peer, code:%d, reason:%s", e.Code, e.Reason)
+	}
+
+	return fmt.Sprintf("session closed, code:%d, reason:%s", e.Code, e.Reason)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// muxSession multiplex streams over a reliable connection
+type muxSession struct {
+	conn   io.ReadWriteCloser
+	local  net.Addr
+	remote net.Addr
+	// negotiated application protocol
+	protocol string
+	// version of the tls under websocket
+	tlsVersion uint16
+
+	// bytes of the connection
+	bytesIn  int64
+	bytesOut int64
+
+	wlock sync.Mutex
+
+	mu      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+
+	accept chan *muxStream
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// newMuxSession client use odd stream ids, server use even ones
+func newMuxSession(conn io.ReadWriteCloser, local, remote net.Addr, protocol string, client bool) *muxSession {
+	ms := &muxSession{
+		conn:     conn,
+		local:    local,
+		remote:   remote,
+		protocol: protocol,
+		streams:  make(map[uint32]*muxStream),
+		nextID:   2,
+		accept:   make(chan *muxStream, acceptBacklog),
+	}
+
+	if client {
+		ms.nextID = 1
+	}
+
+	ms.ctx, ms.cancel = context.WithCancel(context.Background())
+	go ms.readLoop()
+
+	return ms
+}
+
+// Pipe a client and a server session in memory, the tcp transport's mux
+// over net.Pipe, for tests
+func Pipe(protocol string) (Session, Session) {
+	c, s := net.Pipe()
+	client := newMuxSession(c, c.LocalAddr(), c.RemoteAddr(), protocol, true)
+	server := newMuxSession(s, s.LocalAddr(), s.RemoteAddr(), protocol, false)
+
+	return client, server
+}
+
+func (ms *muxSession) writeFrame(typ byte, id uint32, n uint32, payload []byte) error {
+	buf := make([]byte, frameHeaderLen+len(payload))
+	buf[0] = typ
+	binary.BigEndian.PutUint32(buf[1:5], id)
+	binary.BigEndian.PutUint32(buf[5:9], n)
+	copy(buf[frameHeaderLen:], payload)
+
+	ms.wlock.Lock()
+	defer ms.wlock.Unlock()
+
+	written, err := ms.conn.Write(buf)
+	atomic.AddInt64(&ms.bytesOut, int64(written))
+	if err != nil {
+		ms.shutdown(err)
+	}
+
+	return err
+}
+
+func (ms *muxSession) readLoop() {
+	var hdr [frameHeaderLen]byte
+	for {
+		_, err := io.ReadFull(ms.conn, hdr[:])
+		if err != nil {
+			ms.shutdown(err)
+			return
+		}
+
+		atomic.AddInt64(&ms.bytesIn, frameHeaderLen)
+
+		typ := hdr[0]
+		id := binary.BigEndian.Uint32(hdr[1:5])
+		n := binary.BigEndian.Uint32(hdr[5:9])
+
+		switch typ {
+		case frameData, frameGoAway:
+			if n > maxFramePayload {
+				ms.shutdown(fmt.Errorf("mux frame too large:%d", n))
+				return
+			}
+
+			payload := make([]byte, n)
+			_, err = io.ReadFull(ms.conn, payload)
+			if err != nil {
+				ms.shutdown(err)
+				return
+			}
+
+			atomic.AddInt64(&ms.bytesIn, int64(n))
+
+			if typ == frameGoAway {
+				ms.shutdown(&SessionError{Code: uint64(id), Reason: string(payload), Remote: true})
+				return
+			}
+
+			if s := ms.getStream(id); s != nil && !s.pushData(payload) {
+				s.reset(errFlowControl)
+				ms.removeStream(id)
+				ms.writeFrame(frameReset, id, 0, nil)
+			}
+		case frameOpen:
+			ms.onOpen(id)
+		case frameFin:
+			if s := ms.getStream(id); s != nil {
+				s.remoteClose()
+			}
+		case frameReset:
+			if s := ms.getStream(id); s != nil {
+				s.reset(errStreamReset)
+				ms.removeStream(id)
+			}
+		case frameWindow:
+			if s := ms.getStream(id); s != nil {
+				s.addSendWindow(int(n))
+			}
+		default:
+			ms.shutdown(fmt.Errorf("mux unknown frame type:%d", typ))
+			return
+		}
+	}
+}
+
+func (ms *muxSession) onOpen(id uint32) {
+	ms.mu.Lock()
+	if id%2 == ms.nextID%2 || ms.streams[id] != nil {
+		ms.mu.Unlock()
+		ms.shutdown(fmt.Errorf("mux invalid stream id:%d", id))
+		return
+	}
+
+	s := newMuxStream(ms, id)
+	ms.streams[id] = s
+	ms.mu.Unlock()
+
+	select {
+	case ms.accept <- s:
+	default:
+		// backlog full
+		ms.removeStream(id)
+		ms.writeFrame(frameReset, id, 0, nil)
+	}
+}
+
+func (ms *muxSession) getStream(id uint32) *muxStream {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.streams[id]
+}
+
+func (ms *muxSession) removeStream(id uint32) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	delete(ms.streams, id)
+}
+
+// shutdown close the connection and fail all streams, the error set by
+// CloseWithError win
+func (ms *muxSession) shutdown(err error) {
+	ms.closeOnce.Do(func() {
+		ms.mu.Lock()
+		if ms.closeErr == nil {
+			ms.closeErr = err
+		}
+		err = ms.closeErr
+		streams := ms.streams
+		ms.streams = make(map[uint32]*muxStream)
+		ms.mu.Unlock()
+
+		ms.conn.Close()
+		for _, s := range streams {
+			s.reset(err)
+		}
+
+		ms.cancel()
+	})
+}
+
+func (ms *muxSession) err() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	return ms.closeErr
+}
+
+func (ms *muxSession) OpenStreamSync(ctx context.Context) (Stream, error) {
+	select {
+	case <-ms.ctx.Done():
+		return nil, ms.err()
+	default:
+	}
+
+	ms.mu.Lock()
+	id := ms.nextID
+	ms.nextID += 2
+	s := newMuxStream(ms, id)
+	ms.streams[id] = s
+	ms.mu.Unlock()
+
+	err := ms.writeFrame(frameOpen, id, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (ms *muxSession) AcceptStream(ctx context.Context) (Stream, error) {
+	select {
+	case s := <-ms.accept:
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-ms.ctx.Done():
+		return nil, ms.err()
+	}
+}
+
+func (ms *muxSession) CloseWithError(code uint64, reason string) error {
+	if len(reason) > maxFramePayload {
+		reason = reason[:maxFramePayload]
+	}
+
+	// the peer may close the connection once it read the goaway, before
+	// our shutdown
+	err := &SessionError{Code: code, Reason: reason}
+	ms.mu.Lock()
+	if ms.closeErr == nil {
+		ms.closeErr = err
+	}
+	ms.mu.Unlock()
+
+	ms.writeFrame(frameGoAway, uint32(code), uint32(len(reason)), []byte(reason))
+	ms.shutdown(err)
+	return nil
+}
+
+func (ms *muxSession) Context() context.Context {
+	return ms.ctx
+}
+
+func (ms *muxSession) Protocol() string {
+	return ms.protocol
+}
+
+func (ms *muxSession) Stats() SessionStats {
+	ms.mu.Lock()
+	streams := len(ms.streams)
+	ms.mu.Unlock()
+
+	return SessionStats{
+		Transport:  "tcp",
+		TLSVersion: tlsVersionName(ms.tlsVersion),
+		Streams:    streams,
+		BytesIn:    atomic.LoadInt64(&ms.bytesIn),
+		BytesOut:   atomic.LoadInt64(&ms.bytesOut),
+	}
+}
+
+func (ms *muxSession) LocalAddr() net.Addr {
+	return ms.local
+}
+
+func (ms *muxSession) RemoteAddr() net.Addr {
+	return ms.remote
+}
+
+// muxStream a stream of muxSession
+type muxStream struct {
+	id   uint32
+	sess *muxSession
+
+	mu  sync.Mutex
+	buf []byte
+	// bytes read but not yet told peer by window update
+	consumed   int
+	sendWindow int
+	remoteFin  bool
+	localFin   bool
+	err        error
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newMuxStream(sess *muxSession, id uint32) *muxStream {
+	s := &muxStream{
+		id:         id,
+		sess:       sess,
+		sendWindow: streamWindow,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+
+	return s
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// wait until notified, session closed or deadline
+func (s *muxStream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return timeoutError{}
+		}
+
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+	case <-s.sess.ctx.Done():
+		s.reset(s.sess.err())
+	case <-timeout:
+		return timeoutError{}
+	}
+
+	return nil
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.buf) > 0 {
+			n := copy(p, s.buf)
+			s.buf = s.buf[n:]
+			s.consumed += n
+
+			delta := 0
+			if s.consumed >= streamWindow/2 && !s.remoteFin {
+				delta = s.consumed
+				s.consumed = 0
+			}
+			s.mu.Unlock()
+
+			if delta > 0 {
+				s.sess.writeFrame(frameWindow, s.id, uint32(delta), nil)
+			}
+
+			return n, nil
+		}
+
+		if s.remoteFin {
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return 0, err
+		}
+
+		deadline := s.readDeadline
+		s.mu.Unlock()
+
+		err := s.wait(s.readable, deadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	wrote := 0
+	for wrote < len(p) {
+		s.mu.Lock()
+		if s.err != nil {
+			err := s.err
+			s.mu.Unlock()
+			return wrote, err
+		}
+
+		if s.localFin {
+			s.mu.Unlock()
+			return wrote, errStreamClosed
+		}
+
+		if s.sendWindow == 0 {
+			deadline := s.writeDeadline
+			s.mu.Unlock()
+
+			err := s.wait(s.writable, deadline)
+			if err != nil {
+				return wrote, err
+			}
+			continue
+		}
+
+		n := len(p) - wrote
+		if n > s.sendWindow {
+			n = s.sendWindow
+		}
+
+		if n > maxFramePayload {
+			n = maxFramePayload
+		}
+
+		s.sendWindow -= n
+		s.mu.Unlock()
+
+		err := s.sess.writeFrame(frameData, s.id, uint32(n), p[wrote:wrote+n])
+		if err != nil {
+			return wrote, err
+		}
+
+		wrote += n
+	}
+
+	return wrote, nil
+}
+
+// Close close the write direction
+func (s *muxStream) Close() error {
+	s.mu.Lock()
+	if s.localFin || s.err != nil {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.localFin = true
+	done := s.remoteFin
+	s.mu.Unlock()
+
+	if done {
+		s.sess.removeStream(s.id)
+	}
+
+	return s.sess.writeFrame(frameFin, s.id, 0, nil)
+}
+
+func (s *muxStream) SetDeadline(t time.Time) error {
+	s.SetReadDeadline(t)
+	return s.SetWriteDeadline(t)
+}
+
+func (s *muxStream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.mu.Unlock()
+
+	// wake up the waiting reader to apply the new deadline
+	notify(s.readable)
+	return nil
+}
+
+func (s *muxStream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.mu.Unlock()
+
+	notify(s.writable)
+	return nil
+}
+
+// pushData return false if peer send more than the window
+func (s *muxStream) pushData(p []byte) bool {
+	s.mu.Lock()
+	if s.remoteFin || s.err != nil {
+		s.mu.Unlock()
+		return true
+	}
+
+	if len(s.buf)+len(p) > streamWindow {
+		s.mu.Unlock()
+		return false
+	}
+
+	s.buf = append(s.buf, p...)
+	s.mu.Unlock()
+
+	notify(s.readable)
+	return true
+}
+
+func (s *muxStream) remoteClose() {
+	s.mu.Lock()
+	s.remoteFin = true
+	done := s.localFin
+	s.mu.Unlock()
+
+	if done {
+		s.sess.removeStream(s.id)
+	}
+
+	notify(s.readable)
+}
+
+func (s *muxStream) reset(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mu.Unlock()
+
+	notify(s.readable)
+	notify(s.writable)
+}
+
+func (s *muxStream) addSendWindow(n int) {
+	s.mu.Lock()
+	s.sendWindow += n
+	s.mu.Unlock()
+
+	notify(s.writable)
+}
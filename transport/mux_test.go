@@ -0,0 +1,224 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// muxPair a client and a server session over net.Pipe
+func muxPair(t *testing.T) (*muxSession, *muxSession) {
+	c, s := Pipe("test")
+	client, server := c.(*muxSession), s.(*muxSession)
+	t.Cleanup(func() {
+		client.shutdown(io.EOF)
+		server.shutdown(io.EOF)
+	})
+
+	return client, server
+}
+
+// openAccept open a stream on a and accept it on b
+func openAccept(t *testing.T, a, b *muxSession) (*muxStream, *muxStream) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s1, err := a.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s2, err := b.AcceptStream(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s1.(*muxStream), s2.(*muxStream)
+}
+
+func TestMuxOpenAccept(t *testing.T) {
+	client, server := muxPair(t)
+
+	cs, ss := openAccept(t, client, server)
+	if cs.id != ss.id || cs.id%2 != 1 {
+		t.Fatalf("client stream id:%d, server side id:%d", cs.id, ss.id)
+	}
+
+	// server opened streams use even ids
+	ss2, cs2 := openAccept(t, server, client)
+	if ss2.id%2 != 0 || cs2.id != ss2.id {
+		t.Fatalf("server stream id:%d, client side id:%d", ss2.id, cs2.id)
+	}
+
+	go cs.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	_, err := io.ReadFull(ss, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	if client.Stats().Streams != 2 {
+		t.Fatalf("client has %d streams, expect 2", client.Stats().Streams)
+	}
+}
+
+func TestMuxWindow(t *testing.T) {
+	client, server := muxPair(t)
+	cs, ss := openAccept(t, client, server)
+
+	data := make([]byte, streamWindow+maxFramePayload)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// the window is used up, the rest wait until the reader consume
+	cs.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := cs.Write(data)
+	if n != streamWindow {
+		t.Fatalf("wrote %d before window exhausted, expect %d", n, streamWindow)
+	}
+
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("write on exhausted window got %v, expect timeout", err)
+	}
+
+	cs.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := cs.Write(data[n:])
+		if err == nil {
+			err = cs.Close()
+		}
+		done <- err
+	}()
+
+	got, err := ioutil.ReadAll(ss)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes, not the written %d", len(got), len(data))
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxHalfClose(t *testing.T) {
+	client, server := muxPair(t)
+	cs, ss := openAccept(t, client, server)
+
+	err := cs.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the client can not write any more, the server read eof
+	if _, err = cs.Write([]byte("x")); err != errStreamClosed {
+		t.Fatalf("write after close got %v", err)
+	}
+
+	ss.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = ss.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read after peer fin got %v", err)
+	}
+
+	// the other direction still works
+	go ss.Write([]byte("reply"))
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(cs, buf)
+	if err != nil || string(buf) != "reply" {
+		t.Fatalf("read %q, %v", buf, err)
+	}
+
+	// both closed, the stream is gone
+	ss.Close()
+	cs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = cs.Read(buf); err != io.EOF {
+		t.Fatalf("read after fin got %v", err)
+	}
+
+	if n := client.Stats().Streams; n != 0 {
+		t.Fatalf("client keep %d streams after both fin", n)
+	}
+}
+
+func TestMuxReset(t *testing.T) {
+	client, server := muxPair(t)
+	cs, ss := openAccept(t, client, server)
+
+	err := server.writeFrame(frameReset, ss.id, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = cs.Read(make([]byte, 1)); err != errStreamReset {
+		t.Fatalf("read after reset got %v", err)
+	}
+
+	if _, err = cs.Write([]byte("x")); err != errStreamReset {
+		t.Fatalf("write after reset got %v", err)
+	}
+
+	// more than the window is a flow control violation, the stream is
+	// reset and the peer told
+	cs2, ss2 := openAccept(t, client, server)
+	for sent := 0; sent <= streamWindow; sent += maxFramePayload {
+		err = client.writeFrame(frameData, cs2.id, maxFramePayload, make([]byte, maxFramePayload))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ss2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = ioutil.ReadAll(ss2); err != errFlowControl {
+		t.Fatalf("read after flow control violated got %v", err)
+	}
+
+	cs2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = cs2.Read(make([]byte, 1)); err != errStreamReset {
+		t.Fatalf("violator read got %v", err)
+	}
+}
+
+func TestMuxGoAway(t *testing.T) {
+	client, server := muxPair(t)
+	cs, _ := openAccept(t, client, server)
+
+	server.CloseWithError(7, "going away")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := client.AcceptStream(ctx)
+	se, ok := err.(*SessionError)
+	if !ok || se.Code != 7 || se.Reason != "going away" || !se.Remote {
+		t.Fatalf("accept after goaway got %v", err)
+	}
+
+	cs.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = cs.Read(make([]byte, 1)); err != se {
+		t.Fatalf("stream read after goaway got %v", err)
+	}
+
+	if _, err = client.OpenStreamSync(ctx); err != se {
+		t.Fatalf("open after goaway got %v", err)
+	}
+
+	select {
+	case <-client.Context().Done():
+	default:
+		t.Fatal("session context not done after goaway")
+	}
+
+	if se, ok := server.err().(*SessionError); !ok || se.Remote {
+		t.Fatalf("local close got %v", server.err())
+	}
+}
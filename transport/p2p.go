@@ -0,0 +1,69 @@
+package transport
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// PunchCount punch packets send to every peer address
+	PunchCount = 10
+	// PunchInterval interval between punch packets
+	PunchInterval = 200 * time.Millisecond
+)
+
+// PunchPayload junk datagram to open the nat mapping, quic will drop it
+var PunchPayload = []byte("lxquic-punch")
+
+// Punch send datagrams to peer from conn, so that our nat allow the
+// peer's packets, conn should be the one that the direct session use
+func Punch(conn net.PacketConn, address string) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		log.Printf("Punch resolve %s failed:%v", address, err)
+		return
+	}
+
+	for i := 0; i < PunchCount; i++ {
+		_, err = conn.WriteTo(PunchPayload, raddr)
+		if err != nil {
+			log.Printf("Punch %s failed:%v", address, err)
+			return
+		}
+
+		time.Sleep(PunchInterval)
+	}
+}
+
+// GenerateTLSConfig a bare-bones tls config with a self-signed certificate,
+// for listeners that clients do not verify
+func GenerateTLSConfig(nextProtos []string) *tls.Config {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		panic(err)
+	}
+	template := x509.Certificate{SerialNumber: big.NewInt(1)}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		panic(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{tlsCert},
+		NextProtos:   nextProtos,
+	}
+}
@@ -0,0 +1,145 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// natConn simulate a nat with endpoint dependent filtering, packets from
+// addresses that we never sent to are dropped
+type natConn struct {
+	net.PacketConn
+
+	lock   sync.Mutex
+	opened map[string]bool
+}
+
+func newNATConn(t *testing.T) *natConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &natConn{PacketConn: conn, opened: make(map[string]bool)}
+}
+
+func (nc *natConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	nc.lock.Lock()
+	nc.opened[addr.String()] = true
+	nc.lock.Unlock()
+
+	return nc.PacketConn.WriteTo(b, addr)
+}
+
+func (nc *natConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := nc.PacketConn.ReadFrom(b)
+		if err != nil {
+			return n, addr, err
+		}
+
+		nc.lock.Lock()
+		ok := nc.opened[addr.String()]
+		nc.lock.Unlock()
+		if ok {
+			return n, addr, nil
+		}
+	}
+}
+
+func TestPunchDirectSession(t *testing.T) {
+	a := newNATConn(t)
+	b := newNATConn(t)
+
+	listener, err := quic.Listen(b, GenerateTLSConfig([]string{"lxquic-test"}), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		sess, err := listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+
+		stream, err := sess.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		io.Copy(stream, stream)
+		stream.Close()
+	}()
+
+	tlsConf := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"lxquic-test"}}
+
+	// b's nat drop a's packets before b punch
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	_, err = quic.DialContext(ctx, a, b.LocalAddr(), "peer", tlsConf, nil)
+	cancel()
+	if err == nil {
+		t.Fatal("direct session before punch")
+	}
+
+	// both punch at the same time, as the server tell them to
+	go Punch(a, b.LocalAddr().String())
+	go Punch(b, a.LocalAddr().String())
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sess, err := quic.DialContext(ctx, a, b.LocalAddr(), "peer", tlsConf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.CloseWithError(0, "test end")
+
+	stream, err := sess.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = stream.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(stream, buf)
+	if err != nil || string(buf) != "ping" {
+		t.Fatalf("echo got %q, %v", buf, err)
+	}
+}
+
+func TestPunchBadAddress(t *testing.T) {
+	a := newNATConn(t)
+
+	done := make(chan struct{})
+	go func() {
+		Punch(a, "not an address")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Punch keep going with a bad address")
+	}
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if len(a.opened) != 0 {
+		t.Fatal("Punch sent to a bad address")
+	}
+}
@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// quicSession adapt quic.Session to Session
+type quicSession struct {
+	quic.Session
+}
+
+// WrapQuic wrap a quic session
+func WrapQuic(sess quic.Session) Session {
+	return &quicSession{Session: sess}
+}
+
+// IsQuic if the session is a quic one, only quic session
+// can share its udp socket with peer-to-peer direct path
+func IsQuic(sess Session) bool {
+	_, ok := sess.(*quicSession)
+	return ok
+}
+
+func (qs *quicSession) OpenStreamSync(ctx context.Context) (Stream, error) {
+	stream, err := qs.Session.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (qs *quicSession) AcceptStream(ctx context.Context) (Stream, error) {
+	stream, err := qs.Session.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return stream, nil
+}
+
+func (qs *quicSession) CloseWithError(code uint64, reason string) error {
+	return qs.Session.CloseWithError(quic.ErrorCode(code), reason)
+}
+
+func (qs *quicSession) Protocol() string {
+	return qs.ConnectionState().TLS.NegotiatedProtocol
+}
+
+func (qs *quicSession) Stats() SessionStats {
+	state := qs.ConnectionState()
+	return SessionStats{
+		Transport:  "quic",
+		TLSVersion: tlsVersionName(state.TLS.Version),
+		Datagrams:  state.SupportsDatagrams,
+	}
+}
+
+// quicListener adapt quic.Listener to Listener
+type quicListener struct {
+	quic.Listener
+}
+
+// ListenQuic listen quic sessions on udp address
+func ListenQuic(addr string, tlsConf *tls.Config, config *quic.Config) (Listener, error) {
+	listener, err := quic.ListenAddr(addr, tlsConf, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &quicListener{Listener: listener}, nil
+}
+
+// WrapQuicListener wrap a quic listener
+func WrapQuicListener(listener quic.Listener) Listener {
+	return &quicListener{Listener: listener}
+}
+
+func (ql *quicListener) Accept(ctx context.Context) (Session, error) {
+	sess, err := ql.Listener.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return WrapQuic(sess), nil
+}
@@ -0,0 +1,81 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Stream a bidirectional stream in session,
+// Close only close the write direction
+type Stream interface {
+	io.Reader
+	io.Writer
+	io.Closer
+
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// Session a connection that multiplex streams, quic or tls over tcp
+type Session interface {
+	// OpenStreamSync open a new stream
+	OpenStreamSync(ctx context.Context) (Stream, error)
+	// AcceptStream wait for a stream opened by peer
+	AcceptStream(ctx context.Context) (Stream, error)
+	// CloseWithError close the session, tell peer the code and reason
+	CloseWithError(code uint64, reason string) error
+	// Context done when the session is closed
+	Context() context.Context
+	// Protocol the negotiated application protocol, alpn of quic
+	// or websocket subprotocol of tcp
+	Protocol() string
+	// Stats connection level information of the session
+	Stats() SessionStats
+
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// SessionStats connection level information, what the underlying
+// transport can tell
+type SessionStats struct {
+	// quic or tcp
+	Transport  string `json:"transport"`
+	TLSVersion string `json:"tls_version,omitempty"`
+	// quic only, peer support datagrams
+	Datagrams bool `json:"datagrams,omitempty"`
+	// tcp only, quic-go does not export them
+	Streams  int   `json:"streams,omitempty"`
+	BytesIn  int64 `json:"bytes_in,omitempty"`
+	BytesOut int64 `json:"bytes_out,omitempty"`
+}
+
+// tlsVersionName name of tls version
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	case 0:
+		return ""
+	}
+
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// Listener accept sessions
+type Listener interface {
+	Accept(ctx context.Context) (Session, error)
+	Close() error
+	Addr() net.Addr
+}
@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// websocket path of the fallback transport
+	wsPath = "/lxquic"
+)
+
+type connCtxKey struct{}
+
+// wsListener accept websocket over tls connections, every connection
+// is a mux session
+type wsListener struct {
+	listener net.Listener
+	server   *http.Server
+
+	accept    chan Session
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenTCP listen websocket over tls on tcp address, the alpn list of
+// tlsConf is used as websocket subprotocols
+func ListenTCP(addr string, tlsConf *tls.Config) (Listener, error) {
+	protocols := tlsConf.NextProtos
+	conf := tlsConf.Clone()
+	conf.NextProtos = []string{"http/1.1"}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	wl := &wsListener{
+		listener: tls.NewListener(ln, conf),
+		accept:   make(chan Session),
+		closed:   make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(wsPath, websocket.Server{
+		// not a browser, origin does not matter
+		Handshake: func(config *websocket.Config, req *http.Request) error {
+			return selectProtocol(config, protocols)
+		},
+		Handler: wl.serveWS,
+	})
+
+	wl.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connCtxKey{}, c)
+		},
+	}
+
+	go wl.server.Serve(wl.listener)
+	return wl, nil
+}
+
+// serveWS hand the session to Accept, and keep the handler until the
+// session closed, the websocket is closed once the handler return
+func (wl *wsListener) serveWS(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+
+	local, remote := ws.LocalAddr(), ws.RemoteAddr()
+	if c, ok := ws.Request().Context().Value(connCtxKey{}).(net.Conn); ok {
+		local, remote = c.LocalAddr(), c.RemoteAddr()
+	}
+
+	var protocol string
+	if p := ws.Config().Protocol; len(p) == 1 {
+		protocol = p[0]
+	}
+
+	sess := newMuxSession(ws, local, remote, protocol, false)
+	if state := ws.Request().TLS; state != nil {
+		sess.tlsVersion = state.Version
+	}
+
+	select {
+	case wl.accept <- sess:
+	case <-wl.closed:
+		sess.CloseWithError(0, "listener closed")
+		return
+	}
+
+	<-sess.Context().Done()
+}
+
+func (wl *wsListener) Accept(ctx context.Context) (Session, error) {
+	select {
+	case sess := <-wl.accept:
+		return sess, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-wl.closed:
+		return nil, fmt.Errorf("listener closed")
+	}
+}
+
+func (wl *wsListener) Close() error {
+	wl.closeOnce.Do(func() {
+		close(wl.closed)
+	})
+
+	return wl.server.Close()
+}
+
+func (wl *wsListener) Addr() net.Addr {
+	return wl.listener.Addr()
+}
+
+// selectProtocol choose the first of ours that client offered, client
+// that offer nothing get no subprotocol
+func selectProtocol(config *websocket.Config, protocols []string) error {
+	if len(protocols) == 0 || len(config.Protocol) == 0 {
+		config.Protocol = nil
+		return nil
+	}
+
+	for _, p := range protocols {
+		for _, offered := range config.Protocol {
+			if p == offered {
+				config.Protocol = []string{p}
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("no supported protocol in %v", config.Protocol)
+}
+
+// DialTCP dial websocket over tls, the alpn list of tlsConf is
+// offered as websocket subprotocols
+func DialTCP(addr string, tlsConf *tls.Config, timeout time.Duration) (Session, error) {
+	protocols := tlsConf.NextProtos
+	conf := tlsConf.Clone()
+	conf.NextProtos = []string{"http/1.1"}
+	if conf.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		conf.ServerName = host
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	wsConf, err := websocket.NewConfig("wss://"+addr+wsPath, "https://"+addr+"/")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	wsConf.Protocol = protocols
+	conn.SetDeadline(time.Now().Add(timeout))
+	ws, err := websocket.NewClient(wsConf, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	ws.PayloadType = websocket.BinaryFrame
+
+	var protocol string
+	if len(wsConf.Protocol) == 1 {
+		protocol = wsConf.Protocol[0]
+	}
+
+	sess := newMuxSession(ws, conn.LocalAddr(), conn.RemoteAddr(), protocol, true)
+	sess.tlsVersion = conn.ConnectionState().Version
+	return sess, nil
+}